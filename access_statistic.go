@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -34,13 +35,13 @@ type AccessStatistic struct {
 	Data json.RawMessage `gorm:"type:jsonb"`
 }
 
-func AddStatisticInBatch(stats []AccessStatistic) error {
-	return db.Create(&stats).Error
+func (r *Repo) AddStatisticInBatch(ctx context.Context, stats []AccessStatistic) error {
+	return r.conn(ctx).Create(&stats).Error
 }
 
-func GetStatisticInBatchBefore(before uint) ([]AccessStatistic, error) {
+func (r *Repo) GetStatisticInBatchBefore(ctx context.Context, before uint) ([]AccessStatistic, error) {
 	result := make([]AccessStatistic, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Where("id < ?", before).
 		Limit(10).
@@ -52,9 +53,9 @@ func GetStatisticInBatchBefore(before uint) ([]AccessStatistic, error) {
 	return result, nil
 }
 
-func GetStatisticInBatchAfter(after uint) ([]AccessStatistic, error) {
+func (r *Repo) GetStatisticInBatchAfter(ctx context.Context, after uint) ([]AccessStatistic, error) {
 	result := make([]AccessStatistic, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Where("id > ?", after).
 		Limit(10).
@@ -66,12 +67,12 @@ func GetStatisticInBatchAfter(after uint) ([]AccessStatistic, error) {
 	return result, nil
 }
 
-func GetStatisticInBatchBeforeAfter(before, after uint) ([]AccessStatistic, error) {
+func (r *Repo) GetStatisticInBatchBeforeAfter(ctx context.Context, before, after uint) ([]AccessStatistic, error) {
 	if before >= after {
 		return []AccessStatistic{}, nil
 	}
 	result := make([]AccessStatistic, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Where("id < ? and id > ?", before, after).
 		Limit(10).
@@ -83,9 +84,9 @@ func GetStatisticInBatchBeforeAfter(before, after uint) ([]AccessStatistic, erro
 	return result, nil
 }
 
-func GetLatestStatistic() ([]AccessStatistic, error) {
+func (r *Repo) GetLatestStatistic(ctx context.Context) ([]AccessStatistic, error) {
 	result := make([]AccessStatistic, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Limit(10).
 		Order("id desc").
@@ -96,17 +97,17 @@ func GetLatestStatistic() ([]AccessStatistic, error) {
 	return result, nil
 }
 
-func GetAccessCountAfterCustomTime(time time.Time) uint {
+func (r *Repo) GetAccessCountAfterCustomTime(ctx context.Context, time time.Time) uint {
 	var res int64 = 0
-	_ = db.
+	_ = r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Where("time > ?", time).
 		Count(&res)
 	return uint(res)
 }
 
-func GetAccessCountWithIn24Hours() uint {
-	return GetAccessCountAfterCustomTime(time.Now().Add(-24 * time.Hour))
+func (r *Repo) GetAccessCountWithIn24Hours(ctx context.Context) uint {
+	return r.GetAccessCountAfterCustomTime(ctx, time.Now().Add(-24*time.Hour))
 }
 
 type ASReport struct {
@@ -116,9 +117,9 @@ type ASReport struct {
 	IdEnd   uint      `gorm:"column:id_end" json:"id_end"`
 }
 
-func GetDailyReportWithCustomDays(days int) ([]ASReport, error) {
+func (r *Repo) GetDailyReportWithCustomDays(ctx context.Context, days int) ([]ASReport, error) {
 	res := make([]ASReport, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Select("date_trunc('day', time) t, COUNT(*) cnt, MAX(id) id_start, MIN(id) id_end").
 		Group("t").
@@ -128,9 +129,9 @@ func GetDailyReportWithCustomDays(days int) ([]ASReport, error) {
 	return res, tx.Error
 }
 
-func GetHourlyReportWithCustomHours(hours int) ([]ASReport, error) {
+func (r *Repo) GetHourlyReportWithCustomHours(ctx context.Context, hours int) ([]ASReport, error) {
 	res := make([]ASReport, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Select("date_trunc('hour', time) t, COUNT(*) cnt, MAX(id) id_start, MIN(id) id_end").
 		Group("t").
@@ -140,9 +141,9 @@ func GetHourlyReportWithCustomHours(hours int) ([]ASReport, error) {
 	return res, tx.Error
 }
 
-func GetMonthlyReportWithCustomMonths(months int) ([]ASReport, error) {
+func (r *Repo) GetMonthlyReportWithCustomMonths(ctx context.Context, months int) ([]ASReport, error) {
 	res := make([]ASReport, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&AccessStatistic{}).
 		Select("date_trunc('month', time) t, COUNT(*) cnt, MAX(id) id_start, MIN(id) id_end").
 		Group("t").
@@ -152,16 +153,16 @@ func GetMonthlyReportWithCustomMonths(months int) ([]ASReport, error) {
 	return res, tx.Error
 }
 
-func GetLatestHourlyReport() ([]ASReport, error) {
-	return GetHourlyReportWithCustomHours(24)
+func (r *Repo) GetLatestHourlyReport(ctx context.Context) ([]ASReport, error) {
+	return r.GetHourlyReportWithCustomHours(ctx, 24)
 }
 
-func GetLatestDailyReport() ([]ASReport, error) {
-	return GetDailyReportWithCustomDays(30)
+func (r *Repo) GetLatestDailyReport(ctx context.Context) ([]ASReport, error) {
+	return r.GetDailyReportWithCustomDays(ctx, 30)
 }
 
-func GetLatestMonthlyReport() ([]ASReport, error) {
-	return GetMonthlyReportWithCustomMonths(3)
+func (r *Repo) GetLatestMonthlyReport(ctx context.Context) ([]ASReport, error) {
+	return r.GetMonthlyReportWithCustomMonths(ctx, 3)
 }
 
 type CategoryCount struct {
@@ -179,7 +180,7 @@ type StasticsSummary struct {
 	Reports []ASReport `json:"reports"`
 }
 
-func GetOverallStasticsSummary(days int) StasticsSummary {
+func (r *Repo) GetOverallStasticsSummary(ctx context.Context, days int) StasticsSummary {
 	browsers := []CategoryCount{}
 	os := []CategoryCount{}
 	devices := []CategoryCount{}
@@ -189,7 +190,7 @@ func GetOverallStasticsSummary(days int) StasticsSummary {
 	t := time.Now().Add(-24 * time.Hour * time.Duration(days))
 	t.Truncate(24 * time.Hour)
 
-	tx := db.Begin()
+	tx := r.conn(ctx).Begin()
 	tx.Model(&AccessStatistic{}).
 		Select("browser category, COUNT(*) cnt").
 		Where("time > ?", t).
@@ -231,10 +232,10 @@ func GetOverallStasticsSummary(days int) StasticsSummary {
 		Find(&api)
 	tx.Commit()
 
-	reports, _ := GetDailyReportWithCustomDays(days)
+	reports, _ := r.GetDailyReportWithCustomDays(ctx, days)
 
 	return StasticsSummary{
-		TotalCount: GetAccessCountAfterCustomTime(t),
+		TotalCount: r.GetAccessCountAfterCustomTime(ctx, t),
 		Browsers:   browsers,
 		OSs:        os,
 		Devices:    devices,
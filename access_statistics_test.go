@@ -1,19 +1,19 @@
-package models
+package models_test
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
 )
 
 func TestReport(t *testing.T) {
-	dcs := getDcs()
+	repo := modelstest.New(t)
 
-	err := Connect(dcs)
-	if err != nil {
-		t.Error("failed to connect to database.")
-		t.Fatal(err)
-	}
-	rpt, err := GetLatestDailyReport()
+	rpt, err := repo.GetLatestDailyReport(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -21,16 +21,20 @@ func TestReport(t *testing.T) {
 }
 
 func TestSummary(t *testing.T) {
-	dcs := getDcs()
+	repo := modelstest.New(t)
+	ctx := context.Background()
 
-	err := Connect(dcs)
+	err := repo.AddStatisticInBatch(ctx, []models.AccessStatistic{
+		{Time: time.Now(), Path: "/store", Method: "GET", Browser: "Chrome", OS: "iOS"},
+		{Time: time.Now(), Path: "/thread", Method: "GET", Browser: "Safari", OS: "iOS"},
+	})
 	if err != nil {
-		t.Error("failed to connect to database.")
 		t.Fatal(err)
 	}
-	rpt := GetOverallStasticsSummary(60)
-	if rpt.TotalCount == 0 {
-		t.Fail()
+
+	rpt := repo.GetOverallStasticsSummary(ctx, 60)
+	if rpt.TotalCount != 2 {
+		t.Errorf("total count is %d, want 2", rpt.TotalCount)
 	}
 	t.Log(json.Marshal(rpt))
 }
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"context"
+
 	"gorm.io/gorm"
 )
 
@@ -12,7 +14,7 @@ type Administrator struct {
 	Email    string `gorm:"type:text;not null;unique"`
 }
 
-func CreateAdmin(username, password, email string) error {
+func (r *Repo) CreateAdmin(ctx context.Context, username, password, email string) error {
 	salt := genSalt()
 	password = encryptPassword(password, salt)
 	admin := Administrator{
@@ -21,7 +23,7 @@ func CreateAdmin(username, password, email string) error {
 		Salt:     salt,
 		Email:    email,
 	}
-	return db.Create(&admin).Error
+	return r.conn(ctx).Create(&admin).Error
 }
 
 func (u *Administrator) SetPassword(password string) {
@@ -33,24 +35,24 @@ func (u *Administrator) CheckPassword(password string) bool {
 	return u.Password == encryptPassword(password, u.Salt)
 }
 
-func MatchAny(username, password string) (*Administrator, error) {
+func (r *Repo) MatchAny(ctx context.Context, username, password string) (*Administrator, error) {
 	u := Administrator{}
-	tx := db.
+	tx := r.conn(ctx).
 		Where("username = ?", username).
 		First(&u)
 	if tx.Error != nil {
-		return nil, NewRequestError("用户不存在")
+		return nil, ErrUserNotFound.Wrap(tx.Error)
 	}
 
 	if !u.CheckPassword(password) {
-		return nil, NewRequestError("密码错误")
+		return nil, ErrWrongPassword
 	}
 	return &u, nil
 }
 
-func GetAdmin(id uint) (*Administrator, error) {
+func (r *Repo) GetAdmin(ctx context.Context, id uint) (*Administrator, error) {
 	u := Administrator{}
-	tx := db.
+	tx := r.conn(ctx).
 		Where("id = ?", id).
 		First(&u)
 	if tx.Error != nil {
@@ -59,8 +61,8 @@ func GetAdmin(id uint) (*Administrator, error) {
 	return &u, nil
 }
 
-func GetAdministratorCount() uint {
+func (r *Repo) GetAdministratorCount(ctx context.Context) uint {
 	var count int64 = 0
-	db.Model(&Administrator{}).Count(&count)
+	r.conn(ctx).Model(&Administrator{}).Count(&count)
 	return uint(count)
 }
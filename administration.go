@@ -1,76 +1,79 @@
 package models
 
 import (
+	"context"
 	"errors"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // ================== Administator ==================
-func AddAdministrator(username, password, email string) error {
-	return CreateAdmin(username, password, email)
+func (r *Repo) AddAdministrator(ctx context.Context, username, password, email string) error {
+	return r.CreateAdmin(ctx, username, password, email)
 }
 
-func DeleteAdministrator(id uint) error {
-	return db.Model(&Administrator{}).Where("id = ?", id).Delete(&Administrator{}).Error
+func (r *Repo) DeleteAdministrator(ctx context.Context, id uint) error {
+	return r.conn(ctx).Model(&Administrator{}).Where("id = ?", id).Delete(&Administrator{}).Error
 }
 
-func ListAdministrator(limit, page uint) ([]*Administrator, error) {
+func (r *Repo) ListAdministrator(ctx context.Context, limit, page uint) ([]*Administrator, error) {
 	result := make([]*Administrator, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func UpdateAdministrator(admin *Administrator) error {
+func (r *Repo) UpdateAdministrator(ctx context.Context, admin *Administrator) error {
 	admin.Password = encryptPassword(admin.Password, admin.Salt)
-	return db.Save(admin).Error
+	return r.conn(ctx).Save(admin).Error
 }
 
 // ================== Checkin ==================
-func ListCheckin(limit, page uint) ([]*CheckIn, error) {
+func (r *Repo) ListCheckin(ctx context.Context, limit, page uint) ([]*CheckIn, error) {
 	result := make([]*CheckIn, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
 // =================== Configuration =======================
-func ListConfiguration(limit, page uint) ([]*DynamicConfiguration, error) {
+func (r *Repo) ListConfiguration(ctx context.Context, limit, page uint) ([]*DynamicConfiguration, error) {
 	result := make([]*DynamicConfiguration, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func SetConfigurationValue(name, value string) error {
-	return db.
+func (r *Repo) SetConfigurationValue(ctx context.Context, name, value string) error {
+	return r.conn(ctx).
 		Model(&DynamicConfiguration{}).
 		Where("name = ?", name).
 		Update("value", value).
 		Error
 }
 
-func DeleteConfiguration(name string) error {
-	return db.
+func (r *Repo) DeleteConfiguration(ctx context.Context, name string) error {
+	return r.conn(ctx).
 		Model(&DynamicConfiguration{}).
 		Where("name = ?", name).
 		Delete(&DynamicConfiguration{}).
 		Error
 }
 
-func AddConfiguration(name, value string) error {
-	return db.Create(&DynamicConfiguration{
+func (r *Repo) AddConfiguration(ctx context.Context, name, value string) error {
+	return r.conn(ctx).Create(&DynamicConfiguration{
 		Name:  name,
 		Value: value,
 	}).Error
 }
 
 // =================== Event =======================
-func ListEvent(limit, page uint) ([]*Event, error) {
+func (r *Repo) ListEvent(ctx context.Context, limit, page uint) ([]*Event, error) {
 	result := make([]*Event, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func AddEvent(desc, cover, url string, begin, end time.Time) error {
-	return db.Create(&Event{
+func (r *Repo) AddEvent(ctx context.Context, desc, cover, url string, begin, end time.Time) error {
+	return r.conn(ctx).Create(&Event{
 		Desc:      String2Jsonb(desc),
 		BeginTime: begin,
 		EndTime:   end,
@@ -79,39 +82,39 @@ func AddEvent(desc, cover, url string, begin, end time.Time) error {
 	}).Error
 }
 
-func UpdateEvent(evt *Event) error {
-	return db.Save(evt).Error
+func (r *Repo) UpdateEvent(ctx context.Context, evt *Event) error {
+	return r.conn(ctx).Save(evt).Error
 }
 
-func DeleteEvent(id uint) error {
-	return db.Model(&Event{}).Where("id = ?", id).Delete(&Event{}).Error
+func (r *Repo) DeleteEvent(ctx context.Context, id uint) error {
+	return r.conn(ctx).Model(&Event{}).Where("id = ?", id).Delete(&Event{}).Error
 }
 
-func GetEvent(id uint) (*Event, error) {
+func (r *Repo) GetEvent(ctx context.Context, id uint) (*Event, error) {
 	result := &Event{}
-	err := db.Where("id = ?", id).First(result).Error
+	err := r.conn(ctx).Where("id = ?", id).First(result).Error
 	return result, err
 }
 
 // ================== Good ====================
 
-func ListGoods(limit, page uint) ([]*Good, error) {
+func (r *Repo) ListGoods(ctx context.Context, limit, page uint) ([]*Good, error) {
 	result := make([]*Good, 0)
-	err := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result).Error
+	err := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result).Error
 	return result, err
 }
 
 // =================== Devices =======================
 
-func ListDevices(limit, page uint) ([]*Device, error) {
+func (r *Repo) ListDevices(ctx context.Context, limit, page uint) ([]*Device, error) {
 	result := make([]*Device, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func AddDevice(name string, t DeviceKind, deviceId string, seatId *uint) error {
+func (r *Repo) AddDevice(ctx context.Context, name string, t DeviceKind, deviceId string, seatId *uint) error {
 	if len(deviceId) != 128 {
-		return errors.New("device id is not valid")
+		return ErrInvalidDeviceID
 	}
 	device := &Device{
 		Name:     name,
@@ -122,68 +125,102 @@ func AddDevice(name string, t DeviceKind, deviceId string, seatId *uint) error {
 	if seatId != nil {
 		device.SeatID = seatId
 	}
-	return db.Create(device).Error
+	return r.conn(ctx).Create(device).Error
 }
 
-func UpdateDevice(dev *Device) error {
-	return db.Save(dev).Error
+func (r *Repo) UpdateDevice(ctx context.Context, dev *Device) error {
+	return r.conn(ctx).Save(dev).Error
 }
 
-func DeleteDevice(id string) error {
-	return db.Model(&Device{}).Where("device_id = ?", id).Delete(&Device{}).Error
+func (r *Repo) DeleteDevice(ctx context.Context, id string) error {
+	return r.conn(ctx).Model(&Device{}).Where("device_id = ?", id).Delete(&Device{}).Error
 }
 
-func GetDevice(id string) (*Device, error) {
+func (r *Repo) GetDevice(ctx context.Context, id string) (*Device, error) {
 	result := &Device{}
-	err := db.Where("device_id = ?", id).First(result).Error
+	err := r.conn(ctx).Where("device_id = ?", id).First(result).Error
 	return result, err
 }
 
 // =================== Order =======================
-func ListOrder(limit, page uint) ([]*Order, error) {
+func (r *Repo) ListOrder(ctx context.Context, limit, page uint) ([]*Order, error) {
 	result := make([]*Order, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func GetOrder(id uint) (*Order, error) {
+func (r *Repo) GetOrder(ctx context.Context, id uint) (*Order, error) {
 	result := &Order{}
-	err := db.Preload("Affiliate").Where("id = ?", id).First(result).Error
+	err := r.conn(ctx).Preload("Affiliate").Where("id = ?", id).First(result).Error
 	return result, err
 }
 
 // ================== Seat ====================
-func ListSeat(limit, page uint) ([]*Seat, error) {
+func (r *Repo) ListSeat(ctx context.Context, limit, page uint) ([]*Seat, error) {
 	result := make([]*Seat, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func AddSeat(storeId uint, label string) error {
-	return db.Create(&Seat{
-		StoreID:       storeId,
-		Label:         label,
-		CurrentStatus: SeatStatusEnumVacancy,
-	}).Error
-}
-
-func UpdateSeat(seat *Seat) error {
-	return db.Save(seat).Error
-}
-
-func DeleteSeat(id uint) error {
-	return db.Model(&Seat{}).Where("id = ?", id).Delete(&Seat{}).Error
+func (r *Repo) AddSeat(ctx context.Context, storeId uint, label string) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		err := tx.conn(ctx).Create(&Seat{
+			StoreID:       storeId,
+			Label:         label,
+			CurrentStatus: SeatStatusEnumVacancy,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.syncSeatCount(ctx, storeId)
+	})
+}
+
+func (r *Repo) UpdateSeat(ctx context.Context, seat *Seat) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		var storeID uint
+		err := tx.conn(ctx).Model(&Seat{}).Select("store_id").Where("id = ?", seat.ID).Scan(&storeID).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.conn(ctx).Save(seat).Error; err != nil {
+			return err
+		}
+		if storeID != seat.StoreID {
+			if err := tx.syncSeatCount(ctx, storeID); err != nil {
+				return err
+			}
+		}
+		return tx.syncSeatCount(ctx, seat.StoreID)
+	})
+}
+
+func (r *Repo) DeleteSeat(ctx context.Context, id uint) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		seat := &Seat{}
+		err := tx.conn(ctx).First(seat, "id = ?", id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.conn(ctx).Delete(seat).Error; err != nil {
+			return err
+		}
+		return tx.syncSeatCount(ctx, seat.StoreID)
+	})
 }
 
 // ================== Store ====================
-func ListStore(limit, page uint) ([]*Store, error) {
+func (r *Repo) ListStore(ctx context.Context, limit, page uint) ([]*Store, error) {
 	result := make([]*Store, 0)
-	tx := db.Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
+	tx := r.conn(ctx).Limit(int(limit)).Offset(int(limit * (page - 1))).Find(&result)
 	return result, tx.Error
 }
 
-func AddStore(location string, openingHours, openingWeekdays uint, name, conver, facility string) error {
-	return db.Create(&Store{
+func (r *Repo) AddStore(ctx context.Context, location string, openingHours, openingWeekdays uint, name, conver, facility string) error {
+	return r.conn(ctx).Create(&Store{
 		Location:        location,
 		Status:          StoreStatusClosed,
 		OpeningHours:    openingHours,
@@ -195,18 +232,18 @@ func AddStore(location string, openingHours, openingWeekdays uint, name, conver,
 	}).Error
 }
 
-func UpdateStore(store *Store) error {
-	return db.Save(store).Error
+func (r *Repo) UpdateStore(ctx context.Context, store *Store) error {
+	return r.conn(ctx).Save(store).Error
 }
 
-func DeleteStore(id uint) error {
-	return db.Model(&Store{}).Where("id = ?", id).Delete(&Store{}).Error
+func (r *Repo) DeleteStore(ctx context.Context, id uint) error {
+	return r.conn(ctx).Model(&Store{}).Where("id = ?", id).Delete(&Store{}).Error
 }
 
 // ==================== Thread ====================
-func ListThread(limit, page uint) ([]uint, error) {
+func (r *Repo) ListThread(ctx context.Context, limit, page uint) ([]uint, error) {
 	result := make([]uint, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Model(&Thread{}).
 		Select("id").
 		Where("level = 1").
@@ -0,0 +1,459 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Clock tells the time. The billing engine reads it instead of time.Now
+// so that it can be driven by a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = ClockFunc(time.Now)
+
+type BillingUnit string
+
+const (
+	// BillingUnitMinute charges Rate per minute.
+	BillingUnitMinute BillingUnit = "minute"
+	// BillingUnitBlock charges Rate per block of BlockMinutes.
+	BillingUnitBlock BillingUnit = "block"
+)
+
+// RoundingRule decides how a partly used minute or block is charged.
+type RoundingRule string
+
+const (
+	RoundUp      RoundingRule = "up"
+	RoundDown    RoundingRule = "down"
+	RoundNearest RoundingRule = "nearest"
+)
+
+// TariffWindow is a daily time range, in minutes after midnight, on the
+// given weekdays. A zero Weekdays means every day.
+type TariffWindow struct {
+	Weekdays WeekdayMask `json:"weekdays"`
+	Start    int         `json:"start"`
+	End      int         `json:"end"`
+}
+
+type TariffWindows []TariffWindow
+
+func (w TariffWindows) Value() (driver.Value, error) {
+	return json.Marshal(w)
+}
+
+func (w *TariffWindows) Scan(v interface{}) error {
+	return scanJSON(v, w)
+}
+
+func scanJSON(v interface{}, dest interface{}) error {
+	switch data := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, dest)
+	case string:
+		return json.Unmarshal([]byte(data), dest)
+	}
+	return fmt.Errorf("cannot scan %T as json", v)
+}
+
+// contains reports whether t, in its own location, falls in one of the
+// windows.
+func (w TariffWindows) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	for _, win := range w {
+		if win.Weekdays != 0 && !win.Weekdays.Has(t.Weekday()) {
+			continue
+		}
+		if minute >= win.Start && minute < win.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Tariff prices the use of a seat. A tariff applies to the store given by
+// StoreID, or to every store when it is nil, and to seats of SeatClass,
+// or to every seat when it is empty; the most specific one wins.
+type Tariff struct {
+	gorm.Model
+	Name      string `gorm:"type:varchar(64)" json:"name"`
+	StoreID   *uint  `gorm:"index" json:"store_id"`
+	SeatClass string `gorm:"type:varchar(32);not null;default:''" json:"seat_class"`
+	Disabled  bool   `gorm:"not null;default:false" json:"disabled"`
+
+	Unit         BillingUnit  `gorm:"type:varchar(16);not null;default:'minute'" json:"unit"`
+	BlockMinutes uint         `json:"block_minutes"`
+	Rounding     RoundingRule `gorm:"type:varchar(16);not null;default:'up'" json:"rounding"`
+
+	// Rate is charged per unit off-peak; PeakRate during PeakWindows.
+	Rate        Price         `json:"rate"`
+	PeakRate    Price         `json:"peak_rate"`
+	PeakWindows TariffWindows `gorm:"type:jsonb" json:"peak_windows"`
+
+	// ProFreeMinutes are not charged to members at the start of each
+	// session.
+	ProFreeMinutes uint `json:"pro_free_minutes"`
+	// DailyCap bounds what a user pays per day, 0 meaning no cap.
+	DailyCap Price `json:"daily_cap"`
+	// Location is the time zone of the peak windows and of the days the
+	// cap applies to.
+	Location string `gorm:"type:varchar(64);not null;default:'Asia/Shanghai'" json:"location"`
+}
+
+// DefaultTariff is used where no tariff has been configured.
+var DefaultTariff = Tariff{
+	Name:     "default",
+	Unit:     BillingUnitMinute,
+	Rounding: RoundUp,
+	Rate:     DefaultHourlyRate / 60,
+	Location: "Asia/Shanghai",
+}
+
+func (t *Tariff) location() (*time.Location, error) {
+	if t.Location == "" {
+		return time.LoadLocation("Asia/Shanghai")
+	}
+	return time.LoadLocation(t.Location)
+}
+
+func (t *Tariff) unit() time.Duration {
+	if t.Unit == BillingUnitBlock && t.BlockMinutes > 0 {
+		return time.Duration(t.BlockMinutes) * time.Minute
+	}
+	return time.Minute
+}
+
+func (t *Tariff) units(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	u := t.unit()
+	n, rem := int64(d/u), d%u
+	switch t.Rounding {
+	case RoundDown:
+	case RoundNearest:
+		if rem*2 >= u {
+			n++
+		}
+	default:
+		if rem > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+type BillingLineKind string
+
+const (
+	BillingLineUsage    BillingLineKind = "usage"
+	BillingLineProFree  BillingLineKind = "pro_free"
+	BillingLineDailyCap BillingLineKind = "daily_cap"
+)
+
+// BillingLine is one item of a BillingBreakdown. Discounts have a negative
+// amount.
+type BillingLine struct {
+	Kind      BillingLineKind `json:"kind"`
+	Date      string          `json:"date"`
+	Peak      bool            `json:"peak,omitempty"`
+	Units     int64           `json:"units"`
+	UnitPrice Price           `json:"unit_price"`
+	Amount    int64           `json:"amount"`
+}
+
+// BillingBreakdown itemises the fee of a session.
+type BillingBreakdown struct {
+	TariffID uint          `json:"tariff_id"`
+	Tariff   string        `json:"tariff"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Lines    []BillingLine `json:"lines"`
+	Total    Price         `json:"total"`
+}
+
+func (b BillingBreakdown) Value() (driver.Value, error) {
+	return json.Marshal(b)
+}
+
+func (b *BillingBreakdown) Scan(v interface{}) error {
+	return scanJSON(v, b)
+}
+
+// BillingInput describes the use being billed.
+type BillingInput struct {
+	Start time.Time
+	End   time.Time
+	IsPro bool
+	// PriorCharges are what the user already paid on each day, keyed by
+	// date as 2006-01-02, for the daily cap.
+	PriorCharges map[string]Price
+}
+
+// Compute prices in under t. It depends on nothing but its arguments.
+func (t *Tariff) Compute(in BillingInput) (*BillingBreakdown, error) {
+	loc, err := t.location()
+	if err != nil {
+		return nil, err
+	}
+
+	bd := &BillingBreakdown{
+		TariffID: t.ID,
+		Tariff:   t.Name,
+		Start:    in.Start,
+		End:      in.End,
+		Lines:    make([]BillingLine, 0),
+	}
+
+	start := in.Start
+	if in.IsPro && t.ProFreeMinutes > 0 && in.End.After(start) {
+		free := time.Duration(t.ProFreeMinutes) * time.Minute
+		if d := in.End.Sub(start); d < free {
+			free = d
+		}
+		bd.Lines = append(bd.Lines, BillingLine{
+			Kind:  BillingLineProFree,
+			Date:  start.In(loc).Format("2006-01-02"),
+			Units: int64(free / time.Minute),
+		})
+		start = start.Add(free)
+	}
+
+	type key struct {
+		date string
+		peak bool
+	}
+	usage := make(map[key]int64)
+	u := t.unit()
+	n := t.units(in.End.Sub(start))
+	for i := int64(0); i < n; i++ {
+		at := start.Add(time.Duration(i) * u).In(loc)
+		k := key{
+			date: at.Format("2006-01-02"),
+			peak: len(t.PeakWindows) != 0 && t.PeakWindows.contains(at),
+		}
+		usage[k]++
+	}
+
+	keys := make([]key, 0, len(usage))
+	for k := range usage {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].date != keys[j].date {
+			return keys[i].date < keys[j].date
+		}
+		return !keys[i].peak && keys[j].peak
+	})
+
+	daily := make(map[string]int64)
+	dates := make([]string, 0)
+	for _, k := range keys {
+		price := t.Rate
+		if k.peak {
+			price = t.PeakRate
+		}
+		amount := int64(price) * usage[k]
+		bd.Lines = append(bd.Lines, BillingLine{
+			Kind:      BillingLineUsage,
+			Date:      k.date,
+			Peak:      k.peak,
+			Units:     usage[k],
+			UnitPrice: price,
+			Amount:    amount,
+		})
+		if _, ok := daily[k.date]; !ok {
+			dates = append(dates, k.date)
+		}
+		daily[k.date] += amount
+	}
+
+	var total int64
+	for _, date := range dates {
+		amount := daily[date]
+		if t.DailyCap > 0 {
+			room := int64(t.DailyCap) - int64(in.PriorCharges[date])
+			if room < 0 {
+				room = 0
+			}
+			if amount > room {
+				bd.Lines = append(bd.Lines, BillingLine{
+					Kind:   BillingLineDailyCap,
+					Date:   date,
+					Amount: room - amount,
+				})
+				amount = room
+			}
+		}
+		total += amount
+	}
+	bd.Total = Price(total)
+	return bd, nil
+}
+
+// TariffBiller bills sessions by the tariff that applies to their seat,
+// or Default when there is none, and keeps the breakdown on the session.
+type TariffBiller struct {
+	Clock   Clock
+	Default Tariff
+}
+
+// NewTariffBiller returns a TariffBiller falling back to DefaultTariff.
+func NewTariffBiller(clock Clock) *TariffBiller {
+	return &TariffBiller{Clock: clock, Default: DefaultTariff}
+}
+
+func (b *TariffBiller) Bill(ctx context.Context, tx *Repo, s *Session, start, end time.Time) (Price, error) {
+	bd, err := b.breakdown(ctx, tx, s, start, end)
+	if err != nil {
+		return 0, err
+	}
+	s.BillingBreakdown = bd
+	return bd.Total, nil
+}
+
+func (b *TariffBiller) breakdown(ctx context.Context, tx *Repo, s *Session, start, end time.Time) (*BillingBreakdown, error) {
+	seat := Seat{}
+	if err := tx.conn(ctx).First(&seat, s.SeatID).Error; err != nil {
+		return nil, err
+	}
+	tariff, err := tx.findTariff(ctx, seat.StoreID, seat.Class)
+	if err != nil {
+		return nil, err
+	}
+	if tariff == nil {
+		tariff = &b.Default
+	}
+	loc, err := tariff.location()
+	if err != nil {
+		return nil, err
+	}
+
+	user := User{}
+	if err := tx.conn(ctx).First(&user, s.UserID).Error; err != nil {
+		return nil, err
+	}
+	isPro := user.proAt(b.Clock.Now())
+
+	prior := make(map[string]Price)
+	if tariff.DailyCap > 0 {
+		day := start.In(loc)
+		dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+		settled := make([]Session, 0)
+		err := tx.conn(ctx).
+			Select("billing_fee", "actual_end_time").
+			Where("user_id = ? AND id <> ? AND actual_end_time >= ? AND actual_end_time < ?",
+				user.ID, s.ID, dayStart, end.AddDate(0, 0, 1)).
+			Find(&settled).
+			Error
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range settled {
+			prior[other.ActualEndTime.In(loc).Format("2006-01-02")] += other.BillingFee
+		}
+	}
+
+	return tariff.Compute(BillingInput{
+		Start:        start,
+		End:          end,
+		IsPro:        isPro,
+		PriorCharges: prior,
+	})
+}
+
+// findTariff returns the most specific enabled tariff for a seat of class
+// in store, or nil if none applies.
+func (r *Repo) findTariff(ctx context.Context, storeID uint, class string) (*Tariff, error) {
+	tariff := &Tariff{}
+	tx := r.conn(ctx).
+		Where("disabled = ?", false).
+		Where("store_id = ? OR store_id IS NULL", storeID).
+		Where("seat_class = ? OR seat_class = ''", class).
+		Order("store_id IS NULL, seat_class = '', id DESC").
+		Limit(1).
+		Find(tariff)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return nil, tx.Error
+	}
+	return tariff, nil
+}
+
+func (r *Repo) CreateTariff(ctx context.Context, t *Tariff) error {
+	if t.Unit == BillingUnitBlock && t.BlockMinutes == 0 {
+		return ErrInvalidArgument
+	}
+	if _, err := t.location(); err != nil {
+		return ErrInvalidArgument.Wrap(err)
+	}
+	return r.conn(ctx).Create(t).Error
+}
+
+func (r *Repo) ListTariffs(ctx context.Context) ([]*Tariff, error) {
+	tariffs := make([]*Tariff, 0)
+	tx := r.conn(ctx).Order("id asc").Find(&tariffs)
+	return tariffs, tx.Error
+}
+
+// QuoteSession prices s as if it ended now, by the Repo's clock, without
+// saving anything. It needs the Repo to bill with a TariffBiller.
+func (r *Repo) QuoteSession(ctx context.Context, s *Session) (*BillingBreakdown, error) {
+	b, ok := r.biller.(*TariffBiller)
+	if !ok {
+		return nil, errors.New("models: session biller does not itemise fees")
+	}
+	start, err := r.billingStart(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return b.breakdown(ctx, r, s, start, b.Clock.Now())
+}
+
+func migrateTariffs(db *gorm.DB) error {
+	if err := createTables(db, &Tariff{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	if !m.HasColumn(&Seat{}, "Class") {
+		if err := m.AddColumn(&Seat{}, "Class"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&Session{}, "BillingBreakdown") {
+		if err := m.AddColumn(&Session{}, "BillingBreakdown"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropTariffs(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropColumn(&Session{}, "BillingBreakdown"); err != nil {
+		return err
+	}
+	if err := m.DropColumn(&Seat{}, "Class"); err != nil {
+		return err
+	}
+	return m.DropTable(&Tariff{})
+}
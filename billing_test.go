@@ -0,0 +1,246 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func shanghai(t *testing.T, clock string) time.Time {
+	t.Helper()
+	// 2022-03-01 is a Tuesday
+	ts, err := time.Parse(time.RFC3339, "2022-03-01T"+clock+"+08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestTariffCompute(t *testing.T) {
+	perMinute := models.Tariff{Unit: models.BillingUnitMinute, Rate: 10, Rounding: models.RoundUp}
+	block := models.Tariff{Unit: models.BillingUnitBlock, BlockMinutes: 30, Rate: 200, Rounding: models.RoundUp}
+	peak := perMinute
+	peak.PeakRate = 20
+	peak.PeakWindows = models.TariffWindows{{
+		Weekdays: models.WeekdayMaskWorkdays,
+		Start:    18 * 60,
+		End:      22 * 60,
+	}}
+	pro := perMinute
+	pro.ProFreeMinutes = 30
+	capped := perMinute
+	capped.DailyCap = 500
+
+	with := func(t models.Tariff, r models.RoundingRule) models.Tariff {
+		t.Rounding = r
+		return t
+	}
+
+	cases := []struct {
+		name       string
+		tariff     models.Tariff
+		start, end string
+		isPro      bool
+		prior      map[string]models.Price
+		want       models.Price
+		wantLines  int
+	}{
+		{"per minute", perMinute, "09:00:00", "10:30:00", false, nil, 900, 1},
+		{"round up", perMinute, "09:00:00", "10:30:01", false, nil, 910, 1},
+		{"round down", with(perMinute, models.RoundDown), "09:00:00", "10:30:59", false, nil, 900, 1},
+		{"round nearest up", with(perMinute, models.RoundNearest), "09:00:00", "10:30:30", false, nil, 910, 1},
+		{"round nearest down", with(perMinute, models.RoundNearest), "09:00:00", "10:30:29", false, nil, 900, 1},
+		{"blocks", block, "09:00:00", "10:01:00", false, nil, 600, 1},
+		{"blocks round down", with(block, models.RoundDown), "09:00:00", "10:01:00", false, nil, 400, 1},
+		{"empty", perMinute, "09:00:00", "09:00:00", false, nil, 0, 0},
+		{"off-peak", peak, "09:00:00", "10:00:00", false, nil, 600, 1},
+		{"into peak", peak, "17:30:00", "18:30:00", false, nil, 900, 2},
+		{"pro free minutes", pro, "09:00:00", "10:00:00", true, nil, 300, 2},
+		{"pro free minutes not for others", pro, "09:00:00", "10:00:00", false, nil, 600, 1},
+		{"pro within free minutes", pro, "09:00:00", "09:20:00", true, nil, 0, 1},
+		{"daily cap", capped, "09:00:00", "10:00:00", false, nil, 500, 2},
+		{"daily cap with prior charges", capped, "09:00:00", "09:40:00", false, map[string]models.Price{"2022-03-01": 200}, 300, 2},
+		{"daily cap reached", capped, "09:00:00", "09:40:00", false, map[string]models.Price{"2022-03-01": 600}, 0, 2},
+		{"daily cap per day", capped, "23:00:00", "23:59:59", false, nil, 500, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bd, err := c.tariff.Compute(models.BillingInput{
+				Start:        shanghai(t, c.start),
+				End:          shanghai(t, c.end),
+				IsPro:        c.isPro,
+				PriorCharges: c.prior,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bd.Total != c.want {
+				t.Errorf("total = %d, want %d", bd.Total, c.want)
+			}
+			if len(bd.Lines) != c.wantLines {
+				t.Errorf("got %d lines, want %d: %+v", len(bd.Lines), c.wantLines, bd.Lines)
+			}
+			var sum int64
+			for _, l := range bd.Lines {
+				sum += l.Amount
+			}
+			if models.Price(sum) != bd.Total {
+				t.Errorf("lines add up to %d, total is %d", sum, bd.Total)
+			}
+		})
+	}
+}
+
+func TestTariffComputeAcrossMidnight(t *testing.T) {
+	tariff := models.Tariff{Unit: models.BillingUnitMinute, Rate: 10, DailyCap: 200}
+	bd, err := tariff.Compute(models.BillingInput{
+		Start: shanghai(t, "23:30:00"),
+		End:   shanghai(t, "23:30:00").Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bd.Total != 400 {
+		t.Errorf("total = %d, want 400", bd.Total)
+	}
+	dates := make(map[string]bool)
+	for _, l := range bd.Lines {
+		dates[l.Date] = true
+	}
+	if !dates["2022-03-01"] || !dates["2022-03-02"] {
+		t.Errorf("lines do not cover both days: %+v", bd.Lines)
+	}
+}
+
+func TestTariffBiller(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [
+			{"id": 1, "username": "alice", "phone": "13800000001", "is_pro": true},
+			{"id": 2, "username": "bob", "phone": "13800000002"}
+		],
+		"stores": [{"id": 1, "name": "main"}],
+		"seats": [
+			{"id": 1, "store_id": 1, "label": "A"},
+			{"id": 2, "store_id": 1, "label": "B", "class": "booth"}
+		]
+	}`))
+	ctx := context.Background()
+
+	storeID := uint(1)
+	tariffs := []*models.Tariff{
+		{Name: "store", StoreID: &storeID, Rate: 10, ProFreeMinutes: 30},
+		{Name: "booth", StoreID: &storeID, SeatClass: "booth", Rate: 30},
+	}
+	for _, tariff := range tariffs {
+		if err := repo.CreateTariff(ctx, tariff); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	clock := models.ClockFunc(func() time.Time { return now })
+	repo.SetSessionBiller(models.NewTariffBiller(clock))
+
+	ptr := func(ts time.Time) *time.Time { return &ts }
+	cases := []struct {
+		user, seat uint
+		tariff     string
+		want       models.Price
+	}{
+		{1, 1, "store", 300},
+		{2, 2, "booth", 1800},
+	}
+	for _, c := range cases {
+		u := &models.User{}
+		u.ID = c.user
+		seat := &models.Seat{}
+		seat.ID = c.seat
+		s, err := repo.ReserveSession(ctx, sessionKey, u, seat, ptr(now.Add(-time.Hour)), ptr(now.Add(time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bd, err := repo.QuoteSession(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bd.Tariff != c.tariff || bd.Total != c.want {
+			t.Errorf("seat %d: quoted %d by %q, want %d by %q", c.seat, bd.Total, bd.Tariff, c.want, c.tariff)
+		}
+
+		for _, st := range []models.SessionStatus{models.SessionStatusCheckedIn, models.SessionStatusOnGoing} {
+			if err := repo.TransitionSession(ctx, s, st, models.UserActor(u)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := repo.EndSessionEarly(ctx, s, now, models.UserActor(u)); err != nil {
+			t.Fatal(err)
+		}
+		saved := &models.Session{}
+		if err := repo.DB().First(saved, s.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if saved.BillingBreakdown == nil || saved.BillingBreakdown.Total != saved.BillingFee {
+			t.Errorf("seat %d: breakdown %+v was not stored with fee %d", c.seat, saved.BillingBreakdown, saved.BillingFee)
+		}
+	}
+}
+
+func TestCompletedSessionIsSettled(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	storeID := uint(1)
+	if err := repo.CreateTariff(ctx, &models.Tariff{Name: "store", StoreID: &storeID, Rate: 10}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Minute)
+	later := now.Add(time.Hour)
+	clock := models.ClockFunc(func() time.Time { return later })
+	repo.SetSessionBiller(models.NewTariffBiller(clock))
+
+	u := &models.User{}
+	u.ID = 2
+	if _, err := repo.CreditUser(ctx, u, 10000, models.CreditReasonAdminAdjustment, nil, models.SessionActorSystem); err != nil {
+		t.Fatal(err)
+	}
+	seat := &models.Seat{}
+	seat.ID = 2
+	end := now.Add(2 * time.Hour)
+	s, err := repo.ReserveSession(ctx, sessionKey, u, seat, &now, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []models.SessionStatus{
+		models.SessionStatusCheckedIn,
+		models.SessionStatusOnGoing,
+		models.SessionStatusCompleted,
+	} {
+		if err := repo.TransitionSession(ctx, s, st, models.UserActor(u)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := &models.Session{}
+	if err := repo.DB().First(saved, s.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.BillingFee == 0 || saved.ActualEndTime == nil {
+		t.Fatalf("completed session was not settled: fee %d, ended %v", saved.BillingFee, saved.ActualEndTime)
+	}
+	if saved.BillingBreakdown == nil || saved.BillingBreakdown.Total != saved.BillingFee {
+		t.Errorf("breakdown %+v was not stored with fee %d", saved.BillingBreakdown, saved.BillingFee)
+	}
+	balance, err := repo.LedgerBalance(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 10000-saved.BillingFee {
+		t.Errorf("balance = %d, want %d after charging %d", balance, 10000-saved.BillingFee, saved.BillingFee)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,7 +16,8 @@ type CheckIn struct {
 	ExactTime time.Time `json:"-"`
 }
 
-func NewCheckIn(user uint) error {
+func (r *Repo) NewCheckIn(ctx context.Context, user uint) error {
+	db := r.conn(ctx)
 	now := time.Now()
 	record := CheckIn{
 		Year:      uint(now.Year()),
@@ -38,7 +40,7 @@ func NewCheckIn(user uint) error {
 		Count(&cnt)
 
 	if cnt != 0 {
-		return NewRequestError("今天已经签过到了")
+		return ErrAlreadyCheckedIn
 	}
 
 	if tx.Error != nil {
@@ -46,14 +48,30 @@ func NewCheckIn(user uint) error {
 		return tx.Error
 	}
 
-	return db.Create(record).Error
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		if err := tx.conn(ctx).Create(record).Error; err != nil {
+			return err
+		}
+		if CheckInReward == 0 {
+			return nil
+		}
+		u := &User{}
+		u.ID = user
+		_, err := tx.CreditUser(ctx, u, CheckInReward, CreditReasonCheckInReward, nil, SessionActorSystem)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.issueCheckInStreakCoupons(ctx, user, now)
+	return nil
 }
 
-func GetCheckInHistory(uid uint, beforeYear, beforeMonth, beforeDay int) ([]*CheckIn, error) {
+func (r *Repo) GetCheckInHistory(ctx context.Context, uid uint, beforeYear, beforeMonth, beforeDay int) ([]*CheckIn, error) {
 	result := make([]*CheckIn, 0)
 	end := time.Date(int(beforeYear), time.Month(beforeMonth), int(beforeDay), 23, 59, 59, 0, time.Local)
 	start := end.AddDate(0, 0, -31)
-	tx := db.
+	tx := r.conn(ctx).
 		Where("user_id = ? AND exact_time <= ? AND exact_time >= ?", uid, end, start).
 		Omit("user_id").
 		Order("exact_time DESC").
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"time"
 
 	"gorm.io/gorm"
@@ -13,9 +14,9 @@ type DynamicConfiguration struct {
 	LastModified time.Time
 }
 
-func GetConfigurationValue(name string) interface{} {
+func (r *Repo) GetConfigurationValue(ctx context.Context, name string) interface{} {
 	config := DynamicConfiguration{}
-	tx := db.First(&config, "name = ?", name)
+	tx := r.conn(ctx).First(&config, "name = ?", name)
 	if tx.Error != nil {
 		return nil
 	}
@@ -1,11 +1,8 @@
 package models
 
 import (
-	"database/sql/driver"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"math"
+	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -17,44 +14,6 @@ type ICoupon interface {
 	Discount(products []IProduct) []IProduct
 }
 
-type CouponRestrictions []CouponRestriction
-
-// Scanner for CouponRestrictions
-func (c *CouponRestrictions) Scan(value interface{}) error {
-	bytes, ok := value.([]byte)
-	if !ok {
-		return errors.New(fmt.Sprint("解析 CouponRestrictions 失败", value))
-	}
-
-	result := []CouponRestriction{}
-	err := json.Unmarshal(bytes, &result)
-	*c = result
-	return err
-}
-func (c CouponRestrictions) Value() (driver.Value, error) {
-	if len(c) == 0 {
-		return nil, nil
-	}
-	return json.Marshal(c)
-}
-
-// RestrictionType 表示优惠券限制类型，有指定商品、商品金额、指定用户等类型
-type RestrictionType uint
-
-const (
-	// 指定商品
-	CouponRestrictionTypeProductLimit RestrictionType = iota
-	// 满多少元
-	CouponRestrictionTypePriceThreshold
-	// 指定用户
-	CouponRestrictionTypeSpecifiedUser
-)
-
-type CouponRestriction struct {
-	Type        RestrictionType
-	Restriction interface{}
-}
-
 // 表示优惠券类型，如减去固定金额，打折等
 type CouponType uint
 
@@ -73,83 +32,43 @@ type Coupon struct {
 	Used         bool               `gorm:"notNull;default:0" json:"-"`
 	Restrictions CouponRestrictions `gorm:"type:text"`
 	DiscountData uint32             `gorm:"type:int"` // 存放优惠券折扣相关数据
+	CampaignID   *uint              `json:"campaign_id"`
+	RedeemCodeID *uint              `json:"-"`
+	CouponStacking
 }
 
-func IfSatisfyProductLimitRestriction(types []ProductType, p IProduct) bool {
-	satisfy := false
-	for _, t := range types {
-		satisfy = satisfy || t == p.GetType()
-		if satisfy {
-			break
-		}
-	}
-
-	return satisfy
-}
-
-func IfSatisfyPriceThreshold(threshold, price Price) bool {
-	return threshold.ToInt() <= price.ToInt()
-}
-
-func IfSatisfySpecifiedUser(restrictedUser, user uint) bool {
-	return restrictedUser == user
-}
-
-func (coupon *Coupon) IfSatisfyRestriction(product IProduct, user *User) error {
-	for _, res := range coupon.Restrictions {
-		switch res.Type {
-		case CouponRestrictionTypeProductLimit:
-			if !IfSatisfyProductLimitRestriction(res.Restriction.([]ProductType), product) {
-				return errors.New("仅指定商品可用")
-			}
-		case CouponRestrictionTypePriceThreshold:
-			if !IfSatisfyPriceThreshold(res.Restriction.(Price), product.GetSalePrice()) {
-				return errors.New("未达到满减金额")
-			}
-		case CouponRestrictionTypeSpecifiedUser:
-			if !IfSatisfySpecifiedUser(res.Restriction.(uint), user.ID) {
-				return errors.New("仅指定用户可用")
-			}
-		}
-	}
-	return nil
+// Discount returns how much coupon takes off product for u now.
+func (coupon *Coupon) Discount(product IProduct, u *User) (Price, error) {
+	return coupon.DiscountFor(&CouponContext{Product: product, User: u, Now: time.Now()})
 }
 
-// 返回折扣减去的金额
-func (coupon *Coupon) Discount(product IProduct, u *User) (Price, error) {
-	if err := coupon.IfSatisfyRestriction(product, u); err != nil {
+// DiscountFor returns how much coupon takes off c.Product, failing with
+// the first restriction c does not meet.
+func (coupon *Coupon) DiscountFor(c *CouponContext) (Price, error) {
+	if err := coupon.IfSatisfyRestrictions(c); err != nil {
 		return 0, err
 	}
 
-	price := product.GetBasePrice()
-	if product.IsOnSale() {
-		price = product.GetSalePrice()
+	price := c.Product.GetBasePrice()
+	if c.Product.IsOnSale() {
+		price = c.Product.GetSalePrice()
 	}
-
-	switch coupon.Type {
-	case CouponTypeDiscountFixedPrice:
-		if coupon.DiscountData > uint32(price.ToInt()) {
-			return price, nil
-		} else {
-			return Price(coupon.DiscountData), nil
-		}
-	case CouponTypeDiscountPercentage:
-		return Price(math.Floor(float64(uint32(price)*coupon.DiscountData) / 100)), nil
+	if _, err := coupon.discountOn(price); err != nil {
+		return 0, err
 	}
-
-	return 0, errors.New("优惠券类型错误")
+	return coupon.discountOnLine(price, price), nil
 }
 
-func GetCouponById(id uint) (*Coupon, error) {
+func (r *Repo) GetCouponById(ctx context.Context, id uint) (*Coupon, error) {
 	coupon := Coupon{}
-	tx := db.Where("id = ?", id).First(&coupon)
+	tx := r.conn(ctx).Where("id = ?", id).First(&coupon)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	return &coupon, nil
 }
 
-func (c *Coupon) MarkUsed() error {
+func (r *Repo) MarkCouponUsed(ctx context.Context, c *Coupon) error {
 	c.Used = true
-	return db.Save(c).Error
+	return r.conn(ctx).Save(c).Error
 }
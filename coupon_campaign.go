@@ -0,0 +1,400 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CampaignTrigger is what issues the coupons of a campaign on its own.
+type CampaignTrigger string
+
+const (
+	// CampaignTriggerManual campaigns issue coupons in bulk or through
+	// redeem codes only.
+	CampaignTriggerManual        CampaignTrigger = "manual"
+	CampaignTriggerSignup        CampaignTrigger = "signup"
+	CampaignTriggerCheckInStreak CampaignTrigger = "check_in_streak"
+	CampaignTriggerReferral      CampaignTrigger = "referral"
+)
+
+// CouponCampaign is a template coupons are issued from.
+type CouponCampaign struct {
+	gorm.Model
+	Name         string             `gorm:"type:varchar(128);not null" json:"name"`
+	Type         CouponType         `gorm:"type:int" json:"type"`
+	DiscountData uint32             `gorm:"type:int" json:"discount_data"`
+	Restrictions CouponRestrictions `gorm:"type:text" json:"restrictions"`
+	Trigger      CampaignTrigger    `gorm:"column:issue_trigger;type:varchar(32);not null;default:manual;index" json:"trigger"`
+	// StreakDays is the check-in streak a check_in_streak campaign
+	// rewards.
+	StreakDays uint `json:"streak_days,omitempty"`
+	// Quota caps the coupons issued, PerUserLimit those issued to one
+	// user. Zero means no cap.
+	Quota        uint `json:"quota"`
+	PerUserLimit uint `json:"per_user_limit"`
+	Issued       uint `gorm:"not null;default:0" json:"issued"`
+	// StartsAt and EndsAt bound when coupons are issued and used.
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+	// ValidDays is how long an issued coupon lasts, zero meaning until
+	// the campaign ends.
+	ValidDays uint `json:"valid_days"`
+	Disabled  bool `gorm:"not null;default:false" json:"disabled"`
+	// CouponStacking is copied to the coupons issued.
+	CouponStacking
+}
+
+// RedeemCode is a printable code users trade for a coupon of a campaign.
+type RedeemCode struct {
+	ID         uint   `gorm:"primarykey" json:"id"`
+	CampaignID uint   `gorm:"not null;index" json:"campaign_id"`
+	Code       string `gorm:"type:varchar(32);not null;uniqueIndex" json:"code"`
+	// MaxUses is how many users can redeem the code, zero meaning any
+	// number up to the campaign quota.
+	MaxUses   uint      `gorm:"not null" json:"max_uses"`
+	Uses      uint      `gorm:"not null;default:0" json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CampaignStats struct {
+	Issued   int64 `json:"issued"`
+	Redeemed int64 `json:"redeemed"`
+	// Revenue is what was paid for the orders the coupons were used on.
+	Revenue Price `json:"revenue"`
+}
+
+func migrateCouponCampaigns(db *gorm.DB) error {
+	if err := createTables(db, &CouponCampaign{}, &RedeemCode{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	for _, field := range []string{"CampaignID", "RedeemCodeID"} {
+		if !m.HasColumn(&Coupon{}, field) {
+			if err := m.AddColumn(&Coupon{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	return execAll(db,
+		"CREATE INDEX IF NOT EXISTS idx_coupons_campaign_id ON coupons (campaign_id)",
+		"CREATE INDEX IF NOT EXISTS idx_coupons_redeem_code_id ON coupons (redeem_code_id)",
+	)
+}
+
+func dropCouponCampaigns(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, field := range []string{"RedeemCodeID", "CampaignID"} {
+		if err := m.DropColumn(&Coupon{}, field); err != nil {
+			return err
+		}
+	}
+	return m.DropTable(&RedeemCode{}, &CouponCampaign{})
+}
+
+func (c *CouponCampaign) activeAt(t time.Time) bool {
+	return !c.Disabled &&
+		(c.StartsAt == nil || !t.Before(*c.StartsAt)) &&
+		(c.EndsAt == nil || !t.After(*c.EndsAt))
+}
+
+func (r *Repo) CreateCouponCampaign(ctx context.Context, c *CouponCampaign) error {
+	if c.Trigger == "" {
+		c.Trigger = CampaignTriggerManual
+	}
+	return r.conn(ctx).Create(c).Error
+}
+
+func (r *Repo) GetCouponCampaign(ctx context.Context, id uint) (*CouponCampaign, error) {
+	c := &CouponCampaign{}
+	err := r.conn(ctx).First(c, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidArgument.Wrap(err)
+	}
+	return c, err
+}
+
+// IssueCoupon issues a coupon of campaign c to u. The campaign row is
+// locked while issuing so its quota cannot be oversold.
+func (r *Repo) IssueCoupon(ctx context.Context, c *CouponCampaign, u *User) (*Coupon, error) {
+	return r.issueCoupon(ctx, c.ID, u.ID, nil)
+}
+
+func (r *Repo) issueCoupon(ctx context.Context, campaignID, userID uint, code *RedeemCode) (*Coupon, error) {
+	coupon := &Coupon{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		campaign := &CouponCampaign{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(campaign, campaignID).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if !campaign.activeAt(now) {
+			return ErrCampaignInactive
+		}
+		if campaign.Quota > 0 && campaign.Issued >= campaign.Quota {
+			return ErrCampaignExhausted
+		}
+		if campaign.PerUserLimit > 0 {
+			var n int64
+			err := tx.conn(ctx).
+				Model(&Coupon{}).
+				Where("campaign_id = ? AND user_id = ?", campaign.ID, userID).
+				Count(&n).
+				Error
+			if err != nil {
+				return err
+			}
+			if n >= int64(campaign.PerUserLimit) {
+				return ErrCampaignLimit
+			}
+		}
+
+		window := ValidityWindow{NotBefore: &now, NotAfter: campaign.EndsAt}
+		if campaign.ValidDays > 0 {
+			until := now.AddDate(0, 0, int(campaign.ValidDays))
+			if window.NotAfter == nil || until.Before(*window.NotAfter) {
+				window.NotAfter = &until
+			}
+		}
+		restrictions := make(CouponRestrictions, 0, len(campaign.Restrictions)+1)
+		restrictions = append(restrictions, campaign.Restrictions...)
+		restrictions = append(restrictions, NewCouponRestriction(window))
+		*coupon = Coupon{
+			UserID:         userID,
+			Type:           campaign.Type,
+			Restrictions:   restrictions,
+			DiscountData:   campaign.DiscountData,
+			CampaignID:     &campaign.ID,
+			CouponStacking: campaign.CouponStacking,
+		}
+		if code != nil {
+			coupon.RedeemCodeID = &code.ID
+		}
+		if err := tx.conn(ctx).Omit(clause.Associations).Create(coupon).Error; err != nil {
+			return err
+		}
+		return tx.conn(ctx).
+			Model(campaign).
+			Update("issued", gorm.Expr("issued + 1")).
+			Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidArgument.Wrap(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// IssueCampaignCoupons issues a coupon of c to each of userIDs, skipping
+// users who reached the per-user limit, until the quota runs out. It
+// returns how many coupons it issued.
+func (r *Repo) IssueCampaignCoupons(ctx context.Context, c *CouponCampaign, userIDs []uint) (int, error) {
+	issued := 0
+	for _, id := range userIDs {
+		_, err := r.issueCoupon(ctx, c.ID, id, nil)
+		if errors.Is(err, ErrCampaignLimit) {
+			continue
+		}
+		if err != nil {
+			return issued, err
+		}
+		issued++
+	}
+	return issued, nil
+}
+
+// issueTriggered issues to userID a coupon of each active campaign with
+// trigger that match accepts. Campaigns that cannot issue are skipped.
+func (r *Repo) issueTriggered(ctx context.Context, trigger CampaignTrigger, userID uint, match func(*CouponCampaign) bool) []*Coupon {
+	campaigns := make([]*CouponCampaign, 0)
+	err := r.conn(ctx).Where("issue_trigger = ? AND NOT disabled", trigger).Find(&campaigns).Error
+	if err != nil {
+		logrus.WithError(err).WithField("trigger", trigger).Error("Failed to find coupon campaigns")
+		return nil
+	}
+	coupons := make([]*Coupon, 0)
+	for _, c := range campaigns {
+		if match != nil && !match(c) {
+			continue
+		}
+		coupon, err := r.issueCoupon(ctx, c.ID, userID, nil)
+		if err != nil {
+			if !IsRequestError(err) {
+				logrus.WithError(err).WithField("campaign", c.ID).Error("Failed to issue coupon")
+			}
+			continue
+		}
+		coupons = append(coupons, coupon)
+	}
+	return coupons
+}
+
+// IssueSignupCoupons issues the coupons of signup campaigns to the new
+// user u.
+func (r *Repo) IssueSignupCoupons(ctx context.Context, u *User) []*Coupon {
+	return r.issueTriggered(ctx, CampaignTriggerSignup, u.ID, nil)
+}
+
+// IssueReferralCoupons rewards referrer for bringing in a new user.
+func (r *Repo) IssueReferralCoupons(ctx context.Context, referrer *User) []*Coupon {
+	return r.issueTriggered(ctx, CampaignTriggerReferral, referrer.ID, nil)
+}
+
+// issueCheckInStreakCoupons rewards the user whose check-in streak
+// reached the length a campaign asks for.
+func (r *Repo) issueCheckInStreakCoupons(ctx context.Context, userID uint, today time.Time) []*Coupon {
+	streak, err := r.checkInStreak(ctx, userID, today)
+	if err != nil {
+		logrus.WithError(err).WithField("user", userID).Error("Failed to count check-in streak")
+		return nil
+	}
+	return r.issueTriggered(ctx, CampaignTriggerCheckInStreak, userID, func(c *CouponCampaign) bool {
+		return c.StreakDays > 0 && c.StreakDays == streak
+	})
+}
+
+// checkInStreak returns for how many days in a row, up to today, the user
+// checked in.
+func (r *Repo) checkInStreak(ctx context.Context, userID uint, today time.Time) (uint, error) {
+	checkIns := make([]*CheckIn, 0)
+	err := r.conn(ctx).
+		Where("user_id = ? AND exact_time <= ?", userID, today.Add(24*time.Hour)).
+		Order("exact_time DESC").
+		Limit(366).
+		Find(&checkIns).
+		Error
+	if err != nil {
+		return 0, err
+	}
+	var streak uint
+	day := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+	for _, c := range checkIns {
+		if int(c.Year) != day.Year() || time.Month(c.Month) != day.Month() || int(c.Day) != day.Day() {
+			break
+		}
+		streak++
+		day = day.AddDate(0, 0, -1)
+	}
+	return streak, nil
+}
+
+// redeemCodeAlphabet leaves out letters and digits that read alike.
+const redeemCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func printableCode(n int) (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(redeemCodeAlphabet)))
+	for i := 0; i < n; i++ {
+		k, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(redeemCodeAlphabet[k.Int64()])
+	}
+	return b.String(), nil
+}
+
+// CreateRedeemCodes prints n codes for c, each redeemable maxUses times.
+func (r *Repo) CreateRedeemCodes(ctx context.Context, c *CouponCampaign, n int, maxUses uint) ([]*RedeemCode, error) {
+	codes := make([]*RedeemCode, 0, n)
+	for i := 0; i < n; i++ {
+		code, err := printableCode(10)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, &RedeemCode{CampaignID: c.ID, Code: code, MaxUses: maxUses})
+	}
+	if n == 0 {
+		return codes, nil
+	}
+	return codes, r.conn(ctx).Create(&codes).Error
+}
+
+// Redeem trades code for a coupon for u. A user redeems a code once.
+func (r *Repo) Redeem(ctx context.Context, u *User, code string) (*Coupon, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	var coupon *Coupon
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		rc := &RedeemCode{}
+		err := tx.conn(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", code).
+			First(rc).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRedeemCodeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if rc.MaxUses > 0 && rc.Uses >= rc.MaxUses {
+			return ErrRedeemCodeUsed
+		}
+		var n int64
+		err = tx.conn(ctx).
+			Model(&Coupon{}).
+			Where("redeem_code_id = ? AND user_id = ?", rc.ID, u.ID).
+			Count(&n).
+			Error
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrRedeemCodeUsed
+		}
+
+		coupon, err = tx.issueCoupon(ctx, rc.CampaignID, u.ID, rc)
+		if err != nil {
+			return err
+		}
+		return tx.conn(ctx).Model(rc).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	return coupon, err
+}
+
+// orderUsesCouponSQL matches an order with a coupon it used, either as its
+// only coupon or as one of those of its quote.
+const orderUsesCouponSQL = "(orders.coupon_id = coupons.id OR orders.quote -> 'coupon_ids' @> to_jsonb(coupons.id))"
+
+// CampaignStats counts the coupons c issued, those redeemed on paid
+// orders and what those orders brought in, each order counted once.
+func (r *Repo) CampaignStats(ctx context.Context, c *CouponCampaign) (*CampaignStats, error) {
+	stats := &CampaignStats{}
+	err := r.conn(ctx).Model(&Coupon{}).Where("campaign_id = ?", c.ID).Count(&stats.Issued).Error
+	if err != nil {
+		return nil, err
+	}
+	paid := []OrderStatus{OrderStatusPaid, OrderStatusPartiallyRefunded}
+	err = r.conn(ctx).
+		Model(&Coupon{}).
+		Where("campaign_id = ?", c.ID).
+		Where("EXISTS (SELECT 1 FROM orders WHERE "+orderUsesCouponSQL+" AND orders.status IN ? AND orders.deleted_at IS NULL)", paid).
+		Count(&stats.Redeemed).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	var revenue int64
+	err = r.conn(ctx).
+		Model(&Order{}).
+		Where("status IN ?", paid).
+		Where("EXISTS (SELECT 1 FROM coupons WHERE "+orderUsesCouponSQL+" AND coupons.campaign_id = ? AND coupons.deleted_at IS NULL)", c.ID).
+		Select("COALESCE(SUM(discounted_price), 0)").
+		Scan(&revenue).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	stats.Revenue = Price(revenue)
+	return stats, nil
+}
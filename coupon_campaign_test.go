@@ -0,0 +1,158 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestCouponCampaignQuota(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"},
+		{"id": 3, "username": "carol", "phone": "13800000003"}
+	]}`))
+	ctx := context.Background()
+
+	campaign := &models.CouponCampaign{
+		Name:         "Spring",
+		Type:         models.CouponTypeDiscountFixedPrice,
+		DiscountData: 500,
+		Quota:        4,
+		PerUserLimit: 2,
+		ValidDays:    7,
+	}
+	if err := repo.CreateCouponCampaign(ctx, campaign); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 12)
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			u := &models.User{}
+			u.ID = id
+			_, err := repo.IssueCoupon(ctx, campaign, u)
+			errs <- err
+		}(uint(i%3 + 1))
+	}
+	wg.Wait()
+	close(errs)
+	issued := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			issued++
+		case errors.Is(err, models.ErrCampaignExhausted), errors.Is(err, models.ErrCampaignLimit):
+		default:
+			t.Errorf("IssueCoupon() error = %v", err)
+		}
+	}
+	if issued != 4 {
+		t.Errorf("issued %d coupons, want the quota of 4", issued)
+	}
+	stats, err := repo.CampaignStats(ctx, campaign)
+	if err != nil || stats.Issued != 4 {
+		t.Errorf("CampaignStats() = %+v, %v, want 4 issued", stats, err)
+	}
+}
+
+func TestRedeemCodes(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"}
+	]}`))
+	ctx := context.Background()
+	alice, _ := repo.FindUser(ctx, 1)
+	bob, _ := repo.FindUser(ctx, 2)
+
+	campaign := &models.CouponCampaign{Name: "Flyer", Type: models.CouponTypeDiscountFixedPrice, DiscountData: 300}
+	if err := repo.CreateCouponCampaign(ctx, campaign); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := repo.CreateRedeemCodes(ctx, campaign, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := repo.CreateRedeemCodes(ctx, campaign, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coupon, err := repo.Redeem(ctx, alice, codes[0].Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coupon.UserID != alice.ID || coupon.CampaignID == nil || *coupon.CampaignID != campaign.ID {
+		t.Errorf("coupon = %+v", coupon)
+	}
+	if _, err := repo.Redeem(ctx, bob, codes[0].Code); !errors.Is(err, models.ErrRedeemCodeUsed) {
+		t.Errorf("redeeming a one-time code twice: error = %v, want ErrRedeemCodeUsed", err)
+	}
+	if _, err := repo.Redeem(ctx, bob, "NOSUCHCODE"); !errors.Is(err, models.ErrRedeemCodeInvalid) {
+		t.Errorf("redeeming an unknown code: error = %v, want ErrRedeemCodeInvalid", err)
+	}
+	for _, u := range []*models.User{alice, bob} {
+		if _, err := repo.Redeem(ctx, u, shared[0].Code); err != nil {
+			t.Errorf("redeeming a shared code: %v", err)
+		}
+	}
+	if _, err := repo.Redeem(ctx, bob, shared[0].Code); !errors.Is(err, models.ErrRedeemCodeUsed) {
+		t.Errorf("redeeming a shared code again: error = %v, want ErrRedeemCodeUsed", err)
+	}
+
+	o := &models.Order{
+		TimestamppedID:  "20220301000040",
+		Price:           models.ToPrice(10),
+		DiscountedPrice: models.ToPrice(7),
+		Amount:          10,
+		Type:            models.OrderTypeBuyCredits,
+		GoodID:          models.GetCreditGoodID(),
+		AffiliateID:     alice.ID,
+		CouponID:        &coupon.ID,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitOrderPaid(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.CampaignStats(ctx, campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Issued != 3 || stats.Redeemed != 1 || stats.Revenue != models.ToPrice(7) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSignupCoupons(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+	campaign := &models.CouponCampaign{
+		Name:         "Welcome",
+		Type:         models.CouponTypeDiscountPercentage,
+		DiscountData: 20,
+		Trigger:      models.CampaignTriggerSignup,
+		PerUserLimit: 1,
+	}
+	if err := repo.CreateCouponCampaign(ctx, campaign); err != nil {
+		t.Fatal(err)
+	}
+	u, err := repo.NewPhoneUser(ctx, "dave", "13800000004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.CampaignStats(ctx, campaign)
+	if err != nil || stats.Issued != 1 {
+		t.Errorf("signup coupons for %d = %+v, %v, want 1", u.ID, stats, err)
+	}
+}
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RestrictionType 表示优惠券限制类型，有指定商品、商品金额、指定用户等类型
+type RestrictionType uint
+
+const (
+	// 指定商品
+	CouponRestrictionTypeProductLimit RestrictionType = iota
+	// 满多少元
+	CouponRestrictionTypePriceThreshold
+	// 指定用户
+	CouponRestrictionTypeSpecifiedUser
+	// 有效期
+	CouponRestrictionTypeValidityWindow
+	// 仅限首单
+	CouponRestrictionTypeFirstOrderOnly
+	// 仅限会员
+	CouponRestrictionTypeMemberOnly
+	// 指定门店
+	CouponRestrictionTypeStoreLimit
+	// 最短使用时长
+	CouponRestrictionTypeMinSessionLength
+)
+
+// CouponContext is what a coupon is being used for.
+type CouponContext struct {
+	Product IProduct
+	User    *User
+	Now     time.Time
+	// FirstOrder is set when the user has never paid for an order.
+	FirstOrder bool
+	// StoreID and SessionLength describe the session being paid, if any.
+	StoreID       uint
+	SessionLength time.Duration
+}
+
+// CouponRule is the value of a coupon restriction. Each kind of
+// restriction has its own type.
+type CouponRule interface {
+	Kind() RestrictionType
+	// check returns why c does not meet the rule, or nil if it does.
+	check(c *CouponContext) *UnmetRestriction
+}
+
+// ProductLimit limits a coupon to some types of products.
+type ProductLimit []ProductType
+
+// PriceThreshold is the price a product must reach for a coupon to apply.
+type PriceThreshold Price
+
+// SpecifiedUser limits a coupon to one user.
+type SpecifiedUser uint
+
+// ValidityWindow limits when a coupon can be used. Either end may be open.
+type ValidityWindow struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+// FirstOrderOnly limits a coupon to users who never paid for an order.
+type FirstOrderOnly struct{}
+
+// MemberOnly limits a coupon to users who are pro when it is used.
+type MemberOnly struct{}
+
+// StoreLimit limits a coupon to sessions in some stores.
+type StoreLimit []uint
+
+// MinSessionLength is how many minutes a session must last for a coupon
+// to apply to it.
+type MinSessionLength uint
+
+func (ProductLimit) Kind() RestrictionType     { return CouponRestrictionTypeProductLimit }
+func (PriceThreshold) Kind() RestrictionType   { return CouponRestrictionTypePriceThreshold }
+func (SpecifiedUser) Kind() RestrictionType    { return CouponRestrictionTypeSpecifiedUser }
+func (ValidityWindow) Kind() RestrictionType   { return CouponRestrictionTypeValidityWindow }
+func (FirstOrderOnly) Kind() RestrictionType   { return CouponRestrictionTypeFirstOrderOnly }
+func (MemberOnly) Kind() RestrictionType       { return CouponRestrictionTypeMemberOnly }
+func (StoreLimit) Kind() RestrictionType       { return CouponRestrictionTypeStoreLimit }
+func (MinSessionLength) Kind() RestrictionType { return CouponRestrictionTypeMinSessionLength }
+
+func (r ProductLimit) check(c *CouponContext) *UnmetRestriction {
+	if IfSatisfyProductLimitRestriction(r, c.Product) {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: r, Got: c.Product.GetType()}
+}
+
+func (r PriceThreshold) check(c *CouponContext) *UnmetRestriction {
+	if IfSatisfyPriceThreshold(Price(r), c.Product.GetSalePrice()) {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: Price(r), Got: c.Product.GetSalePrice()}
+}
+
+func (r SpecifiedUser) check(c *CouponContext) *UnmetRestriction {
+	if c.User != nil && IfSatisfySpecifiedUser(uint(r), c.User.ID) {
+		return nil
+	}
+	var got uint
+	if c.User != nil {
+		got = c.User.ID
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: uint(r), Got: got}
+}
+
+func (r ValidityWindow) check(c *CouponContext) *UnmetRestriction {
+	if (r.NotBefore == nil || !c.Now.Before(*r.NotBefore)) && (r.NotAfter == nil || !c.Now.After(*r.NotAfter)) {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: r, Got: c.Now}
+}
+
+func (r FirstOrderOnly) check(c *CouponContext) *UnmetRestriction {
+	if c.FirstOrder {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: true, Got: false}
+}
+
+func (r MemberOnly) check(c *CouponContext) *UnmetRestriction {
+	if c.User != nil && c.User.proAt(c.Now) {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: true, Got: false}
+}
+
+func (r StoreLimit) check(c *CouponContext) *UnmetRestriction {
+	for _, id := range r {
+		if id == c.StoreID {
+			return nil
+		}
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: r, Got: c.StoreID}
+}
+
+func (r MinSessionLength) check(c *CouponContext) *UnmetRestriction {
+	got := uint(c.SessionLength / time.Minute)
+	if got >= uint(r) {
+		return nil
+	}
+	return &UnmetRestriction{Type: r.Kind(), Want: uint(r), Got: got}
+}
+
+// newCouponRule returns an empty rule of kind t to decode into.
+func newCouponRule(t RestrictionType) (CouponRule, error) {
+	switch t {
+	case CouponRestrictionTypeProductLimit:
+		return &ProductLimit{}, nil
+	case CouponRestrictionTypePriceThreshold:
+		return new(PriceThreshold), nil
+	case CouponRestrictionTypeSpecifiedUser:
+		return new(SpecifiedUser), nil
+	case CouponRestrictionTypeValidityWindow:
+		return &ValidityWindow{}, nil
+	case CouponRestrictionTypeFirstOrderOnly:
+		return &FirstOrderOnly{}, nil
+	case CouponRestrictionTypeMemberOnly:
+		return &MemberOnly{}, nil
+	case CouponRestrictionTypeStoreLimit:
+		return &StoreLimit{}, nil
+	case CouponRestrictionTypeMinSessionLength:
+		return new(MinSessionLength), nil
+	}
+	return nil, fmt.Errorf("unknown coupon restriction type %d", t)
+}
+
+// CouponRestriction is one restriction of a coupon, stored as its type
+// and the rule's own JSON.
+type CouponRestriction struct {
+	Type        RestrictionType
+	Restriction CouponRule
+}
+
+// NewCouponRestriction wraps rule in a restriction of its kind.
+func NewCouponRestriction(rule CouponRule) CouponRestriction {
+	return CouponRestriction{Type: rule.Kind(), Restriction: rule}
+}
+
+func (c CouponRestriction) MarshalJSON() ([]byte, error) {
+	t := c.Type
+	if c.Restriction != nil {
+		t = c.Restriction.Kind()
+	}
+	return json.Marshal(struct {
+		Type        RestrictionType
+		Restriction CouponRule
+	}{t, c.Restriction})
+}
+
+func (c *CouponRestriction) UnmarshalJSON(data []byte) error {
+	raw := struct {
+		Type        RestrictionType
+		Restriction json.RawMessage
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	rule, err := newCouponRule(raw.Type)
+	if err != nil {
+		return err
+	}
+	if len(raw.Restriction) > 0 && string(raw.Restriction) != "null" {
+		if err := json.Unmarshal(raw.Restriction, rule); err != nil {
+			return fmt.Errorf("coupon restriction %d: %w", raw.Type, err)
+		}
+	}
+	c.Type = raw.Type
+	c.Restriction = derefCouponRule(rule)
+	return nil
+}
+
+// derefCouponRule turns the pointer decoded into back to the rule's value.
+func derefCouponRule(rule CouponRule) CouponRule {
+	switch r := rule.(type) {
+	case *ProductLimit:
+		return *r
+	case *PriceThreshold:
+		return *r
+	case *SpecifiedUser:
+		return *r
+	case *ValidityWindow:
+		return *r
+	case *FirstOrderOnly:
+		return *r
+	case *MemberOnly:
+		return *r
+	case *StoreLimit:
+		return *r
+	case *MinSessionLength:
+		return *r
+	}
+	return rule
+}
+
+type CouponRestrictions []CouponRestriction
+
+func (c *CouponRestrictions) Scan(value interface{}) error {
+	*c = nil
+	return scanJSON(value, c)
+}
+
+func (c CouponRestrictions) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+// restrictionErrors maps each kind of restriction to the error reported
+// when it is not met.
+var restrictionErrors = map[RestrictionType]RequestError{
+	CouponRestrictionTypeProductLimit:     ErrCouponProduct,
+	CouponRestrictionTypePriceThreshold:   ErrCouponThreshold,
+	CouponRestrictionTypeSpecifiedUser:    ErrCouponUser,
+	CouponRestrictionTypeValidityWindow:   ErrCouponWindow,
+	CouponRestrictionTypeFirstOrderOnly:   ErrCouponFirstOrder,
+	CouponRestrictionTypeMemberOnly:       ErrCouponMember,
+	CouponRestrictionTypeStoreLimit:       ErrCouponStore,
+	CouponRestrictionTypeMinSessionLength: ErrCouponSession,
+}
+
+// UnmetRestriction explains why a coupon restriction is not met: what
+// the restriction wants and what it got instead. It matches the request
+// error of its kind under errors.Is.
+type UnmetRestriction struct {
+	Type RestrictionType `json:"type"`
+	Code ErrorCode       `json:"code"`
+	Want interface{}     `json:"want"`
+	Got  interface{}     `json:"got"`
+}
+
+func (u *UnmetRestriction) Error() string {
+	return fmt.Sprintf("%s: want %v, got %v", u.Unwrap().Error(), u.Want, u.Got)
+}
+
+func (u *UnmetRestriction) Unwrap() error {
+	if err, ok := restrictionErrors[u.Type]; ok {
+		return err
+	}
+	return ErrCouponType
+}
+
+// CheckRestrictions returns every restriction of coupon that c does not
+// meet.
+func (coupon *Coupon) CheckRestrictions(c *CouponContext) []*UnmetRestriction {
+	unmet := make([]*UnmetRestriction, 0)
+	for _, res := range coupon.Restrictions {
+		if res.Restriction == nil {
+			continue
+		}
+		if u := res.Restriction.check(c); u != nil {
+			u.Code = restrictionErrors[u.Type].Code
+			unmet = append(unmet, u)
+		}
+	}
+	return unmet
+}
+
+// IfSatisfyRestrictions returns the first restriction of coupon that c
+// does not meet, or nil.
+func (coupon *Coupon) IfSatisfyRestrictions(c *CouponContext) error {
+	if unmet := coupon.CheckRestrictions(c); len(unmet) > 0 {
+		return unmet[0]
+	}
+	return nil
+}
+
+func (coupon *Coupon) IfSatisfyRestriction(product IProduct, user *User) error {
+	return coupon.IfSatisfyRestrictions(&CouponContext{Product: product, User: user, Now: time.Now()})
+}
+
+func IfSatisfyProductLimitRestriction(types []ProductType, p IProduct) bool {
+	satisfy := false
+	for _, t := range types {
+		satisfy = satisfy || t == p.GetType()
+		if satisfy {
+			break
+		}
+	}
+
+	return satisfy
+}
+
+func IfSatisfyPriceThreshold(threshold, price Price) bool {
+	return threshold.ToInt() <= price.ToInt()
+}
+
+func IfSatisfySpecifiedUser(restrictedUser, user uint) bool {
+	return restrictedUser == user
+}
@@ -0,0 +1,372 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaxCombinationCoupons caps how many coupons BestCouponCombination
+// weighs; past it, the coupons worth least on their own are left out.
+var MaxCombinationCoupons = 10
+
+// CouponStacking holds the rules for using a coupon with others. It is
+// embedded in both coupons and the campaigns issuing them.
+type CouponStacking struct {
+	// Exclusive coupons cannot be used with any other coupon.
+	Exclusive bool `gorm:"not null;default:false" json:"exclusive"`
+	// StackGroup names a group of coupons of which at most one is used,
+	// empty meaning no group.
+	StackGroup string `gorm:"type:varchar(32);not null;default:''" json:"stack_group"`
+	// Priority orders coupons on the same line, highest first. Each
+	// coupon discounts what those before it left.
+	Priority int `gorm:"not null;default:0" json:"priority"`
+	// MaxDiscountShare caps, in percent of the line price, what the
+	// coupon takes off. Zero means no cap.
+	MaxDiscountShare uint `gorm:"not null;default:0" json:"max_discount_share"`
+}
+
+// CouponAllocation is a coupon used on a line of a cart.
+type CouponAllocation struct {
+	CouponID uint  `json:"coupon_id"`
+	Line     int   `json:"line"`
+	Discount Price `json:"discount"`
+}
+
+// CouponCombination is a legal set of coupons for a cart.
+type CouponCombination struct {
+	Allocations []CouponAllocation `json:"allocations"`
+	// LineDiscounts is what the coupons take off each line.
+	LineDiscounts []Price `json:"line_discounts"`
+	Discount      Price   `json:"discount"`
+}
+
+func migrateCouponStacking(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, model := range []interface{}{&Coupon{}, &CouponCampaign{}} {
+		for _, field := range []string{"Exclusive", "StackGroup", "Priority", "MaxDiscountShare"} {
+			if m.HasColumn(model, field) {
+				continue
+			}
+			if err := m.AddColumn(model, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropCouponStacking(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, model := range []interface{}{&Coupon{}, &CouponCampaign{}} {
+		for _, field := range []string{"Exclusive", "StackGroup", "Priority", "MaxDiscountShare"} {
+			if err := m.DropColumn(model, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discountOn returns what coupon takes off price, before any cap.
+func (coupon *Coupon) discountOn(price Price) (Price, error) {
+	switch coupon.Type {
+	case CouponTypeDiscountFixedPrice:
+		if Price(coupon.DiscountData) > price {
+			return price, nil
+		}
+		return Price(coupon.DiscountData), nil
+	case CouponTypeDiscountPercentage:
+		return price * Price(coupon.DiscountData) / 100, nil
+	}
+	return 0, ErrCouponType
+}
+
+// discountOnLine returns what coupon takes off a line priced linePrice,
+// of which remaining is left after the coupons before it.
+func (coupon *Coupon) discountOnLine(linePrice, remaining Price) Price {
+	d, err := coupon.discountOn(remaining)
+	if err != nil {
+		return 0
+	}
+	if coupon.MaxDiscountShare > 0 {
+		if limit := linePrice * Price(coupon.MaxDiscountShare) / 100; d > limit {
+			d = limit
+		}
+	}
+	if d > remaining {
+		d = remaining
+	}
+	return d
+}
+
+type couponCandidate struct {
+	coupon *Coupon
+	// lines are those whose restrictions the coupon meets.
+	lines []int
+	// best is the most the coupon takes off a line on its own.
+	best Price
+}
+
+type couponSolver struct {
+	prices     []Price
+	candidates []*couponCandidate
+	mustUseAll bool
+
+	// bounds[k] is the most the candidates from k on can add.
+	bounds    []Price
+	remaining []Price
+	groups    map[string]bool
+	chosen    []CouponAllocation
+	exclusive bool
+	discount  Price
+
+	best *CouponCombination
+}
+
+// BestCouponCombination returns the legal set of coupons that takes the
+// most off products, the lines of a cart, and where each is used. base
+// describes the rest of the purchase; its Product is ignored. Ties go to
+// the set using fewer coupons, then to higher priority and lower IDs, so
+// the result only depends on the inputs.
+func BestCouponCombination(products []IProduct, coupons []*Coupon, base *CouponContext) *CouponCombination {
+	return solveCoupons(products, coupons, base, false)
+}
+
+// solveCoupons finds the best combination, which uses every coupon if
+// mustUseAll is set. It returns nil if no combination can use them all.
+func solveCoupons(products []IProduct, coupons []*Coupon, base *CouponContext, mustUseAll bool) *CouponCombination {
+	s := &couponSolver{
+		prices:     make([]Price, len(products)),
+		remaining:  make([]Price, len(products)),
+		groups:     map[string]bool{},
+		mustUseAll: mustUseAll,
+	}
+	for i, p := range products {
+		s.prices[i] = p.GetSalePrice()
+		s.remaining[i] = s.prices[i]
+	}
+
+	seen := map[uint]bool{}
+	for _, coupon := range coupons {
+		if seen[coupon.ID] {
+			continue
+		}
+		seen[coupon.ID] = true
+		cand := &couponCandidate{coupon: coupon}
+		for i, p := range products {
+			c := *base
+			c.Product = p
+			if coupon.IfSatisfyRestrictions(&c) != nil {
+				continue
+			}
+			cand.lines = append(cand.lines, i)
+			if d := coupon.discountOnLine(s.prices[i], s.prices[i]); d > cand.best {
+				cand.best = d
+			}
+		}
+		if len(cand.lines) == 0 {
+			if mustUseAll {
+				return nil
+			}
+			continue
+		}
+		s.candidates = append(s.candidates, cand)
+	}
+
+	if !mustUseAll && len(s.candidates) > MaxCombinationCoupons {
+		sort.SliceStable(s.candidates, func(i, j int) bool {
+			a, b := s.candidates[i], s.candidates[j]
+			if a.best != b.best {
+				return a.best > b.best
+			}
+			return a.coupon.ID < b.coupon.ID
+		})
+		s.candidates = s.candidates[:MaxCombinationCoupons]
+	}
+	sort.SliceStable(s.candidates, func(i, j int) bool {
+		a, b := s.candidates[i].coupon, s.candidates[j].coupon
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.ID < b.ID
+	})
+
+	s.bounds = make([]Price, len(s.candidates)+1)
+	for k := len(s.candidates) - 1; k >= 0; k-- {
+		s.bounds[k] = s.bounds[k+1] + s.candidates[k].best
+	}
+	if !mustUseAll {
+		s.best = s.result()
+	}
+	s.search(0)
+	return s.best
+}
+
+func (s *couponSolver) result() *CouponCombination {
+	comb := &CouponCombination{
+		Allocations:   append([]CouponAllocation{}, s.chosen...),
+		LineDiscounts: make([]Price, len(s.prices)),
+		Discount:      s.discount,
+	}
+	for _, a := range s.chosen {
+		comb.LineDiscounts[a.Line] += a.Discount
+	}
+	return comb
+}
+
+func (s *couponSolver) better() bool {
+	if s.best == nil || s.discount > s.best.Discount {
+		return true
+	}
+	return s.discount == s.best.Discount && len(s.chosen) < len(s.best.Allocations)
+}
+
+// search decides for each candidate from k on whether, and on which
+// line, it is used. Candidates come in the order they apply to a line,
+// so each discount is final once chosen.
+func (s *couponSolver) search(k int) {
+	if k == len(s.candidates) {
+		if s.better() {
+			s.best = s.result()
+		}
+		return
+	}
+	if s.best != nil && !s.mustUseAll {
+		bound := s.discount + s.bounds[k]
+		if bound < s.best.Discount || (bound == s.best.Discount && len(s.chosen) >= len(s.best.Allocations)) {
+			return
+		}
+	}
+
+	s.use(k)
+	if !s.mustUseAll {
+		s.search(k + 1)
+	}
+}
+
+// use tries candidate k on each line it can go on.
+func (s *couponSolver) use(k int) {
+	cand := s.candidates[k]
+	coupon := cand.coupon
+	if len(s.chosen) > 0 && (coupon.Exclusive || s.exclusive) {
+		return
+	}
+	if coupon.StackGroup != "" && s.groups[coupon.StackGroup] {
+		return
+	}
+	for _, line := range cand.lines {
+		d := coupon.discountOnLine(s.prices[line], s.remaining[line])
+		if d == 0 && !s.mustUseAll {
+			continue
+		}
+		exclusive := s.exclusive
+		s.exclusive = s.exclusive || coupon.Exclusive
+		if coupon.StackGroup != "" {
+			s.groups[coupon.StackGroup] = true
+		}
+		s.remaining[line] -= d
+		s.discount += d
+		s.chosen = append(s.chosen, CouponAllocation{CouponID: coupon.ID, Line: line, Discount: d})
+
+		s.search(k + 1)
+
+		s.chosen = s.chosen[:len(s.chosen)-1]
+		s.discount -= d
+		s.remaining[line] += d
+		if coupon.StackGroup != "" {
+			delete(s.groups, coupon.StackGroup)
+		}
+		s.exclusive = exclusive
+	}
+}
+
+// UnusedCoupons returns the coupons u can still use.
+func (r *Repo) UnusedCoupons(ctx context.Context, u *User) ([]*Coupon, error) {
+	coupons := make([]*Coupon, 0)
+	tx := r.conn(ctx).Where("user_id = ? AND NOT used", u.ID).Order("id asc").Find(&coupons)
+	return coupons, tx.Error
+}
+
+// BestCouponCombination picks, among the unused coupons of u, those
+// taking the most off a cart of items bought for session s, if not nil.
+func (r *Repo) BestCouponCombination(ctx context.Context, u *User, s *Session, items []QuoteItem) (*CouponCombination, error) {
+	coupons, err := r.UnusedCoupons(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	products, err := r.cartProducts(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	base, err := r.couponContext(ctx, u, s, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return BestCouponCombination(products, coupons, base), nil
+}
+
+// couponContext returns what coupons of u are checked against at now. If
+// s is not nil, it is the session being paid, which must be u's, and its
+// store and length are those store and session length restrictions see.
+func (r *Repo) couponContext(ctx context.Context, u *User, s *Session, now time.Time) (*CouponContext, error) {
+	first, err := r.isFirstOrder(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	c := &CouponContext{User: u, Now: now, FirstOrder: first}
+	if s == nil {
+		return c, nil
+	}
+	session := &Session{}
+	err = r.conn(ctx).Preload("Seat").First(session, s.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != u.ID {
+		return nil, ErrInvalidArgument
+	}
+	c.StoreID = session.Seat.StoreID
+	end := session.EndTime
+	if session.ActualEndTime != nil {
+		end = session.ActualEndTime
+	}
+	if end != nil && end.After(*session.StartTime) {
+		c.SessionLength = end.Sub(*session.StartTime)
+	}
+	return c, nil
+}
+
+// cartProducts loads the goods of items, checking they can be bought.
+func (r *Repo) cartProducts(ctx context.Context, items []QuoteItem) ([]IProduct, error) {
+	if len(items) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	products := make([]IProduct, 0, len(items))
+	for _, item := range items {
+		if item.Quantity == 0 {
+			return nil, ErrInvalidArgument
+		}
+		good, err := r.GetGoodByID(ctx, item.GoodID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidArgument.Wrap(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case good.Status == GoodStatusDeleted:
+			return nil, ErrInvalidArgument
+		case good.Status == GoodStatusSoldOut, good.Stock != nil && *good.Stock < item.Quantity:
+			return nil, ErrOutOfStock
+		}
+		products = append(products, &quotedLine{good: good, quantity: item.Quantity})
+	}
+	return products, nil
+}
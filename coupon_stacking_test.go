@@ -0,0 +1,223 @@
+package models_test
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+)
+
+func TestBestCouponCombination(t *testing.T) {
+	products := []models.IProduct{
+		&models.Good{Price: models.ToPrice(100), Type: models.GoodTypeProduct},
+		&models.Good{Price: models.ToPrice(30), Type: models.GoodTypeCredits},
+	}
+	coupons := []*models.Coupon{
+		{Type: models.CouponTypeDiscountPercentage, DiscountData: 50, CouponStacking: models.CouponStacking{Exclusive: true}},
+		{Type: models.CouponTypeDiscountFixedPrice, DiscountData: 2000, CouponStacking: models.CouponStacking{StackGroup: "spring"}},
+		{Type: models.CouponTypeDiscountFixedPrice, DiscountData: 2500, CouponStacking: models.CouponStacking{StackGroup: "spring"}},
+		{Type: models.CouponTypeDiscountPercentage, DiscountData: 20, CouponStacking: models.CouponStacking{Priority: 1, MaxDiscountShare: 10}},
+	}
+	for i, c := range coupons {
+		c.ID = uint(i + 1)
+	}
+	base := &models.CouponContext{User: &models.User{}, Now: time.Now()}
+
+	// the exclusive half-price coupon alone takes 5000, more than the
+	// capped 20% and one spring coupon take together.
+	comb := models.BestCouponCombination(products, coupons, base)
+	if comb.Discount != 5000 || len(comb.Allocations) != 1 || comb.Allocations[0].CouponID != 1 {
+		t.Errorf("combination = %+v, want the exclusive coupon alone", comb)
+	}
+
+	coupons[0].Exclusive = false
+	comb = models.BestCouponCombination(products, coupons, base)
+	// 20% capped at 10% first, then half of the 9000 left, then the
+	// larger spring coupon; ties go to the first line.
+	if comb.Discount != 1000+4500+2500 {
+		t.Errorf("discount = %d, want %d (%+v)", comb.Discount, 1000+4500+2500, comb)
+	}
+	if comb.LineDiscounts[0] != 8000 || comb.LineDiscounts[1] != 0 {
+		t.Errorf("line discounts = %v, want [8000 0]", comb.LineDiscounts)
+	}
+}
+
+type stackingCase struct {
+	products []models.IProduct
+	coupons  []*models.Coupon
+}
+
+func randomStackingCase(rng *rand.Rand) stackingCase {
+	c := stackingCase{}
+	types := []models.GoodType{models.GoodTypeCredits, models.GoodTypeSubscription, models.GoodTypeProduct}
+	for i := rng.Intn(3) + 1; i > 0; i-- {
+		c.products = append(c.products, &models.Good{
+			Price: models.Price(rng.Intn(5000) + 100),
+			Type:  types[rng.Intn(len(types))],
+		})
+	}
+	groups := []string{"", "", "a", "b"}
+	n := rng.Intn(6)
+	for i := 0; i < n; i++ {
+		coupon := &models.Coupon{
+			Type: models.CouponType(rng.Intn(2)),
+			CouponStacking: models.CouponStacking{
+				Exclusive:  rng.Intn(6) == 0,
+				StackGroup: groups[rng.Intn(len(groups))],
+				Priority:   rng.Intn(3),
+			},
+		}
+		coupon.ID = uint(i + 1)
+		if coupon.Type == models.CouponTypeDiscountPercentage {
+			coupon.DiscountData = uint32(rng.Intn(50) + 5)
+		} else {
+			coupon.DiscountData = uint32(rng.Intn(2000) + 50)
+		}
+		if rng.Intn(3) == 0 {
+			coupon.MaxDiscountShare = uint(rng.Intn(70) + 30)
+		}
+		if rng.Intn(3) == 0 {
+			product := c.products[rng.Intn(len(c.products))]
+			coupon.Restrictions = models.CouponRestrictions{
+				models.NewCouponRestriction(models.ProductLimit{product.GetType()}),
+			}
+		}
+		c.coupons = append(c.coupons, coupon)
+	}
+	return c
+}
+
+// lineDiscount applies coupons, already in priority order, to a line.
+func lineDiscount(price models.Price, coupons []*models.Coupon) models.Price {
+	remaining := price
+	for _, c := range coupons {
+		var d models.Price
+		if c.Type == models.CouponTypeDiscountPercentage {
+			d = remaining * models.Price(c.DiscountData) / 100
+		} else {
+			d = models.Price(c.DiscountData)
+		}
+		if c.MaxDiscountShare > 0 && d > price*models.Price(c.MaxDiscountShare)/100 {
+			d = price * models.Price(c.MaxDiscountShare) / 100
+		}
+		if d > remaining {
+			d = remaining
+		}
+		remaining -= d
+	}
+	return price - remaining
+}
+
+func byPriority(coupons []*models.Coupon) {
+	sort.SliceStable(coupons, func(i, j int) bool {
+		if coupons[i].Priority != coupons[j].Priority {
+			return coupons[i].Priority > coupons[j].Priority
+		}
+		return coupons[i].ID < coupons[j].ID
+	})
+}
+
+// bruteForce tries every assignment of coupons to lines, or to none.
+func bruteForce(c stackingCase, base *models.CouponContext) models.Price {
+	n, lines := len(c.coupons), len(c.products)
+	assign := make([]int, n)
+	var best models.Price
+	var try func(k int)
+	try = func(k int) {
+		if k < n {
+			for line := -1; line < lines; line++ {
+				assign[k] = line
+				try(k + 1)
+			}
+			return
+		}
+		used, exclusive, groups := 0, false, map[string]bool{}
+		perLine := make([][]*models.Coupon, lines)
+		for i, line := range assign {
+			if line < 0 {
+				continue
+			}
+			coupon := c.coupons[i]
+			ctx := *base
+			ctx.Product = c.products[line]
+			if coupon.IfSatisfyRestrictions(&ctx) != nil {
+				return
+			}
+			if coupon.StackGroup != "" {
+				if groups[coupon.StackGroup] {
+					return
+				}
+				groups[coupon.StackGroup] = true
+			}
+			used++
+			exclusive = exclusive || coupon.Exclusive
+			perLine[line] = append(perLine[line], coupon)
+		}
+		if exclusive && used > 1 {
+			return
+		}
+		var total models.Price
+		for line, coupons := range perLine {
+			byPriority(coupons)
+			total += lineDiscount(c.products[line].GetSalePrice(), coupons)
+		}
+		if total > best {
+			best = total
+		}
+	}
+	try(0)
+	return best
+}
+
+func TestBestCouponCombinationProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(20220301))
+	base := &models.CouponContext{User: &models.User{}, Now: time.Now()}
+
+	for i := 0; i < 300; i++ {
+		c := randomStackingCase(rng)
+		comb := models.BestCouponCombination(c.products, c.coupons, base)
+
+		if want := bruteForce(c, base); comb.Discount != want {
+			t.Fatalf("case %d: discount = %d, brute force finds %d", i, comb.Discount, want)
+		}
+
+		// the combination is legal and adds up
+		byID := map[uint]*models.Coupon{}
+		for _, coupon := range c.coupons {
+			byID[coupon.ID] = coupon
+		}
+		groups := map[string]bool{}
+		var sum models.Price
+		for _, a := range comb.Allocations {
+			coupon := byID[a.CouponID]
+			if coupon.Exclusive && len(comb.Allocations) > 1 {
+				t.Errorf("case %d: exclusive coupon %d used with others", i, a.CouponID)
+			}
+			if coupon.StackGroup != "" {
+				if groups[coupon.StackGroup] {
+					t.Errorf("case %d: two coupons of group %q", i, coupon.StackGroup)
+				}
+				groups[coupon.StackGroup] = true
+			}
+			sum += a.Discount
+		}
+		if sum != comb.Discount {
+			t.Errorf("case %d: allocations add up to %d, discount is %d", i, sum, comb.Discount)
+		}
+		for line, d := range comb.LineDiscounts {
+			if d > c.products[line].GetSalePrice() {
+				t.Errorf("case %d: line %d discounted %d past its price", i, line, d)
+			}
+		}
+
+		// the result does not depend on the order coupons are given in
+		shuffled := append([]*models.Coupon{}, c.coupons...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if again := models.BestCouponCombination(c.products, shuffled, base); !reflect.DeepEqual(again, comb) {
+			t.Errorf("case %d: shuffled coupons give %+v, want %+v", i, again, comb)
+		}
+	}
+}
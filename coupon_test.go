@@ -0,0 +1,118 @@
+package models_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+)
+
+func TestCouponRestrictionsScan(t *testing.T) {
+	stored := `[
+		{"Type": 0, "Restriction": ["SubscriptionPlan"]},
+		{"Type": 1, "Restriction": 3000},
+		{"Type": 2, "Restriction": 7},
+		{"Type": 4, "Restriction": {}},
+		{"Type": 6, "Restriction": [1, 2]},
+		{"Type": 7, "Restriction": 60}
+	]`
+	var restrictions models.CouponRestrictions
+	if err := restrictions.Scan(stored); err != nil {
+		t.Fatal(err)
+	}
+	want := []models.CouponRule{
+		models.ProductLimit{models.ProductTypeSubscriptionPlan},
+		models.PriceThreshold(3000),
+		models.SpecifiedUser(7),
+		models.FirstOrderOnly{},
+		models.StoreLimit{1, 2},
+		models.MinSessionLength(60),
+	}
+	if len(restrictions) != len(want) {
+		t.Fatalf("scanned %d restrictions, want %d", len(restrictions), len(want))
+	}
+	for i, r := range restrictions {
+		if r.Restriction.Kind() != want[i].Kind() || r.Type != want[i].Kind() {
+			t.Errorf("restriction %d = %#v, want %#v", i, r.Restriction, want[i])
+		}
+	}
+
+	value, err := restrictions.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again models.CouponRestrictions
+	if err := again.Scan(value); err != nil {
+		t.Fatal(err)
+	}
+	if threshold, ok := again[1].Restriction.(models.PriceThreshold); !ok || threshold != 3000 {
+		t.Errorf("round-tripped threshold = %#v", again[1].Restriction)
+	}
+
+	if err := again.Scan(`[{"Type": 99, "Restriction": null}]`); err == nil {
+		t.Error("scanning an unknown restriction type succeeded")
+	}
+}
+
+func TestCouponCheckRestrictions(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	until := now.Add(-time.Hour)
+	coupon := &models.Coupon{
+		Type:         models.CouponTypeDiscountFixedPrice,
+		DiscountData: 500,
+		Restrictions: models.CouponRestrictions{
+			models.NewCouponRestriction(models.ValidityWindow{NotAfter: &until}),
+			models.NewCouponRestriction(models.FirstOrderOnly{}),
+			models.NewCouponRestriction(models.MemberOnly{}),
+			models.NewCouponRestriction(models.StoreLimit{3}),
+			models.NewCouponRestriction(models.MinSessionLength(120)),
+		},
+	}
+	alice := &models.User{IsPro: true}
+	alice.ID = 1
+	c := &models.CouponContext{
+		Product:       &models.Good{Price: models.ToPrice(10)},
+		User:          alice,
+		Now:           now,
+		StoreID:       2,
+		SessionLength: 90 * time.Minute,
+	}
+
+	unmet := coupon.CheckRestrictions(c)
+	codes := make([]models.ErrorCode, 0, len(unmet))
+	for _, u := range unmet {
+		codes = append(codes, u.Code)
+	}
+	want := []models.ErrorCode{models.CodeCouponWindow, models.CodeCouponFirstOrder, models.CodeCouponStore, models.CodeCouponSession}
+	if len(codes) != len(want) {
+		t.Fatalf("unmet = %v, want %v", codes, want)
+	}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("unmet[%d] = %s, want %s", i, codes[i], want[i])
+		}
+	}
+	if unmet[3].Want != uint(120) || unmet[3].Got != uint(90) {
+		t.Errorf("session length explanation = want %v, got %v", unmet[3].Want, unmet[3].Got)
+	}
+
+	_, err := coupon.DiscountFor(c)
+	if !errors.Is(err, models.ErrCouponWindow) || !models.IsRequestError(err) {
+		t.Errorf("DiscountFor() error = %v, want ErrCouponWindow", err)
+	}
+
+	c.Now = until.Add(-time.Minute)
+	c.FirstOrder = true
+	c.StoreID = 3
+	c.SessionLength = 2 * time.Hour
+	if d, err := coupon.DiscountFor(c); err != nil || d != 500 {
+		t.Errorf("DiscountFor() = %d, %v, want 500", d, err)
+	}
+
+	lapsed := c.Now.Add(-time.Minute)
+	alice.ProDeadline = &lapsed
+	if _, err := coupon.DiscountFor(c); !errors.Is(err, models.ErrCouponMember) {
+		t.Errorf("DiscountFor() past the pro deadline: error = %v, want ErrCouponMember", err)
+	}
+}
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CreditReason string
+
+const (
+	CreditReasonOpeningBalance  CreditReason = "opening_balance"
+	CreditReasonTopUp           CreditReason = "order_top_up"
+	CreditReasonSessionCharge   CreditReason = "session_charge"
+	CreditReasonRefund          CreditReason = "refund"
+	CreditReasonAdminAdjustment CreditReason = "admin_adjustment"
+	CreditReasonCheckInReward   CreditReason = "check_in_reward"
+)
+
+const (
+	creditHouseAccountPrefix = "house:"
+	creditUserAccountPrefix  = "user:"
+)
+
+// CheckInReward is credited to a user on each daily check-in, 0 meaning
+// check-ins are not rewarded.
+var CheckInReward Price = 0
+
+// creditHouseAccount is the account on the other side of a user's
+// movements for reason: a top-up is funded by house:order_top_up, a session
+// charge is earned by house:session_charge and so on.
+func creditHouseAccount(reason CreditReason) string {
+	return creditHouseAccountPrefix + string(reason)
+}
+
+func creditUserAccount(uid uint) string {
+	return fmt.Sprintf("%s%d", creditUserAccountPrefix, uid)
+}
+
+// CreditSource points at the row a movement originates from, such as
+// the order of a top-up.
+type CreditSource struct {
+	Type string
+	ID   uint
+}
+
+func OrderCreditSource(o *Order) *CreditSource {
+	return &CreditSource{Type: "orders", ID: o.ID}
+}
+
+func SessionCreditSource(s *Session) *CreditSource {
+	return &CreditSource{Type: "sessions", ID: s.ID}
+}
+
+// CreditLedgerEntry is one leg of a credit movement. Every movement posts
+// two legs under the same TransactionID, one on the user's account and
+// one on a house account, whose amounts add up to zero. Balance is the
+// user's balance after the movement and is only set on user legs.
+type CreditLedgerEntry struct {
+	ID            uint         `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	TransactionID string       `gorm:"type:varchar(64);not null;index" json:"transaction_id"`
+	Account       string       `gorm:"type:varchar(64);not null;index" json:"account"`
+	UserID        *uint        `gorm:"index" json:"user_id,omitempty"`
+	Amount        int64        `gorm:"not null" json:"amount"`
+	Balance       *Price       `json:"balance,omitempty"`
+	Reason        CreditReason `gorm:"type:varchar(32);not null" json:"reason"`
+	SourceType    string       `gorm:"type:varchar(32)" json:"source_type,omitempty"`
+	SourceID      *uint        `json:"source_id,omitempty"`
+	Actor         string       `gorm:"type:varchar(64)" json:"actor,omitempty"`
+}
+
+const openingBalanceSQL = `
+INSERT INTO credit_ledger_entries (created_at, transaction_id, account, user_id, amount, balance, reason, actor)
+SELECT now(), 'opening-' || u.id, 'user:' || u.id, u.id, u.remaining_credit, u.remaining_credit, 'opening_balance', 'system'
+FROM users u
+WHERE u.remaining_credit > 0
+  AND NOT EXISTS (SELECT 1 FROM credit_ledger_entries e WHERE e.user_id = u.id)`
+
+const openingBalanceHouseSQL = `
+INSERT INTO credit_ledger_entries (created_at, transaction_id, account, amount, reason, actor)
+SELECT e.created_at, e.transaction_id, 'house:opening_balance', -e.amount, e.reason, e.actor
+FROM credit_ledger_entries e
+WHERE e.reason = 'opening_balance' AND e.user_id IS NOT NULL
+  AND NOT EXISTS (
+    SELECT 1 FROM credit_ledger_entries h
+    WHERE h.transaction_id = e.transaction_id AND h.user_id IS NULL)`
+
+// migrateCreditLedger creates the ledger and opens it with the balances
+// users have at that point.
+func migrateCreditLedger(db *gorm.DB) error {
+	if err := createTables(db, &CreditLedgerEntry{}); err != nil {
+		return err
+	}
+	return execAll(db, openingBalanceSQL, openingBalanceHouseSQL)
+}
+
+func dropCreditLedger(db *gorm.DB) error {
+	return db.Migrator().DropTable(&CreditLedgerEntry{})
+}
+
+// postCredit moves amount, positive or negative, into u's account and
+// returns the user's leg. The user's balance is locked for the duration,
+// and a movement that would take it below zero fails with
+// ErrInsufficientCredit.
+func (r *Repo) postCredit(ctx context.Context, u *User, amount int64, reason CreditReason, source *CreditSource, actor string) (*CreditLedgerEntry, error) {
+	if amount == 0 {
+		return nil, ErrInvalidArgument
+	}
+	entry := &CreditLedgerEntry{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		db := tx.conn(ctx)
+		current := User{}
+		err := db.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "remaining_credit").
+			First(&current, u.ID).
+			Error
+		if err != nil {
+			return err
+		}
+		balance := int64(current.RemainingCredit) + amount
+		if balance < 0 {
+			return ErrInsufficientCredit
+		}
+		if err := db.Model(&current).Update("remaining_credit", balance).Error; err != nil {
+			return err
+		}
+
+		newBalance := Price(balance)
+		txID := randomToken(16)
+		legs := []*CreditLedgerEntry{
+			{
+				TransactionID: txID,
+				Account:       creditUserAccount(u.ID),
+				UserID:        &current.ID,
+				Amount:        amount,
+				Balance:       &newBalance,
+			},
+			{
+				TransactionID: txID,
+				Account:       creditHouseAccount(reason),
+				Amount:        -amount,
+			},
+		}
+		for _, leg := range legs {
+			leg.Reason = reason
+			leg.Actor = actor
+			if source != nil {
+				leg.SourceType = source.Type
+				leg.SourceID = &source.ID
+			}
+		}
+		if err := db.Create(&legs).Error; err != nil {
+			return err
+		}
+		*entry = *legs[0]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.RemainingCredit = *entry.Balance
+	return entry, nil
+}
+
+// CreditUser adds amount to u's balance.
+func (r *Repo) CreditUser(ctx context.Context, u *User, amount Price, reason CreditReason, source *CreditSource, actor string) (*CreditLedgerEntry, error) {
+	return r.postCredit(ctx, u, int64(amount), reason, source, actor)
+}
+
+// DebitUser takes amount from u's balance, failing with
+// ErrInsufficientCredit if the balance does not cover it.
+func (r *Repo) DebitUser(ctx context.Context, u *User, amount Price, reason CreditReason, source *CreditSource, actor string) (*CreditLedgerEntry, error) {
+	return r.postCredit(ctx, u, -int64(amount), reason, source, actor)
+}
+
+// ChargeSession debits the billing fee of the settled session s from its
+// user, if it has one. A session is charged at most once.
+func (r *Repo) ChargeSession(ctx context.Context, s *Session, actor string) (*CreditLedgerEntry, error) {
+	var entry *CreditLedgerEntry
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current := &Session{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(current, s.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		if current.Status != SessionStatusCompleted {
+			return ErrInvalidArgument
+		}
+		if current.BillingFee == 0 {
+			return nil
+		}
+		var charged int64
+		err = tx.conn(ctx).Model(&CreditLedgerEntry{}).
+			Where("source_type = ? AND source_id = ? AND reason = ?", "sessions", current.ID, CreditReasonSessionCharge).
+			Count(&charged).
+			Error
+		if err != nil {
+			return err
+		}
+		if charged != 0 {
+			return ErrIllegalTransition
+		}
+		u := &User{}
+		u.ID = current.UserID
+		entry, err = tx.DebitUser(ctx, u, current.BillingFee, CreditReasonSessionCharge, SessionCreditSource(current), actor)
+		return err
+	})
+	return entry, err
+}
+
+func (r *Repo) ListCreditLedger(ctx context.Context, u *User, limit, page uint) ([]*CreditLedgerEntry, error) {
+	entries := make([]*CreditLedgerEntry, 0)
+	tx := r.conn(ctx).
+		Where("user_id = ?", u.ID).
+		Order("id desc").
+		Limit(int(limit)).
+		Offset(int(page * limit)).
+		Find(&entries)
+	return entries, tx.Error
+}
+
+// LedgerBalance returns u's balance as recorded by the ledger.
+func (r *Repo) LedgerBalance(ctx context.Context, u *User) (Price, error) {
+	var sum int64
+	tx := r.conn(ctx).
+		Model(&CreditLedgerEntry{}).
+		Where("user_id = ?", u.ID).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&sum)
+	return Price(sum), tx.Error
+}
+
+// CreditDiscrepancy is a user whose stored balance disagrees with the
+// ledger.
+type CreditDiscrepancy struct {
+	UserID          uint  `json:"user_id"`
+	RemainingCredit Price `json:"remaining_credit"`
+	LedgerBalance   int64 `json:"ledger_balance"`
+}
+
+// ReconcileCredits lists the users whose remaining credit is not what
+// their ledger adds up to.
+func (r *Repo) ReconcileCredits(ctx context.Context) ([]CreditDiscrepancy, error) {
+	result := make([]CreditDiscrepancy, 0)
+	tx := r.conn(ctx).Raw(`
+SELECT u.id AS user_id, u.remaining_credit, COALESCE(l.balance, 0) AS ledger_balance
+FROM users u
+LEFT JOIN (
+  SELECT user_id, SUM(amount) AS balance FROM credit_ledger_entries
+  WHERE user_id IS NOT NULL GROUP BY user_id
+) l ON l.user_id = u.id
+WHERE u.remaining_credit <> COALESCE(l.balance, 0)
+ORDER BY u.id`).Scan(&result)
+	return result, tx.Error
+}
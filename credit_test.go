@@ -0,0 +1,141 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestCreditLedger(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+
+	balance := func() models.Price {
+		t.Helper()
+		u, ok := repo.FindUser(ctx, 1)
+		if !ok {
+			t.Fatal("user 1 not found")
+		}
+		return u.RemainingCredit
+	}
+
+	u, _ := repo.FindUser(ctx, 1)
+	if err := repo.IncreaseCreditBy(ctx, u, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.IncreaseCreditBy(ctx, u, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(); got != models.ToPrice(5) {
+		t.Fatalf("balance after two top-ups = %d, want %d", got, models.ToPrice(5))
+	}
+
+	if err := repo.DecreaseCreditBy(ctx, u, 10); !errors.Is(err, models.ErrInsufficientCredit) {
+		t.Errorf("overdraft: error = %v, want ErrInsufficientCredit", err)
+	}
+	if got := balance(); got != models.ToPrice(5) {
+		t.Errorf("balance after refused overdraft = %d, want %d", got, models.ToPrice(5))
+	}
+
+	o := &models.Order{
+		TimestamppedID: "20220301000002",
+		Amount:         1,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := repo.CommitOrderPaid(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := balance(); got != models.ToPrice(6) {
+		t.Errorf("balance after committing an order twice = %d, want %d", got, models.ToPrice(6))
+	}
+
+	// six of the ten concurrent debits fit in the balance
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := &models.User{}
+			u.ID = 1
+			_, err := repo.DebitUser(ctx, u, models.ToPrice(1), models.CreditReasonSessionCharge, nil, models.SessionActorSystem)
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			} else if !errors.Is(err, models.ErrInsufficientCredit) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 6 {
+		t.Errorf("%d debits succeeded, want 6", succeeded)
+	}
+	if got := balance(); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+
+	entries, err := repo.ListCreditLedger(ctx, u, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 9 {
+		t.Errorf("got %d ledger entries, want 9", len(entries))
+	}
+	if ledger, err := repo.LedgerBalance(ctx, u); err != nil || ledger != 0 {
+		t.Errorf("ledger balance = %d, %v, want 0", ledger, err)
+	}
+	if diff, err := repo.ReconcileCredits(ctx); err != nil || len(diff) != 0 {
+		t.Errorf("ReconcileCredits() = %+v, %v, want no discrepancies", diff, err)
+	}
+}
+
+func TestUserSettersKeepBalance(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"}
+	]}`))
+	ctx := context.Background()
+
+	stale, _ := repo.FindUser(ctx, 1)
+	bob, _ := repo.FindUser(ctx, 2)
+	if _, err := repo.CreditUser(ctx, stale, models.ToPrice(5), models.CreditReasonAdminAdjustment, nil, models.SessionActorSystem); err != nil {
+		t.Fatal(err)
+	}
+	stale.RemainingCredit = 0
+
+	if err := repo.SetUserBillingStatus(ctx, stale, models.UserBillingStatusNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetUserWxSession(ctx, stale, "wx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.FollowUser(ctx, stale, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitNotificationRead(ctx, stale, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := repo.FindUser(ctx, 1); u.RemainingCredit != models.ToPrice(5) {
+		t.Errorf("balance = %d after saving a stale user, want %d", u.RemainingCredit, models.ToPrice(5))
+	}
+	if n := repo.GetFollowingsCount(ctx, stale); n != 1 {
+		t.Errorf("followings = %d, want 1", n)
+	}
+}
@@ -0,0 +1,899 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// The package-level functions below predate Repo. They run against the
+// Repo set up by Connect and are kept for existing callers.
+
+// Deprecated: use Repo.AddStatisticInBatch.
+func AddStatisticInBatch(stats []AccessStatistic) error {
+	return defaultRepo.AddStatisticInBatch(context.Background(), stats)
+}
+
+// Deprecated: use Repo.GetStatisticInBatchBefore.
+func GetStatisticInBatchBefore(before uint) ([]AccessStatistic, error) {
+	return defaultRepo.GetStatisticInBatchBefore(context.Background(), before)
+}
+
+// Deprecated: use Repo.GetStatisticInBatchAfter.
+func GetStatisticInBatchAfter(after uint) ([]AccessStatistic, error) {
+	return defaultRepo.GetStatisticInBatchAfter(context.Background(), after)
+}
+
+// Deprecated: use Repo.GetStatisticInBatchBeforeAfter.
+func GetStatisticInBatchBeforeAfter(before, after uint) ([]AccessStatistic, error) {
+	return defaultRepo.GetStatisticInBatchBeforeAfter(context.Background(), before, after)
+}
+
+// Deprecated: use Repo.GetLatestStatistic.
+func GetLatestStatistic() ([]AccessStatistic, error) {
+	return defaultRepo.GetLatestStatistic(context.Background())
+}
+
+// Deprecated: use Repo.GetAccessCountAfterCustomTime.
+func GetAccessCountAfterCustomTime(time time.Time) uint {
+	return defaultRepo.GetAccessCountAfterCustomTime(context.Background(), time)
+}
+
+// Deprecated: use Repo.GetAccessCountWithIn24Hours.
+func GetAccessCountWithIn24Hours() uint {
+	return defaultRepo.GetAccessCountWithIn24Hours(context.Background())
+}
+
+// Deprecated: use Repo.GetDailyReportWithCustomDays.
+func GetDailyReportWithCustomDays(days int) ([]ASReport, error) {
+	return defaultRepo.GetDailyReportWithCustomDays(context.Background(), days)
+}
+
+// Deprecated: use Repo.GetHourlyReportWithCustomHours.
+func GetHourlyReportWithCustomHours(hours int) ([]ASReport, error) {
+	return defaultRepo.GetHourlyReportWithCustomHours(context.Background(), hours)
+}
+
+// Deprecated: use Repo.GetMonthlyReportWithCustomMonths.
+func GetMonthlyReportWithCustomMonths(months int) ([]ASReport, error) {
+	return defaultRepo.GetMonthlyReportWithCustomMonths(context.Background(), months)
+}
+
+// Deprecated: use Repo.GetLatestHourlyReport.
+func GetLatestHourlyReport() ([]ASReport, error) {
+	return defaultRepo.GetLatestHourlyReport(context.Background())
+}
+
+// Deprecated: use Repo.GetLatestDailyReport.
+func GetLatestDailyReport() ([]ASReport, error) {
+	return defaultRepo.GetLatestDailyReport(context.Background())
+}
+
+// Deprecated: use Repo.GetLatestMonthlyReport.
+func GetLatestMonthlyReport() ([]ASReport, error) {
+	return defaultRepo.GetLatestMonthlyReport(context.Background())
+}
+
+// Deprecated: use Repo.GetOverallStasticsSummary.
+func GetOverallStasticsSummary(days int) StasticsSummary {
+	return defaultRepo.GetOverallStasticsSummary(context.Background(), days)
+}
+
+// Deprecated: use Repo.CreateAdmin.
+func CreateAdmin(username, password, email string) error {
+	return defaultRepo.CreateAdmin(context.Background(), username, password, email)
+}
+
+// Deprecated: use Repo.MatchAny.
+func MatchAny(username, password string) (*Administrator, error) {
+	return defaultRepo.MatchAny(context.Background(), username, password)
+}
+
+// Deprecated: use Repo.GetAdmin.
+func GetAdmin(id uint) (*Administrator, error) {
+	return defaultRepo.GetAdmin(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetAdministratorCount.
+func GetAdministratorCount() uint {
+	return defaultRepo.GetAdministratorCount(context.Background())
+}
+
+// Deprecated: use Repo.AddAdministrator.
+func AddAdministrator(username, password, email string) error {
+	return defaultRepo.AddAdministrator(context.Background(), username, password, email)
+}
+
+// Deprecated: use Repo.DeleteAdministrator.
+func DeleteAdministrator(id uint) error {
+	return defaultRepo.DeleteAdministrator(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListAdministrator.
+func ListAdministrator(limit, page uint) ([]*Administrator, error) {
+	return defaultRepo.ListAdministrator(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.UpdateAdministrator.
+func UpdateAdministrator(admin *Administrator) error {
+	return defaultRepo.UpdateAdministrator(context.Background(), admin)
+}
+
+// Deprecated: use Repo.ListCheckin.
+func ListCheckin(limit, page uint) ([]*CheckIn, error) {
+	return defaultRepo.ListCheckin(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.ListConfiguration.
+func ListConfiguration(limit, page uint) ([]*DynamicConfiguration, error) {
+	return defaultRepo.ListConfiguration(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.SetConfigurationValue.
+func SetConfigurationValue(name, value string) error {
+	return defaultRepo.SetConfigurationValue(context.Background(), name, value)
+}
+
+// Deprecated: use Repo.DeleteConfiguration.
+func DeleteConfiguration(name string) error {
+	return defaultRepo.DeleteConfiguration(context.Background(), name)
+}
+
+// Deprecated: use Repo.AddConfiguration.
+func AddConfiguration(name, value string) error {
+	return defaultRepo.AddConfiguration(context.Background(), name, value)
+}
+
+// Deprecated: use Repo.ListEvent.
+func ListEvent(limit, page uint) ([]*Event, error) {
+	return defaultRepo.ListEvent(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.AddEvent.
+func AddEvent(desc, cover, url string, begin, end time.Time) error {
+	return defaultRepo.AddEvent(context.Background(), desc, cover, url, begin, end)
+}
+
+// Deprecated: use Repo.UpdateEvent.
+func UpdateEvent(evt *Event) error {
+	return defaultRepo.UpdateEvent(context.Background(), evt)
+}
+
+// Deprecated: use Repo.DeleteEvent.
+func DeleteEvent(id uint) error {
+	return defaultRepo.DeleteEvent(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetEvent.
+func GetEvent(id uint) (*Event, error) {
+	return defaultRepo.GetEvent(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListGoods.
+func ListGoods(limit, page uint) ([]*Good, error) {
+	return defaultRepo.ListGoods(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.ListDevices.
+func ListDevices(limit, page uint) ([]*Device, error) {
+	return defaultRepo.ListDevices(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.AddDevice.
+func AddDevice(name string, t DeviceKind, deviceId string, seatId *uint) error {
+	return defaultRepo.AddDevice(context.Background(), name, t, deviceId, seatId)
+}
+
+// Deprecated: use Repo.UpdateDevice.
+func UpdateDevice(dev *Device) error {
+	return defaultRepo.UpdateDevice(context.Background(), dev)
+}
+
+// Deprecated: use Repo.DeleteDevice.
+func DeleteDevice(id string) error {
+	return defaultRepo.DeleteDevice(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetDevice.
+func GetDevice(id string) (*Device, error) {
+	return defaultRepo.GetDevice(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListOrder.
+func ListOrder(limit, page uint) ([]*Order, error) {
+	return defaultRepo.ListOrder(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.GetOrder.
+func GetOrder(id uint) (*Order, error) {
+	return defaultRepo.GetOrder(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListSeat.
+func ListSeat(limit, page uint) ([]*Seat, error) {
+	return defaultRepo.ListSeat(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.AddSeat.
+func AddSeat(storeId uint, label string) error {
+	return defaultRepo.AddSeat(context.Background(), storeId, label)
+}
+
+// Deprecated: use Repo.UpdateSeat.
+func UpdateSeat(seat *Seat) error {
+	return defaultRepo.UpdateSeat(context.Background(), seat)
+}
+
+// Deprecated: use Repo.DeleteSeat.
+func DeleteSeat(id uint) error {
+	return defaultRepo.DeleteSeat(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListStore.
+func ListStore(limit, page uint) ([]*Store, error) {
+	return defaultRepo.ListStore(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.AddStore.
+func AddStore(location string, openingHours, openingWeekdays uint, name, conver, facility string) error {
+	return defaultRepo.AddStore(context.Background(), location, openingHours, openingWeekdays, name, conver, facility)
+}
+
+// Deprecated: use Repo.UpdateStore.
+func UpdateStore(store *Store) error {
+	return defaultRepo.UpdateStore(context.Background(), store)
+}
+
+// Deprecated: use Repo.DeleteStore.
+func DeleteStore(id uint) error {
+	return defaultRepo.DeleteStore(context.Background(), id)
+}
+
+// Deprecated: use Repo.ListThread.
+func ListThread(limit, page uint) ([]uint, error) {
+	return defaultRepo.ListThread(context.Background(), limit, page)
+}
+
+// Deprecated: use Repo.NewCheckIn.
+func NewCheckIn(user uint) error {
+	return defaultRepo.NewCheckIn(context.Background(), user)
+}
+
+// Deprecated: use Repo.GetCheckInHistory.
+func GetCheckInHistory(uid uint, beforeYear, beforeMonth, beforeDay int) ([]*CheckIn, error) {
+	return defaultRepo.GetCheckInHistory(context.Background(), uid, beforeYear, beforeMonth, beforeDay)
+}
+
+// Deprecated: use Repo.GetConfigurationValue.
+func GetConfigurationValue(name string) interface{} {
+	return defaultRepo.GetConfigurationValue(context.Background(), name)
+}
+
+// Deprecated: use Repo.GetCouponById.
+func GetCouponById(id uint) (*Coupon, error) {
+	return defaultRepo.GetCouponById(context.Background(), id)
+}
+
+// Deprecated: use Repo.MarkCouponUsed.
+func (c *Coupon) MarkUsed() error {
+	return defaultRepo.MarkCouponUsed(context.Background(), c)
+}
+
+// Deprecated: use Repo.GetRecentEvents.
+func GetRecentEvents() []*Event {
+	return defaultRepo.GetRecentEvents(context.Background())
+}
+
+// Deprecated: use Repo.NewFile.
+func NewFile(uuid, filename, ext string) {
+	_ = defaultRepo.NewFile(context.Background(), uuid, filename, ext)
+}
+
+// Deprecated: use Repo.GetGoodByID.
+func GetGoodByID(id uint) (*Good, error) {
+	return defaultRepo.GetGoodByID(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetCreditGood.
+func GetCreditGood() *Good {
+	return defaultRepo.GetCreditGood(context.Background())
+}
+
+// Deprecated: use Repo.GetMonthlySubscriptionGood.
+func GetMonthlySubscriptionGood() *Good {
+	return defaultRepo.GetMonthlySubscriptionGood(context.Background())
+}
+
+// Deprecated: use Repo.GetSeasonSubscriptionGood.
+func GetSeasonSubscriptionGood() *Good {
+	return defaultRepo.GetSeasonSubscriptionGood(context.Background())
+}
+
+// Deprecated: use Repo.CreateDeviceToken.
+func (d *Device) CreateToken(key []byte, expiration uint, u *User, s *Session) string {
+	return defaultRepo.CreateDeviceToken(context.Background(), key, expiration, d, u, s)
+}
+
+// Deprecated: use Repo.SaveToken.
+func SaveToken(device *Device, token string, expiration time.Time, u *User, s *Session) error {
+	return defaultRepo.SaveToken(context.Background(), device, token, expiration, u, s)
+}
+
+// Deprecated: use Repo.EmptyToken.
+func EmptyToken(device *Device) error {
+	return defaultRepo.EmptyToken(context.Background(), device)
+}
+
+// Deprecated: use Repo.SetDeviceTokenValid.
+func (t *DeviceToken) SetValid(valid bool) error {
+	return defaultRepo.SetDeviceTokenValid(context.Background(), t, valid)
+}
+
+// Deprecated: use Repo.SetDeviceStatus.
+func (d *Device) SetDeviceStatus(status DeviceStatus) error {
+	return defaultRepo.SetDeviceStatus(context.Background(), d, status)
+}
+
+// Deprecated: use Repo.SetDeviceConnectionID.
+func (d *Device) SetConnectionID(id string) error {
+	return defaultRepo.SetDeviceConnectionID(context.Background(), d, id)
+}
+
+// Deprecated: use Repo.EmptyDeviceConnectID.
+func (d *Device) EmptyConnectID() error {
+	return defaultRepo.EmptyDeviceConnectID(context.Background(), d)
+}
+
+// Deprecated: use Repo.GetDeviceByID.
+func GetDeviceByID(deviceId string) *Device {
+	return defaultRepo.GetDeviceByID(context.Background(), deviceId)
+}
+
+// Deprecated: use Repo.GetDeviceToken.
+func GetDeviceToken(token string) *DeviceToken {
+	return defaultRepo.GetDeviceToken(context.Background(), token)
+}
+
+// Deprecated: use Repo.CreateDoorNonce.
+func CreateDoorNonce(user *User, session *Session) *DoorNonce {
+	return defaultRepo.CreateDoorNonce(context.Background(), user, session)
+}
+
+// Deprecated: use Repo.CleanThoseExpired.
+func CleanThoseExpired() {
+	defaultRepo.CleanThoseExpired(context.Background())
+}
+
+// Deprecated: use Repo.GetDoorNonce.
+func GetDoorNonce(nonce string) (*DoorNonce, error) {
+	return defaultRepo.GetDoorNonce(context.Background(), nonce)
+}
+
+// Deprecated: use Repo.SetDoorNonceNoLongerValid.
+func (n *DoorNonce) SetNoLongerValid() error {
+	return defaultRepo.SetDoorNonceNoLongerValid(context.Background(), n)
+}
+
+// Deprecated: use Repo.UserHasValidNonceBefore.
+func UserHasValidNonceBefore(u *User) bool {
+	return defaultRepo.UserHasValidNonceBefore(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetRecentValidNonce.
+func GetRecentValidNonce(u *User) *DoorNonce {
+	return defaultRepo.GetRecentValidNonce(context.Background(), u)
+}
+
+// Deprecated: use Repo.PushNotification.
+func PushNotification(n *Notification) error {
+	return defaultRepo.PushNotification(context.Background(), n)
+}
+
+// Deprecated: use Repo.DeleteNotification.
+func DeleteNotification(t NotificationType, uid, aff_id uint) error {
+	return defaultRepo.DeleteNotification(context.Background(), t, uid, aff_id)
+}
+
+// Deprecated: use Repo.DeleteNotifications.
+func DeleteNotifications(t NotificationType, aff_id uint) error {
+	return defaultRepo.DeleteNotifications(context.Background(), t, aff_id)
+}
+
+// Deprecated: use Repo.DeleteNotificationOfManyType.
+func DeleteNotificationOfManyType(t []NotificationType, aff_id uint) error {
+	return defaultRepo.DeleteNotificationOfManyType(context.Background(), t, aff_id)
+}
+
+// Deprecated: use Repo.QueryNotificationOfType.
+func QueryNotificationOfType(t NotificationType, u User, limit, page int) ([]*Notification, error) {
+	return defaultRepo.QueryNotificationOfType(context.Background(), t, u, limit, page)
+}
+
+// Deprecated: use Repo.QueryNotification.
+func QueryNotification(u User, limit, page int) ([]*Notification, error) {
+	return defaultRepo.QueryNotification(context.Background(), u, limit, page)
+}
+
+// Deprecated: use Repo.CommitNotificationRead.
+func (u *User) CommitNotificationRead(t time.Time) error {
+	return defaultRepo.CommitNotificationRead(context.Background(), u, t)
+}
+
+// Deprecated: use Repo.PushThreadReplyNotification.
+func PushThreadReplyNotification(threadId, replyId uint) {
+	defaultRepo.PushThreadReplyNotification(context.Background(), threadId, replyId)
+}
+
+// Deprecated: use Repo.PushThreadLikeNotification.
+func PushThreadLikeNotification(threadId, likedUserId uint) {
+	defaultRepo.PushThreadLikeNotification(context.Background(), threadId, likedUserId)
+}
+
+// Deprecated: use Repo.PushFollowNotification.
+func PushFollowNotification(followedUserId, followerId uint) {
+	defaultRepo.PushFollowNotification(context.Background(), followedUserId, followerId)
+}
+
+// Deprecated: use Repo.CreateOrder.
+func CreateOrder(o *Order) error {
+	return defaultRepo.CreateOrder(context.Background(), o)
+}
+
+// Deprecated: use Repo.GetOrderByID.
+func GetOrderByID(id string) (Order, error) {
+	return defaultRepo.GetOrderByID(context.Background(), id)
+}
+
+// Deprecated: use Repo.MarkOrderPaid.
+func (o *Order) MarkPaid() error {
+	return defaultRepo.MarkOrderPaid(context.Background(), o)
+}
+
+// Deprecated: use Repo.CommitOrderPaid.
+func (o *Order) CommitPaid() error {
+	return defaultRepo.CommitOrderPaid(context.Background(), o)
+}
+
+// Deprecated: use Repo.ListUserOrders.
+func (u *User) ListOrders() ([]Order, error) {
+	return defaultRepo.ListUserOrders(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetNetRevenu.
+func GetNetRevenu() Price {
+	return defaultRepo.GetNetRevenu(context.Background())
+}
+
+// Deprecated: use Repo.CombineSeatStatus.
+func (s *Seat) CombineStatus(day time.Time) (*CombinedSeatStatus, error) {
+	return defaultRepo.CombineSeatStatus(context.Background(), s, day)
+}
+
+// Deprecated: use Repo.GetSeatByIDWithDevices.
+func GetSeatByIDWithDevices(id uint) *Seat {
+	return defaultRepo.GetSeatByIDWithDevices(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetSeatByID.
+func GetSeatByID(id uint) *Seat {
+	return defaultRepo.GetSeatByID(context.Background(), id)
+}
+
+// Deprecated: use Repo.SetSeatStatus.
+func (s *Seat) SetStatus(status SeatStatusEnum) error {
+	return defaultRepo.SetSeatStatus(context.Background(), s, status)
+}
+
+// Deprecated: use Repo.CreateSession.
+func CreateSession(key []byte, u *User, s *Seat, startTime, endTime *time.Time) string {
+	return defaultRepo.CreateSession(context.Background(), key, u, s, startTime, endTime)
+}
+
+// Deprecated: use Repo.SaveSession.
+func SaveSession(token string, u *User, s *Seat, startTime, endTime *time.Time) error {
+	return defaultRepo.SaveSession(context.Background(), token, u, s, startTime, endTime)
+}
+
+// Deprecated: use Repo.GetSession.
+func GetSession(session string) *Session {
+	return defaultRepo.GetSession(context.Background(), session)
+}
+
+// Deprecated: use Repo.SetSessionEndTime.
+func (s *Session) SetEndTime(t *time.Time) error {
+	return defaultRepo.SetSessionEndTime(context.Background(), s, t)
+}
+
+// Deprecated: use Repo.SetSessionStatus.
+func (s *Session) SetStatus(status SessionStatus) error {
+	return defaultRepo.SetSessionStatus(context.Background(), s, status)
+}
+
+// Deprecated: use Repo.ValidateSession.
+func ValidateSession(uid, seatID uint, start, end *time.Time) error {
+	return defaultRepo.ValidateSession(context.Background(), uid, seatID, start, end)
+}
+
+// Deprecated: use Repo.GetSessionViaUser.
+func GetSessionViaUser(u *User) *Session {
+	return defaultRepo.GetSessionViaUser(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetUserSessionHistory.
+func GetUserSessionHistory(u *User, page int) []*Session {
+	return defaultRepo.GetUserSessionHistory(context.Background(), u, page)
+}
+
+// Deprecated: use Repo.SetSessionBillingFee.
+func (s *Session) SetBillingFee(fee Price) error {
+	return defaultRepo.SetSessionBillingFee(context.Background(), s, fee)
+}
+
+// Deprecated: use Repo.SetSessionActualEndTime.
+func (s *Session) SetActualEndTime(time *time.Time) error {
+	return defaultRepo.SetSessionActualEndTime(context.Background(), s, time)
+}
+
+// Deprecated: use Repo.SetSmsStatusUsed.
+func (sms *ValidationCodeSms) SetStatusUsed() {
+	_ = defaultRepo.SetSmsStatusUsed(context.Background(), sms)
+}
+
+// Deprecated: use Repo.FindSmsOfPhone.
+func FindSmsOfPhone(phone string) *ValidationCodeSms {
+	return defaultRepo.FindSmsOfPhone(context.Background(), phone)
+}
+
+// Deprecated: use Repo.FindSmsOfUser.
+func FindSmsOfUser(u *User) *ValidationCodeSms {
+	return defaultRepo.FindSmsOfUser(context.Background(), u)
+}
+
+// Deprecated: use Repo.NewValidationCodeSmsOf.
+func NewValidationCodeSmsOf(phone string, len uint, expireTime uint) *ValidationCodeSms {
+	return defaultRepo.NewValidationCodeSmsOf(context.Background(), phone, len, expireTime)
+}
+
+// Deprecated: use Repo.NewValidationCodeSmsOfUser.
+func NewValidationCodeSmsOfUser(u *User, len, expireTime uint) *ValidationCodeSms {
+	return defaultRepo.NewValidationCodeSmsOfUser(context.Background(), u, len, expireTime)
+}
+
+// Deprecated: use Repo.DeleteValidationCodeSms.
+func DeleteValidationCodeSms(sms *ValidationCodeSms) {
+	_ = defaultRepo.DeleteValidationCodeSms(context.Background(), sms)
+}
+
+// Deprecated: use Repo.GetStoreSeatStatus.
+func (s *Store) GetStoreSeatStatus(day time.Time) ([]StoreSeatsStautusSummaryWithSectorLabel, error) {
+	return defaultRepo.GetStoreSeatStatus(context.Background(), s, day)
+}
+
+// Deprecated: use Repo.GetSeatStatusBySeatID.
+func GetSeatStatusBySeatID(seat_id uint, truncatedDay time.Time) SeatStatusSeries {
+	return defaultRepo.GetSeatStatusBySeatID(context.Background(), seat_id, truncatedDay)
+}
+
+// Deprecated: use Repo.GetStore.
+func GetStore() *Store {
+	return defaultRepo.GetStore(context.Background())
+}
+
+// Deprecated: use Repo.GetStoreByID.
+func GetStoreByID(id uint) *Store {
+	return defaultRepo.GetStoreByID(context.Background(), id)
+}
+
+// Deprecated: use Repo.StarStore.
+func StarStore(s Store, u *User) *StoreStar {
+	return defaultRepo.StarStore(context.Background(), s, u)
+}
+
+// Deprecated: use Repo.UnstarStore.
+func UnstarStore(s Store, u *User) bool {
+	return defaultRepo.UnstarStore(context.Background(), s, u)
+}
+
+// Deprecated: use Repo.GetStaredStores.
+func GetStaredStores(u *User, page int) []Store {
+	return defaultRepo.GetStaredStores(context.Background(), u, page)
+}
+
+// Deprecated: use Repo.GetThreadByID.
+func GetThreadByID(id uint) *Thread {
+	return defaultRepo.GetThreadByID(context.Background(), id)
+}
+
+// Deprecated: use Repo.SearchThread.
+func SearchThread(keyword string, uid, page uint) []*Post {
+	return defaultRepo.SearchThread(context.Background(), keyword, uid, page)
+}
+
+// Deprecated: use Repo.ConstructPostObject.
+func ConstructPostObject(t Thread, uid uint) *Post {
+	return defaultRepo.ConstructPostObject(context.Background(), t, uid)
+}
+
+// Deprecated: use Repo.NewPost.
+func NewPost(title, content string, author uint) (*Thread, error) {
+	return defaultRepo.NewPost(context.Background(), title, content, author)
+}
+
+// Deprecated: use Repo.CommentOnThread.
+func CommentOnThread(thread uint, author uint, content string) error {
+	return defaultRepo.CommentOnThread(context.Background(), thread, author, content)
+}
+
+// Deprecated: use Repo.ReplyToThread.
+func ReplyToThread(thread uint, author uint, content string) error {
+	return defaultRepo.ReplyToThread(context.Background(), thread, author, content)
+}
+
+// Deprecated: use Repo.ReplyToComment.
+func ReplyToComment(comment, author uint, content string) error {
+	return defaultRepo.ReplyToComment(context.Background(), comment, author, content)
+}
+
+// Deprecated: use Repo.ReplyToReply.
+func ReplyToReply(comment, author, replyTo uint, content string) error {
+	return defaultRepo.ReplyToReply(context.Background(), comment, author, replyTo, content)
+}
+
+// Deprecated: use Repo.LikeThread.
+func LikeThread(threadId uint, userId uint) error {
+	return defaultRepo.LikeThread(context.Background(), threadId, userId)
+}
+
+// Deprecated: use Repo.UnlikeThread.
+func UnlikeThread(threadId uint, userId uint) error {
+	return defaultRepo.UnlikeThread(context.Background(), threadId, userId)
+}
+
+// Deprecated: use Repo.StarThread.
+func StarThread(threadId uint, userId uint) error {
+	return defaultRepo.StarThread(context.Background(), threadId, userId)
+}
+
+// Deprecated: use Repo.UnstarThread.
+func UnstarThread(threadId uint, userId uint) error {
+	return defaultRepo.UnstarThread(context.Background(), threadId, userId)
+}
+
+// Deprecated: use Repo.DeleteThread.
+func DeleteThread(id uint) error {
+	return defaultRepo.DeleteThread(context.Background(), id)
+}
+
+// Deprecated: use Repo.GetRandomThreads.
+func GetRandomThreads(count int, uid uint) ([]*Post, error) {
+	return defaultRepo.GetRandomThreads(context.Background(), count, uid)
+}
+
+// Deprecated: use Repo.GetUserReplies.
+func GetUserReplies(uid uint, page int) ([]Thread, error) {
+	return defaultRepo.GetUserReplies(context.Background(), uid, page)
+}
+
+// Deprecated: use Repo.GetUserPosts.
+func GetUserPosts(uid uint, page int) ([]*Post, error) {
+	return defaultRepo.GetUserPosts(context.Background(), uid, page)
+}
+
+// Deprecated: use Repo.GetPostSummary.
+func GetPostSummary(id uint) *PostSummary {
+	return defaultRepo.GetPostSummary(context.Background(), id)
+}
+
+// Deprecated: use Repo.CreateThreadLike.
+func CreateThreadLike(tid uint, uid uint) error {
+	return defaultRepo.CreateThreadLike(context.Background(), tid, uid)
+}
+
+// Deprecated: use Repo.DeleteThreadLike.
+func DeleteThreadLike(t *ThreadLike) error {
+	return defaultRepo.DeleteThreadLike(context.Background(), t)
+}
+
+// Deprecated: use Repo.DeleteThreadLikeOfThreadForUser.
+func DeleteThreadLikeOfThreadForUser(threadID uint, uid uint) error {
+	return defaultRepo.DeleteThreadLikeOfThreadForUser(context.Background(), threadID, uid)
+}
+
+// Deprecated: use Repo.FindThreadLikeForUser.
+func FindThreadLikeForUser(uid uint) ([]ThreadLike, error) {
+	return defaultRepo.FindThreadLikeForUser(context.Background(), uid)
+}
+
+// Deprecated: use Repo.FindThreadLikeCount.
+func FindThreadLikeCount(threadID uint) uint {
+	return defaultRepo.FindThreadLikeCount(context.Background(), threadID)
+}
+
+// Deprecated: use Repo.CreateThreadStar.
+func CreateThreadStar(threadId, userId uint) error {
+	return defaultRepo.CreateThreadStar(context.Background(), threadId, userId)
+}
+
+// Deprecated: use Repo.DeleteThreadStar.
+func DeleteThreadStar(t *ThreadStar) error {
+	return defaultRepo.DeleteThreadStar(context.Background(), t)
+}
+
+// Deprecated: use Repo.DeleteThreadStarOfThreadForUser.
+func DeleteThreadStarOfThreadForUser(threadID uint, uid uint) error {
+	return defaultRepo.DeleteThreadStarOfThreadForUser(context.Background(), threadID, uid)
+}
+
+// Deprecated: use Repo.FindThreadStarForUser.
+func FindThreadStarForUser(uid uint) ([]ThreadStar, error) {
+	return defaultRepo.FindThreadStarForUser(context.Background(), uid)
+}
+
+// Deprecated: use Repo.FindThreadStarCount.
+func FindThreadStarCount(threadID uint) uint {
+	return defaultRepo.FindThreadStarCount(context.Background(), threadID)
+}
+
+// Deprecated: use Repo.GetUserStaredThreads.
+func GetUserStaredThreads(uid uint, page int) ([]*Post, error) {
+	return defaultRepo.GetUserStaredThreads(context.Background(), uid, page)
+}
+
+// Deprecated: use Repo.NewWxUser.
+func NewWxUser(username, openid, unionid, session string) (*User, error) {
+	return defaultRepo.NewWxUser(context.Background(), username, openid, unionid, session)
+}
+
+// Deprecated: use Repo.NewPhoneUser.
+func NewPhoneUser(username, phone string) (*User, error) {
+	return defaultRepo.NewPhoneUser(context.Background(), username, phone)
+}
+
+// Deprecated: use Repo.FindWxUser.
+func FindWxUser(openid string) (*User, bool) {
+	return defaultRepo.FindWxUser(context.Background(), openid)
+}
+
+// Deprecated: use Repo.FindUser.
+func FindUser(id uint) (*User, bool) {
+	return defaultRepo.FindUser(context.Background(), id)
+}
+
+// Deprecated: use Repo.FindUserByPhone.
+func FindUserByPhone(phone string) (*User, bool) {
+	return defaultRepo.FindUserByPhone(context.Background(), phone)
+}
+
+// Deprecated: use Repo.UpdateUser.
+func UpdateUser(id uint, updateField map[string]interface{}) error {
+	return defaultRepo.UpdateUser(context.Background(), id, updateField)
+}
+
+// Deprecated: use Repo.SetPassword.
+func SetPassword(user *User, password, oldPassword string) error {
+	return defaultRepo.SetPassword(context.Background(), user, password, oldPassword)
+}
+
+// Deprecated: use Repo.SetUserAvatar.
+func (u *User) SetAvatar(avatar string) error {
+	return defaultRepo.SetUserAvatar(context.Background(), u, avatar)
+}
+
+// Deprecated: use Repo.GetFollowersCount.
+func (u *User) GetFollowersCount() int64 {
+	return defaultRepo.GetFollowersCount(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetFollowingsCount.
+func (u *User) GetFollowingsCount() int64 {
+	return defaultRepo.GetFollowingsCount(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetAuthBaseInfomation.
+func (u *User) GetAuthBaseInfomation(signup bool) map[string]interface{} {
+	return defaultRepo.GetAuthBaseInfomation(context.Background(), u, signup)
+}
+
+// Deprecated: use Repo.GetPhoneAuthBaseInfomation.
+func (u *User) GetPhoneAuthBaseInfomation(signup bool) map[string]interface{} {
+	return defaultRepo.GetPhoneAuthBaseInfomation(context.Background(), u, signup)
+}
+
+// Deprecated: use Repo.GetDetailedInfomation.
+func (u *User) GetDetailedInfomation(whoInquery *User) map[string]interface{} {
+	return defaultRepo.GetDetailedInfomation(context.Background(), u, whoInquery)
+}
+
+// Deprecated: use Repo.GetPublicInfomation.
+func (u *User) GetPublicInfomation() UserPublicInfomation {
+	return defaultRepo.GetPublicInfomation(context.Background(), u)
+}
+
+// Deprecated: use Repo.FollowUser.
+func FollowUser(user, userToBeFollowed *User) error {
+	return defaultRepo.FollowUser(context.Background(), user, userToBeFollowed)
+}
+
+// Deprecated: use Repo.UnfollowUser.
+func UnfollowUser(user, userToBeFollowed *User) error {
+	return defaultRepo.UnfollowUser(context.Background(), user, userToBeFollowed)
+}
+
+// Deprecated: use Repo.IncreaseCreditBy.
+func (u *User) IncreaseCreditBy(cnt float64) error {
+	return defaultRepo.IncreaseCreditBy(context.Background(), u, cnt)
+}
+
+// Deprecated: use Repo.DecreaseCreditBy.
+func (u *User) DecreaseCreditBy(cnt float64) error {
+	return defaultRepo.DecreaseCreditBy(context.Background(), u, cnt)
+}
+
+// Deprecated: use Repo.SetUserStatus.
+func (u *User) SetStatus(s UserStatus) error {
+	return defaultRepo.SetUserStatus(context.Background(), u, s)
+}
+
+// Deprecated: use Repo.SetUserBillingStatus.
+func (u *User) SetBillingStatus(s UserBillingStatus) error {
+	return defaultRepo.SetUserBillingStatus(context.Background(), u, s)
+}
+
+// Deprecated: use Repo.SetUserRecentBillTime.
+func (u *User) SetRecentBillTime(t *time.Time) error {
+	return defaultRepo.SetUserRecentBillTime(context.Background(), u, t)
+}
+
+// Deprecated: use Repo.SetUserProDeadline.
+func (u *User) SetProDeadline(t *time.Time) error {
+	return defaultRepo.SetUserProDeadline(context.Background(), u, t)
+}
+
+// Deprecated: use Repo.SetUserCurrentOccupiedSeat.
+func (u *User) SetCurrentOccupiedSeat(seat *Seat) error {
+	return defaultRepo.SetUserCurrentOccupiedSeat(context.Background(), u, seat)
+}
+
+// Deprecated: use Repo.GetUserCurrentOccupiedDevices.
+func (u *User) GetCurrentOccupiedDevices() []Device {
+	return defaultRepo.GetUserCurrentOccupiedDevices(context.Background(), u)
+}
+
+// Deprecated: use Repo.SetUserSession.
+func (u *User) SetSession(s *Session) error {
+	return defaultRepo.SetUserSession(context.Background(), u, s)
+}
+
+// Deprecated: use Repo.ClearUserSession.
+func (u *User) ClearSession() error {
+	return defaultRepo.ClearUserSession(context.Background(), u)
+}
+
+// Deprecated: use Repo.SetUserWxSession.
+func (u *User) SetWxSession(s string) error {
+	return defaultRepo.SetUserWxSession(context.Background(), u, s)
+}
+
+// Deprecated: use Repo.GetUserFollowers.
+func (u *User) GetFollowers() ([]UserPublicInfomation, error) {
+	return defaultRepo.GetUserFollowers(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetUserFollowings.
+func (u *User) GetFollowings() ([]UserPublicInfomation, error) {
+	return defaultRepo.GetUserFollowings(context.Background(), u)
+}
+
+// Deprecated: use Repo.GetUserCount.
+func GetUserCount() uint {
+	return defaultRepo.GetUserCount(context.Background())
+}
+
+// Deprecated: use Repo.CreateVisitorToken.
+func CreateVisitorToken() (*VisitorMark, error) {
+	return defaultRepo.CreateVisitorToken(context.Background())
+}
+
+// Deprecated: use Repo.GetExistingVisitorToken.
+func GetExistingVisitorToken(uuid string) (*VisitorMark, error) {
+	return defaultRepo.GetExistingVisitorToken(context.Background(), uuid)
+}
@@ -1,24 +1,277 @@
 package models
 
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is the stable, machine readable identity of a RequestError.
+type ErrorCode string
+
+const (
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeInvalidArgument    ErrorCode = "invalid_argument"
+	CodeInvalidPage        ErrorCode = "invalid_page"
+	CodeInvalidTime        ErrorCode = "invalid_time"
+	CodeInvalidDeviceID    ErrorCode = "invalid_device_id"
+	CodeUserNotFound       ErrorCode = "user_not_found"
+	CodeWrongPassword      ErrorCode = "wrong_password"
+	CodeQueryUserFailed    ErrorCode = "query_user_failed"
+	CodeUpdateUserFailed   ErrorCode = "update_user_failed"
+	CodeUpdatePassword     ErrorCode = "update_password_failed"
+	CodeUpdateAvatar       ErrorCode = "update_avatar_failed"
+	CodeAlreadyCheckedIn   ErrorCode = "already_checked_in"
+	CodeSeatTaken          ErrorCode = "seat_taken"
+	CodeUserHasBooking     ErrorCode = "user_has_booking"
+	CodeSeatStatusQuery    ErrorCode = "seat_status_query_failed"
+	CodeStoreClosed        ErrorCode = "store_closed"
+	CodeSessionNotFound    ErrorCode = "session_not_found"
+	CodeIllegalTransition  ErrorCode = "illegal_session_transition"
+	CodeHoldExpired        ErrorCode = "waitlist_hold_expired"
+	CodeThreadNotFound     ErrorCode = "thread_not_found"
+	CodeCannotStarComment  ErrorCode = "cannot_star_comment"
+	CodeAlreadyLiked       ErrorCode = "already_liked"
+	CodeNotLiked           ErrorCode = "not_liked"
+	CodeAlreadyStarred     ErrorCode = "already_starred"
+	CodeNotStarred         ErrorCode = "not_starred"
+	CodeInsufficientCredit ErrorCode = "insufficient_credit"
+	CodeOrderNotPending    ErrorCode = "order_not_pending"
+	CodePaymentSignature   ErrorCode = "payment_signature_invalid"
+	CodePaymentMismatch    ErrorCode = "payment_amount_mismatch"
+	CodePaymentFailed      ErrorCode = "payment_failed"
+	CodeRefundAmount       ErrorCode = "refund_amount_invalid"
+	CodeRefundState        ErrorCode = "refund_state_invalid"
+	CodeCouponProduct      ErrorCode = "coupon_product_limit"
+	CodeCouponThreshold    ErrorCode = "coupon_price_threshold"
+	CodeCouponUser         ErrorCode = "coupon_specified_user"
+	CodeCouponType         ErrorCode = "coupon_type_invalid"
+	CodeCouponUsed         ErrorCode = "coupon_used"
+	CodeCouponStacking     ErrorCode = "coupon_stacking"
+	CodeCouponWindow       ErrorCode = "coupon_outside_validity"
+	CodeCouponFirstOrder   ErrorCode = "coupon_first_order_only"
+	CodeCouponMember       ErrorCode = "coupon_member_only"
+	CodeCouponStore        ErrorCode = "coupon_store"
+	CodeCouponSession      ErrorCode = "coupon_session_length"
+	CodeCampaignInactive   ErrorCode = "campaign_inactive"
+	CodeCampaignExhausted  ErrorCode = "campaign_exhausted"
+	CodeCampaignLimit      ErrorCode = "campaign_user_limit"
+	CodeRedeemCodeInvalid  ErrorCode = "redeem_code_invalid"
+	CodeRedeemCodeUsed     ErrorCode = "redeem_code_used"
+	CodeOutOfStock         ErrorCode = "out_of_stock"
+	CodeQuoteExpired       ErrorCode = "quote_expired"
+	CodeQuoteChanged       ErrorCode = "quote_changed"
+	CodeSeatMapInvalid     ErrorCode = "seat_map_invalid"
+	CodeSeatMapConflict    ErrorCode = "seat_map_conflict"
+	CodeSeatBooked         ErrorCode = "seat_booked"
+	CodeReviewNotAllowed   ErrorCode = "review_not_allowed"
+	CodeAlreadyReviewed    ErrorCode = "already_reviewed"
+)
+
+// Lang selects the language of an error message.
+type Lang string
+
+const (
+	LangZh Lang = "zh"
+	LangEn Lang = "en"
+)
+
+// DefaultLang is the language returned by RequestError.Error.
+var DefaultLang = LangZh
+
+var errorMessages = map[ErrorCode]map[Lang]string{
+	CodeBadRequest:         {LangZh: "请求错误", LangEn: "bad request"},
+	CodeInvalidArgument:    {LangZh: "参数错误", LangEn: "invalid argument"},
+	CodeInvalidPage:        {LangZh: "页码错误", LangEn: "page must be greater than 0"},
+	CodeInvalidTime:        {LangZh: "时间不正确", LangEn: "invalid time"},
+	CodeInvalidDeviceID:    {LangZh: "设备 ID 不正确", LangEn: "device id is not valid"},
+	CodeUserNotFound:       {LangZh: "用户不存在", LangEn: "user does not exist"},
+	CodeWrongPassword:      {LangZh: "密码错误", LangEn: "wrong password"},
+	CodeQueryUserFailed:    {LangZh: "查询用户时出现错误", LangEn: "failed to query user"},
+	CodeUpdateUserFailed:   {LangZh: "更新用户时出现错误", LangEn: "failed to update user"},
+	CodeUpdatePassword:     {LangZh: "更新密码时出现错误", LangEn: "failed to update password"},
+	CodeUpdateAvatar:       {LangZh: "更新头像时出现错误", LangEn: "failed to update avatar"},
+	CodeAlreadyCheckedIn:   {LangZh: "今天已经签过到了", LangEn: "already checked in today"},
+	CodeSeatTaken:          {LangZh: "座位已被预约", LangEn: "seat is already booked"},
+	CodeUserHasBooking:     {LangZh: "用户已有预约", LangEn: "user already has a booking"},
+	CodeSeatStatusQuery:    {LangZh: "查询座位状态失败", LangEn: "failed to query seat status"},
+	CodeStoreClosed:        {LangZh: "门店不在营业时间", LangEn: "store is closed at that time"},
+	CodeSessionNotFound:    {LangZh: "预约不存在", LangEn: "session does not exist"},
+	CodeIllegalTransition:  {LangZh: "当前预约状态不允许此操作", LangEn: "session cannot move to the requested status"},
+	CodeHoldExpired:        {LangZh: "候补保留已过期", LangEn: "the waitlist hold has expired"},
+	CodeThreadNotFound:     {LangZh: "帖子不存在", LangEn: "thread does not exist"},
+	CodeCannotStarComment:  {LangZh: "不能收藏评论", LangEn: "comments cannot be starred"},
+	CodeAlreadyLiked:       {LangZh: "已经点过赞了", LangEn: "already liked"},
+	CodeNotLiked:           {LangZh: "没有点过赞", LangEn: "not liked yet"},
+	CodeAlreadyStarred:     {LangZh: "已经收藏过了", LangEn: "already starred"},
+	CodeNotStarred:         {LangZh: "没有收藏过", LangEn: "not starred yet"},
+	CodeInsufficientCredit: {LangZh: "余额不足", LangEn: "insufficient credit"},
+	CodeOrderNotPending:    {LangZh: "订单不是待支付状态", LangEn: "order is not pending payment"},
+	CodePaymentSignature:   {LangZh: "支付通知签名无效", LangEn: "payment notification signature is invalid"},
+	CodePaymentMismatch:    {LangZh: "支付金额与订单不符", LangEn: "paid amount does not match the order"},
+	CodePaymentFailed:      {LangZh: "支付失败", LangEn: "payment failed"},
+	CodeRefundAmount:       {LangZh: "退款金额超出可退金额", LangEn: "refund exceeds the refundable amount"},
+	CodeRefundState:        {LangZh: "当前退款状态不允许此操作", LangEn: "refund cannot be processed in its current status"},
+	CodeCouponProduct:      {LangZh: "仅指定商品可用", LangEn: "coupon only applies to specified products"},
+	CodeCouponThreshold:    {LangZh: "未达到满减金额", LangEn: "order does not reach the coupon threshold"},
+	CodeCouponUser:         {LangZh: "仅指定用户可用", LangEn: "coupon only applies to a specified user"},
+	CodeCouponType:         {LangZh: "优惠券类型错误", LangEn: "invalid coupon type"},
+	CodeCouponUsed:         {LangZh: "优惠券已被使用", LangEn: "coupon has already been used"},
+	CodeCouponStacking:     {LangZh: "所选优惠券不能同时使用", LangEn: "coupons cannot be used together"},
+	CodeCouponWindow:       {LangZh: "不在优惠券有效期内", LangEn: "coupon is not valid at this time"},
+	CodeCouponFirstOrder:   {LangZh: "仅限首单使用", LangEn: "coupon only applies to a first order"},
+	CodeCouponMember:       {LangZh: "仅限会员使用", LangEn: "coupon only applies to members"},
+	CodeCouponStore:        {LangZh: "该门店不可用", LangEn: "coupon does not apply at this store"},
+	CodeCouponSession:      {LangZh: "未达到最短使用时长", LangEn: "session is too short for the coupon"},
+	CodeCampaignInactive:   {LangZh: "活动未开始或已结束", LangEn: "campaign is not running"},
+	CodeCampaignExhausted:  {LangZh: "优惠券已领完", LangEn: "campaign has run out of coupons"},
+	CodeCampaignLimit:      {LangZh: "已达到领取上限", LangEn: "coupon limit per user reached"},
+	CodeRedeemCodeInvalid:  {LangZh: "兑换码无效", LangEn: "invalid redeem code"},
+	CodeRedeemCodeUsed:     {LangZh: "兑换码已被使用", LangEn: "redeem code has been used"},
+	CodeOutOfStock:         {LangZh: "商品库存不足", LangEn: "good is out of stock"},
+	CodeQuoteExpired:       {LangZh: "报价已过期，请重新下单", LangEn: "quote has expired"},
+	CodeQuoteChanged:       {LangZh: "价格已变动，请重新确认", LangEn: "prices changed since the quote"},
+	CodeSeatMapInvalid:     {LangZh: "座位图格式错误", LangEn: "invalid seat map"},
+	CodeSeatMapConflict:    {LangZh: "座位图已被修改，请刷新后重试", LangEn: "seat map was changed by someone else"},
+	CodeSeatBooked:         {LangZh: "座位仍有未完成的预约", LangEn: "seat has upcoming bookings"},
+	CodeReviewNotAllowed:   {LangZh: "只能评价自己已完成的预约", LangEn: "only completed sessions of your own can be reviewed"},
+	CodeAlreadyReviewed:    {LangZh: "该预约已评价过", LangEn: "session already reviewed"},
+}
+
+var (
+	ErrBadRequest         = newRequestError(CodeBadRequest, http.StatusBadRequest)
+	ErrInvalidArgument    = newRequestError(CodeInvalidArgument, http.StatusBadRequest)
+	ErrInvalidPage        = newRequestError(CodeInvalidPage, http.StatusBadRequest)
+	ErrInvalidTime        = newRequestError(CodeInvalidTime, http.StatusBadRequest)
+	ErrInvalidDeviceID    = newRequestError(CodeInvalidDeviceID, http.StatusBadRequest)
+	ErrUserNotFound       = newRequestError(CodeUserNotFound, http.StatusNotFound)
+	ErrWrongPassword      = newRequestError(CodeWrongPassword, http.StatusUnauthorized)
+	ErrQueryUserFailed    = newRequestError(CodeQueryUserFailed, http.StatusInternalServerError)
+	ErrUpdateUserFailed   = newRequestError(CodeUpdateUserFailed, http.StatusInternalServerError)
+	ErrUpdatePassword     = newRequestError(CodeUpdatePassword, http.StatusInternalServerError)
+	ErrUpdateAvatar       = newRequestError(CodeUpdateAvatar, http.StatusInternalServerError)
+	ErrAlreadyCheckedIn   = newRequestError(CodeAlreadyCheckedIn, http.StatusConflict)
+	ErrSeatTaken          = newRequestError(CodeSeatTaken, http.StatusConflict)
+	ErrUserHasBooking     = newRequestError(CodeUserHasBooking, http.StatusConflict)
+	ErrSeatStatusQuery    = newRequestError(CodeSeatStatusQuery, http.StatusInternalServerError)
+	ErrStoreClosed        = newRequestError(CodeStoreClosed, http.StatusUnprocessableEntity)
+	ErrSessionNotFound    = newRequestError(CodeSessionNotFound, http.StatusNotFound)
+	ErrIllegalTransition  = newRequestError(CodeIllegalTransition, http.StatusConflict)
+	ErrHoldExpired        = newRequestError(CodeHoldExpired, http.StatusGone)
+	ErrThreadNotFound     = newRequestError(CodeThreadNotFound, http.StatusNotFound)
+	ErrCannotStarComment  = newRequestError(CodeCannotStarComment, http.StatusBadRequest)
+	ErrAlreadyLiked       = newRequestError(CodeAlreadyLiked, http.StatusConflict)
+	ErrNotLiked           = newRequestError(CodeNotLiked, http.StatusConflict)
+	ErrAlreadyStarred     = newRequestError(CodeAlreadyStarred, http.StatusConflict)
+	ErrNotStarred         = newRequestError(CodeNotStarred, http.StatusConflict)
+	ErrInsufficientCredit = newRequestError(CodeInsufficientCredit, http.StatusPaymentRequired)
+	ErrOrderNotPending    = newRequestError(CodeOrderNotPending, http.StatusConflict)
+	ErrPaymentSignature   = newRequestError(CodePaymentSignature, http.StatusUnauthorized)
+	ErrPaymentMismatch    = newRequestError(CodePaymentMismatch, http.StatusConflict)
+	ErrPaymentFailed      = newRequestError(CodePaymentFailed, http.StatusBadGateway)
+	ErrRefundAmount       = newRequestError(CodeRefundAmount, http.StatusUnprocessableEntity)
+	ErrRefundState        = newRequestError(CodeRefundState, http.StatusConflict)
+	ErrCouponProduct      = newRequestError(CodeCouponProduct, http.StatusUnprocessableEntity)
+	ErrCouponThreshold    = newRequestError(CodeCouponThreshold, http.StatusUnprocessableEntity)
+	ErrCouponUser         = newRequestError(CodeCouponUser, http.StatusForbidden)
+	ErrCouponType         = newRequestError(CodeCouponType, http.StatusInternalServerError)
+	ErrCouponUsed         = newRequestError(CodeCouponUsed, http.StatusConflict)
+	ErrCouponStacking     = newRequestError(CodeCouponStacking, http.StatusUnprocessableEntity)
+	ErrCouponWindow       = newRequestError(CodeCouponWindow, http.StatusUnprocessableEntity)
+	ErrCouponFirstOrder   = newRequestError(CodeCouponFirstOrder, http.StatusUnprocessableEntity)
+	ErrCouponMember       = newRequestError(CodeCouponMember, http.StatusForbidden)
+	ErrCouponStore        = newRequestError(CodeCouponStore, http.StatusUnprocessableEntity)
+	ErrCouponSession      = newRequestError(CodeCouponSession, http.StatusUnprocessableEntity)
+	ErrCampaignInactive   = newRequestError(CodeCampaignInactive, http.StatusGone)
+	ErrCampaignExhausted  = newRequestError(CodeCampaignExhausted, http.StatusConflict)
+	ErrCampaignLimit      = newRequestError(CodeCampaignLimit, http.StatusConflict)
+	ErrRedeemCodeInvalid  = newRequestError(CodeRedeemCodeInvalid, http.StatusNotFound)
+	ErrRedeemCodeUsed     = newRequestError(CodeRedeemCodeUsed, http.StatusConflict)
+	ErrOutOfStock         = newRequestError(CodeOutOfStock, http.StatusConflict)
+	ErrQuoteExpired       = newRequestError(CodeQuoteExpired, http.StatusConflict)
+	ErrQuoteChanged       = newRequestError(CodeQuoteChanged, http.StatusConflict)
+	ErrSeatMapInvalid     = newRequestError(CodeSeatMapInvalid, http.StatusUnprocessableEntity)
+	ErrSeatMapConflict    = newRequestError(CodeSeatMapConflict, http.StatusConflict)
+	ErrSeatBooked         = newRequestError(CodeSeatBooked, http.StatusConflict)
+	ErrReviewNotAllowed   = newRequestError(CodeReviewNotAllowed, http.StatusForbidden)
+	ErrAlreadyReviewed    = newRequestError(CodeAlreadyReviewed, http.StatusConflict)
+)
+
+// RequestError is an error that can be reported back to the client. Two
+// RequestErrors match under errors.Is when their codes are equal, so the
+// sentinels above can be compared against wrapped or annotated copies.
 type RequestError struct {
-	error
+	Code   ErrorCode
+	Status int
+	Cause  error
+
 	msg string
 }
 
+func newRequestError(code ErrorCode, status int) RequestError {
+	return RequestError{
+		Code:   code,
+		Status: status,
+	}
+}
+
+// NewRequestError returns a bad request error with a custom message.
 func NewRequestError(msg string) RequestError {
 	return RequestError{
-		msg: msg,
+		Code:   CodeBadRequest,
+		Status: http.StatusBadRequest,
+		msg:    msg,
 	}
 }
 
 func (err RequestError) Error() string {
-	return err.msg
+	return err.Message(DefaultLang)
 }
 
-func IsRequestError(err error) bool {
-	if _, ok := err.(RequestError); ok {
-		return true
-	} else {
-		return false
+// Message returns the message of the error in the given language, falling
+// back to Chinese when there is no translation.
+func (err RequestError) Message(lang Lang) string {
+	if err.msg != "" {
+		return err.msg
 	}
+	if msg, ok := errorMessages[err.Code][lang]; ok {
+		return msg
+	}
+	return errorMessages[err.Code][LangZh]
+}
+
+// HTTPStatus hints the status code an API layer should respond with.
+func (err RequestError) HTTPStatus() int {
+	if err.Status == 0 {
+		return http.StatusBadRequest
+	}
+	return err.Status
+}
+
+func (err RequestError) Unwrap() error {
+	return err.Cause
+}
+
+func (err RequestError) Is(target error) bool {
+	t, ok := target.(RequestError)
+	return ok && t.Code == err.Code
+}
+
+// Wrap returns a copy of err caused by cause.
+func (err RequestError) Wrap(cause error) RequestError {
+	err.Cause = cause
+	return err
+}
+
+// IsRequestError reports whether err, or any error it wraps, is a
+// RequestError.
+func IsRequestError(err error) bool {
+	var re RequestError
+	return errors.As(err, &re)
+}
+
+// AsRequestError extracts the RequestError wrapped in err.
+func AsRequestError(err error) (RequestError, bool) {
+	var re RequestError
+	ok := errors.As(err, &re)
+	return re, ok
 }
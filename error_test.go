@@ -0,0 +1,61 @@
+package models_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+)
+
+func TestRequestErrorIs(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := fmt.Errorf("booking: %w", models.ErrSeatTaken.Wrap(cause))
+
+	if !errors.Is(err, models.ErrSeatTaken) {
+		t.Error("wrapped ErrSeatTaken does not match the sentinel")
+	}
+	if errors.Is(err, models.ErrUserHasBooking) {
+		t.Error("ErrSeatTaken matches ErrUserHasBooking")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("cause is not reachable through errors.Is")
+	}
+
+	re, ok := models.AsRequestError(err)
+	if !ok {
+		t.Fatal("AsRequestError failed on a wrapped RequestError")
+	}
+	if re.Code != models.CodeSeatTaken {
+		t.Errorf("code is %q, want %q", re.Code, models.CodeSeatTaken)
+	}
+	if re.HTTPStatus() != http.StatusConflict {
+		t.Errorf("status is %d, want %d", re.HTTPStatus(), http.StatusConflict)
+	}
+}
+
+func TestRequestErrorMessage(t *testing.T) {
+	cases := []struct {
+		err  models.RequestError
+		lang models.Lang
+		want string
+	}{
+		{models.ErrAlreadyLiked, models.LangZh, "已经点过赞了"},
+		{models.ErrAlreadyLiked, models.LangEn, "already liked"},
+		{models.ErrAlreadyLiked, models.Lang("fr"), "已经点过赞了"},
+		{models.NewRequestError("自定义"), models.LangEn, "自定义"},
+	}
+	for _, c := range cases {
+		if got := c.err.Message(c.lang); got != c.want {
+			t.Errorf("%s.Message(%s) = %q, want %q", c.err.Code, c.lang, got, c.want)
+		}
+	}
+
+	if models.ErrInsufficientCredit.Error() != "余额不足" {
+		t.Errorf("Error() = %q, want the Chinese message", models.ErrInsufficientCredit.Error())
+	}
+	if !models.IsRequestError(models.NewRequestError("x")) {
+		t.Error("NewRequestError is not a request error")
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"time"
 
 	"github.com/jinzhu/gorm/dialects/postgres"
@@ -16,10 +17,10 @@ type Event struct {
 	Url       string         `gorm:"type:text;not null"`
 }
 
-func GetRecentEvents() []*Event {
+func (r *Repo) GetRecentEvents(ctx context.Context) []*Event {
 	events := make([]*Event, 0)
 	now := time.Now()
 	begin := now.Add(-time.Hour * 24 * 3)
-	db.Where("begin_time > ? AND end_time > ?", begin, now).Order("created_at desc").Find(&events)
+	r.conn(ctx).Where("begin_time > ? AND end_time > ?", begin, now).Order("created_at desc").Find(&events)
 	return events
 }
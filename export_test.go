@@ -0,0 +1,4 @@
+package models
+
+// Migrations exposes the registry to the external tests.
+var Migrations = migrations
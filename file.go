@@ -1,6 +1,10 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
 
 type File struct {
 	gorm.Model
@@ -9,12 +13,12 @@ type File struct {
 	Ext      string
 }
 
-func NewFile(uuid, filename, ext string) {
+func (r *Repo) NewFile(ctx context.Context, uuid, filename, ext string) error {
 	f := File{
 		UUID:     uuid,
 		Filename: filename,
 		Ext:      ext,
 	}
 
-	db.Create(&f)
+	return r.conn(ctx).Create(&f).Error
 }
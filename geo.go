@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"math"
+
+	"gorm.io/gorm"
+)
+
+const earthRadiusKm = 6371.0
+
+// GeoArea is the circle of RadiusKm kilometres around a point.
+type GeoArea struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	RadiusKm  float64 `json:"radius_km"`
+}
+
+// distanceKm returns the great-circle distance between two points.
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBox returns the latitudes and longitudes bounding the area, for
+// a cheap filter before the distance is computed.
+func (a GeoArea) boundingBox() (minLat, maxLat, minLng, maxLng float64) {
+	dLat := a.RadiusKm / earthRadiusKm * 180 / math.Pi
+	minLat, maxLat = a.Latitude-dLat, a.Latitude+dLat
+	if minLat <= -90 || maxLat >= 90 {
+		return math.Max(minLat, -90), math.Min(maxLat, 90), -180, 180
+	}
+	dLng := dLat / math.Cos(a.Latitude*math.Pi/180)
+	minLng, maxLng = a.Longitude-dLng, a.Longitude+dLng
+	if minLng < -180 || maxLng > 180 {
+		// the area crosses the antimeridian, where longitudes wrap
+		return minLat, maxLat, -180, 180
+	}
+	return minLat, maxLat, minLng, maxLng
+}
+
+// DistanceKm returns how far the store is from the centre of a.
+func (a GeoArea) DistanceKm(s *Store) float64 {
+	return distanceKm(a.Latitude, a.Longitude, s.Latitude, s.Longitude)
+}
+
+// distanceSQL is the great-circle distance in kilometres from a store to
+// a point, given as its latitude, its latitude again and its longitude.
+var distanceSQL = fmt.Sprintf(`(%g * asin(least(1, sqrt(
+	power(sin(radians(latitude - ?) / 2), 2) +
+	cos(radians(?)) * cos(radians(latitude)) * power(sin(radians(longitude - ?) / 2), 2)))))`, 2*earthRadiusKm)
+
+// scope limits a query on stores to those within the area. The bounding
+// box goes through the GiST index on the store locations.
+func (a GeoArea) scope(db *gorm.DB) *gorm.DB {
+	minLat, maxLat, minLng, maxLng := a.boundingBox()
+	return db.
+		Where("point(longitude, latitude) <@ box(point(?, ?), point(?, ?))", minLng, minLat, maxLng, maxLat).
+		Where(distanceSQL+" <= ?", a.Latitude, a.Latitude, a.Longitude, a.RadiusKm)
+}
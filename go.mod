@@ -3,6 +3,7 @@ module github.com/Suse-Orphanage/models
 go 1.17
 
 require (
+	github.com/jackc/pgconn v1.11.0
 	github.com/jinzhu/gorm v1.9.16
 	github.com/sirupsen/logrus v1.8.1
 	gorm.io/gorm v1.23.2
@@ -10,7 +11,6 @@ require (
 
 require (
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgconn v1.11.0 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgproto3/v2 v2.2.0 // indirect
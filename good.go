@@ -1,6 +1,10 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
 
 type GoodType = uint
 
@@ -28,6 +32,52 @@ type Good struct {
 	Description string `json:"description"`
 	Image       string `json:"image"`
 	SaleCount   uint   `json:"sale_count"`
+	// SalePrice replaces Price while the good is on sale.
+	SalePrice *Price `json:"sale_price"`
+	// Stock is how many are left to sell, nil meaning unlimited.
+	Stock *uint `json:"stock"`
+}
+
+func (g *Good) GetName() string {
+	return g.Name
+}
+
+func (g *Good) GetBasePrice() Price {
+	return g.Price
+}
+
+func (g *Good) GetSalePrice() Price {
+	if g.IsOnSale() {
+		return *g.SalePrice
+	}
+	return g.Price
+}
+
+func (g *Good) IsOnSale() bool {
+	return g.SalePrice != nil && *g.SalePrice < g.Price
+}
+
+func (g *Good) GetType() ProductType {
+	switch g.Type {
+	case GoodTypeCredits:
+		return ProductTypeCredits
+	case GoodTypeSubscription:
+		return ProductTypeSubscriptionPlan
+	}
+	return ProductTypePhysical
+}
+
+func (g *Good) GetID() uint {
+	return g.ID
+}
+
+func (g *Good) ApplyCoupon(coupon *Coupon, u *User) (Price, Price, error) {
+	price := g.GetSalePrice()
+	discount, err := coupon.Discount(g, u)
+	if err != nil {
+		return price, price, err
+	}
+	return price, price - discount, nil
 }
 
 func GetBuiltinGoods() *[]Good {
@@ -68,26 +118,26 @@ func GetSeasonSubscriptionGoodID() uint {
 	return 3
 }
 
-func GetGoodByID(id uint) (*Good, error) {
+func (r *Repo) GetGoodByID(ctx context.Context, id uint) (*Good, error) {
 	var good Good
-	tx := db.First(&good, "id = ?", id)
+	tx := r.conn(ctx).First(&good, "id = ?", id)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	return &good, nil
 }
 
-func GetCreditGood() *Good {
-	good, _ := GetGoodByID(GetCreditGoodID())
+func (r *Repo) GetCreditGood(ctx context.Context) *Good {
+	good, _ := r.GetGoodByID(ctx, GetCreditGoodID())
 	return good
 }
 
-func GetMonthlySubscriptionGood() *Good {
-	good, _ := GetGoodByID(GetMonthlySubscriptionGoodID())
+func (r *Repo) GetMonthlySubscriptionGood(ctx context.Context) *Good {
+	good, _ := r.GetGoodByID(ctx, GetMonthlySubscriptionGoodID())
 	return good
 }
 
-func GetSeasonSubscriptionGood() *Good {
-	good, _ := GetGoodByID(GetSeasonSubscriptionGoodID())
+func (r *Repo) GetSeasonSubscriptionGood(ctx context.Context) *Good {
+	good, _ := r.GetGoodByID(ctx, GetSeasonSubscriptionGoodID())
 	return good
 }
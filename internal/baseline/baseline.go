@@ -0,0 +1,407 @@
+// Package baseline holds the models as they stood when the schema history
+// began. Version 1 of the migrations creates its tables from these frozen
+// definitions, so that every column added afterwards is owned by the
+// migration that added it and goes away when that migration is reverted.
+//
+// Nothing in here may change: databases migrated before would no longer
+// match the ones created from scratch.
+package baseline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"gorm.io/gorm"
+)
+
+type (
+	UserType          int
+	UserStatus        uint
+	UserBillingStatus uint
+	Price             uint64
+	StoreStatus       = uint
+	SeatStatusEnum    uint
+	GoodType          = uint
+	GoodStatus        = uint
+	OrderType         uint
+	OrderStatus       uint
+	CouponType        uint
+	DeviceKind        uint
+	DeviceStatus      uint
+	SessionStatus     string
+	NotificationType  string
+)
+
+type User struct {
+	gorm.Model
+	Type        UserType   `gorm:"type:int;notNull"`
+	Username    string     `gorm:"type:varchar(32)"`
+	Password    string     `gorm:"type:varchar(64)"`
+	Salt        string     `gorm:"type:varchar(10)"`
+	Bio         string     `gorm:"type:varchar(255)"`
+	Phone       string     `gorm:"type:varchar(11);uniqueIndex"`
+	Openid      string     `gorm:"type:varchar(32);index"`
+	Unionid     string     `gorm:"type:varchar(64);index"`
+	WxSession   string     `gorm:"type:varchar(64)"`
+	IsPro       bool       `gorm:"notNull;default:false"`
+	ProDeadline *time.Time `gorm:"default:NULL"`
+	Avatar      string     `gorm:"default:''"`
+
+	CurrentOccupiedSeat   *Seat
+	CurrentOccupiedSeatID *uint
+
+	Status              UserStatus        `gorm:"default:0"`
+	BillingStatus       UserBillingStatus `gorm:"default:0"`
+	RecentBillStartTime *time.Time        `gorm:"default:NULL"`
+	Session             string            `gorm:"type:text;default:''"`
+
+	RemainingCredit Price `gorm:"default:0"`
+
+	Followers  []*User `gorm:"many2many:user_relations;foreignKey:ID;joinForeignKey:following_id;References:ID;joinReferences:user_id"`
+	Followings []*User `gorm:"many2many:user_relations;foreignKey:ID;joinForeignKey:user_id;References:ID;joinReferences:following_id"`
+
+	LikedThread  []*Thread `gorm:"many2many:user_liked_thread;"`
+	StaredThread []*Thread `gorm:"many2many:user_stared_thread;"`
+
+	LatestNotificationReadTime time.Time
+}
+
+type UserRelation struct {
+	UserID      int `gorm:"primaryKey"`
+	FollowingID int `gorm:"primaryKey"`
+	CreatedAt   time.Time
+}
+
+type ValidationCodeSms struct {
+	gorm.Model
+	Code      string `gorm:"type:char(4)"`
+	ExpiresAt time.Time
+	Phone     string `gorm:"type:char(11);index"`
+	Used      bool   `gorm:"type:bool;default:false"`
+}
+
+type Store struct {
+	gorm.Model
+	Location        string
+	Status          StoreStatus `gorm:"type:int"`
+	OpeningHours    uint
+	OpeningWeekdays uint
+
+	Latitude  float64
+	Longitude float64
+
+	SeatCount uint
+	SeatMap   []byte
+
+	Seats []Seat
+
+	Cover    string
+	Name     string
+	Facility string
+}
+
+type StoreStar struct {
+	StoreID uint `gorm:"primaryKey"`
+	Store   Store
+	UserID  uint `gorm:"primaryKey"`
+	User    User
+}
+
+type Seat struct {
+	gorm.Model
+	Label         string
+	StoreID       uint
+	CurrentStatus SeatStatusEnum
+	Status        []SeatStatus
+	Devices       []Device
+}
+
+type SeatStatus struct {
+	gorm.Model
+	SeatID uint
+	Date   uint `gorm:"index"`
+	Hour   uint
+	Status SeatStatusEnum
+}
+
+type Good struct {
+	gorm.Model
+	Name   string `gorm:"type:varchar(128)"`
+	Price  Price
+	Type   GoodType
+	Status GoodStatus
+
+	Description string
+	Image       string
+	SaleCount   uint
+}
+
+type Order struct {
+	gorm.Model
+	TimestamppedID  string `gorm:"index"`
+	Date            time.Time
+	Price           Price
+	DiscountedPrice Price
+	Amount          uint
+	Type            OrderType
+	GoodID          uint
+	Good            Good
+	CouponID        *uint
+	Coupon          *Coupon
+	Affiliate       User
+	AffiliateID     uint
+
+	Data string
+
+	Status OrderStatus `gorm:"notNull;type:int;default:0"`
+}
+
+type Thread struct {
+	gorm.Model
+	Content   postgres.Jsonb `gorm:"type:jsonb;not null" sql:"DEFAULT '{}'::JSONB"`
+	LikeCount uint           `gorm:"default:0"`
+	Title     string         `gorm:"type:varchar(20);not null"`
+
+	ParentID        *uint `gorm:"default:null"`
+	Parent          *Thread
+	ReplyToID       *uint `gorm:"deafault:null"`
+	ReplyTo         *Thread
+	AffiliatePostID *uint `gorm:"default:null"`
+	AffiliatePost   *Thread
+
+	AuthorID uint `gorm:"not null"`
+	Author   *User
+	Level    int `gorm:"type:int;default:1"`
+
+	Deleted bool `gorm:"default:false"`
+}
+
+type CheckIn struct {
+	Year      uint `gorm:"primaryKey"`
+	Month     uint `gorm:"primaryKey"`
+	Day       uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"primaryKey"`
+	User      User
+	ExactTime time.Time
+}
+
+type Coupon struct {
+	gorm.Model
+	UserID       uint
+	User         User       `gorm:"foreignKey:user_id"`
+	Type         CouponType `gorm:"type:int"`
+	Used         bool       `gorm:"notNull;default:0"`
+	Restrictions string     `gorm:"type:text"`
+	DiscountData uint32     `gorm:"type:int"`
+}
+
+type File struct {
+	gorm.Model
+	UUID     string `gorm:"type:uuid"`
+	Filename string
+	Ext      string
+}
+
+type DynamicConfiguration struct {
+	gorm.Model
+	Name         string `gorm:"uniqueIndex;type:varchar(128)"`
+	Value        string
+	LastModified time.Time
+}
+
+type Device struct {
+	gorm.Model
+	DeviceID     string       `gorm:"uniqueIndex;type:varchar(128)"`
+	Name         string       `gorm:"type:varchar(128)"`
+	Kind         DeviceKind   `gorm:"type:int;default:0"`
+	Status       DeviceStatus `gorm:"type:int;default:0"`
+	Seat         *Seat
+	SeatID       *uint
+	ConnectionID *string `gorm:"type:varchar(128);uniqueIndex"`
+	CurrentToken *string `gorm:"type:varchar(1024)"`
+
+	LastActiveAt *time.Time `gorm:"type:timestamp"`
+
+	ExpectedStatus *json.RawMessage `gorm:"type:jsonb"`
+}
+
+type DeviceToken struct {
+	gorm.Model
+	Affiliate   Device
+	AffiliateID uint
+	User        User
+	UserID      uint `gorm:"not null"`
+	Session     Session
+	SessionID   uint `gorm:"not null"`
+	Token       string
+	Valid       *bool     `gorm:"defualt:true"`
+	Deadline    time.Time `gorm:"not null"`
+}
+
+type Session struct {
+	gorm.Model
+	User   User
+	UserID uint
+
+	Seat   Seat
+	SeatID uint
+
+	StartTime *time.Time `gorm:"not null"`
+	EndTime   *time.Time
+
+	ActualEndTime *time.Time
+	BillingFee    Price
+
+	Status SessionStatus `gorm:"default:'valid'"`
+
+	Token string `gorm:"uniqueIndex,type:varchar(1024)"`
+}
+
+type DoorNonce struct {
+	Nonce string `gorm:"index;primaryKey"`
+
+	CreationTime time.Time
+	ExpireTime   time.Time
+
+	User      User
+	UserID    uint `gorm:"not null"`
+	Session   *Session
+	SessionID *uint
+
+	Valid bool `gorm:"default:true;primaryKey"`
+}
+
+type ThreadStar struct {
+	CreateAt sql.NullTime
+	ThreadID uint `gorm:"not null;primaryKey"`
+	Thread   Thread
+	UserID   uint `gorm:"not null;primaryKey"`
+	User     User
+}
+
+type ThreadLike struct {
+	CreateAt sql.NullTime
+	ThreadID uint `gorm:"not null;primaryKey"`
+	Thread   Thread
+	UserID   uint `gorm:"not null;primaryKey"`
+	User     User
+}
+
+type Event struct {
+	gorm.Model
+	Desc      postgres.Jsonb `gorm:"not null"`
+	BeginTime time.Time      `gorm:"type:timestamp;not null"`
+	EndTime   time.Time      `gorm:"type:timestamp;not null"`
+	Cover     string         `gorm:"type:text;not null"`
+	Url       string         `gorm:"type:text;not null"`
+}
+
+type AccessStatistic struct {
+	gorm.Model
+	Time            time.Time
+	IP              string `gorm:"type:varchar(15);index"`
+	UserAgent       string `gorm:"type:text"`
+	Path            string `gorm:"type:text"`
+	Method          string `gorm:"type:text"`
+	Status          int
+	Referer         string `gorm:"type:text"`
+	UserID          *uint
+	User            *User
+	AdministratorID *uint
+	Administrator   *Administrator
+
+	Headers        json.RawMessage `gorm:"type:jsonb"`
+	Country        string          `gorm:"type:varchar(127)"`
+	Region         string          `gorm:"type:varchar(255)"`
+	City           string          `gorm:"type:varchar(255)"`
+	OS             string          `gorm:"type:varchar(255)"`
+	OSVersion      string          `gorm:"type:varchar(255)"`
+	Browser        string          `gorm:"type:varchar(255)"`
+	BrowserVersion string          `gorm:"type:varchar(255)"`
+	Device         string          `gorm:"type:varchar(127)"`
+
+	Data json.RawMessage `gorm:"type:jsonb"`
+}
+
+type Administrator struct {
+	gorm.Model
+	Username string `gorm:"type:text;not null;unique"`
+	Password string `gorm:"type:text;not null"`
+	Salt     string `gorm:"text;not null"`
+	Email    string `gorm:"type:text;not null;unique"`
+}
+
+type Notification struct {
+	gorm.Model
+	Type NotificationType `gorm:"type:string;not null"`
+
+	AffiliateNotificationSubjectID *uint
+	User                           *User
+	UserID                         uint
+	Data                           json.RawMessage `gorm:"type:jsonb"`
+}
+
+// Models lists the baseline models in the order they were migrated.
+func Models() []interface{} {
+	return []interface{}{
+		&User{},
+		&ValidationCodeSms{},
+		&Store{},
+		&StoreStar{},
+		&Seat{},
+		&SeatStatus{},
+		&Good{},
+		&Order{},
+		&Thread{},
+		&CheckIn{},
+		&Coupon{},
+		&File{},
+		&DynamicConfiguration{},
+		&Device{},
+		&Session{},
+		&DeviceToken{},
+		&DoorNonce{},
+		&ThreadStar{},
+		&ThreadLike{},
+		&Event{},
+		&AccessStatistic{},
+		&Administrator{},
+		&Notification{},
+	}
+}
+
+// JoinTables lists the many-to-many tables created alongside Models.
+func JoinTables() []string {
+	return []string{"user_relations", "user_liked_thread", "user_stared_thread"}
+}
+
+// Migrate creates the baseline tables.
+func Migrate(db *gorm.DB) error {
+	err := db.SetupJoinTable(&User{}, "Followings", &UserRelation{})
+	if err != nil {
+		return err
+	}
+	err = db.SetupJoinTable(&User{}, "Followers", &UserRelation{})
+	if err != nil {
+		return err
+	}
+	return db.AutoMigrate(Models()...)
+}
+
+// Drop removes the baseline tables.
+func Drop(db *gorm.DB) error {
+	tables := Models()
+	for i := len(tables) - 1; i >= 0; i-- {
+		if err := db.Migrator().DropTable(tables[i]); err != nil {
+			return err
+		}
+	}
+	for _, table := range JoinTables() {
+		if err := db.Migrator().DropTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
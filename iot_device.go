@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -101,7 +102,16 @@ type DeviceToken struct {
 	Deadline    time.Time `gorm:"not null"`
 }
 
-func (d *Device) CreateToken(key []byte, expiration uint, u *User, s *Session) string {
+func (r *Repo) CreateDeviceToken(ctx context.Context, key []byte, expiration uint, d *Device, u *User, s *Session) string {
+	token, err := r.issueDeviceToken(ctx, key, expiration, d, u, s)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to save device token into database")
+		return ""
+	}
+	return token
+}
+
+func (r *Repo) issueDeviceToken(ctx context.Context, key []byte, expiration uint, d *Device, u *User, s *Session) (string, error) {
 	id := d.DeviceID
 	exp := time.Now().Add(time.Duration(expiration) * time.Minute)
 
@@ -121,13 +131,13 @@ func (d *Device) CreateToken(key []byte, expiration uint, u *User, s *Session) s
 
 	encrypt, err := aes.NewCipher(key)
 	if err != nil {
-		return ""
+		return "", err
 	}
 
 	ciphertext := make([]byte, aes.BlockSize+len(hash))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return ""
+		return "", err
 	}
 
 	stream := cipher.NewCFBEncrypter(encrypt, iv)
@@ -135,15 +145,14 @@ func (d *Device) CreateToken(key []byte, expiration uint, u *User, s *Session) s
 
 	token := base64.URLEncoding.EncodeToString(ciphertext)
 
-	err = SaveToken(d, token, exp, u, s)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to save device token into database")
-		return ""
+	if err := r.SaveToken(ctx, d, token, exp, u, s); err != nil {
+		return "", err
 	}
-	return token
+	return token, nil
 }
 
-func SaveToken(device *Device, token string, expiration time.Time, u *User, s *Session) error {
+func (r *Repo) SaveToken(ctx context.Context, device *Device, token string, expiration time.Time, u *User, s *Session) error {
+	db := r.conn(ctx)
 	tx := db.Create(&DeviceToken{
 		AffiliateID: device.ID,
 		Token:       token,
@@ -155,17 +164,17 @@ func SaveToken(device *Device, token string, expiration time.Time, u *User, s *S
 		return tx.Error
 	}
 	device.CurrentToken = &token
-	return db.Save(&device).Error
+	return db.Model(device).Update("current_token", token).Error
 }
 
-func EmptyToken(device *Device) error {
-	tx := db.Model(device).Update("current_token", nil)
+func (r *Repo) EmptyToken(ctx context.Context, device *Device) error {
+	tx := r.conn(ctx).Model(device).Update("current_token", nil)
 	return tx.Error
 }
 
-func (t *DeviceToken) SetValid(valid bool) error {
+func (r *Repo) SetDeviceTokenValid(ctx context.Context, t *DeviceToken, valid bool) error {
 	t.Valid = &valid
-	tx := db.Save(t)
+	tx := r.conn(ctx).Save(t)
 	return tx.Error
 }
 
@@ -173,36 +182,36 @@ func (t *DeviceToken) IsExpired() bool {
 	return *t.Valid && time.Now().After(t.Deadline)
 }
 
-func (d *Device) SetDeviceStatus(status DeviceStatus) error {
+func (r *Repo) SetDeviceStatus(ctx context.Context, d *Device, status DeviceStatus) error {
 	d.Status = status
-	tx := db.Save(d)
+	tx := r.conn(ctx).Save(d)
 	return tx.Error
 }
 
-func (d *Device) SetConnectionID(id string) error {
+func (r *Repo) SetDeviceConnectionID(ctx context.Context, d *Device, id string) error {
 	d.ConnectionID = &id
-	tx := db.Save(d)
+	tx := r.conn(ctx).Save(d)
 	return tx.Error
 }
 
-func (d *Device) EmptyConnectID() error {
+func (r *Repo) EmptyDeviceConnectID(ctx context.Context, d *Device) error {
 	d.ConnectionID = nil
-	tx := db.Save(d)
+	tx := r.conn(ctx).Save(d)
 	return tx.Error
 }
 
-func GetDeviceByID(deviceId string) *Device {
+func (r *Repo) GetDeviceByID(ctx context.Context, deviceId string) *Device {
 	d := Device{}
-	tx := db.First(&d, "device_id = ?", deviceId)
+	tx := r.conn(ctx).First(&d, "device_id = ?", deviceId)
 	if tx.Error != nil {
 		return nil
 	}
 	return &d
 }
 
-func GetDeviceToken(token string) *DeviceToken {
+func (r *Repo) GetDeviceToken(ctx context.Context, token string) *DeviceToken {
 	t := DeviceToken{}
-	tx := db.Preload("Device").First(&t, "token = ?", token)
+	tx := r.conn(ctx).Preload("Device").First(&t, "token = ?", token)
 	if tx.Error != nil {
 		return nil
 	}
@@ -0,0 +1,11 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestMain(m *testing.M) {
+	modelstest.Main(m)
+}
@@ -1,65 +1,394 @@
 package models
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Suse-Orphanage/models/internal/baseline"
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-func Migrate(connStr string) error {
-	logrus.Info("Start migration.")
-	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{})
-	if err != nil {
-		return err
+// Migration is one step of the schema history. A step is either a pair of
+// Go functions or a pair of raw SQL statements; Down (or DownSQL) may be
+// left empty for steps that cannot be reverted.
+type Migration struct {
+	Version uint
+	Name    string
+
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+
+	UpSQL   string
+	DownSQL string
+}
+
+func (m *Migration) up(tx *gorm.DB) error {
+	if m.Up != nil {
+		return m.Up(tx)
 	}
+	return tx.Exec(m.UpSQL).Error
+}
 
-	err = db.SetupJoinTable(&User{}, "Followings", &UserRelation{})
-	if err != nil {
-		return err
+func (m *Migration) down(tx *gorm.DB) error {
+	if m.Down != nil {
+		return m.Down(tx)
 	}
-	err = db.SetupJoinTable(&User{}, "Followers", &UserRelation{})
-	if err != nil {
+	if m.DownSQL == "" {
+		return fmt.Errorf("migration %d (%s) is irreversible", m.Version, m.Name)
+	}
+	return tx.Exec(m.DownSQL).Error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type MigrationStatus struct {
+	Version   uint       `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// migrationLockKey identifies the advisory lock held while migrating,
+// so that two instances never migrate the same database at once.
+const migrationLockKey int64 = 0x5375736530
+
+// migrations is the ordered schema history. New steps are appended with
+// a version greater than the last one.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up:      migrateBaseline,
+		Down:    dropBaseline,
+	},
+	{
+		Version: 2,
+		Name:    "session_period_exclusion",
+		Up:      migrateSessionPeriod,
+		Down:    dropSessionPeriod,
+	},
+	{
+		Version: 3,
+		Name:    "session_events",
+		Up:      migrateSessionEvents,
+		Down:    dropSessionEvents,
+	},
+	{
+		Version: 4,
+		Name:    "no_show",
+		Up:      migrateNoShow,
+		Down:    dropNoShow,
+	},
+	{
+		Version: 5,
+		Name:    "recurring_reservations",
+		Up:      migrateRecurringReservations,
+		Down:    dropRecurringReservations,
+	},
+	{
+		Version: 6,
+		Name:    "waitlist",
+		Up:      migrateWaitlist,
+		Down:    dropWaitlist,
+	},
+	{
+		Version: 7,
+		Name:    "tariffs",
+		Up:      migrateTariffs,
+		Down:    dropTariffs,
+	},
+	{
+		Version: 8,
+		Name:    "credit_ledger",
+		Up:      migrateCreditLedger,
+		Down:    dropCreditLedger,
+	},
+	{
+		Version: 9,
+		Name:    "subscriptions",
+		Up:      migrateSubscriptions,
+		Down:    dropSubscriptions,
+	},
+	{
+		Version: 10,
+		Name:    "payments",
+		Up:      migratePayments,
+		Down:    dropPayments,
+	},
+	{
+		Version: 11,
+		Name:    "refunds",
+		Up:      migrateRefunds,
+		Down:    dropRefunds,
+	},
+	{
+		Version: 12,
+		Name:    "order_expiry",
+		Up:      migrateOrderExpiry,
+		Down:    dropOrderExpiry,
+	},
+	{
+		Version: 13,
+		Name:    "quotes",
+		Up:      migrateQuotes,
+		Down:    dropQuotes,
+	},
+	{
+		Version: 14,
+		Name:    "coupon_campaigns",
+		Up:      migrateCouponCampaigns,
+		Down:    dropCouponCampaigns,
+	},
+	{
+		Version: 15,
+		Name:    "coupon_stacking",
+		Up:      migrateCouponStacking,
+		Down:    dropCouponStacking,
+	},
+	{
+		Version: 16,
+		Name:    "store_schedules",
+		Up:      migrateStoreSchedules,
+		Down:    dropStoreSchedules,
+	},
+	{
+		Version: 17,
+		Name:    "seat_attributes",
+		Up:      migrateSeatAttributes,
+		Down:    dropSeatAttributes,
+	},
+	{
+		Version: 18,
+		Name:    "seat_maps",
+		Up:      migrateSeatMaps,
+		Down:    dropSeatMaps,
+	},
+	{
+		Version: 19,
+		Name:    "store_locations",
+		Up:      migrateStoreLocations,
+		Down:    dropStoreLocations,
+	},
+	{
+		Version: 20,
+		Name:    "store_reviews",
+		Up:      migrateStoreReviews,
+		Down:    dropStoreReviews,
+	},
+	{
+		Version: 21,
+		Name:    "waitlist_attributes",
+		Up:      migrateWaitlistAttributes,
+		Down:    dropWaitlistAttributes,
+	},
+	{
+		Version: 22,
+		Name:    "stray_refunds",
+		Up:      migrateStrayRefunds,
+		Down:    dropStrayRefunds,
+	},
+}
+
+// migrateBaseline creates the schema as it stood before the history began,
+// from the models frozen in package baseline, and seeds the builtin goods.
+func migrateBaseline(db *gorm.DB) error {
+	if err := baseline.Migrate(db); err != nil {
 		return err
 	}
 
-	err = db.AutoMigrate(
-		&User{},
-		&ValidationCodeSms{},
-		&Store{},
-		&StoreStar{},
-		&Seat{},
-		&SeatStatus{},
-		&Good{},
-		&Order{},
-		&Thread{},
-		&CheckIn{},
-		&Coupon{},
-		&File{},
-		&DynamicConfiguration{},
-		&Device{},
-		&DeviceToken{},
-		&DoorNonce{},
-		&ThreadStar{},
-		&ThreadLike{},
-		&Event{},
-		&AccessStatistic{},
-		&Administrator{},
-		&Notification{},
-	)
+	for _, good := range *GetBuiltinGoods() {
+		if db.Find(&baseline.Good{}, good.ID).RowsAffected != 0 {
+			continue
+		}
+		row := baseline.Good{
+			Model:       good.Model,
+			Name:        good.Name,
+			Price:       baseline.Price(good.Price),
+			Type:        good.Type,
+			Status:      good.Status,
+			Description: good.Description,
+			Image:       good.Image,
+			SaleCount:   good.SaleCount,
+		}
+		if err := db.Create(&row).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dropBaseline(db *gorm.DB) error {
+	return baseline.Drop(db)
+}
+
+// createTables creates the tables of models that do not exist yet. Unlike
+// AutoMigrate it leaves the tables they reference alone: the columns of
+// those belong to the migrations that added them.
+func createTables(db *gorm.DB, models ...interface{}) error {
+	m := db.Migrator()
+	for _, model := range models {
+		if m.HasTable(model) {
+			continue
+		}
+		if err := m.CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func execAll(db *gorm.DB, stmts ...string) error {
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestSchemaVersion returns the version of the newest registered migration.
+func LatestSchemaVersion() uint {
+	return migrations[len(migrations)-1].Version
+}
 
+func Migrate(connStr string) error {
+	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{})
 	if err != nil {
 		return err
 	}
+	return NewRepo(db).Migrate(context.Background())
+}
 
-	goodsList := *GetBuiltinGoods()
-	for idx, good := range goodsList {
-		if db.Find(&Good{}, good.ID).RowsAffected == 0 {
-			tx := db.Create(&goodsList[idx])
-			if tx.Error != nil {
-				return tx.Error
-			}
+// Migrate brings the schema up to the latest version.
+func (r *Repo) Migrate(ctx context.Context) error {
+	return r.MigrateTo(ctx, LatestSchemaVersion())
+}
+
+// withMigrationLock runs fn in a transaction holding the migration lock.
+func (r *Repo) withMigrationLock(ctx context.Context, fn func(tx *gorm.DB, applied map[uint]SchemaMigration) error) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		db := tx.conn(ctx)
+		if err := db.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+			return err
 		}
+
+		records := make([]SchemaMigration, 0)
+		if err := db.Find(&records).Error; err != nil {
+			return err
+		}
+		applied := make(map[uint]SchemaMigration, len(records))
+		for _, rec := range records {
+			applied[rec.Version] = rec
+		}
+		return fn(db, applied)
+	})
+}
+
+func applyMigration(db *gorm.DB, m *Migration) error {
+	logrus.Infof("Applying migration %d (%s).", m.Version, m.Name)
+	if err := m.up(db); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
 	}
+	return db.Create(&SchemaMigration{
+		Version:   m.Version,
+		Name:      m.Name,
+		AppliedAt: time.Now(),
+	}).Error
+}
 
-	return nil
+func revertMigration(db *gorm.DB, m *Migration) error {
+	logrus.Infof("Reverting migration %d (%s).", m.Version, m.Name)
+	if err := m.down(db); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	return db.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+}
+
+// MigrateTo applies every pending migration up to version and reverts the
+// applied ones above it. The whole run happens in one transaction.
+func (r *Repo) MigrateTo(ctx context.Context, version uint) error {
+	return r.withMigrationLock(ctx, func(db *gorm.DB, applied map[uint]SchemaMigration) error {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := &migrations[i]
+			if _, ok := applied[m.Version]; ok && m.Version > version {
+				if err := revertMigration(db, m); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range migrations {
+			m := &migrations[i]
+			if _, ok := applied[m.Version]; !ok && m.Version <= version {
+				if err := applyMigration(db, m); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback reverts the n most recently applied migrations.
+func (r *Repo) Rollback(ctx context.Context, n int) error {
+	return r.withMigrationLock(ctx, func(db *gorm.DB, applied map[uint]SchemaMigration) error {
+		for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+			m := &migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := revertMigration(db, m); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+// Status lists every registered migration and whether it has been applied.
+func (r *Repo) Status(ctx context.Context) ([]MigrationStatus, error) {
+	result := make([]MigrationStatus, len(migrations))
+	err := r.withMigrationLock(ctx, func(db *gorm.DB, applied map[uint]SchemaMigration) error {
+		for i, m := range migrations {
+			result[i] = MigrationStatus{
+				Version: m.Version,
+				Name:    m.Name,
+			}
+			if rec, ok := applied[m.Version]; ok {
+				appliedAt := rec.AppliedAt
+				result[i].Applied = true
+				result[i].AppliedAt = &appliedAt
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for
+// an empty database.
+func (r *Repo) SchemaVersion(ctx context.Context) (uint, error) {
+	status, err := r.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var version uint
+	for _, st := range status {
+		if st.Applied {
+			version = st.Version
+		}
+	}
+	return version, nil
 }
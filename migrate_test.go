@@ -1,35 +1,93 @@
-package models
+package models_test
 
 import (
-	"os"
+	"context"
 	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
 )
 
-func getDcs() string {
-	dcs := ""
-	dcs = os.Getenv("DB_CONNECTION_STRING")
-	if dcs == "" {
-		panic("failed to retrieve DB_CONNECTION_STRING from environment variables.")
+func TestMigrationsOrdered(t *testing.T) {
+	for i := 1; i < len(models.Migrations); i++ {
+		if models.Migrations[i].Version <= models.Migrations[i-1].Version {
+			t.Errorf("migration %d is registered after %d", models.Migrations[i].Version, models.Migrations[i-1].Version)
+		}
+	}
+	for _, m := range models.Migrations {
+		if m.Up == nil && m.UpSQL == "" {
+			t.Errorf("migration %d has no up step", m.Version)
+		}
 	}
-
-	return dcs
 }
 
 func TestMigrate(t *testing.T) {
-	dcs := getDcs()
+	repo := modelstest.New(t)
+	ctx := context.Background()
 
-	err := Connect(dcs)
+	version, err := repo.SchemaVersion(ctx)
 	if err != nil {
-		t.Error("failed to connect to database.")
 		t.Fatal(err)
 	}
-	err = db.Migrator().DropTable(&Thread{})
-	if err != nil {
-		t.Error(err)
+	if version != models.LatestSchemaVersion() {
+		t.Errorf("schema version is %d, want %d", version, models.LatestSchemaVersion())
 	}
 
-	err = Migrate(dcs)
+	status, err := repo.Status(ctx)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if !s.Applied {
+			t.Errorf("migration %d (%s) is not applied", s.Version, s.Name)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+
+	if err := repo.MigrateTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if repo.DB().Migrator().HasTable(&models.User{}) {
+		t.Error("users table survived rolling back to version 0")
+	}
+
+	if err := repo.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.DB().Migrator().HasTable(&models.User{}) {
+		t.Error("users table is missing after migrating again")
+	}
+}
+
+func TestRollbackDropsLaterColumns(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+	m := repo.DB().Migrator()
+
+	if err := repo.MigrateTo(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if m.HasColumn(&models.Session{}, "BillingBreakdown") {
+		t.Error("baseline created sessions.billing_breakdown")
+	}
+	if m.HasColumn(&models.User{}, "NoShowCount") {
+		t.Error("baseline created users.no_show_count")
+	}
+	if m.HasColumn(&models.Order{}, "ExpiresAt") {
+		t.Error("baseline created orders.expires_at")
+	}
+	if !m.HasTable(&models.Session{}) {
+		t.Error("baseline did not create sessions")
+	}
+
+	if err := repo.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasColumn(&models.Session{}, "BillingBreakdown") {
+		t.Error("sessions.billing_breakdown is missing after migrating again")
 	}
 }
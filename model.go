@@ -1,20 +1,77 @@
 package models
 
 import (
+	"context"
+
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-var db *gorm.DB
+// Repo holds a database handle. Every operation of the package is a
+// method on Repo that accepts a context, so several databases can be
+// used side by side and a caller's transaction can be threaded through.
+type Repo struct {
+	db     *gorm.DB
+	hooks  *sessionHooks
+	biller SessionBiller
+}
 
-func Connect(connStr string) error {
-	models, err := gorm.Open(postgres.Open(connStr), &gorm.Config{
+// defaultRepo is the handle set up by Connect, used by the deprecated
+// package-level functions.
+var defaultRepo *Repo
+
+// Open connects to the database described by connStr.
+func Open(connStr string) (*Repo, error) {
+	conn, err := gorm.Open(postgres.Open(connStr), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return NewRepo(conn), nil
+}
+
+// NewRepo wraps an existing gorm handle, which may be a transaction.
+func NewRepo(conn *gorm.DB) *Repo {
+	return &Repo{
+		db:     conn,
+		hooks:  newSessionHooks(),
+		biller: NewTariffBiller(SystemClock),
+	}
+}
+
+// Connect opens the database and makes it the default Repo.
+func Connect(connStr string) error {
+	r, err := Open(connStr)
 	if err != nil {
 		return err
 	}
-	db = models
+	defaultRepo = r
 	return nil
 }
+
+// Default returns the Repo set up by Connect.
+func Default() *Repo {
+	return defaultRepo
+}
+
+// DB returns the underlying gorm handle.
+func (r *Repo) DB() *gorm.DB {
+	return r.db
+}
+
+func (r *Repo) conn(ctx context.Context) *gorm.DB {
+	return r.db.WithContext(ctx)
+}
+
+// WithTx runs fn inside a transaction. fn receives a Repo bound to the
+// transaction; returning an error (or panicking) rolls it back. Calling
+// WithTx on a Repo that is already in a transaction uses a savepoint.
+func (r *Repo) WithTx(ctx context.Context, fn func(tx *Repo) error) error {
+	return r.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		repo := *r
+		repo.db = tx
+		return fn(&repo)
+	})
+}
@@ -0,0 +1,247 @@
+package modelstest
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Fixture is the declarative description of rows to load before a test.
+// Rows reference each other by the ids given in the fixture.
+//
+//	{
+//	  "users":    [{"id": 1, "username": "alice", "phone": "13800000001"}],
+//	  "stores":   [{"id": 1, "name": "main"}],
+//	  "seats":    [{"id": 1, "store_id": 1, "label": "A"}],
+//	  "sessions": [{"id": 1, "user_id": 1, "seat_id": 1,
+//	                "start_time": "2022-03-01T09:00:00+08:00",
+//	                "end_time": "2022-03-01T11:00:00+08:00"}]
+//	}
+type Fixture struct {
+	Users    []UserFixture    `json:"users"`
+	Stores   []StoreFixture   `json:"stores"`
+	Seats    []SeatFixture    `json:"seats"`
+	Sessions []SessionFixture `json:"sessions"`
+	Goods    []GoodFixture    `json:"goods"`
+	Threads  []ThreadFixture  `json:"threads"`
+}
+
+type UserFixture struct {
+	ID              uint         `json:"id"`
+	Username        string       `json:"username"`
+	Phone           string       `json:"phone"`
+	Openid          string       `json:"openid"`
+	IsPro           bool         `json:"is_pro"`
+	ProDeadline     *time.Time   `json:"pro_deadline"`
+	RemainingCredit models.Price `json:"remaining_credit"`
+}
+
+type StoreFixture struct {
+	ID        uint                    `json:"id"`
+	Name      string                  `json:"name"`
+	Location  string                  `json:"location"`
+	Status    models.StoreStatus      `json:"status"`
+	Latitude  float64                 `json:"latitude"`
+	Longitude float64                 `json:"longitude"`
+	TimeZone  string                  `json:"time_zone"`
+	Schedule  *models.OpeningSchedule `json:"schedule"`
+}
+
+type SeatFixture struct {
+	ID         uint                  `json:"id"`
+	StoreID    uint                  `json:"store_id"`
+	Label      string                `json:"label"`
+	Class      string                `json:"class"`
+	Zone       string                `json:"zone"`
+	Attributes models.SeatAttributes `json:"attributes"`
+}
+
+type SessionFixture struct {
+	ID        uint                 `json:"id"`
+	UserID    uint                 `json:"user_id"`
+	SeatID    uint                 `json:"seat_id"`
+	StartTime time.Time            `json:"start_time"`
+	EndTime   *time.Time           `json:"end_time"`
+	Status    models.SessionStatus `json:"status"`
+	Token     string               `json:"token"`
+}
+
+type GoodFixture struct {
+	ID          uint              `json:"id"`
+	Name        string            `json:"name"`
+	Price       models.Price      `json:"price"`
+	Type        models.GoodType   `json:"type"`
+	Status      models.GoodStatus `json:"status"`
+	Description string            `json:"description"`
+	Stock       *uint             `json:"stock"`
+	SalePrice   *models.Price     `json:"sale_price"`
+}
+
+type ThreadFixture struct {
+	ID        uint            `json:"id"`
+	Title     string          `json:"title"`
+	Content   json.RawMessage `json:"content"`
+	AuthorID  uint            `json:"author_id"`
+	ParentID  *uint           `json:"parent_id"`
+	ReplyToID *uint           `json:"reply_to_id"`
+	Level     int             `json:"level"`
+}
+
+// LoadFile reads a JSON fixture from path and loads it into r.
+func LoadFile(t testing.TB, r *models.Repo, path string) {
+	t.Helper()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read fixture %s: %v", path, err)
+	}
+	LoadJSON(t, r, raw)
+}
+
+// LoadJSON decodes a JSON fixture and loads it into r.
+func LoadJSON(t testing.TB, r *models.Repo, raw []byte) {
+	t.Helper()
+
+	f := Fixture{}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	Load(t, r, &f)
+}
+
+// Load inserts the rows of f, replacing rows that already exist with the
+// same id.
+func Load(t testing.TB, r *models.Repo, f *Fixture) {
+	t.Helper()
+
+	err := r.DB().Transaction(func(tx *gorm.DB) error {
+		tx = tx.Clauses(clause.OnConflict{UpdateAll: true})
+		for _, u := range f.Users {
+			err := tx.Create(&models.User{
+				Model:           gorm.Model{ID: u.ID},
+				Type:            models.UserTypePhone,
+				Username:        u.Username,
+				Phone:           u.Phone,
+				Openid:          u.Openid,
+				IsPro:           u.IsPro,
+				ProDeadline:     u.ProDeadline,
+				RemainingCredit: u.RemainingCredit,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range f.Stores {
+			err := tx.Create(&models.Store{
+				Model:     gorm.Model{ID: s.ID},
+				Name:      s.Name,
+				Location:  s.Location,
+				Status:    s.Status,
+				Latitude:  s.Latitude,
+				Longitude: s.Longitude,
+				TimeZone:  s.TimeZone,
+				Schedule:  s.Schedule,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range f.Seats {
+			err := tx.Create(&models.Seat{
+				Model:      gorm.Model{ID: s.ID},
+				StoreID:    s.StoreID,
+				Label:      s.Label,
+				Class:      s.Class,
+				Zone:       s.Zone,
+				Attributes: s.Attributes,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, g := range f.Goods {
+			err := tx.Create(&models.Good{
+				Model:       gorm.Model{ID: g.ID},
+				Name:        g.Name,
+				Price:       g.Price,
+				Type:        g.Type,
+				Status:      g.Status,
+				Description: g.Description,
+				Stock:       g.Stock,
+				SalePrice:   g.SalePrice,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range f.Sessions {
+			start := s.StartTime
+			status := s.Status
+			if status == "" {
+				status = models.SessionStatusValid
+			}
+			token := s.Token
+			if token == "" {
+				token = randomHex(16)
+			}
+			err := tx.Omit(clause.Associations).Create(&models.Session{
+				Model:     gorm.Model{ID: s.ID},
+				UserID:    s.UserID,
+				SeatID:    s.SeatID,
+				StartTime: &start,
+				EndTime:   s.EndTime,
+				Status:    status,
+				Token:     token,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, th := range f.Threads {
+			level := th.Level
+			if level == 0 {
+				level = models.ThreadLevelPost
+			}
+			content := th.Content
+			if len(content) == 0 {
+				content = json.RawMessage("{}")
+			}
+			err := tx.Omit(clause.Associations).Create(&models.Thread{
+				Model:     gorm.Model{ID: th.ID},
+				Title:     th.Title,
+				Content:   models.String2Jsonb(string(content)),
+				AuthorID:  th.AuthorID,
+				ParentID:  th.ParentID,
+				ReplyToID: th.ReplyToID,
+				Level:     level,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return resetSequences(tx, "users", "stores", "seats", "goods", "sessions", "threads")
+	})
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+}
+
+// resetSequences moves the id sequence of each table past its largest id,
+// since fixtures insert rows with explicit ids.
+func resetSequences(tx *gorm.DB, tables ...string) error {
+	for _, table := range tables {
+		err := tx.Exec(
+			"SELECT setval(pg_get_serial_sequence(?, 'id'), COALESCE((SELECT MAX(id) FROM "+table+"), 0) + 1, false)",
+			table,
+		).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
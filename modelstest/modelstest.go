@@ -0,0 +1,203 @@
+// Package modelstest provides isolated databases for testing the models
+// package.
+//
+// Every call to New creates a fresh Postgres schema, runs the migrations in
+// it and drops it when the test finishes. The server is taken from
+// DB_CONNECTION_STRING when it is set; otherwise a throwaway server is
+// started from the initdb and pg_ctl binaries found on PATH. When neither
+// is available the test is skipped.
+package modelstest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"gorm.io/gorm"
+)
+
+var (
+	serverOnce sync.Once
+	serverDSN  string
+	serverErr  error
+	stopServer func()
+)
+
+// Main runs the tests of a package and stops the throwaway server, if one
+// was started. Call it from TestMain:
+//
+//	func TestMain(m *testing.M) { modelstest.Main(m) }
+func Main(m *testing.M) {
+	code := m.Run()
+	if stopServer != nil {
+		stopServer()
+	}
+	os.Exit(code)
+}
+
+func server() (string, error) {
+	serverOnce.Do(func() {
+		if dsn := os.Getenv("DB_CONNECTION_STRING"); dsn != "" {
+			serverDSN = dsn
+			return
+		}
+		serverDSN, stopServer, serverErr = startLocalPostgres()
+	})
+	return serverDSN, serverErr
+}
+
+func startLocalPostgres() (string, func(), error) {
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		return "", nil, err
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "modelstest")
+	if err != nil {
+		return "", nil, err
+	}
+	data := filepath.Join(dir, "data")
+
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "--auth=trust", "-E", "UTF8").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("initdb: %v: %s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-o", opts, "-l", filepath.Join(dir, "log"), "-w", "start").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("pg_ctl start: %v: %s", err, out)
+	}
+
+	stop := func() {
+		_ = exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").Run()
+		os.RemoveAll(dir)
+	}
+	dsn := fmt.Sprintf("host=127.0.0.1 port=%d user=postgres dbname=postgres sslmode=disable", port)
+	return dsn, stop, nil
+}
+
+// withSearchPath appends a search_path runtime parameter to dsn, which may
+// be either a URL or a key=value connection string.
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// New returns a Repo bound to a freshly migrated schema of its own. The
+// schema is dropped when t finishes.
+func New(t testing.TB) *models.Repo {
+	t.Helper()
+
+	dsn, err := server()
+	if err != nil {
+		t.Skipf("no Postgres available: %v", err)
+	}
+
+	admin, err := models.Open(dsn)
+	if err != nil {
+		t.Skipf("cannot connect to Postgres: %v", err)
+	}
+
+	schema := "modelstest_" + randomHex(6)
+	if err := admin.DB().Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema %s: %v", schema, err)
+	}
+
+	repo, err := models.Open(withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("connect to schema %s: %v", schema, err)
+	}
+
+	t.Cleanup(func() {
+		closeRepo(repo)
+		if err := admin.DB().Exec("DROP SCHEMA " + schema + " CASCADE").Error; err != nil {
+			t.Errorf("drop schema %s: %v", schema, err)
+		}
+		closeRepo(admin)
+	})
+
+	if err := repo.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate schema %s: %v", schema, err)
+	}
+	return repo
+}
+
+func closeRepo(r *models.Repo) {
+	if sqlDB, err := r.DB().DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+// Truncate empties every table of the schema except the migration
+// records, and restores the builtin goods. It is meant for table-driven
+// tests that share one Repo between cases.
+func Truncate(t testing.TB, r *models.Repo) {
+	t.Helper()
+
+	db := r.DB()
+	tables := make([]string, 0)
+	err := db.
+		Raw("SELECT tablename FROM pg_tables WHERE schemaname = CURRENT_SCHEMA() AND tablename <> 'schema_migrations'").
+		Scan(&tables).
+		Error
+	if err != nil {
+		t.Fatalf("list tables: %v", err)
+	}
+	if len(tables) == 0 {
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("TRUNCATE TABLE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE").Error; err != nil {
+			return err
+		}
+		if err := tx.Create(models.GetBuiltinGoods()).Error; err != nil {
+			return err
+		}
+		return resetSequences(tx, "goods")
+	})
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"time"
@@ -18,10 +19,12 @@ type DoorNonce struct {
 	SessionID *uint
 
 	Valid bool `gorm:"default:true;primaryKey"`
+	// UsedAt is set when the nonce opens the door.
+	UsedAt *time.Time `json:"used_at"`
 }
 
-func CreateDoorNonce(user *User, session *Session) *DoorNonce {
-	if n := GetRecentValidNonce(user); n != nil {
+func (r *Repo) CreateDoorNonce(ctx context.Context, user *User, session *Session) *DoorNonce {
+	if n := r.GetRecentValidNonce(ctx, user); n != nil {
 		return n
 	}
 
@@ -48,45 +51,62 @@ func CreateDoorNonce(user *User, session *Session) *DoorNonce {
 			d.SessionID = nil
 		}
 
-		tx := db.Create(d)
+		tx := r.conn(ctx).Create(d)
 		work = tx.Error == nil
 	}
 	return d
 }
 
-func CleanThoseExpired() {
+func (r *Repo) CleanThoseExpired(ctx context.Context) {
 	nonces := []DoorNonce{}
-	_ = db.Where(&nonces, "valid = ? AND expire_time > ?", true, time.Now()).Update("valid", false)
+	_ = r.conn(ctx).Where(&nonces, "valid = ? AND expire_time > ?", true, time.Now()).Update("valid", false)
 }
 
-func GetDoorNonce(nonce string) (*DoorNonce, error) {
+func (r *Repo) GetDoorNonce(ctx context.Context, nonce string) (*DoorNonce, error) {
 	d := &DoorNonce{}
-	tx := db.Where("nonce = ? AND valid = ?", nonce, true).First(d)
+	tx := r.conn(ctx).Where("nonce = ? AND valid = ?", nonce, true).First(d)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	return d, nil
 }
 
-func (n *DoorNonce) SetNoLongerValid() error {
-	tx := db.Model(n).Update("valid", false)
+func (r *Repo) SetDoorNonceNoLongerValid(ctx context.Context, n *DoorNonce) error {
+	tx := r.conn(ctx).Model(n).Update("valid", false)
 	return tx.Error
 }
 
-func UserHasValidNonceBefore(u *User) bool {
-	CleanThoseExpired()
+// UseDoorNonce consumes n when it opens the door. Unlike
+// SetDoorNonceNoLongerValid it records the use, which counts as the user
+// showing up for the nonce's session.
+func (r *Repo) UseDoorNonce(ctx context.Context, n *DoorNonce) error {
+	now := time.Now()
+	tx := r.conn(ctx).Model(n).Updates(map[string]interface{}{
+		"valid":   false,
+		"used_at": now,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	n.Valid = false
+	n.UsedAt = &now
+	return nil
+}
+
+func (r *Repo) UserHasValidNonceBefore(ctx context.Context, u *User) bool {
+	r.CleanThoseExpired(ctx)
 
 	nonces := []DoorNonce{}
-	_ = db.Find(&nonces, "user_id = ? AND valid = ?", u.ID, true)
+	_ = r.conn(ctx).Find(&nonces, "user_id = ? AND valid = ?", u.ID, true)
 
 	return len(nonces) != 0
 }
 
-func GetRecentValidNonce(u *User) *DoorNonce {
-	CleanThoseExpired()
+func (r *Repo) GetRecentValidNonce(ctx context.Context, u *User) *DoorNonce {
+	r.CleanThoseExpired(ctx)
 
 	nonce := &DoorNonce{}
-	tx := db.First(&nonce, "user_id = ? AND valid = ? AND expire_time > ?", u.ID, true, time.Now())
+	tx := r.conn(ctx).First(&nonce, "user_id = ? AND valid = ? AND expire_time > ?", u.ID, true, time.Now())
 	if tx.RowsAffected == 0 {
 		return nil
 	}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func migrateNoShow(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasColumn(&User{}, "NoShowCount") {
+		if err := m.AddColumn(&User{}, "NoShowCount"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&DoorNonce{}, "UsedAt") {
+		if err := m.AddColumn(&DoorNonce{}, "UsedAt"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropNoShow(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropColumn(&DoorNonce{}, "UsedAt"); err != nil {
+		return err
+	}
+	return m.DropColumn(&User{}, "NoShowCount")
+}
+
+// ReleaseNoShows marks as no-show every reservation that started more than
+// grace ago without the user checking in, opening the door or activating a
+// device, and returns how many were released.
+func (r *Repo) ReleaseNoShows(ctx context.Context, grace time.Duration) (int, error) {
+	sessions := make([]*Session, 0)
+	tx := r.conn(ctx).
+		Where("status = ?", SessionStatusReserved).
+		Where("start_time < ?", time.Now().Add(-grace)).
+		Where("NOT EXISTS (SELECT 1 FROM door_nonces WHERE door_nonces.session_id = sessions.id AND door_nonces.used_at IS NOT NULL)").
+		Where("NOT EXISTS (SELECT 1 FROM device_tokens WHERE device_tokens.session_id = sessions.id AND device_tokens.deleted_at IS NULL)").
+		Find(&sessions)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	released := 0
+	for _, s := range sessions {
+		err := r.TransitionSession(ctx, s, SessionStatusNoShow, SessionActorSystem)
+		if errors.Is(err, ErrIllegalTransition) {
+			// checked in meanwhile
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("session", s.ID).Error("Failed to release no-show session")
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// noShowHook runs when a session becomes a no-show: it frees the seat
+// unless someone else is sitting there, invalidates the session's door
+// nonces, counts the no-show against the user and notifies them.
+func noShowHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	db := tx.conn(ctx)
+	err := db.Model(&Seat{}).
+		Where("id = ?", s.SeatID).
+		Where("NOT EXISTS (SELECT 1 FROM sessions WHERE seat_id = ? AND status IN ? AND deleted_at IS NULL)",
+			s.SeatID, []SessionStatus{SessionStatusCheckedIn, SessionStatusOnGoing}).
+		Update("current_status", SeatStatusEnumVacancy).
+		Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(&DoorNonce{}).
+		Where("session_id = ? AND valid = ?", s.ID, true).
+		Update("valid", false).
+		Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(&User{}).
+		Where("id = ?", s.UserID).
+		Update("no_show_count", gorm.Expr("no_show_count + 1")).
+		Error
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"seat_id":    s.SeatID,
+		"start_time": s.StartTime,
+		"end_time":   s.EndTime,
+	})
+	if err != nil {
+		return err
+	}
+	sid := s.ID
+	return tx.PushNotification(ctx, &Notification{
+		Type:                           NotificationTypeSessionNoShow,
+		UserID:                         s.UserID,
+		AffiliateNotificationSubjectID: &sid,
+		Data:                           data,
+	})
+}
+
+// GetUserNoShowCount returns how many reservations u has missed, for use
+// by booking penalty policies.
+func (r *Repo) GetUserNoShowCount(ctx context.Context, u *User) (uint, error) {
+	var cnt uint
+	tx := r.conn(ctx).Model(&User{}).Where("id = ?", u.ID).Select("no_show_count").Scan(&cnt)
+	return cnt, tx.Error
+}
+
+// ResetUserNoShowCount clears the no-show counter of u, e.g. once a
+// penalty has been served.
+func (r *Repo) ResetUserNoShowCount(ctx context.Context, u *User) error {
+	u.NoShowCount = 0
+	return r.conn(ctx).Model(u).Update("no_show_count", 0).Error
+}
@@ -0,0 +1,135 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+	"gorm.io/gorm/clause"
+)
+
+const noShowFixture = `{
+	"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"}
+	],
+	"stores": [{"id": 1, "name": "main"}],
+	"seats": [
+		{"id": 1, "store_id": 1, "label": "A"},
+		{"id": 2, "store_id": 1, "label": "B"}
+	],
+	"sessions": [
+		{"id": 1, "user_id": 1, "seat_id": 1,
+		 "start_time": "2022-03-01T09:00:00+08:00",
+		 "end_time": "2022-03-01T11:00:00+08:00"},
+		{"id": 2, "user_id": 2, "seat_id": 2,
+		 "start_time": "2022-03-01T09:00:00+08:00",
+		 "end_time": "2022-03-01T11:00:00+08:00"}
+	]
+}`
+
+func TestReleaseNoShows(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(noShowFixture))
+	ctx := context.Background()
+	db := repo.DB()
+
+	if err := db.Model(&models.Seat{}).Where("id = ?", 1).Update("current_status", models.SeatStatusEnumOccupied).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// bob opened the door for session 2
+	sid := uint(2)
+	nonce := &models.DoorNonce{
+		Nonce:        "0002",
+		UserID:       2,
+		SessionID:    &sid,
+		Valid:        true,
+		CreationTime: time.Now(),
+		ExpireTime:   time.Now().Add(time.Hour),
+	}
+	if err := db.Omit(clause.Associations).Create(nonce).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UseDoorNonce(ctx, nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's door nonce for session 1 was never used
+	aliceSid := uint(1)
+	err := db.Omit(clause.Associations).Create(&models.DoorNonce{
+		Nonce:        "0001",
+		UserID:       1,
+		SessionID:    &aliceSid,
+		Valid:        true,
+		CreationTime: time.Now(),
+		ExpireTime:   time.Now().Add(time.Hour),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a reservation that has not started yet
+	alice := &models.User{}
+	alice.ID = 1
+	seat2 := &models.Seat{}
+	seat2.ID = 2
+	start := time.Now().Add(time.Hour)
+	end := start.Add(time.Hour)
+	future, err := repo.ReserveSession(ctx, sessionKey, alice, seat2, &start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := repo.ReleaseNoShows(ctx, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 1 {
+		t.Errorf("ReleaseNoShows() released %d sessions, want 1", released)
+	}
+
+	statuses := map[uint]models.SessionStatus{
+		1:         models.SessionStatusNoShow,
+		2:         models.SessionStatusReserved,
+		future.ID: models.SessionStatusReserved,
+	}
+	for id, want := range statuses {
+		s := models.Session{}
+		if err := db.First(&s, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != want {
+			t.Errorf("session %d status = %s, want %s", id, s.Status, want)
+		}
+	}
+
+	if seat := repo.GetSeatByID(ctx, 1); seat.CurrentStatus != models.SeatStatusEnumVacancy {
+		t.Errorf("seat 1 status = %v, want vacancy", seat.CurrentStatus)
+	}
+
+	var valid int64
+	db.Model(&models.DoorNonce{}).Where("session_id = ? AND valid = ?", 1, true).Count(&valid)
+	if valid != 0 {
+		t.Errorf("%d door nonces of the no-show are still valid", valid)
+	}
+
+	if cnt, err := repo.GetUserNoShowCount(ctx, alice); err != nil || cnt != 1 {
+		t.Errorf("GetUserNoShowCount() = %d, %v, want 1", cnt, err)
+	}
+
+	notifications, err := repo.QueryNotificationOfType(ctx, models.NotificationTypeSessionNoShow, *alice, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 {
+		t.Errorf("got %d no-show notifications, want 1", len(notifications))
+	}
+
+	// running again finds nothing new
+	if released, err := repo.ReleaseNoShows(ctx, 15*time.Minute); err != nil || released != 0 {
+		t.Errorf("second ReleaseNoShows() = %d, %v, want 0", released, err)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -20,6 +21,8 @@ const (
 	NotificationTypeScheduledTimeArrive = "scheduled_time_arrive"
 	NotificationTypeFollowingOnline     = "following_online"
 	NotificationTypeLinkedMessage       = "linked_message"
+	NotificationTypeSessionNoShow       = "session_no_show"
+	NotificationTypeWaitlistHold        = "waitlist_hold"
 )
 
 type Notification struct {
@@ -35,6 +38,8 @@ type Notification struct {
 }
 
 func (n *Notification) MarshalJSON() ([]byte, error) {
+	ctx := context.Background()
+	repo := Default()
 	r := make(map[string]interface{}, 0)
 	r["type"] = n.Type
 	r["time"] = n.CreatedAt
@@ -47,7 +52,7 @@ func (n *Notification) MarshalJSON() ([]byte, error) {
 			logrus.Errorf("Notification.MarshalJSON: notification id %d has no affiliate subject id", n.ID)
 			return json.Marshal(nil)
 		}
-		post := GetPostSummary(*n.AffiliateNotificationSubjectID)
+		post := repo.GetPostSummary(ctx, *n.AffiliateNotificationSubjectID)
 		if post == nil {
 			logrus.Errorf("PushThreadReplyNotification: failed to get post summary, post object is nil")
 			return json.Marshal(nil)
@@ -59,8 +64,8 @@ func (n *Notification) MarshalJSON() ([]byte, error) {
 	case NotificationTypeFollows:
 		var u *User
 		if n.AffiliateNotificationSubjectID != nil {
-			u, _ = FindUser(n.UserID)
-			r["follower"] = u.GetPublicInfomation()
+			u, _ = repo.FindUser(ctx, n.UserID)
+			r["follower"] = repo.GetPublicInfomation(ctx, u)
 		} else {
 			logrus.Errorf("Notification.MarshalJSON: notification id %d has no follower id", n.ID)
 		}
@@ -70,8 +75,8 @@ func (n *Notification) MarshalJSON() ([]byte, error) {
 	case NotificationTypeChat:
 		var u *User
 		if n.AffiliateNotificationSubjectID != nil {
-			u, _ = FindUser(n.UserID)
-			r["sender"] = u.GetPublicInfomation()
+			u, _ = repo.FindUser(ctx, n.UserID)
+			r["sender"] = repo.GetPublicInfomation(ctx, u)
 		} else {
 			logrus.Errorf("Notification.MarshalJSON: notification id %d has no sender id", n.ID)
 		}
@@ -80,11 +85,19 @@ func (n *Notification) MarshalJSON() ([]byte, error) {
 	case NotificationTypeScheduledTimeArrive:
 		// TODO: add related session
 		break
+	case NotificationTypeSessionNoShow:
+		if n.AffiliateNotificationSubjectID != nil {
+			r["session_id"] = *n.AffiliateNotificationSubjectID
+		}
+	case NotificationTypeWaitlistHold:
+		if n.AffiliateNotificationSubjectID != nil {
+			r["waitlist_entry_id"] = *n.AffiliateNotificationSubjectID
+		}
 	case NotificationTypeFollowingOnline:
 		var u *User
 		if n.AffiliateNotificationSubjectID != nil {
-			u, _ = FindUser(n.UserID)
-			r["following"] = u.GetPublicInfomation()
+			u, _ = repo.FindUser(ctx, n.UserID)
+			r["following"] = repo.GetPublicInfomation(ctx, u)
 		} else {
 			logrus.Errorf("Notification.MarshalJSON: notification id %d has no friends id", n.ID)
 		}
@@ -92,13 +105,13 @@ func (n *Notification) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r)
 }
 
-func PushNotification(n *Notification) error {
-	err := db.Save(n).Error
+func (r *Repo) PushNotification(ctx context.Context, n *Notification) error {
+	err := r.conn(ctx).Save(n).Error
 	return err
 }
 
-func DeleteNotification(t NotificationType, uid, aff_id uint) error {
-	return db.Delete(
+func (r *Repo) DeleteNotification(ctx context.Context, t NotificationType, uid, aff_id uint) error {
+	return r.conn(ctx).Delete(
 		"type = ? AND user_id = ? AND affiliate_notification_subject_id = ?",
 		t,
 		uid,
@@ -106,25 +119,25 @@ func DeleteNotification(t NotificationType, uid, aff_id uint) error {
 	).Error
 }
 
-func DeleteNotifications(t NotificationType, aff_id uint) error {
-	return db.Delete(
+func (r *Repo) DeleteNotifications(ctx context.Context, t NotificationType, aff_id uint) error {
+	return r.conn(ctx).Delete(
 		"type = ? AND affiliate_notification_subject_id = ?",
 		t,
 		aff_id,
 	).Error
 }
 
-func DeleteNotificationOfManyType(t []NotificationType, aff_id uint) error {
-	return db.Delete(
+func (r *Repo) DeleteNotificationOfManyType(ctx context.Context, t []NotificationType, aff_id uint) error {
+	return r.conn(ctx).Delete(
 		"type in ? AND affiliate_notification_subject_id = ?",
 		t,
 		aff_id,
 	).Error
 }
 
-func QueryNotificationOfType(t NotificationType, u User, limit, page int) ([]*Notification, error) {
+func (r *Repo) QueryNotificationOfType(ctx context.Context, t NotificationType, u User, limit, page int) ([]*Notification, error) {
 	result := make([]*Notification, 0)
-	err := db.
+	err := r.conn(ctx).
 		Where("type = ? AND user_id = ?", t, u.ID).
 		Limit(limit).
 		Offset(limit * (page - 1)).
@@ -134,9 +147,9 @@ func QueryNotificationOfType(t NotificationType, u User, limit, page int) ([]*No
 	return result, err
 }
 
-func QueryNotification(u User, limit, page int) ([]*Notification, error) {
+func (r *Repo) QueryNotification(ctx context.Context, u User, limit, page int) ([]*Notification, error) {
 	notifications := make([]*Notification, 0)
-	err := db.
+	err := r.conn(ctx).
 		Where("user_id = ? AND created_at > ?", u.ID, u.LatestNotificationReadTime).
 		Limit(limit).
 		Offset(limit * (page - 1)).
@@ -146,22 +159,22 @@ func QueryNotification(u User, limit, page int) ([]*Notification, error) {
 	return notifications, err
 }
 
-func (u *User) CommitNotificationRead(t time.Time) error {
+func (r *Repo) CommitNotificationRead(ctx context.Context, u *User, t time.Time) error {
 	if t.After(time.Now().Add(time.Second * 5)) {
-		return NewRequestError("时间不正确")
+		return ErrInvalidTime
 	}
 	u.LatestNotificationReadTime = t
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("latest_notification_read_time", t).Error
 }
 
-func PushThreadReplyNotification(threadId, replyId uint) {
+func (r *Repo) PushThreadReplyNotification(ctx context.Context, threadId, replyId uint) {
 	var authorId uint = 0
-	err := db.Model(Thread{}).Where("id = ?", threadId).Select("author_id").Scan(&authorId).Error
+	err := r.conn(ctx).Model(Thread{}).Where("id = ?", threadId).Select("author_id").Scan(&authorId).Error
 	if err != nil {
 		logrus.WithError(err).Error("PushThreadReplyNotification: failed to get author id")
 	}
 
-	err = PushNotification(&Notification{
+	err = r.PushNotification(ctx, &Notification{
 		Type:                           NotificationTypeThreadReply,
 		UserID:                         authorId,
 		AffiliateNotificationSubjectID: &threadId,
@@ -171,14 +184,14 @@ func PushThreadReplyNotification(threadId, replyId uint) {
 	}
 }
 
-func PushThreadLikeNotification(threadId, likedUserId uint) {
+func (r *Repo) PushThreadLikeNotification(ctx context.Context, threadId, likedUserId uint) {
 	var authorId uint = 0
-	err := db.Model(Thread{}).Where("id = ?", threadId).Select("author_id").Scan(&authorId).Error
+	err := r.conn(ctx).Model(Thread{}).Where("id = ?", threadId).Select("author_id").Scan(&authorId).Error
 	if err != nil {
 		logrus.WithError(err).Error("PushThreadLikeNotification: failed to get author id")
 	}
 
-	err = PushNotification(&Notification{
+	err = r.PushNotification(ctx, &Notification{
 		Type:                           NotificationTypeThreadLike,
 		UserID:                         authorId,
 		AffiliateNotificationSubjectID: &likedUserId,
@@ -188,8 +201,8 @@ func PushThreadLikeNotification(threadId, likedUserId uint) {
 	}
 }
 
-func PushFollowNotification(followedUserId, followerId uint) {
-	err := PushNotification(&Notification{
+func (r *Repo) PushFollowNotification(ctx context.Context, followedUserId, followerId uint) {
+	err := r.PushNotification(ctx, &Notification{
 		Type:                           NotificationTypeFollows,
 		UserID:                         followedUserId,
 		AffiliateNotificationSubjectID: &followerId,
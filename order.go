@@ -1,9 +1,11 @@
 package models
 
 import (
+	"context"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type OrderType uint
@@ -41,6 +43,8 @@ const (
 	OrderStatusPending OrderStatus = iota
 	OrderStatusPaid
 	OrderStatusCancelled
+	OrderStatusPartiallyRefunded
+	OrderStatusRefunded
 )
 
 func (status *OrderStatus) MarshalJSON() ([]byte, error) {
@@ -50,6 +54,12 @@ func (status *OrderStatus) MarshalJSON() ([]byte, error) {
 		str = "pending"
 	case OrderStatusPaid:
 		str = "paid"
+	case OrderStatusCancelled:
+		str = "cancelled"
+	case OrderStatusPartiallyRefunded:
+		str = "partially_refunded"
+	case OrderStatusRefunded:
+		str = "refunded"
 	}
 	return []byte(`"` + str + `"`), nil
 }
@@ -72,74 +82,143 @@ type Order struct {
 	Data string `json:"-"`
 
 	Status OrderStatus `gorm:"notNull;type:int;default:0" json:"status"`
+	// ExpiresAt is when a pending order is cancelled if it was not paid.
+	ExpiresAt *time.Time `gorm:"index" json:"expires_at"`
+	// Quote is what the user was shown, and what the order charges.
+	Quote *Quote `gorm:"type:jsonb" json:"quote,omitempty"`
 }
 
-func CreateOrder(o *Order) error {
-	tx := db.Create(o)
-	return tx.Error
+// CreateOrder inserts the pending order o, reserving its coupons and the
+// stock of its goods until it is paid or expires. An order with a quote is
+// priced at it, provided pricing it again gives the same.
+func (r *Repo) CreateOrder(ctx context.Context, o *Order) error {
+	now := time.Now()
+	if o.Quote != nil {
+		if err := r.requote(ctx, o, now); err != nil {
+			return err
+		}
+		if err := o.applyQuote(); err != nil {
+			return err
+		}
+	}
+	if o.ExpiresAt == nil {
+		expires := now.Add(OrderPaymentTimeout)
+		o.ExpiresAt = &expires
+	}
+	return r.WithTx(ctx, func(tx *Repo) error {
+		for _, id := range o.couponIDs() {
+			res := tx.conn(ctx).
+				Model(&Coupon{}).
+				Where("id = ? AND user_id = ? AND NOT used", id, o.AffiliateID).
+				Update("used", true)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return ErrCouponUsed
+			}
+		}
+		if o.Type == OrderTypeBuyProduct {
+			for _, item := range o.items() {
+				if err := tx.reserveStock(ctx, item.GoodID, item.Quantity); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.conn(ctx).Create(o).Error
+	})
 }
 
-func GetOrderByID(id string) (Order, error) {
+func (r *Repo) GetOrderByID(ctx context.Context, id string) (Order, error) {
 	var o Order
-	tx := db.Preload("Affiliate").Where("timestampped_id = ?", id).First(&o)
+	tx := r.conn(ctx).Preload("Affiliate").Where("timestampped_id = ?", id).First(&o)
 	return o, tx.Error
 }
 
 // mark paid only marks current order to paid status,
-// to keep atomic operation, use CommitPaid instead.
-func (o *Order) MarkPaid() error {
-	tx := db.Model(o).Update("status", OrderStatusPaid)
+// to keep atomic operation, use CommitOrderPaid instead.
+func (r *Repo) MarkOrderPaid(ctx context.Context, o *Order) error {
+	tx := r.conn(ctx).Model(o).Update("status", OrderStatusPaid)
 	return tx.Error
 }
 
-// CommitPaid commits the order to paid status,
-// and increase user's credits in one transaction.
-func (o *Order) CommitPaid() error {
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+// CommitOrderPaid commits the order to paid status, and credits the
+// user for a credits order or activates their subscription for a
+// subscription order, in one transaction. Committing an order that
+// is already paid does nothing; a cancelled order cannot be paid.
+func (r *Repo) CommitOrderPaid(ctx context.Context, o *Order) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current := Order{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, o.ID).Error
+		if err != nil {
+			return err
+		}
+		switch current.Status {
+		case OrderStatusPaid, OrderStatusPartiallyRefunded, OrderStatusRefunded:
+			o.Status = current.Status
+			return nil
+		case OrderStatusCancelled:
+			return ErrOrderNotPending
+		}
+		if err := tx.setOrderStatus(ctx, &current, OrderStatusPaid, SessionActorSystem); err != nil {
+			return err
+		}
+		o.Status = OrderStatusPaid
+		for _, item := range current.items() {
+			err = tx.conn(ctx).
+				Model(&Good{}).
+				Where("id = ?", item.GoodID).
+				Update("sale_count", gorm.Expr("sale_count + ?", item.Quantity)).
+				Error
+			if err != nil {
+				return err
+			}
 		}
-	}()
-
-	err := tx.
-		Model(o).
-		Update("status", OrderStatusPaid).
-		Error
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	err = tx.
-		Model(User{}).
-		Where("id = ?", o.AffiliateID).
-		Update("remaining_credit", gorm.Expr("remaining_credit + ? * 100", o.Amount)).
-		Error
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
 
-	return tx.Commit().Error
+		switch current.Type {
+		case OrderTypeBuyCredits:
+			if current.Amount == 0 {
+				return nil
+			}
+			u := &User{}
+			u.ID = current.AffiliateID
+			_, err = tx.CreditUser(ctx, u, Price(current.Amount)*100, CreditReasonTopUp, OrderCreditSource(&current), UserActor(u))
+			return err
+		case OrderTypeSubscription, OrderTypeSubscriptionAutoRenew:
+			return tx.activateSubscription(ctx, &current, time.Now())
+		}
+		return nil
+	})
 }
 
-func (u *User) ListOrders() ([]Order, error) {
+func (r *Repo) ListUserOrders(ctx context.Context, u *User) ([]Order, error) {
 	orders := []Order{}
-	tx := db.Preload("Good").Where("affiliate_id = ?", u.ID).Order("id desc").Find(&orders)
+	tx := r.conn(ctx).Preload("Good").Where("affiliate_id = ?", u.ID).Order("id desc").Find(&orders)
 	return orders, tx.Error
 }
 
-func GetNetRevenu() Price {
-	var result = struct {
-		Revenu Price `gorm:"column:revenu" json:"revenu"`
-	}{}
-	tx := db.
-		Where("status = ? AND created_at > ?", OrderStatusPaid, time.Now().AddDate(0, -1, 0)).
-		Select("SUM(price) revenu").
-		Scan(&result)
+// GetNetRevenu returns what orders of the last month brought in, less
+// what has been refunded of them.
+func (r *Repo) GetNetRevenu(ctx context.Context) Price {
+	counted := []OrderStatus{OrderStatusPaid, OrderStatusPartiallyRefunded, OrderStatusRefunded}
+	since := time.Now().AddDate(0, -1, 0)
+	var revenu, refunded int64
+	tx := r.conn(ctx).
+		Model(&Order{}).
+		Where("status IN ? AND created_at > ?", counted, since).
+		Select("COALESCE(SUM(price), 0)").
+		Scan(&revenu)
+	if tx.Error != nil {
+		return 0
+	}
+	tx = r.conn(ctx).
+		Model(&Refund{}).
+		Where("status = ? AND NOT stray", RefundStatusSucceeded).
+		Where("EXISTS (SELECT 1 FROM orders WHERE orders.id = refunds.order_id AND orders.status IN ? AND orders.created_at > ? AND orders.deleted_at IS NULL)", counted, since).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&refunded)
 	if tx.Error != nil {
 		return 0
 	}
-	return result.Revenu
+	return Price(revenu - refunded)
 }
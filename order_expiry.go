@@ -0,0 +1,186 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrderPaymentTimeout is how long a new order waits for payment before it
+// is cancelled.
+var OrderPaymentTimeout = 15 * time.Minute
+
+// OrderEvent records a change of an order's status.
+type OrderEvent struct {
+	ID        uint        `gorm:"primarykey" json:"id"`
+	OrderID   uint        `gorm:"not null;index" json:"order_id"`
+	From      OrderStatus `gorm:"column:from_status;type:int;not null" json:"from"`
+	To        OrderStatus `gorm:"column:to_status;type:int;not null" json:"to"`
+	Actor     string      `gorm:"type:varchar(64)" json:"actor"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+func (o *Order) quantity() uint {
+	if o.Amount == 0 {
+		return 1
+	}
+	return o.Amount
+}
+
+func migrateOrderExpiry(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasColumn(&Order{}, "ExpiresAt") {
+		if err := m.AddColumn(&Order{}, "ExpiresAt"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&Good{}, "Stock") {
+		if err := m.AddColumn(&Good{}, "Stock"); err != nil {
+			return err
+		}
+	}
+	if !m.HasIndex(&Order{}, "ExpiresAt") {
+		if err := m.CreateIndex(&Order{}, "ExpiresAt"); err != nil {
+			return err
+		}
+	}
+	if err := createTables(db, &OrderEvent{}); err != nil {
+		return err
+	}
+	// orders left pending before expiry existed are long stale
+	return db.Exec(
+		"UPDATE orders SET expires_at = created_at + ? * interval '1 second' WHERE status = ? AND expires_at IS NULL",
+		int64(OrderPaymentTimeout/time.Second), OrderStatusPending,
+	).Error
+}
+
+func dropOrderExpiry(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropTable(&OrderEvent{}); err != nil {
+		return err
+	}
+	if err := m.DropColumn(&Good{}, "Stock"); err != nil {
+		return err
+	}
+	return m.DropColumn(&Order{}, "ExpiresAt")
+}
+
+// setOrderStatus moves the locked order o to status and records it.
+func (r *Repo) setOrderStatus(ctx context.Context, o *Order, status OrderStatus, actor string) error {
+	if o.Status == status {
+		return nil
+	}
+	if err := r.conn(ctx).Model(o).Update("status", status).Error; err != nil {
+		return err
+	}
+	event := &OrderEvent{OrderID: o.ID, From: o.Status, To: status, Actor: actor}
+	o.Status = status
+	return r.conn(ctx).Create(event).Error
+}
+
+func (r *Repo) ListOrderEvents(ctx context.Context, o *Order) ([]*OrderEvent, error) {
+	events := make([]*OrderEvent, 0)
+	tx := r.conn(ctx).Where("order_id = ?", o.ID).Order("id asc").Find(&events)
+	return events, tx.Error
+}
+
+// reserveStock takes n off the stock of good, failing with ErrOutOfStock
+// if there is not enough. Goods without a stock are unlimited.
+func (r *Repo) reserveStock(ctx context.Context, goodID uint, n uint) error {
+	res := r.conn(ctx).
+		Model(&Good{}).
+		Where("id = ? AND (stock IS NULL OR stock >= ?)", goodID, n).
+		Update("stock", gorm.Expr("stock - ?", n))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrOutOfStock
+	}
+	return nil
+}
+
+func (r *Repo) releaseStock(ctx context.Context, goodID uint, n uint) error {
+	return r.conn(ctx).
+		Model(&Good{}).
+		Where("id = ? AND stock IS NOT NULL", goodID).
+		Update("stock", gorm.Expr("stock + ?", n)).
+		Error
+}
+
+// CancelOrder cancels the pending order o, giving back its coupon and the
+// stock it reserved. A cancelled renewal order stays linked to its
+// subscription, so no other is issued for the same period.
+func (r *Repo) CancelOrder(ctx context.Context, o *Order, actor string) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current := &Order{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(current, o.ID).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != OrderStatusPending {
+			return ErrOrderNotPending
+		}
+		if err := tx.cancelOrder(ctx, current, actor); err != nil {
+			return err
+		}
+		o.Status = current.Status
+		return nil
+	})
+}
+
+func (r *Repo) cancelOrder(ctx context.Context, o *Order, actor string) error {
+	if err := r.setOrderStatus(ctx, o, OrderStatusCancelled, actor); err != nil {
+		return err
+	}
+	if ids := o.couponIDs(); len(ids) > 0 {
+		err := r.conn(ctx).Model(&Coupon{}).Where("id IN ?", ids).Update("used", false).Error
+		if err != nil {
+			return err
+		}
+	}
+	if o.Type == OrderTypeBuyProduct {
+		for _, item := range o.items() {
+			if err := r.releaseStock(ctx, item.GoodID, item.Quantity); err != nil {
+				return err
+			}
+		}
+	}
+	return r.conn(ctx).
+		Model(&PaymentAttempt{}).
+		Where("order_id = ? AND status = ?", o.ID, PaymentAttemptStatusCreated).
+		Update("status", PaymentAttemptStatusClosed).
+		Error
+}
+
+// ExpirePendingOrders cancels the pending orders whose deadline passed
+// before now and returns how many it cancelled.
+func (r *Repo) ExpirePendingOrders(ctx context.Context, now time.Time) (int, error) {
+	orders := make([]*Order, 0)
+	tx := r.conn(ctx).
+		Where("status = ? AND expires_at < ?", OrderStatusPending, now).
+		Order("expires_at asc").
+		Find(&orders)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	expired := 0
+	for _, o := range orders {
+		err := r.CancelOrder(ctx, o, SessionActorSystem)
+		if errors.Is(err, ErrOrderNotPending) {
+			// paid meanwhile
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("order", o.ID).Error("Failed to expire pending order")
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
@@ -0,0 +1,123 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestCommitOrderPaid(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+
+	o := &models.Order{
+		TimestamppedID: "20220301000001",
+		Price:          models.ToPrice(3),
+		Amount:         3,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitOrderPaid(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+
+	u, ok := repo.FindUser(ctx, 1)
+	if !ok {
+		t.Fatal("user 1 not found")
+	}
+	if u.RemainingCredit != models.ToPrice(3) {
+		t.Errorf("remaining credit is %d, want %d", u.RemainingCredit, models.ToPrice(3))
+	}
+
+	paid, err := repo.GetOrderByID(ctx, o.TimestamppedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.Status != models.OrderStatusPaid {
+		t.Errorf("order status is %d, want paid", paid.Status)
+	}
+}
+
+func TestExpirePendingOrders(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"goods": [{"id": 100, "name": "Coffee", "price": 1500, "type": 2, "status": 0, "stock": 2}]
+	}`))
+	ctx := context.Background()
+	coupon := &models.Coupon{UserID: 1, Type: models.CouponTypeDiscountFixedPrice, DiscountData: 500}
+	if err := repo.DB().Create(coupon).Error; err != nil {
+		t.Fatal(err)
+	}
+	stock := func() uint {
+		g, err := repo.GetGoodByID(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *g.Stock
+	}
+
+	past := time.Now().Add(-time.Minute)
+	stale := &models.Order{
+		TimestamppedID: "20220301000020",
+		Price:          models.ToPrice(30),
+		Amount:         2,
+		Type:           models.OrderTypeBuyProduct,
+		GoodID:         100,
+		AffiliateID:    1,
+		CouponID:       &coupon.ID,
+		ExpiresAt:      &past,
+	}
+	if err := repo.CreateOrder(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if got := stock(); got != 0 {
+		t.Errorf("stock after ordering = %d, want 0", got)
+	}
+	again := &models.Order{TimestamppedID: "20220301000021", Price: models.ToPrice(15), Amount: 1, Type: models.OrderTypeBuyProduct, GoodID: 100, AffiliateID: 1}
+	if err := repo.CreateOrder(ctx, again); !errors.Is(err, models.ErrOutOfStock) {
+		t.Errorf("ordering past the stock: error = %v, want ErrOutOfStock", err)
+	}
+	reused := &models.Order{TimestamppedID: "20220301000022", Price: models.ToPrice(3), Amount: 3, Type: models.OrderTypeBuyCredits, GoodID: models.GetCreditGoodID(), AffiliateID: 1, CouponID: &coupon.ID}
+	if err := repo.CreateOrder(ctx, reused); !errors.Is(err, models.ErrCouponUsed) {
+		t.Errorf("reusing a reserved coupon: error = %v, want ErrCouponUsed", err)
+	}
+
+	n, err := repo.ExpirePendingOrders(ctx, time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("ExpirePendingOrders() = %d, %v, want 1", n, err)
+	}
+	if got := stock(); got != 2 {
+		t.Errorf("stock after expiry = %d, want 2", got)
+	}
+	if c, _ := repo.GetCouponById(ctx, coupon.ID); c.Used {
+		t.Error("coupon is still used after expiry")
+	}
+	if err := repo.CommitOrderPaid(ctx, stale); !errors.Is(err, models.ErrOrderNotPending) {
+		t.Errorf("paying an expired order: error = %v, want ErrOrderNotPending", err)
+	}
+	events, err := repo.ListOrderEvents(ctx, stale)
+	if err != nil || len(events) != 1 || events[0].To != models.OrderStatusCancelled {
+		t.Errorf("ListOrderEvents() = %+v, %v", events, err)
+	}
+
+	fresh := &models.Order{TimestamppedID: "20220301000023", Price: models.ToPrice(15), Amount: 1, Type: models.OrderTypeBuyProduct, GoodID: 100, AffiliateID: 1}
+	if err := repo.CreateOrder(ctx, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitOrderPaid(ctx, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := repo.GetGoodByID(ctx, 100); g.SaleCount != 1 || *g.Stock != 1 {
+		t.Errorf("good after sale = %d sold, %d left, want 1, 1", g.SaleCount, *g.Stock)
+	}
+}
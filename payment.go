@@ -0,0 +1,312 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PaymentProvider is a payment gateway.
+type PaymentProvider interface {
+	// Name identifies the provider on the attempts it handles.
+	Name() string
+	// Prepay opens a transaction with the gateway, returning what the
+	// client needs to pay it.
+	Prepay(ctx context.Context, req *PrepayRequest) (*PrepayResult, error)
+	// VerifyCallback authenticates a payment notification sent by the
+	// gateway and decodes it. It fails with ErrPaymentSignature if the
+	// notification cannot be authenticated.
+	VerifyCallback(ctx context.Context, header http.Header, body []byte) (*PaymentResult, error)
+	// Query asks the gateway for the state of a transaction.
+	Query(ctx context.Context, outTradeNo string) (*PaymentResult, error)
+	// Refund returns money paid for a transaction.
+	Refund(ctx context.Context, req *RefundRequest) (*RefundResult, error)
+}
+
+type PrepayRequest struct {
+	OutTradeNo  string
+	Amount      Price
+	Description string
+	// Openid is the payer, for gateways that pay from a WeChat account.
+	Openid string
+	// ExpiresAt, when set, is when the gateway stops accepting payment.
+	ExpiresAt time.Time
+}
+
+type PrepayResult struct {
+	PrepayID string
+	// Params are handed to the client to invoke the payment.
+	Params map[string]string
+}
+
+// PaymentResult is the state of a transaction as reported by the gateway.
+type PaymentResult struct {
+	OutTradeNo    string
+	TransactionID string
+	Status        PaymentAttemptStatus
+	Amount        Price
+	PaidAt        *time.Time
+	FailureReason string
+}
+
+type RefundRequest struct {
+	OutTradeNo  string
+	OutRefundNo string
+	Amount      Price
+	Total       Price
+	Reason      string
+}
+
+type RefundResult struct {
+	RefundID string
+	// Pending is set when the gateway accepted the refund but has not
+	// completed it yet.
+	Pending bool
+}
+
+type PaymentAttemptStatus string
+
+const (
+	PaymentAttemptStatusCreated   PaymentAttemptStatus = "created"
+	PaymentAttemptStatusSucceeded PaymentAttemptStatus = "succeeded"
+	PaymentAttemptStatusFailed    PaymentAttemptStatus = "failed"
+	PaymentAttemptStatusClosed    PaymentAttemptStatus = "closed"
+)
+
+// PaymentAttempt is one try at paying an order through a provider. An
+// order can have several attempts, of which at most one pays it.
+type PaymentAttempt struct {
+	gorm.Model
+	Order         Order                `json:"-"`
+	OrderID       uint                 `gorm:"not null;index" json:"order_id"`
+	Provider      string               `gorm:"type:varchar(32);not null" json:"provider"`
+	OutTradeNo    string               `gorm:"type:varchar(64);not null;uniqueIndex" json:"out_trade_no"`
+	Amount        Price                `gorm:"not null" json:"amount"`
+	Status        PaymentAttemptStatus `gorm:"type:varchar(16);not null;index" json:"status"`
+	PrepayID      string               `gorm:"type:varchar(128)" json:"-"`
+	TransactionID *string              `gorm:"type:varchar(64);uniqueIndex" json:"transaction_id"`
+	PaidAt        *time.Time           `json:"paid_at"`
+	FailureReason string               `gorm:"type:varchar(255)" json:"failure_reason,omitempty"`
+}
+
+// Payable returns what is to be paid for o.
+func (o *Order) Payable() Price {
+	if o.CouponID != nil {
+		return o.DiscountedPrice
+	}
+	return o.Price
+}
+
+func migratePayments(db *gorm.DB) error {
+	return createTables(db, &PaymentAttempt{})
+}
+
+func dropPayments(db *gorm.DB) error {
+	return db.Migrator().DropTable(&PaymentAttempt{})
+}
+
+// StartPayment opens a payment attempt for the pending order o with p.
+// The attempt is kept, as failed, if the provider refuses it.
+func (r *Repo) StartPayment(ctx context.Context, p PaymentProvider, o *Order, openid string) (*PaymentAttempt, *PrepayResult, error) {
+	attempt := &PaymentAttempt{}
+	var expiresAt time.Time
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current := Order{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, o.ID).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != OrderStatusPending {
+			return ErrOrderNotPending
+		}
+		if current.ExpiresAt != nil {
+			expiresAt = *current.ExpiresAt
+		}
+		var n int64
+		if err := tx.conn(ctx).Model(&PaymentAttempt{}).Where("order_id = ?", current.ID).Count(&n).Error; err != nil {
+			return err
+		}
+		*attempt = PaymentAttempt{
+			OrderID:    current.ID,
+			Provider:   p.Name(),
+			OutTradeNo: fmt.Sprintf("%s-%d", current.TimestamppedID, n+1),
+			Amount:     current.Payable(),
+			Status:     PaymentAttemptStatusCreated,
+		}
+		return tx.conn(ctx).Omit(clause.Associations).Create(attempt).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	good, err := r.GetGoodByID(ctx, o.GoodID)
+	description := ""
+	if err == nil {
+		description = good.Name
+	}
+	result, err := p.Prepay(ctx, &PrepayRequest{
+		OutTradeNo:  attempt.OutTradeNo,
+		Amount:      attempt.Amount,
+		Description: description,
+		Openid:      openid,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		attempt.Status = PaymentAttemptStatusFailed
+		attempt.FailureReason = truncate(err.Error(), 255)
+		if uerr := r.conn(ctx).Model(attempt).Updates(map[string]interface{}{
+			"status":         attempt.Status,
+			"failure_reason": attempt.FailureReason,
+		}).Error; uerr != nil {
+			logrus.WithError(uerr).WithField("out_trade_no", attempt.OutTradeNo).Error("Failed to record failed payment attempt")
+		}
+		return attempt, nil, ErrPaymentFailed.Wrap(err)
+	}
+	attempt.PrepayID = result.PrepayID
+	if err := r.conn(ctx).Model(attempt).Update("prepay_id", result.PrepayID).Error; err != nil {
+		return nil, nil, err
+	}
+	return attempt, result, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// HandlePaymentCallback verifies a notification sent by p and applies it.
+// Notifications are idempotent: repeating one, or one for an attempt that
+// has already been settled, changes nothing.
+func (r *Repo) HandlePaymentCallback(ctx context.Context, p PaymentProvider, header http.Header, body []byte) (*PaymentAttempt, error) {
+	result, err := p.VerifyCallback(ctx, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return r.applyPaymentResult(ctx, p, result)
+}
+
+// SyncPayment asks p for the state of attempt and applies it, for when a
+// notification was lost.
+func (r *Repo) SyncPayment(ctx context.Context, p PaymentProvider, attempt *PaymentAttempt) (*PaymentAttempt, error) {
+	result, err := p.Query(ctx, attempt.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status == PaymentAttemptStatusCreated {
+		return attempt, nil
+	}
+	return r.applyPaymentResult(ctx, p, result)
+}
+
+// applyPaymentResult records result on its attempt. A success is recorded
+// even on an attempt closed by the order expiring, since the money was
+// taken all the same. A success for an order that is no longer pending,
+// because it expired or another attempt paid it, is refunded as stray.
+func (r *Repo) applyPaymentResult(ctx context.Context, p PaymentProvider, result *PaymentResult) (*PaymentAttempt, error) {
+	attempt := &PaymentAttempt{}
+	var stray *Refund
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		err := tx.conn(ctx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("out_trade_no = ? AND provider = ?", result.OutTradeNo, p.Name()).
+			First(attempt).
+			Error
+		if err != nil {
+			return err
+		}
+		if attempt.Status == PaymentAttemptStatusSucceeded {
+			return nil
+		}
+		if attempt.Status == PaymentAttemptStatusClosed && result.Status != PaymentAttemptStatusSucceeded {
+			return nil
+		}
+
+		switch result.Status {
+		case PaymentAttemptStatusSucceeded:
+			if result.Amount != attempt.Amount {
+				logrus.WithFields(logrus.Fields{
+					"out_trade_no": attempt.OutTradeNo,
+					"expected":     attempt.Amount,
+					"paid":         result.Amount,
+				}).Error("Paid amount does not match the payment attempt")
+				return ErrPaymentMismatch
+			}
+			paidAt := time.Now()
+			if result.PaidAt != nil {
+				paidAt = *result.PaidAt
+			}
+			attempt.Status = PaymentAttemptStatusSucceeded
+			attempt.TransactionID = &result.TransactionID
+			attempt.PaidAt = &paidAt
+			err := tx.conn(ctx).Model(attempt).Updates(map[string]interface{}{
+				"status":         attempt.Status,
+				"transaction_id": result.TransactionID,
+				"paid_at":        paidAt,
+			}).Error
+			if err != nil {
+				return err
+			}
+			order := &Order{}
+			err = tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(order, attempt.OrderID).Error
+			if err != nil {
+				return err
+			}
+			if order.Status == OrderStatusPending {
+				return tx.CommitOrderPaid(ctx, order)
+			}
+			// the money was taken for an order that expired meanwhile, or
+			// that another attempt paid already
+			reason := "order paid by another payment"
+			if order.Status == OrderStatusCancelled {
+				reason = "order cancelled before payment arrived"
+			}
+			logrus.WithField("out_trade_no", attempt.OutTradeNo).Warn("Refunding payment of an order that is no longer pending: " + reason)
+			stray = &Refund{
+				OrderID:          &order.ID,
+				UserID:           order.AffiliateID,
+				Amount:           attempt.Amount,
+				Reason:           reason,
+				PaymentAttemptID: &attempt.ID,
+				Stray:            true,
+				RequestedBy:      SessionActorSystem,
+			}
+			return tx.createRefund(ctx, stray)
+		case PaymentAttemptStatusFailed, PaymentAttemptStatusClosed:
+			attempt.Status = result.Status
+			attempt.FailureReason = truncate(result.FailureReason, 255)
+			return tx.conn(ctx).Model(attempt).Updates(map[string]interface{}{
+				"status":         attempt.Status,
+				"failure_reason": attempt.FailureReason,
+			}).Error
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidArgument.Wrap(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stray != nil {
+		// a refund the gateway refuses is left failed, with the payment
+		// still on record
+		if _, err := r.ProcessRefund(ctx, p, stray); err != nil {
+			logrus.WithError(err).WithField("refund", stray.ID).Error("Failed to refund stray payment")
+		}
+	}
+	return attempt, nil
+}
+
+func (r *Repo) ListPaymentAttempts(ctx context.Context, o *Order) ([]*PaymentAttempt, error) {
+	attempts := make([]*PaymentAttempt, 0)
+	tx := r.conn(ctx).Where("order_id = ?", o.ID).Order("id asc").Find(&attempts)
+	return attempts, tx.Error
+}
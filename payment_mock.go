@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const mockPaymentSignatureHeader = "X-Mock-Signature"
+
+// MockPaymentProvider is an in-process gateway for tests and local
+// development. Transactions are paid or failed by calling Pay or Fail,
+// which return the notification the gateway would send.
+type MockPaymentProvider struct {
+	// Secret signs notifications.
+	Secret []byte
+	// PrepayErr, when set, is returned by Prepay.
+	PrepayErr error
+
+	mu           sync.Mutex
+	seq          int
+	transactions map[string]*PaymentResult
+	expires      map[string]time.Time
+	refunds      map[string]*RefundRequest
+}
+
+func NewMockPaymentProvider(secret []byte) *MockPaymentProvider {
+	return &MockPaymentProvider{
+		Secret:       secret,
+		transactions: make(map[string]*PaymentResult),
+		expires:      make(map[string]time.Time),
+		refunds:      make(map[string]*RefundRequest),
+	}
+}
+
+func (m *MockPaymentProvider) Name() string {
+	return "mock"
+}
+
+func (m *MockPaymentProvider) Prepay(ctx context.Context, req *PrepayRequest) (*PrepayResult, error) {
+	if m.PrepayErr != nil {
+		return nil, m.PrepayErr
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.transactions[req.OutTradeNo]; ok {
+		return nil, fmt.Errorf("mock: duplicate out_trade_no %s", req.OutTradeNo)
+	}
+	m.seq++
+	m.transactions[req.OutTradeNo] = &PaymentResult{
+		OutTradeNo: req.OutTradeNo,
+		Status:     PaymentAttemptStatusCreated,
+		Amount:     req.Amount,
+	}
+	if !req.ExpiresAt.IsZero() {
+		m.expires[req.OutTradeNo] = req.ExpiresAt
+	}
+	prepayID := fmt.Sprintf("mock-prepay-%d", m.seq)
+	return &PrepayResult{
+		PrepayID: prepayID,
+		Params:   map[string]string{"prepay_id": prepayID},
+	}, nil
+}
+
+// Pay settles the transaction outTradeNo with amount, which may differ
+// from what was asked, and returns the notification. Like a real gateway
+// it refuses transactions past their expiry.
+func (m *MockPaymentProvider) Pay(outTradeNo string, amount Price) (http.Header, []byte, error) {
+	m.mu.Lock()
+	t, ok := m.transactions[outTradeNo]
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil, fmt.Errorf("mock: unknown out_trade_no %s", outTradeNo)
+	}
+	paidAt := time.Now()
+	if expires, ok := m.expires[outTradeNo]; ok && paidAt.After(expires) {
+		m.mu.Unlock()
+		return nil, nil, fmt.Errorf("mock: %s has expired", outTradeNo)
+	}
+	m.seq++
+	t.Status = PaymentAttemptStatusSucceeded
+	t.TransactionID = fmt.Sprintf("mock-txn-%d", m.seq)
+	t.Amount = amount
+	t.PaidAt = &paidAt
+	result := *t
+	m.mu.Unlock()
+	return m.notify(&result)
+}
+
+// Fail declines the transaction outTradeNo and returns the notification.
+func (m *MockPaymentProvider) Fail(outTradeNo, reason string) (http.Header, []byte, error) {
+	m.mu.Lock()
+	t, ok := m.transactions[outTradeNo]
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil, fmt.Errorf("mock: unknown out_trade_no %s", outTradeNo)
+	}
+	t.Status = PaymentAttemptStatusFailed
+	t.FailureReason = reason
+	result := *t
+	m.mu.Unlock()
+	return m.notify(&result)
+}
+
+func (m *MockPaymentProvider) notify(result *PaymentResult) (http.Header, []byte, error) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := http.Header{}
+	header.Set(mockPaymentSignatureHeader, m.sign(body))
+	return header, body, nil
+}
+
+func (m *MockPaymentProvider) sign(body []byte) string {
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *MockPaymentProvider) VerifyCallback(ctx context.Context, header http.Header, body []byte) (*PaymentResult, error) {
+	signature, err := hex.DecodeString(header.Get(mockPaymentSignatureHeader))
+	if err != nil {
+		return nil, ErrPaymentSignature.Wrap(err)
+	}
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrPaymentSignature
+	}
+	result := &PaymentResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, ErrBadRequest.Wrap(err)
+	}
+	return result, nil
+}
+
+func (m *MockPaymentProvider) Query(ctx context.Context, outTradeNo string) (*PaymentResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.transactions[outTradeNo]
+	if !ok {
+		return nil, fmt.Errorf("mock: unknown out_trade_no %s", outTradeNo)
+	}
+	result := *t
+	return &result, nil
+}
+
+func (m *MockPaymentProvider) Refund(ctx context.Context, req *RefundRequest) (*RefundResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.transactions[req.OutTradeNo]
+	if !ok || t.Status != PaymentAttemptStatusSucceeded {
+		return nil, fmt.Errorf("mock: %s was not paid", req.OutTradeNo)
+	}
+	if prev, ok := m.refunds[req.OutRefundNo]; ok {
+		if prev.Amount != req.Amount {
+			return nil, fmt.Errorf("mock: refund %s was requested with another amount", req.OutRefundNo)
+		}
+	} else {
+		var refunded Price
+		for _, r := range m.refunds {
+			if r.OutTradeNo == req.OutTradeNo {
+				refunded += r.Amount
+			}
+		}
+		if refunded+req.Amount > t.Amount {
+			return nil, fmt.Errorf("mock: refunds exceed the amount paid for %s", req.OutTradeNo)
+		}
+		copied := *req
+		m.refunds[req.OutRefundNo] = &copied
+	}
+	return &RefundResult{RefundID: "mock-refund-" + req.OutRefundNo}, nil
+}
@@ -0,0 +1,398 @@
+package models_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestPaymentCallback(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	provider := models.NewMockPaymentProvider([]byte("secret"))
+
+	o := &models.Order{
+		TimestamppedID: "20220301000003",
+		Price:          models.ToPrice(5),
+		Amount:         5,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.PrepayErr = errors.New("gateway down")
+	failed, _, err := repo.StartPayment(ctx, provider, o, "openid")
+	if !errors.Is(err, models.ErrPaymentFailed) || failed.Status != models.PaymentAttemptStatusFailed {
+		t.Errorf("StartPayment() with the gateway down = %v, %v", failed, err)
+	}
+	provider.PrepayErr = nil
+
+	attempt, prepay, err := repo.StartPayment(ctx, provider, o, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepay.PrepayID == "" || attempt.Amount != models.ToPrice(5) {
+		t.Errorf("attempt = %+v, prepay = %+v", attempt, prepay)
+	}
+
+	header, body, err := provider.Pay(attempt.OutTradeNo, models.ToPrice(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := http.Header{}
+	forged.Set("X-Mock-Signature", "00")
+	if _, err := repo.HandlePaymentCallback(ctx, provider, forged, body); !errors.Is(err, models.ErrPaymentSignature) {
+		t.Errorf("forged callback: error = %v, want ErrPaymentSignature", err)
+	}
+	for i := 0; i < 3; i++ {
+		settled, err := repo.HandlePaymentCallback(ctx, provider, header, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settled.Status != models.PaymentAttemptStatusSucceeded || settled.TransactionID == nil {
+			t.Errorf("attempt = %+v, want succeeded", settled)
+		}
+	}
+	if u, _ := repo.FindUser(ctx, 1); u.RemainingCredit != models.ToPrice(5) {
+		t.Errorf("credit after repeated callbacks = %d, want %d", u.RemainingCredit, models.ToPrice(5))
+	}
+	if _, _, err := repo.StartPayment(ctx, provider, o, "openid"); !errors.Is(err, models.ErrOrderNotPending) {
+		t.Errorf("paying a paid order: error = %v, want ErrOrderNotPending", err)
+	}
+
+	short := &models.Order{
+		TimestamppedID: "20220301000004",
+		Price:          models.ToPrice(5),
+		Amount:         5,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, short); err != nil {
+		t.Fatal(err)
+	}
+	attempt, _, err = repo.StartPayment(ctx, provider, short, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, _ = provider.Pay(attempt.OutTradeNo, models.ToPrice(1))
+	if _, err := repo.HandlePaymentCallback(ctx, provider, header, body); !errors.Is(err, models.ErrPaymentMismatch) {
+		t.Errorf("short payment: error = %v, want ErrPaymentMismatch", err)
+	}
+	if u, _ := repo.FindUser(ctx, 1); u.RemainingCredit != models.ToPrice(5) {
+		t.Errorf("short payment was credited")
+	}
+
+	late := &models.Order{
+		TimestamppedID: "20220301000005",
+		Price:          models.ToPrice(5),
+		Amount:         5,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DB().Model(late).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	attempt, _, err = repo.StartPayment(ctx, provider, late, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := provider.Pay(attempt.OutTradeNo, models.ToPrice(5)); err == nil {
+		t.Error("the gateway took payment past the order deadline")
+	}
+}
+
+func TestPaymentAfterExpiry(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	provider := models.NewMockPaymentProvider([]byte("secret"))
+
+	o := &models.Order{
+		TimestamppedID: "20220301000006",
+		Price:          models.ToPrice(5),
+		Amount:         5,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	attempt, _, err := repo.StartPayment(ctx, provider, o, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sweeper runs before the gateway's notification arrives
+	if n, err := repo.ExpirePendingOrders(ctx, o.ExpiresAt.Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("ExpirePendingOrders() = %d, %v, want 1", n, err)
+	}
+	header, body, err := provider.Pay(attempt.OutTradeNo, models.ToPrice(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settled, err := repo.HandlePaymentCallback(ctx, provider, header, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settled.Status != models.PaymentAttemptStatusSucceeded || settled.TransactionID == nil {
+		t.Errorf("attempt = %+v, want succeeded with its transaction", settled)
+	}
+	if _, err := repo.HandlePaymentCallback(ctx, provider, header, body); err != nil {
+		t.Errorf("repeated callback: %v", err)
+	}
+
+	current, err := repo.GetOrderByID(ctx, o.TimestamppedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Status != models.OrderStatusCancelled {
+		t.Errorf("order status = %d, want cancelled", current.Status)
+	}
+	alice, _ := repo.FindUser(ctx, 1)
+	if alice.RemainingCredit != 0 {
+		t.Errorf("credit = %d, want 0", alice.RemainingCredit)
+	}
+	refunds, err := repo.ListUserRefunds(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 1 || !refunds[0].Stray || refunds[0].Status != models.RefundStatusSucceeded || refunds[0].Amount != models.ToPrice(5) {
+		t.Errorf("refunds = %+v, want one succeeded stray refund of the payment", refunds)
+	}
+}
+
+func TestPaymentOfPaidOrder(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	provider := models.NewMockPaymentProvider([]byte("secret"))
+
+	o := &models.Order{
+		TimestamppedID: "20220301000007",
+		Price:          models.ToPrice(5),
+		Amount:         5,
+		Type:           models.OrderTypeBuyCredits,
+		GoodID:         models.GetCreditGoodID(),
+		AffiliateID:    1,
+	}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	// the client retries before the first payment is confirmed
+	first, _, err := repo.StartPayment(ctx, provider, o, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := repo.StartPayment(ctx, provider, o, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, attempt := range []*models.PaymentAttempt{first, second} {
+		header, body, err := provider.Pay(attempt.OutTradeNo, models.ToPrice(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.HandlePaymentCallback(ctx, provider, header, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice, _ := repo.FindUser(ctx, 1)
+	if alice.RemainingCredit != models.ToPrice(5) {
+		t.Errorf("credit = %d, want %d", alice.RemainingCredit, models.ToPrice(5))
+	}
+	refunds, err := repo.ListUserRefunds(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 1 || !refunds[0].Stray || refunds[0].PaymentAttemptID == nil || *refunds[0].PaymentAttemptID != second.ID {
+		t.Errorf("refunds = %+v, want one stray refund of the second payment", refunds)
+	}
+	current, _ := repo.GetOrderByID(ctx, o.TimestamppedID)
+	if current.Status != models.OrderStatusPaid {
+		t.Errorf("order status = %d, want paid", current.Status)
+	}
+}
+
+type wechatPayFixture struct {
+	merchant, platform *rsa.PrivateKey
+	apiKey             []byte
+	now                time.Time
+}
+
+func newWeChatPayFixture(t *testing.T) *wechatPayFixture {
+	t.Helper()
+	merchant, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wechatPayFixture{
+		merchant: merchant,
+		platform: platform,
+		apiKey:   []byte("0123456789abcdef0123456789abcdef"),
+		now:      time.Unix(1646096400, 0),
+	}
+}
+
+func (f *wechatPayFixture) provider(baseURL string) *models.WeChatPayProvider {
+	return &models.WeChatPayProvider{
+		AppID:        "wx-app",
+		MchID:        "1900000001",
+		SerialNo:     "merchant-serial",
+		PrivateKey:   f.merchant,
+		PlatformKeys: map[string]*rsa.PublicKey{"platform-serial": &f.platform.PublicKey},
+		APIv3Key:     f.apiKey,
+		NotifyURL:    "https://example.com/notify",
+		BaseURL:      baseURL,
+		Clock:        models.ClockFunc(func() time.Time { return f.now }),
+	}
+}
+
+// signed returns the platform headers for body, as sent at ts.
+func (f *wechatPayFixture) signed(t *testing.T, ts time.Time, body []byte) http.Header {
+	t.Helper()
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	nonce := "nonce"
+	hashed := sha256.Sum256([]byte(timestamp + "\n" + nonce + "\n" + string(body) + "\n"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.platform, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set("Wechatpay-Serial", "platform-serial")
+	header.Set("Wechatpay-Timestamp", timestamp)
+	header.Set("Wechatpay-Nonce", nonce)
+	header.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+	return header
+}
+
+func (f *wechatPayFixture) notification(t *testing.T, transaction interface{}) []byte {
+	t.Helper()
+	plaintext, err := json.Marshal(transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(f.apiKey)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := "0123456789ab"
+	n := models.WeChatPayNotification{ID: "evt-1", EventType: "TRANSACTION.SUCCESS", ResourceType: "encrypt-resource"}
+	n.Resource.Algorithm = "AEAD_AES_256_GCM"
+	n.Resource.AssociatedData = "transaction"
+	n.Resource.Nonce = nonce
+	n.Resource.Ciphertext = base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plaintext, []byte("transaction")))
+	body, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestWeChatPayCallback(t *testing.T) {
+	f := newWeChatPayFixture(t)
+	w := f.provider("")
+	ctx := context.Background()
+
+	body := f.notification(t, map[string]interface{}{
+		"out_trade_no":   "20220301000001-1",
+		"transaction_id": "4200000001",
+		"trade_state":    "SUCCESS",
+		"success_time":   "2022-03-01T09:00:00+08:00",
+		"amount":         map[string]interface{}{"total": 500},
+	})
+
+	result, err := w.VerifyCallback(ctx, f.signed(t, f.now, body), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != models.PaymentAttemptStatusSucceeded || result.Amount != 500 || result.TransactionID != "4200000001" {
+		t.Errorf("result = %+v", result)
+	}
+
+	tampered := append([]byte{}, body...)
+	tampered[len(tampered)-2] = ' '
+	if _, err := w.VerifyCallback(ctx, f.signed(t, f.now, body), tampered); !errors.Is(err, models.ErrPaymentSignature) {
+		t.Errorf("tampered body: error = %v, want ErrPaymentSignature", err)
+	}
+	if _, err := w.VerifyCallback(ctx, f.signed(t, f.now.Add(-time.Hour), body), body); !errors.Is(err, models.ErrPaymentSignature) {
+		t.Errorf("replayed notification: error = %v, want ErrPaymentSignature", err)
+	}
+}
+
+func TestWeChatPayPrepay(t *testing.T) {
+	f := newWeChatPayFixture(t)
+	auth := regexp.MustCompile(`^WECHATPAY2-SHA256-RSA2048 mchid="1900000001",nonce_str="(\w+)",signature="([^"]+)",timestamp="(\d+)",serial_no="merchant-serial"$`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		m := auth.FindStringSubmatch(req.Header.Get("Authorization"))
+		if m == nil {
+			t.Errorf("malformed authorization %q", req.Header.Get("Authorization"))
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.StdEncoding.DecodeString(m[2])
+		hashed := sha256.Sum256([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + m[3] + "\n" + m[1] + "\n" + string(body) + "\n"))
+		if err := rsa.VerifyPKCS1v15(&f.merchant.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+			t.Errorf("request signature: %v", err)
+		}
+
+		in := map[string]interface{}{}
+		_ = json.Unmarshal(body, &in)
+		if in["out_trade_no"] != "20220301000001-1" || in["amount"].(map[string]interface{})["total"] != float64(500) {
+			t.Errorf("request = %s", body)
+		}
+		if in["time_expire"] != "2022-03-01T09:15:00+08:00" {
+			t.Errorf("time_expire = %v, want the order deadline", in["time_expire"])
+		}
+		resp := []byte(`{"prepay_id":"wx-prepay-1"}`)
+		for k, v := range f.signed(t, f.now, resp) {
+			rw.Header()[k] = v
+		}
+		_, _ = rw.Write(resp)
+	}))
+	defer server.Close()
+
+	result, err := f.provider(server.URL).Prepay(context.Background(), &models.PrepayRequest{
+		OutTradeNo:  "20220301000001-1",
+		Amount:      500,
+		Description: "Credit",
+		Openid:      "openid",
+		ExpiresAt:   time.Date(2022, 3, 1, 1, 15, 0, 0, time.UTC).In(time.FixedZone("CST", 8*3600)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PrepayID != "wx-prepay-1" || result.Params["package"] != "prepay_id=wx-prepay-1" {
+		t.Errorf("result = %+v", result)
+	}
+}
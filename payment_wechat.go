@@ -0,0 +1,334 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	wechatPayBaseURL = "https://api.mch.weixin.qq.com"
+	// notifications older than this are rejected as replays
+	wechatPayMaxClockSkew = 5 * time.Minute
+	// wechatPayTimeLayout is RFC 3339 with the offset always numeric, as
+	// the gateway does not take "Z"
+	wechatPayTimeLayout = "2006-01-02T15:04:05-07:00"
+)
+
+// WeChatPayProvider pays through WeChat Pay API v3 with JSAPI (mini
+// program) transactions.
+type WeChatPayProvider struct {
+	AppID string
+	MchID string
+	// SerialNo is the serial number of the merchant certificate whose
+	// key is PrivateKey.
+	SerialNo   string
+	PrivateKey *rsa.PrivateKey
+	// PlatformKeys are the WeChat Pay platform public keys, by
+	// certificate serial number, that responses and notifications are
+	// signed with.
+	PlatformKeys map[string]*rsa.PublicKey
+	// APIv3Key decrypts notifications.
+	APIv3Key  []byte
+	NotifyURL string
+
+	BaseURL string
+	Client  *http.Client
+	Clock   Clock
+}
+
+func (w *WeChatPayProvider) Name() string {
+	return "wechat_pay"
+}
+
+func (w *WeChatPayProvider) now() time.Time {
+	if w.Clock != nil {
+		return w.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (w *WeChatPayProvider) sign(message string) (string, error) {
+	hashed := sha256.Sum256([]byte(message))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, w.PrivateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verify checks the platform signature of a response or notification.
+func (w *WeChatPayProvider) verify(header http.Header, body []byte) error {
+	serial := header.Get("Wechatpay-Serial")
+	key, ok := w.PlatformKeys[serial]
+	if !ok {
+		return ErrPaymentSignature.Wrap(fmt.Errorf("wechat pay: unknown platform certificate %q", serial))
+	}
+	timestamp := header.Get("Wechatpay-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrPaymentSignature.Wrap(err)
+	}
+	if skew := w.now().Sub(time.Unix(ts, 0)); skew > wechatPayMaxClockSkew || skew < -wechatPayMaxClockSkew {
+		return ErrPaymentSignature.Wrap(fmt.Errorf("wechat pay: timestamp %s is out of range", timestamp))
+	}
+	sig, err := base64.StdEncoding.DecodeString(header.Get("Wechatpay-Signature"))
+	if err != nil {
+		return ErrPaymentSignature.Wrap(err)
+	}
+	message := timestamp + "\n" + header.Get("Wechatpay-Nonce") + "\n" + string(body) + "\n"
+	hashed := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return ErrPaymentSignature.Wrap(err)
+	}
+	return nil
+}
+
+type wechatPayError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *wechatPayError) Error() string {
+	return fmt.Sprintf("wechat pay: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (w *WeChatPayProvider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	base := w.BaseURL
+	if base == "" {
+		base = wechatPayBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	nonce := randomToken(16)
+	timestamp := strconv.FormatInt(w.now().Unix(), 10)
+	sig, err := w.sign(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + string(body) + "\n")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		w.MchID, nonce, sig, timestamp, w.SerialNo,
+	))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := &wechatPayError{Status: resp.StatusCode}
+		_ = json.Unmarshal(respBody, e)
+		return e
+	}
+	if err := w.verify(resp.Header, respBody); err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+type wechatPayAmount struct {
+	Total    int64  `json:"total"`
+	Refund   int64  `json:"refund,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+func (w *WeChatPayProvider) Prepay(ctx context.Context, req *PrepayRequest) (*PrepayResult, error) {
+	in := map[string]interface{}{
+		"appid":        w.AppID,
+		"mchid":        w.MchID,
+		"description":  req.Description,
+		"out_trade_no": req.OutTradeNo,
+		"notify_url":   w.NotifyURL,
+		"amount":       wechatPayAmount{Total: int64(req.Amount), Currency: "CNY"},
+		"payer":        map[string]string{"openid": req.Openid},
+	}
+	if !req.ExpiresAt.IsZero() {
+		in["time_expire"] = req.ExpiresAt.Format(wechatPayTimeLayout)
+	}
+	out := struct {
+		PrepayID string `json:"prepay_id"`
+	}{}
+	if err := w.do(ctx, http.MethodPost, "/v3/pay/transactions/jsapi", in, &out); err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(w.now().Unix(), 10)
+	nonce := randomToken(16)
+	pkg := "prepay_id=" + out.PrepayID
+	paySign, err := w.sign(w.AppID + "\n" + timestamp + "\n" + nonce + "\n" + pkg + "\n")
+	if err != nil {
+		return nil, err
+	}
+	return &PrepayResult{
+		PrepayID: out.PrepayID,
+		Params: map[string]string{
+			"appId":     w.AppID,
+			"timeStamp": timestamp,
+			"nonceStr":  nonce,
+			"package":   pkg,
+			"signType":  "RSA",
+			"paySign":   paySign,
+		},
+	}, nil
+}
+
+type wechatPayTransaction struct {
+	OutTradeNo     string          `json:"out_trade_no"`
+	TransactionID  string          `json:"transaction_id"`
+	TradeState     string          `json:"trade_state"`
+	TradeStateDesc string          `json:"trade_state_desc"`
+	SuccessTime    string          `json:"success_time"`
+	Amount         wechatPayAmount `json:"amount"`
+}
+
+func (t *wechatPayTransaction) result() *PaymentResult {
+	result := &PaymentResult{
+		OutTradeNo:    t.OutTradeNo,
+		TransactionID: t.TransactionID,
+		Amount:        Price(t.Amount.Total),
+	}
+	switch t.TradeState {
+	case "SUCCESS":
+		result.Status = PaymentAttemptStatusSucceeded
+		if paidAt, err := time.Parse(time.RFC3339, t.SuccessTime); err == nil {
+			result.PaidAt = &paidAt
+		}
+	case "CLOSED", "REVOKED":
+		result.Status = PaymentAttemptStatusClosed
+		result.FailureReason = t.TradeStateDesc
+	case "PAYERROR":
+		result.Status = PaymentAttemptStatusFailed
+		result.FailureReason = t.TradeStateDesc
+	default:
+		// NOTPAY, USERPAYING
+		result.Status = PaymentAttemptStatusCreated
+	}
+	return result
+}
+
+// WeChatPayNotification is the envelope of a WeChat Pay notification.
+type WeChatPayNotification struct {
+	ID           string `json:"id"`
+	EventType    string `json:"event_type"`
+	ResourceType string `json:"resource_type"`
+	Resource     struct {
+		Algorithm      string `json:"algorithm"`
+		Ciphertext     string `json:"ciphertext"`
+		AssociatedData string `json:"associated_data"`
+		Nonce          string `json:"nonce"`
+	} `json:"resource"`
+}
+
+func (w *WeChatPayProvider) VerifyCallback(ctx context.Context, header http.Header, body []byte) (*PaymentResult, error) {
+	if err := w.verify(header, body); err != nil {
+		return nil, err
+	}
+	n := WeChatPayNotification{}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, ErrBadRequest.Wrap(err)
+	}
+	if n.Resource.Algorithm != "AEAD_AES_256_GCM" {
+		return nil, ErrBadRequest.Wrap(fmt.Errorf("wechat pay: unsupported algorithm %q", n.Resource.Algorithm))
+	}
+	plaintext, err := w.decrypt(n.Resource.Nonce, n.Resource.AssociatedData, n.Resource.Ciphertext)
+	if err != nil {
+		return nil, ErrPaymentSignature.Wrap(err)
+	}
+	t := wechatPayTransaction{}
+	if err := json.Unmarshal(plaintext, &t); err != nil {
+		return nil, ErrBadRequest.Wrap(err)
+	}
+	return t.result(), nil
+}
+
+func (w *WeChatPayProvider) decrypt(nonce, associatedData, ciphertext string) ([]byte, error) {
+	block, err := aes.NewCipher(w.APIv3Key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, []byte(nonce), data, []byte(associatedData))
+}
+
+func (w *WeChatPayProvider) Query(ctx context.Context, outTradeNo string) (*PaymentResult, error) {
+	t := wechatPayTransaction{}
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(outTradeNo) + "?mchid=" + url.QueryEscape(w.MchID)
+	if err := w.do(ctx, http.MethodGet, path, nil, &t); err != nil {
+		return nil, err
+	}
+	return t.result(), nil
+}
+
+func (w *WeChatPayProvider) Refund(ctx context.Context, req *RefundRequest) (*RefundResult, error) {
+	in := map[string]interface{}{
+		"out_trade_no":  req.OutTradeNo,
+		"out_refund_no": req.OutRefundNo,
+		"reason":        req.Reason,
+		"amount": wechatPayAmount{
+			Refund:   int64(req.Amount),
+			Total:    int64(req.Total),
+			Currency: "CNY",
+		},
+	}
+	out := struct {
+		RefundID string `json:"refund_id"`
+		Status   string `json:"status"`
+	}{}
+	if err := w.do(ctx, http.MethodPost, "/v3/refund/domestic/refunds", in, &out); err != nil {
+		return nil, err
+	}
+	switch out.Status {
+	case "SUCCESS":
+		return &RefundResult{RefundID: out.RefundID}, nil
+	case "PROCESSING":
+		return &RefundResult{RefundID: out.RefundID, Pending: true}, nil
+	}
+	return nil, fmt.Errorf("wechat pay: refund %s is %s", req.OutRefundNo, out.Status)
+}
@@ -4,6 +4,8 @@ type ProductType string
 
 const (
 	ProductTypeSubscriptionPlan ProductType = "SubscriptionPlan"
+	ProductTypeCredits          ProductType = "Credits"
+	ProductTypePhysical         ProductType = "PhysicalProduct"
 )
 
 // IProduct 接口，所有商品都应该实现这个接口
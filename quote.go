@@ -0,0 +1,334 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// QuoteValidity is how long a quote can be ordered at its prices.
+var QuoteValidity = 10 * time.Minute
+
+// QuoteItem asks for Quantity of a good.
+type QuoteItem struct {
+	GoodID   uint `json:"good_id"`
+	Quantity uint `json:"quantity"`
+}
+
+// QuoteLine is what one item of a quote costs.
+type QuoteLine struct {
+	GoodID        uint        `json:"good_id"`
+	Name          string      `json:"name"`
+	Type          ProductType `json:"type"`
+	Quantity      uint        `json:"quantity"`
+	UnitBasePrice Price       `json:"unit_base_price"`
+	UnitSalePrice Price       `json:"unit_sale_price"`
+	BasePrice     Price       `json:"base_price"`
+	SalePrice     Price       `json:"sale_price"`
+	CouponIDs     []uint      `json:"coupon_ids,omitempty"`
+	Discount      Price       `json:"discount"`
+	Price         Price       `json:"price"`
+}
+
+// Quote is the price of a set of goods for a user, as shown to them
+// before they order.
+type Quote struct {
+	UserID uint `json:"user_id"`
+	// SessionID is the session the goods are bought for, if any.
+	SessionID *uint       `json:"session_id,omitempty"`
+	Lines     []QuoteLine `json:"lines"`
+	CouponIDs []uint      `json:"coupon_ids"`
+	BasePrice Price       `json:"base_price"`
+	SalePrice Price       `json:"sale_price"`
+	Discount  Price       `json:"discount"`
+	Total     Price       `json:"total"`
+	QuotedAt  time.Time   `json:"quoted_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+func (q Quote) Value() (driver.Value, error) {
+	return json.Marshal(q)
+}
+
+func (q *Quote) Scan(v interface{}) error {
+	return scanJSON(v, q)
+}
+
+// quotedLine is a quantity of a good, priced as one product so coupon
+// restrictions and discounts apply to the whole line.
+type quotedLine struct {
+	good     *Good
+	quantity uint
+}
+
+func (l *quotedLine) GetName() string      { return l.good.GetName() }
+func (l *quotedLine) GetBasePrice() Price  { return l.good.GetBasePrice() * Price(l.quantity) }
+func (l *quotedLine) GetSalePrice() Price  { return l.good.GetSalePrice() * Price(l.quantity) }
+func (l *quotedLine) IsOnSale() bool       { return l.good.IsOnSale() }
+func (l *quotedLine) GetType() ProductType { return l.good.GetType() }
+func (l *quotedLine) GetID() uint          { return l.good.GetID() }
+
+func (l *quotedLine) ApplyCoupon(coupon *Coupon, u *User) (Price, Price, error) {
+	price := l.GetSalePrice()
+	discount, err := coupon.Discount(l, u)
+	if err != nil {
+		return price, price, err
+	}
+	return price, price - discount, nil
+}
+
+func migrateQuotes(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasColumn(&Good{}, "SalePrice") {
+		if err := m.AddColumn(&Good{}, "SalePrice"); err != nil {
+			return err
+		}
+	}
+	if !m.HasColumn(&Order{}, "Quote") {
+		if err := m.AddColumn(&Order{}, "Quote"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropQuotes(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropColumn(&Order{}, "Quote"); err != nil {
+		return err
+	}
+	return m.DropColumn(&Good{}, "SalePrice")
+}
+
+// Quote prices items for u with the coupons given, which must all be
+// usable together. s, if not nil, is the session the items are bought
+// for. Credits and subscription plans are ordered on their own; only
+// physical products can share a cart.
+func (r *Repo) Quote(ctx context.Context, u *User, s *Session, items []QuoteItem, couponIDs []uint) (*Quote, error) {
+	products, err := r.cartProducts(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	if len(products) > 1 {
+		for _, p := range products {
+			if p.GetType() != ProductTypePhysical {
+				return nil, ErrInvalidArgument
+			}
+		}
+	}
+	now := time.Now()
+	base, err := r.couponContext(ctx, u, s, now)
+	if err != nil {
+		return nil, err
+	}
+	q := &Quote{
+		UserID:    u.ID,
+		Lines:     make([]QuoteLine, 0, len(items)),
+		CouponIDs: make([]uint, 0, len(couponIDs)),
+		QuotedAt:  now,
+		ExpiresAt: now.Add(QuoteValidity),
+	}
+	for _, p := range products {
+		l := p.(*quotedLine)
+		q.Lines = append(q.Lines, QuoteLine{
+			GoodID:        l.good.ID,
+			Name:          l.good.Name,
+			Type:          l.GetType(),
+			Quantity:      l.quantity,
+			UnitBasePrice: l.good.GetBasePrice(),
+			UnitSalePrice: l.good.GetSalePrice(),
+			BasePrice:     l.GetBasePrice(),
+			SalePrice:     l.GetSalePrice(),
+			Price:         l.GetSalePrice(),
+		})
+	}
+
+	coupons := make([]*Coupon, 0, len(couponIDs))
+	for _, id := range couponIDs {
+		for _, c := range coupons {
+			if c.ID == id {
+				return nil, ErrInvalidArgument
+			}
+		}
+		coupon, err := r.GetCouponById(ctx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidArgument.Wrap(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if coupon.UserID != u.ID {
+			return nil, ErrCouponUser
+		}
+		if coupon.Used {
+			return nil, ErrCouponUsed
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	if s != nil {
+		q.SessionID = &s.ID
+	}
+	if len(coupons) > 0 {
+		comb := solveCoupons(products, coupons, base, true)
+		if comb == nil {
+			return nil, couponsUnusable(products, coupons, base)
+		}
+		for _, a := range comb.Allocations {
+			line := &q.Lines[a.Line]
+			line.CouponIDs = append(line.CouponIDs, a.CouponID)
+			line.Discount += a.Discount
+			line.Price -= a.Discount
+			q.CouponIDs = append(q.CouponIDs, a.CouponID)
+		}
+	}
+
+	for _, line := range q.Lines {
+		q.BasePrice += line.BasePrice
+		q.SalePrice += line.SalePrice
+		q.Discount += line.Discount
+		q.Total += line.Price
+	}
+	return q, nil
+}
+
+// couponsUnusable explains why coupons cannot all be used on products:
+// the first coupon no line meets the restrictions of, or else the
+// stacking rules.
+func couponsUnusable(products []IProduct, coupons []*Coupon, base *CouponContext) error {
+	for _, coupon := range coupons {
+		var reason error
+		for _, p := range products {
+			c := *base
+			c.Product = p
+			reason = coupon.IfSatisfyRestrictions(&c)
+			if reason == nil {
+				break
+			}
+		}
+		if reason != nil {
+			return reason
+		}
+	}
+	return ErrCouponStacking
+}
+
+// isFirstOrder reports whether u never paid for an order.
+func (r *Repo) isFirstOrder(ctx context.Context, u *User) (bool, error) {
+	var n int64
+	err := r.conn(ctx).
+		Model(&Order{}).
+		Where("affiliate_id = ? AND status IN ?", u.ID, []OrderStatus{OrderStatusPaid, OrderStatusPartiallyRefunded, OrderStatusRefunded}).
+		Count(&n).
+		Error
+	return n == 0, err
+}
+
+// couponIDs returns the coupons o uses.
+func (o *Order) couponIDs() []uint {
+	if o.Quote != nil {
+		return o.Quote.CouponIDs
+	}
+	if o.CouponID != nil {
+		return []uint{*o.CouponID}
+	}
+	return nil
+}
+
+// items returns the goods o is for.
+func (o *Order) items() []QuoteItem {
+	if o.Quote == nil {
+		return []QuoteItem{{GoodID: o.GoodID, Quantity: o.quantity()}}
+	}
+	items := make([]QuoteItem, 0, len(o.Quote.Lines))
+	for _, line := range o.Quote.Lines {
+		items = append(items, QuoteItem{GoodID: line.GoodID, Quantity: line.Quantity})
+	}
+	return items
+}
+
+// requote prices the quote of o again, so that what the client sent is
+// only trusted for what it asks for. It fails with ErrQuoteChanged if the
+// prices are no longer those quoted.
+func (r *Repo) requote(ctx context.Context, o *Order, now time.Time) error {
+	q := o.Quote
+	if o.AffiliateID != 0 && o.AffiliateID != q.UserID {
+		return ErrInvalidArgument
+	}
+	if now.After(q.ExpiresAt) {
+		return ErrQuoteExpired
+	}
+	u := &User{}
+	err := r.conn(ctx).First(u, q.UserID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidArgument.Wrap(err)
+	}
+	if err != nil {
+		return err
+	}
+	var s *Session
+	if q.SessionID != nil {
+		s = &Session{}
+		s.ID = *q.SessionID
+	}
+	fresh, err := r.Quote(ctx, u, s, o.items(), q.CouponIDs)
+	if err != nil {
+		return err
+	}
+	if !fresh.sameAs(q) {
+		return ErrQuoteChanged
+	}
+	fresh.QuotedAt = q.QuotedAt
+	fresh.ExpiresAt = q.ExpiresAt
+	o.Quote = fresh
+	return nil
+}
+
+// sameAs reports whether q charges what other does, line by line.
+func (q *Quote) sameAs(other *Quote) bool {
+	if q.Total != other.Total || q.SalePrice != other.SalePrice || len(q.Lines) != len(other.Lines) {
+		return false
+	}
+	for i, line := range q.Lines {
+		o := other.Lines[i]
+		if line.GoodID != o.GoodID || line.Quantity != o.Quantity || line.SalePrice != o.SalePrice || line.Price != o.Price {
+			return false
+		}
+	}
+	return true
+}
+
+// applyQuote prices o at its quote. An order for several goods is a
+// product order recorded under its first good.
+func (o *Order) applyQuote() error {
+	q := o.Quote
+	line := q.Lines[0]
+	o.AffiliateID = q.UserID
+	o.GoodID = line.GoodID
+	o.Amount = line.Quantity
+	o.Price = q.SalePrice
+	o.DiscountedPrice = q.Total
+	o.CouponID = nil
+	if len(q.CouponIDs) > 0 {
+		o.CouponID = &q.CouponIDs[0]
+	}
+	want := OrderTypeBuyProduct
+	switch line.Type {
+	case ProductTypeCredits:
+		want = OrderTypeBuyCredits
+	case ProductTypeSubscriptionPlan:
+		want = OrderTypeSubscription
+		if o.Type == OrderTypeSubscriptionAutoRenew {
+			want = o.Type
+		}
+	}
+	if o.Type != OrderTypeUnknown && o.Type != want {
+		return ErrInvalidArgument
+	}
+	o.Type = want
+	return nil
+}
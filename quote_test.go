@@ -0,0 +1,219 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestGoodApplyCoupon(t *testing.T) {
+	sale := models.ToPrice(20)
+	good := &models.Good{Name: "Mug", Price: models.ToPrice(25), SalePrice: &sale, Type: models.GoodTypeProduct}
+	alice := &models.User{}
+	alice.ID = 1
+
+	var _ models.IProduct = good
+	if good.GetType() != models.ProductTypePhysical || !good.IsOnSale() || good.GetSalePrice() != sale {
+		t.Errorf("good = %s, on sale %v at %d", good.GetType(), good.IsOnSale(), good.GetSalePrice())
+	}
+
+	coupon := &models.Coupon{Type: models.CouponTypeDiscountFixedPrice, DiscountData: 500}
+	price, discounted, err := good.ApplyCoupon(coupon, alice)
+	if err != nil || price != sale || discounted != models.ToPrice(15) {
+		t.Errorf("ApplyCoupon() = %d, %d, %v, want %d, %d", price, discounted, err, sale, models.ToPrice(15))
+	}
+
+	coupon.Restrictions = models.CouponRestrictions{
+		models.NewCouponRestriction(models.PriceThreshold(models.ToPrice(30))),
+	}
+	if _, _, err := good.ApplyCoupon(coupon, alice); !errors.Is(err, models.ErrCouponThreshold) {
+		t.Errorf("below the threshold: error = %v, want ErrCouponThreshold", err)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"goods": [{"id": 100, "name": "Coffee", "price": 1500, "sale_price": 1200, "type": 2, "status": 0, "stock": 5}]
+	}`))
+	ctx := context.Background()
+	alice, _ := repo.FindUser(ctx, 1)
+	coupon := &models.Coupon{UserID: 1, Type: models.CouponTypeDiscountPercentage, DiscountData: 10}
+	if err := repo.DB().Create(coupon).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := repo.Quote(ctx, alice, nil, []models.QuoteItem{{GoodID: 100, Quantity: 2}}, []uint{coupon.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.BasePrice != 3000 || q.SalePrice != 2400 || q.Discount != 240 || q.Total != 2160 {
+		t.Errorf("quote = %+v", q)
+	}
+	if _, err := repo.Quote(ctx, alice, nil, []models.QuoteItem{{GoodID: 100, Quantity: 6}}, nil); !errors.Is(err, models.ErrOutOfStock) {
+		t.Errorf("quoting past the stock: error = %v, want ErrOutOfStock", err)
+	}
+
+	o := &models.Order{TimestamppedID: "20220301000030", Quote: q}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := repo.GetOrderByID(ctx, o.TimestamppedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Type != models.OrderTypeBuyProduct || saved.Amount != 2 || saved.Payable() != q.Total {
+		t.Errorf("order = %+v, want %d payable", saved, q.Total)
+	}
+	if saved.Quote == nil || saved.Quote.Total != q.Total || len(saved.Quote.Lines) != 1 {
+		t.Errorf("saved quote = %+v", saved.Quote)
+	}
+	if _, err := repo.Quote(ctx, alice, nil, []models.QuoteItem{{GoodID: 100, Quantity: 1}}, []uint{coupon.ID}); !errors.Is(err, models.ErrCouponUsed) {
+		t.Errorf("quoting with a reserved coupon: error = %v, want ErrCouponUsed", err)
+	}
+}
+
+func TestQuoteCart(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"goods": [
+			{"id": 100, "name": "Coffee", "price": 1500, "type": 2, "status": 0, "stock": 5},
+			{"id": 101, "name": "Mug", "price": 2500, "type": 2, "status": 0, "stock": 3}
+		]
+	}`))
+	ctx := context.Background()
+	alice, _ := repo.FindUser(ctx, 1)
+
+	mixed := []models.QuoteItem{{GoodID: 100, Quantity: 1}, {GoodID: models.GetCreditGoodID(), Quantity: 10}}
+	if _, err := repo.Quote(ctx, alice, nil, mixed, nil); !errors.Is(err, models.ErrInvalidArgument) {
+		t.Errorf("quoting credits with a product: error = %v, want ErrInvalidArgument", err)
+	}
+
+	campaign := &models.CouponCampaign{Name: "Cart", Type: models.CouponTypeDiscountFixedPrice, DiscountData: 500}
+	if err := repo.CreateCouponCampaign(ctx, campaign); err != nil {
+		t.Fatal(err)
+	}
+	couponIDs := make([]uint, 0, 2)
+	for i := 0; i < 2; i++ {
+		coupon, err := repo.IssueCoupon(ctx, campaign, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		couponIDs = append(couponIDs, coupon.ID)
+	}
+	items := []models.QuoteItem{{GoodID: 100, Quantity: 1}, {GoodID: 101, Quantity: 2}}
+	q, err := repo.Quote(ctx, alice, nil, items, couponIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.SalePrice != 6500 || q.Total != 5500 || len(q.CouponIDs) != 2 {
+		t.Fatalf("quote = %+v", q)
+	}
+
+	tampered := *q
+	tampered.Lines = append([]models.QuoteLine(nil), q.Lines...)
+	tampered.Lines[1].Price = 100
+	tampered.Total = 100
+	if err := repo.CreateOrder(ctx, &models.Order{TimestamppedID: "20220301000031", Quote: &tampered}); !errors.Is(err, models.ErrQuoteChanged) {
+		t.Errorf("ordering a tampered quote: error = %v, want ErrQuoteChanged", err)
+	}
+
+	o := &models.Order{TimestamppedID: "20220301000032", Quote: q}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Type != models.OrderTypeBuyProduct || o.Payable() != q.Total {
+		t.Errorf("order = %+v, want a product order of %d", o, q.Total)
+	}
+	for id, want := range map[uint]uint{100: 4, 101: 1} {
+		good, err := repo.GetGoodByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if good.Stock == nil || *good.Stock != want {
+			t.Errorf("stock of %d = %v, want %d", id, good.Stock, want)
+		}
+	}
+
+	if err := repo.CommitOrderPaid(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.CampaignStats(ctx, campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Redeemed != 2 || stats.Revenue != q.Total {
+		t.Errorf("stats = %+v, want 2 redeemed for %d", stats, q.Total)
+	}
+}
+
+func TestQuoteSessionCoupons(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	modelstest.LoadJSON(t, repo, []byte(`{"goods": [{"id": 100, "name": "Coffee", "price": 1500, "type": 2, "status": 0}]}`))
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	if err := repo.DB().Model(&models.User{}).Where("id = ?", 1).Updates(map[string]interface{}{"is_pro": true, "pro_deadline": past}).Error; err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := repo.FindUser(ctx, 1)
+	session := &models.Session{}
+	session.ID = 1
+
+	coupon := func(rule models.CouponRule) uint {
+		c := &models.Coupon{
+			UserID:       1,
+			Type:         models.CouponTypeDiscountFixedPrice,
+			DiscountData: 300,
+			Restrictions: models.CouponRestrictions{models.NewCouponRestriction(rule)},
+		}
+		if err := repo.DB().Create(c).Error; err != nil {
+			t.Fatal(err)
+		}
+		return c.ID
+	}
+	here := coupon(models.StoreLimit{1})
+	elsewhere := coupon(models.StoreLimit{2})
+	long := coupon(models.MinSessionLength(180))
+	member := coupon(models.MemberOnly{})
+	items := []models.QuoteItem{{GoodID: 100, Quantity: 1}}
+
+	if _, err := repo.Quote(ctx, alice, nil, items, []uint{here}); !errors.Is(err, models.ErrCouponStore) {
+		t.Errorf("store coupon without a session: error = %v, want ErrCouponStore", err)
+	}
+	cases := []struct {
+		coupon uint
+		want   error
+	}{
+		{elsewhere, models.ErrCouponStore},
+		{long, models.ErrCouponSession},
+		{member, models.ErrCouponMember},
+	}
+	for _, c := range cases {
+		if _, err := repo.Quote(ctx, alice, session, items, []uint{c.coupon}); !errors.Is(err, c.want) {
+			t.Errorf("coupon %d: error = %v, want %v", c.coupon, err, c.want)
+		}
+	}
+
+	q, err := repo.Quote(ctx, alice, session, items, []uint{here})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.SessionID == nil || *q.SessionID != session.ID || q.Total != 1200 {
+		t.Errorf("quote = %+v", q)
+	}
+	if err := repo.CreateOrder(ctx, &models.Order{TimestamppedID: "20220301000033", Quote: q}); err != nil {
+		t.Errorf("ordering a session quote: %v", err)
+	}
+
+	bob, _ := repo.FindUser(ctx, 2)
+	if _, err := repo.Quote(ctx, bob, session, items, nil); !errors.Is(err, models.ErrInvalidArgument) {
+		t.Errorf("quoting for another user's session: error = %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,474 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WeekdayMask is a set of weekdays, bit n standing for time.Weekday(n).
+type WeekdayMask uint8
+
+const WeekdayMaskWorkdays = WeekdayMask(1<<time.Monday | 1<<time.Tuesday | 1<<time.Wednesday | 1<<time.Thursday | 1<<time.Friday)
+
+func NewWeekdayMask(days ...time.Weekday) WeekdayMask {
+	var m WeekdayMask
+	for _, d := range days {
+		m |= 1 << d
+	}
+	return m
+}
+
+func (m WeekdayMask) Has(d time.Weekday) bool {
+	return m&(1<<d) != 0
+}
+
+type RecurringReservationStatus string
+
+const (
+	RecurringReservationActive   RecurringReservationStatus = "active"
+	RecurringReservationCanceled RecurringReservationStatus = "canceled"
+)
+
+// RecurringReservation books the same seat on the given weekdays, from
+// WindowStart to WindowEnd, between StartDate and Until (inclusive). The
+// window is in minutes after midnight, in Location.
+type RecurringReservation struct {
+	gorm.Model
+	User   User `json:"-"`
+	UserID uint `gorm:"not null" json:"user_id"`
+	Seat   Seat `json:"-"`
+	SeatID uint `gorm:"not null" json:"seat_id"`
+
+	Weekdays    WeekdayMask `gorm:"not null" json:"weekdays"`
+	WindowStart int         `gorm:"not null" json:"window_start"`
+	WindowEnd   int         `gorm:"not null" json:"window_end"`
+	Location    string      `gorm:"type:varchar(64);not null;default:'Asia/Shanghai'" json:"location"`
+
+	StartDate time.Time  `gorm:"type:date;not null" json:"start_date"`
+	Until     *time.Time `gorm:"type:date" json:"until"`
+
+	Status RecurringReservationStatus `gorm:"type:varchar(16);not null;default:'active'" json:"status"`
+}
+
+// RecurringReservationSkip marks an occurrence that must not be
+// materialised.
+type RecurringReservationSkip struct {
+	ID                     uint      `gorm:"primarykey"`
+	RecurringReservationID uint      `gorm:"uniqueIndex:idx_recurring_skip;not null"`
+	Occurrence             time.Time `gorm:"uniqueIndex:idx_recurring_skip;not null"`
+	CreatedAt              time.Time
+}
+
+func migrateRecurringReservations(db *gorm.DB) error {
+	if err := createTables(db, &RecurringReservation{}, &RecurringReservationSkip{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	for _, field := range []string{"RecurringReservationID", "Occurrence"} {
+		if !m.HasColumn(&Session{}, field) {
+			if err := m.AddColumn(&Session{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	if !m.HasIndex(&Session{}, "RecurringReservationID") {
+		return m.CreateIndex(&Session{}, "RecurringReservationID")
+	}
+	return nil
+}
+
+func dropRecurringReservations(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropColumn(&Session{}, "Occurrence"); err != nil {
+		return err
+	}
+	if err := m.DropColumn(&Session{}, "RecurringReservationID"); err != nil {
+		return err
+	}
+	return m.DropTable(&RecurringReservationSkip{}, &RecurringReservation{})
+}
+
+// OccurrenceConflict is an occurrence that could not be booked.
+type OccurrenceConflict struct {
+	Occurrence time.Time `json:"occurrence"`
+	Err        error     `json:"-"`
+}
+
+// MaterialiseReport lists what materialising a series did.
+type MaterialiseReport struct {
+	RecurringReservationID uint                 `json:"recurring_reservation_id"`
+	Created                []*Session           `json:"created"`
+	Conflicts              []OccurrenceConflict `json:"conflicts"`
+}
+
+// civilDate turns the calendar date of t into a comparable number.
+func civilDate(t time.Time) int {
+	return t.Year()*10000 + int(t.Month())*100 + t.Day()
+}
+
+func (rr *RecurringReservation) location() (*time.Location, error) {
+	if rr.Location == "" {
+		return time.LoadLocation("Asia/Shanghai")
+	}
+	return time.LoadLocation(rr.Location)
+}
+
+func (rr *RecurringReservation) validate() error {
+	if rr.Weekdays&0x7f == 0 {
+		return ErrInvalidArgument
+	}
+	if rr.WindowStart < 0 || rr.WindowEnd > 24*60 || rr.WindowStart >= rr.WindowEnd {
+		return ErrInvalidTime
+	}
+	if rr.StartDate.IsZero() {
+		return ErrInvalidTime
+	}
+	if rr.Until != nil && civilDate(*rr.Until) < civilDate(rr.StartDate) {
+		return ErrInvalidTime
+	}
+	if _, err := rr.location(); err != nil {
+		return ErrInvalidArgument.Wrap(err)
+	}
+	return nil
+}
+
+func clockOn(day time.Time, minutes int, loc *time.Location) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minutes/60, minutes%60, 0, 0, loc)
+}
+
+// Occurrences returns the start times of the series in [from, to).
+func (rr *RecurringReservation) Occurrences(from, to time.Time) ([]time.Time, error) {
+	loc, err := rr.location()
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := civilDate(rr.StartDate), math.MaxInt32
+	if rr.Until != nil {
+		last = civilDate(*rr.Until)
+	}
+
+	ret := make([]time.Time, 0)
+	f := from.In(loc)
+	for day := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		c := civilDate(day)
+		if c > last {
+			break
+		}
+		if c < first || !rr.Weekdays.Has(day.Weekday()) {
+			continue
+		}
+		start := clockOn(day, rr.WindowStart, loc)
+		if start.Before(from) || !start.Before(to) {
+			continue
+		}
+		ret = append(ret, start)
+	}
+	return ret, nil
+}
+
+// end returns the end of the occurrence starting at occurrence.
+func (rr *RecurringReservation) end(occurrence time.Time) time.Time {
+	return clockOn(occurrence, rr.WindowEnd, occurrence.Location())
+}
+
+func (rr *RecurringReservation) isOccurrence(t time.Time) bool {
+	occ, err := rr.Occurrences(t, t.Add(time.Nanosecond))
+	return err == nil && len(occ) == 1
+}
+
+// CreateRecurringReservation saves rr and materialises its occurrences
+// within horizon from now.
+func (r *Repo) CreateRecurringReservation(ctx context.Context, key []byte, rr *RecurringReservation, horizon time.Duration) (*MaterialiseReport, error) {
+	if err := rr.validate(); err != nil {
+		return nil, err
+	}
+	rr.Status = RecurringReservationActive
+	if err := r.conn(ctx).Omit(clause.Associations).Create(rr).Error; err != nil {
+		return nil, err
+	}
+	return r.MaterialiseRecurringReservation(ctx, key, rr, time.Now(), horizon)
+}
+
+func (r *Repo) GetRecurringReservation(ctx context.Context, id uint) (*RecurringReservation, error) {
+	rr := &RecurringReservation{}
+	tx := r.conn(ctx).First(rr, id)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return rr, nil
+}
+
+func (r *Repo) ListUserRecurringReservations(ctx context.Context, u *User) ([]*RecurringReservation, error) {
+	ret := make([]*RecurringReservation, 0)
+	tx := r.conn(ctx).
+		Where("user_id = ? AND status = ?", u.ID, RecurringReservationActive).
+		Order("created_at desc").
+		Find(&ret)
+	return ret, tx.Error
+}
+
+// handledOccurrences returns the occurrences of rr between from and to
+// that are already materialised or skipped, keyed by unix time.
+func (r *Repo) handledOccurrences(ctx context.Context, rr *RecurringReservation, from, to time.Time) (map[int64]bool, error) {
+	handled := make(map[int64]bool)
+
+	sessions := make([]Session, 0)
+	err := r.conn(ctx).
+		Select("occurrence").
+		Where("recurring_reservation_id = ? AND occurrence BETWEEN ? AND ?", rr.ID, from, to).
+		Find(&sessions).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		handled[s.Occurrence.Unix()] = true
+	}
+
+	skips := make([]RecurringReservationSkip, 0)
+	err = r.conn(ctx).
+		Where("recurring_reservation_id = ? AND occurrence BETWEEN ? AND ?", rr.ID, from, to).
+		Find(&skips).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range skips {
+		handled[s.Occurrence.Unix()] = true
+	}
+	return handled, nil
+}
+
+func (r *Repo) reserveOccurrence(ctx context.Context, key []byte, rr *RecurringReservation, occurrence, start, end time.Time) (*Session, error) {
+	session := &Session{
+		UserID:                 rr.UserID,
+		SeatID:                 rr.SeatID,
+		StartTime:              &start,
+		EndTime:                &end,
+		RecurringReservationID: &rr.ID,
+		Occurrence:             &occurrence,
+	}
+	if err := r.reserve(ctx, key, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// MaterialiseRecurringReservation books the occurrences of rr that start
+// within horizon from now and are neither booked nor skipped yet. An
+// occurrence that clashes with another session is reported in Conflicts
+// and retried on the next run; it does not fail the series.
+func (r *Repo) MaterialiseRecurringReservation(ctx context.Context, key []byte, rr *RecurringReservation, now time.Time, horizon time.Duration) (*MaterialiseReport, error) {
+	report := &MaterialiseReport{
+		RecurringReservationID: rr.ID,
+		Created:                make([]*Session, 0),
+		Conflicts:              make([]OccurrenceConflict, 0),
+	}
+	if rr.Status != RecurringReservationActive {
+		return report, nil
+	}
+
+	occurrences, err := rr.Occurrences(now, now.Add(horizon))
+	if err != nil || len(occurrences) == 0 {
+		return report, err
+	}
+	handled, err := r.handledOccurrences(ctx, rr, occurrences[0], occurrences[len(occurrences)-1])
+	if err != nil {
+		return report, err
+	}
+
+	for _, occ := range occurrences {
+		if handled[occ.Unix()] {
+			continue
+		}
+		session, err := r.reserveOccurrence(ctx, key, rr, occ, occ, rr.end(occ))
+		conflict := &SessionConflictError{}
+		if errors.As(err, &conflict) || errors.Is(err, ErrStoreClosed) {
+			report.Conflicts = append(report.Conflicts, OccurrenceConflict{
+				Occurrence: occ,
+				Err:        err,
+			})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Created = append(report.Created, session)
+	}
+	return report, nil
+}
+
+// MaterialiseRecurringReservations materialises every active series, for
+// use by a periodic worker.
+func (r *Repo) MaterialiseRecurringReservations(ctx context.Context, key []byte, now time.Time, horizon time.Duration) ([]*MaterialiseReport, error) {
+	series := make([]*RecurringReservation, 0)
+	tx := r.conn(ctx).
+		Where("status = ?", RecurringReservationActive).
+		Where("until IS NULL OR until >= ?", now.AddDate(0, 0, -1)).
+		Find(&series)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	reports := make([]*MaterialiseReport, 0, len(series))
+	for _, rr := range series {
+		report, err := r.MaterialiseRecurringReservation(ctx, key, rr, now, horizon)
+		if err != nil {
+			logrus.WithError(err).WithField("recurring_reservation", rr.ID).Error("Failed to materialise recurring reservation")
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (r *Repo) findOccurrence(ctx context.Context, rr *RecurringReservation, occurrence time.Time) (*Session, error) {
+	session := &Session{}
+	tx := r.conn(ctx).
+		Where("recurring_reservation_id = ? AND occurrence = ?", rr.ID, occurrence).
+		Limit(1).
+		Find(session)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return nil, tx.Error
+	}
+	return session, nil
+}
+
+func (r *Repo) isOccurrenceSkipped(ctx context.Context, rr *RecurringReservation, occurrence time.Time) (bool, error) {
+	var cnt int64
+	tx := r.conn(ctx).
+		Model(&RecurringReservationSkip{}).
+		Where("recurring_reservation_id = ? AND occurrence = ?", rr.ID, occurrence).
+		Count(&cnt)
+	return cnt != 0, tx.Error
+}
+
+// SkipOccurrence drops one occurrence from the series, canceling its
+// session if it is already booked.
+func (r *Repo) SkipOccurrence(ctx context.Context, rr *RecurringReservation, occurrence time.Time, actor string) error {
+	if !rr.isOccurrence(occurrence) {
+		return ErrInvalidArgument
+	}
+
+	return r.WithTx(ctx, func(tx *Repo) error {
+		session, err := tx.findOccurrence(ctx, rr, occurrence)
+		if err != nil {
+			return err
+		}
+		if session != nil && session.Status != SessionStatusCanceled {
+			if err := tx.TransitionSession(ctx, session, SessionStatusCanceled, actor); err != nil {
+				return err
+			}
+		}
+		return tx.conn(ctx).
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RecurringReservationSkip{
+				RecurringReservationID: rr.ID,
+				Occurrence:             occurrence,
+			}).
+			Error
+	})
+}
+
+// EditOccurrence moves one occurrence of the series to [start, end),
+// booking it first if it has not been materialised yet.
+func (r *Repo) EditOccurrence(ctx context.Context, key []byte, rr *RecurringReservation, occurrence time.Time, start, end *time.Time) (*Session, error) {
+	if !rr.isOccurrence(occurrence) {
+		return nil, ErrInvalidArgument
+	}
+	if !end.After(*start) {
+		return nil, ErrInvalidTime
+	}
+
+	skipped, err := r.isOccurrenceSkipped(ctx, rr, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	if skipped {
+		return nil, ErrSessionNotFound
+	}
+
+	session, err := r.findOccurrence(ctx, rr, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return r.reserveOccurrence(ctx, key, rr, occurrence, *start, *end)
+	}
+	if session.Status != SessionStatusReserved {
+		return nil, ErrIllegalTransition
+	}
+	if err := r.rescheduleSession(ctx, session, start, end); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CancelSeriesFrom ends the series before day, canceling the booked
+// occurrences on or after it. Canceling from the first day cancels the
+// whole series.
+func (r *Repo) CancelSeriesFrom(ctx context.Context, rr *RecurringReservation, day time.Time, actor string) error {
+	loc, err := rr.location()
+	if err != nil {
+		return err
+	}
+	d := day.In(loc)
+	from := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+
+	return r.WithTx(ctx, func(tx *Repo) error {
+		sessions := make([]*Session, 0)
+		err := tx.conn(ctx).
+			Where("recurring_reservation_id = ? AND occurrence >= ?", rr.ID, from).
+			Where("status = ?", SessionStatusReserved).
+			Find(&sessions).
+			Error
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			if err := tx.TransitionSession(ctx, s, SessionStatusCanceled, actor); err != nil {
+				return err
+			}
+		}
+
+		if civilDate(from) <= civilDate(rr.StartDate) {
+			rr.Status = RecurringReservationCanceled
+		} else {
+			until := from.AddDate(0, 0, -1)
+			rr.Until = &until
+		}
+		return tx.conn(ctx).Model(rr).Select("status", "until").Updates(rr).Error
+	})
+}
+
+// EditSeriesFrom changes the rest of the series from day on: the current
+// series is ended before day and next, starting on day, replaces it. The
+// user of next is taken from rr, as is the seat if next leaves it unset.
+func (r *Repo) EditSeriesFrom(ctx context.Context, key []byte, rr *RecurringReservation, day time.Time, next *RecurringReservation, horizon time.Duration, actor string) (*MaterialiseReport, error) {
+	next.UserID = rr.UserID
+	if next.SeatID == 0 {
+		next.SeatID = rr.SeatID
+	}
+	next.StartDate = day
+	if err := next.validate(); err != nil {
+		return nil, err
+	}
+
+	var report *MaterialiseReport
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		if err := tx.CancelSeriesFrom(ctx, rr, day, actor); err != nil {
+			return err
+		}
+		var err error
+		report, err = tx.CreateRecurringReservation(ctx, key, next, horizon)
+		return err
+	})
+	return report, err
+}
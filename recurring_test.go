@@ -0,0 +1,145 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestOccurrences(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	until := time.Date(2022, 3, 8, 0, 0, 0, 0, time.UTC)
+	rr := &models.RecurringReservation{
+		Weekdays:    models.WeekdayMaskWorkdays,
+		WindowStart: 19 * 60,
+		WindowEnd:   22 * 60,
+		Location:    "Asia/Shanghai",
+		StartDate:   time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		Until:       &until,
+	}
+
+	cases := []struct {
+		name     string
+		from, to time.Time
+		want     []int
+	}{
+		{"whole series", time.Date(2022, 2, 20, 0, 0, 0, 0, loc), time.Date(2022, 4, 1, 0, 0, 0, 0, loc), []int{1, 2, 3, 4, 7, 8}},
+		{"after first window", time.Date(2022, 3, 1, 19, 30, 0, 0, loc), time.Date(2022, 3, 3, 0, 0, 0, 0, loc), []int{2}},
+		{"to is exclusive", time.Date(2022, 3, 7, 0, 0, 0, 0, loc), time.Date(2022, 3, 8, 19, 0, 0, 0, loc), []int{7}},
+		{"weekend", time.Date(2022, 3, 5, 0, 0, 0, 0, loc), time.Date(2022, 3, 7, 0, 0, 0, 0, loc), []int{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := rr.Occurrences(c.from, c.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("Occurrences() = %v, want days %v", got, c.want)
+			}
+			for i, day := range c.want {
+				want := time.Date(2022, 3, day, 19, 0, 0, 0, loc)
+				if !got[i].Equal(want) {
+					t.Errorf("occurrence %d = %v, want %v", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecurringReservation(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Now().In(loc)
+	day := func(n int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+n, 0, 0, 0, 0, loc)
+	}
+	clock := func(n, hour int) *time.Time {
+		ts := day(n).Add(time.Duration(hour) * time.Hour)
+		return &ts
+	}
+
+	// bob holds the seat on the second day
+	bob := &models.User{}
+	bob.ID = 2
+	seat := &models.Seat{}
+	seat.ID = 1
+	if _, err := repo.ReserveSession(ctx, sessionKey, bob, seat, clock(2, 10), clock(2, 11)); err != nil {
+		t.Fatal(err)
+	}
+
+	until := day(3)
+	rr := &models.RecurringReservation{
+		UserID:      1,
+		SeatID:      1,
+		Weekdays:    0x7f,
+		WindowStart: 10 * 60,
+		WindowEnd:   12 * 60,
+		Location:    "Asia/Shanghai",
+		StartDate:   day(1),
+		Until:       &until,
+	}
+	report, err := repo.CreateRecurringReservation(ctx, sessionKey, rr, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) != 2 || len(report.Conflicts) != 1 {
+		t.Fatalf("created %d, conflicts %d, want 2 and 1", len(report.Created), len(report.Conflicts))
+	}
+	if !report.Conflicts[0].Occurrence.Equal(*clock(2, 10)) {
+		t.Errorf("conflicting occurrence = %v, want %v", report.Conflicts[0].Occurrence, clock(2, 10))
+	}
+	if !errors.Is(report.Conflicts[0].Err, models.ErrSeatTaken) {
+		t.Errorf("conflict error = %v, want ErrSeatTaken", report.Conflicts[0].Err)
+	}
+
+	if err := repo.SkipOccurrence(ctx, rr, *clock(3, 10), models.SessionActorSystem); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SkipOccurrence(ctx, rr, *clock(3, 11), models.SessionActorSystem); !errors.Is(err, models.ErrInvalidArgument) {
+		t.Errorf("skipping a time off the pattern: error = %v, want ErrInvalidArgument", err)
+	}
+
+	report, err = repo.MaterialiseRecurringReservation(ctx, sessionKey, rr, time.Now(), 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) != 0 || len(report.Conflicts) != 1 {
+		t.Errorf("rerun created %d, conflicts %d, want 0 and 1", len(report.Created), len(report.Conflicts))
+	}
+
+	edited, err := repo.EditOccurrence(ctx, sessionKey, rr, *clock(1, 10), clock(1, 13), clock(1, 14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edited.StartTime.Equal(*clock(1, 13)) {
+		t.Errorf("edited start = %v, want %v", edited.StartTime, clock(1, 13))
+	}
+
+	if err := repo.CancelSeriesFrom(ctx, rr, day(1), models.SessionActorSystem); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Status != models.RecurringReservationCanceled {
+		t.Errorf("series status = %s, want canceled", rr.Status)
+	}
+	s := models.Session{}
+	if err := repo.DB().First(&s, edited.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != models.SessionStatusCanceled {
+		t.Errorf("occurrence status = %s, want canceled", s.Status)
+	}
+}
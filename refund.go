@@ -0,0 +1,504 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// RefundApprovalThreshold is the amount above which a refund waits
+	// for an administrator to approve it.
+	RefundApprovalThreshold = ToPrice(50)
+	// RestoreCouponOnRefund gives the coupon of an order back to the user
+	// when the order is refunded in full.
+	RestoreCouponOnRefund = true
+)
+
+type RefundStatus string
+
+const (
+	RefundStatusRequested  RefundStatus = "requested"
+	RefundStatusApproved   RefundStatus = "approved"
+	RefundStatusRejected   RefundStatus = "rejected"
+	RefundStatusProcessing RefundStatus = "processing"
+	RefundStatusSucceeded  RefundStatus = "succeeded"
+	RefundStatusFailed     RefundStatus = "failed"
+)
+
+// refundCounted are the statuses whose amount counts against what is left
+// to refund.
+var refundCounted = []RefundStatus{
+	RefundStatusRequested,
+	RefundStatusApproved,
+	RefundStatusProcessing,
+	RefundStatusSucceeded,
+}
+
+// Refund gives back all or part of what was paid for an order, or of the
+// credit charged for a session.
+type Refund struct {
+	gorm.Model
+	Order     *Order   `json:"-"`
+	OrderID   *uint    `gorm:"index" json:"order_id,omitempty"`
+	Session   *Session `json:"-"`
+	SessionID *uint    `gorm:"index" json:"session_id,omitempty"`
+	User      User     `json:"-"`
+	UserID    uint     `gorm:"not null;index" json:"user_id"`
+
+	Amount      Price        `gorm:"not null" json:"amount"`
+	Reason      string       `gorm:"type:varchar(255)" json:"reason"`
+	Status      RefundStatus `gorm:"type:varchar(16);not null;index" json:"status"`
+	OutRefundNo string       `gorm:"type:varchar(64);not null;uniqueIndex" json:"out_refund_no"`
+
+	PaymentAttempt   *PaymentAttempt `json:"-"`
+	PaymentAttemptID *uint           `json:"-"`
+	ProviderRefundID string          `gorm:"type:varchar(64)" json:"-"`
+	// Stray is set on the refund of a payment that arrived after its order
+	// was cancelled. It returns the money and leaves the order alone.
+	Stray bool `gorm:"not null;default:false" json:"stray,omitempty"`
+
+	RequestedBy   string     `gorm:"type:varchar(64)" json:"requested_by"`
+	ReviewedBy    string     `gorm:"type:varchar(64)" json:"reviewed_by,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewed_at,omitempty"`
+	FailureReason string     `gorm:"type:varchar(255)" json:"failure_reason,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+func migrateRefunds(db *gorm.DB) error {
+	return createTables(db, &Refund{})
+}
+
+func dropRefunds(db *gorm.DB) error {
+	return db.Migrator().DropTable(&Refund{})
+}
+
+func migrateStrayRefunds(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasColumn(&Refund{}, "Stray") {
+		return nil
+	}
+	return m.AddColumn(&Refund{}, "Stray")
+}
+
+func dropStrayRefunds(db *gorm.DB) error {
+	return db.Migrator().DropColumn(&Refund{}, "Stray")
+}
+
+func (r *Repo) refunded(ctx context.Context, column string, id uint) (Price, error) {
+	var sum int64
+	tx := r.conn(ctx).
+		Model(&Refund{}).
+		Where(column+" = ? AND status IN ? AND NOT stray", id, refundCounted).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&sum)
+	return Price(sum), tx.Error
+}
+
+func (r *Repo) createRefund(ctx context.Context, refund *Refund) error {
+	refund.Status = RefundStatusApproved
+	if refund.Amount > RefundApprovalThreshold && !refund.Stray {
+		refund.Status = RefundStatusRequested
+	}
+	refund.OutRefundNo = time.Now().Format("20060102150405") + randomToken(6)
+	return r.conn(ctx).Omit(clause.Associations).Create(refund).Error
+}
+
+// RequestOrderRefund asks to refund amount of the paid order o. Refunds up
+// to RefundApprovalThreshold are approved straight away.
+func (r *Repo) RequestOrderRefund(ctx context.Context, o *Order, amount Price, reason, actor string) (*Refund, error) {
+	refund := &Refund{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current := Order{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, o.ID).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != OrderStatusPaid && current.Status != OrderStatusPartiallyRefunded {
+			return ErrRefundState
+		}
+		done, err := tx.refunded(ctx, "order_id", current.ID)
+		if err != nil {
+			return err
+		}
+		if amount == 0 || done+amount > current.Payable() {
+			return ErrRefundAmount
+		}
+
+		*refund = Refund{
+			OrderID:     &current.ID,
+			UserID:      current.AffiliateID,
+			Amount:      amount,
+			Reason:      reason,
+			RequestedBy: actor,
+		}
+		return tx.createRefund(ctx, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// RequestSessionRefund asks to give back amount of the credit charged for
+// session s.
+func (r *Repo) RequestSessionRefund(ctx context.Context, s *Session, amount Price, reason, actor string) (*Refund, error) {
+	refund := &Refund{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current := Session{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, s.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		var charged int64
+		err = tx.conn(ctx).
+			Model(&CreditLedgerEntry{}).
+			Where("source_type = ? AND source_id = ? AND reason = ? AND user_id IS NOT NULL", "sessions", current.ID, CreditReasonSessionCharge).
+			Select("COALESCE(-SUM(amount), 0)").
+			Scan(&charged).
+			Error
+		if err != nil {
+			return err
+		}
+		done, err := tx.refunded(ctx, "session_id", current.ID)
+		if err != nil {
+			return err
+		}
+		if amount == 0 || int64(done+amount) > charged {
+			return ErrRefundAmount
+		}
+
+		*refund = Refund{
+			SessionID:   &current.ID,
+			UserID:      current.UserID,
+			Amount:      amount,
+			Reason:      reason,
+			RequestedBy: actor,
+		}
+		return tx.createRefund(ctx, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+func (r *Repo) GetRefund(ctx context.Context, id uint) (*Refund, error) {
+	refund := &Refund{}
+	tx := r.conn(ctx).First(refund, id)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return refund, nil
+}
+
+// ListPendingRefunds returns the refunds waiting for approval, oldest
+// first.
+func (r *Repo) ListPendingRefunds(ctx context.Context, limit, page uint) ([]*Refund, error) {
+	refunds := make([]*Refund, 0)
+	tx := r.conn(ctx).
+		Where("status = ?", RefundStatusRequested).
+		Order("id asc").
+		Limit(int(limit)).
+		Offset(int(page * limit)).
+		Find(&refunds)
+	return refunds, tx.Error
+}
+
+func (r *Repo) ListUserRefunds(ctx context.Context, u *User) ([]*Refund, error) {
+	refunds := make([]*Refund, 0)
+	tx := r.conn(ctx).Where("user_id = ?", u.ID).Order("id desc").Find(&refunds)
+	return refunds, tx.Error
+}
+
+// lockRefund reloads refund for update and checks it is in status.
+func (r *Repo) lockRefund(ctx context.Context, refund *Refund, status RefundStatus) (*Refund, error) {
+	current := &Refund{}
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(current, refund.ID).Error
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != status {
+		return nil, ErrRefundState
+	}
+	return current, nil
+}
+
+func (r *Repo) reviewRefund(ctx context.Context, refund *Refund, admin *Administrator, status RefundStatus, note string) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current, err := tx.lockRefund(ctx, refund, RefundStatusRequested)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		updates := map[string]interface{}{
+			"status":      status,
+			"reviewed_by": AdministratorActor(admin),
+			"reviewed_at": now,
+		}
+		if note != "" {
+			updates["failure_reason"] = truncate(note, 255)
+		}
+		if err := tx.conn(ctx).Model(current).Updates(updates).Error; err != nil {
+			return err
+		}
+		refund.Status = status
+		refund.ReviewedBy = AdministratorActor(admin)
+		refund.ReviewedAt = &now
+		return nil
+	})
+}
+
+// ApproveRefund lets a refund above the approval threshold go ahead.
+func (r *Repo) ApproveRefund(ctx context.Context, refund *Refund, admin *Administrator) error {
+	return r.reviewRefund(ctx, refund, admin, RefundStatusApproved, "")
+}
+
+func (r *Repo) RejectRefund(ctx context.Context, refund *Refund, admin *Administrator, note string) error {
+	return r.reviewRefund(ctx, refund, admin, RefundStatusRejected, note)
+}
+
+// ProcessRefund carries out the approved refund. Order refunds are paid
+// back through p, the provider the order was paid with, and take back
+// what the order gave: credits or subscription time. Session refunds
+// give the credit back. Stray refunds only pay back the attempt they
+// name. A refund the provider accepts but has not completed stays
+// processing until CompleteRefund is called.
+func (r *Repo) ProcessRefund(ctx context.Context, p PaymentProvider, refund *Refund) (*Refund, error) {
+	var current *Refund
+	var order *Order
+	var attempt *PaymentAttempt
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		var err error
+		current, err = tx.lockRefund(ctx, refund, RefundStatusApproved)
+		if err != nil {
+			return err
+		}
+		if current.SessionID != nil {
+			return tx.settleRefund(ctx, current, nil)
+		}
+
+		order = &Order{}
+		if err := tx.conn(ctx).First(order, *current.OrderID).Error; err != nil {
+			return err
+		}
+		if order.Type == OrderTypeBuyCredits && !current.Stray {
+			// taken first so that credit already spent stops the refund
+			u := &User{}
+			u.ID = current.UserID
+			credits := Price(uint64(order.Amount) * 100 * uint64(current.Amount) / uint64(order.Payable()))
+			if credits > 0 {
+				_, err := tx.DebitUser(ctx, u, credits, CreditReasonRefund, refundCreditSource(current), current.RequestedBy)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		attempt = &PaymentAttempt{}
+		res := tx.conn(ctx).Where("order_id = ? AND status = ?", order.ID, PaymentAttemptStatusSucceeded)
+		if current.PaymentAttemptID != nil {
+			res = res.Where("id = ?", *current.PaymentAttemptID)
+		}
+		res = res.Order("id desc").Limit(1).Find(attempt)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// not paid through a provider
+			attempt = nil
+			return tx.settleRefund(ctx, current, order)
+		}
+		current.Status = RefundStatusProcessing
+		current.PaymentAttemptID = &attempt.ID
+		return tx.conn(ctx).Model(current).Updates(map[string]interface{}{
+			"status":             current.Status,
+			"payment_attempt_id": attempt.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attempt == nil {
+		return current, nil
+	}
+
+	result, err := p.Refund(ctx, &RefundRequest{
+		OutTradeNo:  attempt.OutTradeNo,
+		OutRefundNo: current.OutRefundNo,
+		Amount:      current.Amount,
+		Total:       attempt.Amount,
+		Reason:      current.Reason,
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("refund", current.ID).Error("Payment provider refused refund")
+		if ferr := r.CompleteRefund(ctx, current, false, err.Error()); ferr != nil {
+			return nil, ferr
+		}
+		return current, ErrPaymentFailed.Wrap(err)
+	}
+	if err := r.conn(ctx).Model(current).Update("provider_refund_id", result.RefundID).Error; err != nil {
+		return nil, err
+	}
+	current.ProviderRefundID = result.RefundID
+	if result.Pending {
+		return current, nil
+	}
+	return current, r.CompleteRefund(ctx, current, true, "")
+}
+
+// CompleteRefund records the outcome of a refund the provider was
+// processing. A failed refund gives back what was taken for it.
+func (r *Repo) CompleteRefund(ctx context.Context, refund *Refund, ok bool, failure string) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current, err := tx.lockRefund(ctx, refund, RefundStatusProcessing)
+		if err != nil {
+			return err
+		}
+		order := &Order{}
+		if err := tx.conn(ctx).First(order, *current.OrderID).Error; err != nil {
+			return err
+		}
+		if ok {
+			if err := tx.settleRefund(ctx, current, order); err != nil {
+				return err
+			}
+		} else {
+			if err := tx.failRefund(ctx, current, order, failure); err != nil {
+				return err
+			}
+		}
+		*refund = *current
+		return nil
+	})
+}
+
+func refundCreditSource(refund *Refund) *CreditSource {
+	return &CreditSource{Type: "refunds", ID: refund.ID}
+}
+
+// settleRefund marks refund succeeded and applies it to the order or
+// session it refunds.
+func (r *Repo) settleRefund(ctx context.Context, refund *Refund, order *Order) error {
+	now := time.Now()
+	refund.Status = RefundStatusSucceeded
+	refund.CompletedAt = &now
+	err := r.conn(ctx).Model(refund).Updates(map[string]interface{}{
+		"status":       refund.Status,
+		"completed_at": now,
+	}).Error
+	if err != nil || refund.Stray {
+		return err
+	}
+
+	if refund.SessionID != nil {
+		u := &User{}
+		u.ID = refund.UserID
+		_, err := r.CreditUser(ctx, u, refund.Amount, CreditReasonRefund, refundCreditSource(refund), refund.RequestedBy)
+		return err
+	}
+
+	if order.Type == OrderTypeSubscription || order.Type == OrderTypeSubscriptionAutoRenew {
+		if err := r.refundSubscription(ctx, order, refund); err != nil {
+			return err
+		}
+	}
+
+	var done int64
+	err = r.conn(ctx).
+		Model(&Refund{}).
+		Where("order_id = ? AND status = ? AND NOT stray", order.ID, RefundStatusSucceeded).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&done).
+		Error
+	if err != nil {
+		return err
+	}
+	status := OrderStatusPartiallyRefunded
+	if Price(done) >= order.Payable() {
+		status = OrderStatusRefunded
+		if ids := order.couponIDs(); RestoreCouponOnRefund && len(ids) > 0 {
+			err := r.conn(ctx).Model(&Coupon{}).Where("id IN ?", ids).Update("used", false).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.setOrderStatus(ctx, order, status, SessionActorSystem)
+}
+
+func (r *Repo) failRefund(ctx context.Context, refund *Refund, order *Order, failure string) error {
+	refund.Status = RefundStatusFailed
+	refund.FailureReason = truncate(failure, 255)
+	err := r.conn(ctx).Model(refund).Updates(map[string]interface{}{
+		"status":         refund.Status,
+		"failure_reason": refund.FailureReason,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if order.Type != OrderTypeBuyCredits {
+		return nil
+	}
+	var taken int64
+	err = r.conn(ctx).
+		Model(&CreditLedgerEntry{}).
+		Where("source_type = ? AND source_id = ? AND user_id IS NOT NULL", "refunds", refund.ID).
+		Select("COALESCE(-SUM(amount), 0)").
+		Scan(&taken).
+		Error
+	if err != nil || taken <= 0 {
+		return err
+	}
+	u := &User{}
+	u.ID = refund.UserID
+	_, err = r.CreditUser(ctx, u, Price(taken), CreditReasonRefund, refundCreditSource(refund), SessionActorSystem)
+	return err
+}
+
+// refundSubscription takes back the share of the subscription time bought
+// by order that refund pays back. A subscription left without time lapses
+// at once.
+func (r *Repo) refundSubscription(ctx context.Context, order *Order, refund *Refund) error {
+	months, ok := subscriptionMonths(order.GoodID)
+	if !ok {
+		return nil
+	}
+	if order.Amount > 1 {
+		months *= int(order.Amount)
+	}
+	sub := &Subscription{}
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", order.AffiliateID).First(sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bought := sub.ExpiresAt.Sub(sub.ExpiresAt.AddDate(0, -months, 0))
+	cut := time.Duration(float64(bought) * float64(refund.Amount) / float64(order.Payable()))
+	sub.ExpiresAt = sub.ExpiresAt.Add(-cut)
+	if !sub.ExpiresAt.After(time.Now()) {
+		sub.Status = SubscriptionStatusLapsed
+	}
+	err = r.conn(ctx).Model(sub).Updates(map[string]interface{}{
+		"expires_at": sub.ExpiresAt,
+		"status":     sub.Status,
+	}).Error
+	if err != nil {
+		return err
+	}
+	orderID := order.ID
+	if err := r.recordSubscription(ctx, sub, SubscriptionEventRefunded, &orderID); err != nil {
+		return err
+	}
+	return r.syncPro(ctx, sub)
+}
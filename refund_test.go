@@ -0,0 +1,153 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestRefunds(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	provider := models.NewMockPaymentProvider([]byte("secret"))
+	alice := &models.User{}
+	alice.ID = 1
+	admin := &models.Administrator{}
+	admin.ID = 1
+
+	paid := func(id string, price models.Price, amount uint, typ models.OrderType, good uint) *models.Order {
+		t.Helper()
+		o := &models.Order{TimestamppedID: id, Price: price, Amount: amount, Type: typ, GoodID: good, AffiliateID: 1}
+		if err := repo.CreateOrder(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		attempt, _, err := repo.StartPayment(ctx, provider, o, "openid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body, _ := provider.Pay(attempt.OutTradeNo, price)
+		if _, err := repo.HandlePaymentCallback(ctx, provider, header, body); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	order := func(o *models.Order) models.Order {
+		t.Helper()
+		current, err := repo.GetOrderByID(ctx, o.TimestamppedID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	credit := func() models.Price {
+		u, _ := repo.FindUser(ctx, 1)
+		return u.RemainingCredit
+	}
+
+	credits := paid("20220301000010", models.ToPrice(5), 5, models.OrderTypeBuyCredits, models.GetCreditGoodID())
+
+	t.Run("partial", func(t *testing.T) {
+		refund, err := repo.RequestOrderRefund(ctx, credits, models.ToPrice(2), "changed my mind", models.UserActor(alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refund.Status != models.RefundStatusApproved {
+			t.Errorf("small refund status = %s, want approved", refund.Status)
+		}
+		if _, err := repo.RequestOrderRefund(ctx, credits, models.ToPrice(4), "", models.UserActor(alice)); !errors.Is(err, models.ErrRefundAmount) {
+			t.Errorf("refunding more than paid: error = %v, want ErrRefundAmount", err)
+		}
+		refund, err = repo.ProcessRefund(ctx, provider, refund)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refund.Status != models.RefundStatusSucceeded {
+			t.Errorf("status = %s, want succeeded", refund.Status)
+		}
+		if got := credit(); got != models.ToPrice(3) {
+			t.Errorf("credit = %d, want %d", got, models.ToPrice(3))
+		}
+		if o := order(credits); o.Status != models.OrderStatusPartiallyRefunded {
+			t.Errorf("order status = %d, want partially refunded", o.Status)
+		}
+		if got := repo.GetNetRevenu(ctx); got != models.ToPrice(3) {
+			t.Errorf("GetNetRevenu() = %d, want %d", got, models.ToPrice(3))
+		}
+	})
+
+	t.Run("needs approval", func(t *testing.T) {
+		threshold := models.RefundApprovalThreshold
+		models.RefundApprovalThreshold = models.ToPrice(1)
+		defer func() { models.RefundApprovalThreshold = threshold }()
+
+		refund, err := repo.RequestOrderRefund(ctx, credits, models.ToPrice(3), "", models.UserActor(alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refund.Status != models.RefundStatusRequested {
+			t.Fatalf("status = %s, want requested", refund.Status)
+		}
+		if _, err := repo.ProcessRefund(ctx, provider, refund); !errors.Is(err, models.ErrRefundState) {
+			t.Errorf("processing an unapproved refund: error = %v, want ErrRefundState", err)
+		}
+		pending, err := repo.ListPendingRefunds(ctx, 10, 0)
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("ListPendingRefunds() = %d, %v, want 1", len(pending), err)
+		}
+		if err := repo.ApproveRefund(ctx, refund, admin); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ProcessRefund(ctx, provider, refund); err != nil {
+			t.Fatal(err)
+		}
+		if got := credit(); got != 0 {
+			t.Errorf("credit = %d, want 0", got)
+		}
+		if o := order(credits); o.Status != models.OrderStatusRefunded {
+			t.Errorf("order status = %d, want refunded", o.Status)
+		}
+	})
+
+	t.Run("spent credit", func(t *testing.T) {
+		o := paid("20220301000011", models.ToPrice(2), 2, models.OrderTypeBuyCredits, models.GetCreditGoodID())
+		if _, err := repo.DebitUser(ctx, alice, models.ToPrice(2), models.CreditReasonSessionCharge, nil, models.SessionActorSystem); err != nil {
+			t.Fatal(err)
+		}
+		refund, err := repo.RequestOrderRefund(ctx, o, models.ToPrice(2), "", models.UserActor(alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ProcessRefund(ctx, provider, refund); !errors.Is(err, models.ErrInsufficientCredit) {
+			t.Errorf("refunding spent credit: error = %v, want ErrInsufficientCredit", err)
+		}
+		if current, _ := repo.GetRefund(ctx, refund.ID); current.Status != models.RefundStatusApproved {
+			t.Errorf("status = %s, want approved", current.Status)
+		}
+	})
+
+	t.Run("subscription", func(t *testing.T) {
+		good, _ := repo.GetGoodByID(ctx, models.GetMonthlySubscriptionGoodID())
+		o := paid("20220301000012", good.Price, 1, models.OrderTypeSubscription, good.ID)
+		if u, _ := repo.FindUser(ctx, 1); !u.IsPro {
+			t.Fatal("subscription was not activated")
+		}
+		refund, err := repo.RequestOrderRefund(ctx, o, good.Price, "", models.UserActor(alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ProcessRefund(ctx, provider, refund); err != nil {
+			t.Fatal(err)
+		}
+		sub, _ := repo.GetUserSubscription(ctx, alice)
+		if sub.Status != models.SubscriptionStatusLapsed {
+			t.Errorf("subscription status = %s, want lapsed", sub.Status)
+		}
+		if u, _ := repo.FindUser(ctx, 1); u.IsPro {
+			t.Error("user is still pro after a full refund")
+		}
+	})
+}
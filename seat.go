@@ -1,7 +1,7 @@
 package models
 
 import (
-	"errors"
+	"context"
 	"time"
 
 	"gorm.io/gorm"
@@ -18,6 +18,9 @@ type Seat struct {
 	gorm.Model
 	Label         string
 	StoreID       uint
+	Class         string         `gorm:"type:varchar(32);not null;default:''"`
+	Zone          string         `gorm:"type:varchar(32);not null;default:''" json:"zone"`
+	Attributes    SeatAttributes `gorm:"type:jsonb;not null;default:'[]'" json:"attributes"`
 	CurrentStatus SeatStatusEnum `json:"-"`
 	Status        []SeatStatus
 	Devices       []Device `json:"-"`
@@ -59,13 +62,13 @@ func (s *Seat) GetNewDayOfStatus(day time.Time) []SeatStatus {
 }
 
 // deprecated
-func (s *Seat) CombineStatus(day time.Time) (*CombinedSeatStatus, error) {
+func (r *Repo) CombineSeatStatus(ctx context.Context, s *Seat, day time.Time) (*CombinedSeatStatus, error) {
 	dayIdentifier := uint(day.Year())*1000 + uint(day.Month())*10 + uint(day.Day())
 	status := make([]SeatStatus, 0, 24)
-	tx := db.Model(&SeatStatus{}).Where("SeatID = ? AND Date = ?", s.ID, dayIdentifier).Find(&status)
+	tx := r.conn(ctx).Model(&SeatStatus{}).Where("SeatID = ? AND Date = ?", s.ID, dayIdentifier).Find(&status)
 
 	if tx.Error != nil || len(status) == 0 {
-		return nil, errors.New("查询座位状态失败")
+		return nil, ErrSeatStatusQuery.Wrap(tx.Error)
 	}
 
 	ret := &CombinedSeatStatus{
@@ -89,27 +92,27 @@ func (s *Seat) CombineStatus(day time.Time) (*CombinedSeatStatus, error) {
 	return ret, nil
 }
 
-func GetSeatByIDWithDevices(id uint) *Seat {
+func (r *Repo) GetSeatByIDWithDevices(ctx context.Context, id uint) *Seat {
 	seat := &Seat{}
-	tx := db.Preload("Devices").First(seat, "id = ?", id)
+	tx := r.conn(ctx).Preload("Devices").First(seat, "id = ?", id)
 	if tx.Error != nil {
 		return nil
 	}
 	return seat
 }
 
-func GetSeatByID(id uint) *Seat {
+func (r *Repo) GetSeatByID(ctx context.Context, id uint) *Seat {
 	seat := &Seat{}
-	tx := db.First(seat, "id = ?", id)
+	tx := r.conn(ctx).First(seat, "id = ?", id)
 	if tx.Error != nil {
 		return nil
 	}
 	return seat
 }
 
-func (s *Seat) SetStatus(status SeatStatusEnum) error {
+func (r *Repo) SetSeatStatus(ctx context.Context, s *Seat, status SeatStatusEnum) error {
 	s.CurrentStatus = status
-	tx := db.Save(s)
+	tx := r.conn(ctx).Save(s)
 	return tx.Error
 }
 
@@ -0,0 +1,440 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SeatMapFormat is the version of the seat map schema.
+const SeatMapFormat = 1
+
+// SeatMap lays out the floors of a store. Coordinates are in metres from
+// the top left corner of a floor, rotations in degrees clockwise.
+type SeatMap struct {
+	Format int            `json:"format"`
+	Floors []SeatMapFloor `json:"floors"`
+}
+
+type SeatMapFloor struct {
+	ID     string        `json:"id"`
+	Name   string        `json:"name"`
+	Width  float64       `json:"width"`
+	Height float64       `json:"height"`
+	Zones  []SeatMapZone `json:"zones,omitempty"`
+	Walls  []SeatMapWall `json:"walls,omitempty"`
+	Doors  []SeatMapDoor `json:"doors,omitempty"`
+	Seats  []SeatMapSeat `json:"seats"`
+}
+
+type SeatMapPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// SeatMapZone is an area of a floor. Its ID is stored in Seat.Zone, so it
+// is unique in the map.
+type SeatMapZone struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Outline []SeatMapPoint `json:"outline,omitempty"`
+}
+
+type SeatMapWall struct {
+	From SeatMapPoint `json:"from"`
+	To   SeatMapPoint `json:"to"`
+}
+
+type SeatMapDoor struct {
+	At       SeatMapPoint `json:"at"`
+	Width    float64      `json:"width"`
+	Rotation float64      `json:"rotation"`
+}
+
+// SeatMapSeat places a seat on a floor. SeatID binds it to a Seat; zero
+// means the seat is yet to be created.
+type SeatMapSeat struct {
+	SeatID     uint           `json:"seat_id,omitempty"`
+	Label      string         `json:"label"`
+	Zone       string         `json:"zone,omitempty"`
+	Class      string         `json:"class,omitempty"`
+	Attributes SeatAttributes `json:"attributes,omitempty"`
+	At         SeatMapPoint   `json:"at"`
+	Rotation   float64        `json:"rotation"`
+}
+
+func (m SeatMap) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+func (m *SeatMap) Scan(v interface{}) error {
+	return scanJSON(v, m)
+}
+
+// SeatMapError tells where a seat map is invalid. It unwraps to
+// ErrSeatMapInvalid.
+type SeatMapError struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (e *SeatMapError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrSeatMapInvalid.Error(), e.Path, e.Reason)
+}
+
+func (e *SeatMapError) Unwrap() error {
+	return ErrSeatMapInvalid
+}
+
+func seatMapError(path, format string, args ...interface{}) *SeatMapError {
+	return &SeatMapError{Path: path, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks the map follows the schema: IDs are set and unique,
+// everything lies on its floor and each seat is bound at most once. It
+// sorts the attributes of the seats.
+func (m *SeatMap) Validate() error {
+	if m.Format != SeatMapFormat {
+		return seatMapError("format", "unsupported format %d", m.Format)
+	}
+	if len(m.Floors) == 0 {
+		return seatMapError("floors", "no floors")
+	}
+	floors, zones, seats := map[string]bool{}, map[string]bool{}, map[uint]bool{}
+	for i := range m.Floors {
+		f := &m.Floors[i]
+		path := fmt.Sprintf("floors[%d]", i)
+		if f.ID == "" || floors[f.ID] {
+			return seatMapError(path+".id", "missing or repeated id %q", f.ID)
+		}
+		floors[f.ID] = true
+		if !(f.Width > 0) || !(f.Height > 0) {
+			return seatMapError(path, "floor has no area")
+		}
+		inside := func(p SeatMapPoint) bool {
+			return p.X >= 0 && p.X <= f.Width && p.Y >= 0 && p.Y <= f.Height
+		}
+		onFloor := map[string]bool{}
+		for j, z := range f.Zones {
+			zpath := fmt.Sprintf("%s.zones[%d]", path, j)
+			if z.ID == "" || len(z.ID) > 32 || zones[z.ID] {
+				return seatMapError(zpath+".id", "missing, too long or repeated id %q", z.ID)
+			}
+			zones[z.ID], onFloor[z.ID] = true, true
+			for k, p := range z.Outline {
+				if !inside(p) {
+					return seatMapError(fmt.Sprintf("%s.outline[%d]", zpath, k), "point off the floor")
+				}
+			}
+		}
+		for j, w := range f.Walls {
+			if !inside(w.From) || !inside(w.To) {
+				return seatMapError(fmt.Sprintf("%s.walls[%d]", path, j), "wall off the floor")
+			}
+		}
+		for j, d := range f.Doors {
+			if !inside(d.At) || !(d.Width > 0) || !validRotation(d.Rotation) {
+				return seatMapError(fmt.Sprintf("%s.doors[%d]", path, j), "door off the floor, without width or badly rotated")
+			}
+		}
+		for j := range f.Seats {
+			s := &f.Seats[j]
+			spath := fmt.Sprintf("%s.seats[%d]", path, j)
+			switch {
+			case s.Label == "":
+				return seatMapError(spath+".label", "missing label")
+			case s.Zone != "" && !onFloor[s.Zone]:
+				return seatMapError(spath+".zone", "no zone %q on the floor", s.Zone)
+			case len(s.Class) > 32:
+				return seatMapError(spath+".class", "class too long")
+			case !inside(s.At):
+				return seatMapError(spath+".at", "seat off the floor")
+			case !validRotation(s.Rotation):
+				return seatMapError(spath+".rotation", "rotation out of [0, 360)")
+			case s.SeatID != 0 && seats[s.SeatID]:
+				return seatMapError(spath+".seat_id", "seat %d placed twice", s.SeatID)
+			}
+			if s.SeatID != 0 {
+				seats[s.SeatID] = true
+			}
+			attrs, err := s.Attributes.normalize()
+			if err != nil {
+				return seatMapError(spath+".attributes", "unknown attribute")
+			}
+			s.Attributes = attrs
+		}
+	}
+	return nil
+}
+
+func validRotation(deg float64) bool {
+	return deg >= 0 && deg < 360
+}
+
+// SeatCount returns the number of seats placed on the map.
+func (m *SeatMap) SeatCount() uint {
+	var n uint
+	for _, f := range m.Floors {
+		n += uint(len(f.Seats))
+	}
+	return n
+}
+
+// SeatMapRevision is a version of the seat map of a store.
+type SeatMapRevision struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	StoreID   uint      `gorm:"not null;uniqueIndex:idx_seat_map_revisions_version" json:"store_id"`
+	Version   uint      `gorm:"not null;uniqueIndex:idx_seat_map_revisions_version" json:"version"`
+	Map       *SeatMap  `gorm:"type:jsonb;not null" json:"map"`
+	Note      string    `gorm:"type:varchar(255);not null;default:''" json:"note"`
+	Actor     string    `gorm:"type:varchar(64);not null;default:''" json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SeatMapDiff is what applying a seat map does to the seats of a store.
+type SeatMapDiff struct {
+	Create []*SeatMapSeat `json:"create"`
+	Update []*SeatMapSeat `json:"update"`
+	// Restore are seats deleted before that the map places again.
+	Restore []*SeatMapSeat `json:"restore"`
+	// Delete are the IDs of seats the map no longer places.
+	Delete []uint `json:"delete"`
+}
+
+// Empty reports whether the seats are left as they are.
+func (d *SeatMapDiff) Empty() bool {
+	return len(d.Create)+len(d.Update)+len(d.Restore)+len(d.Delete) == 0
+}
+
+func migrateSeatMaps(db *gorm.DB) error {
+	if err := createTables(db, &SeatMapRevision{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	if !m.HasColumn(&Store{}, "SeatMapVersion") {
+		if err := m.AddColumn(&Store{}, "SeatMapVersion"); err != nil {
+			return err
+		}
+	}
+	return execAll(db, syncSeatCountSQL)
+}
+
+func dropSeatMaps(db *gorm.DB) error {
+	if err := db.Migrator().DropTable(&SeatMapRevision{}); err != nil {
+		return err
+	}
+	return db.Migrator().DropColumn(&Store{}, "SeatMapVersion")
+}
+
+const syncSeatCountSQL = `UPDATE stores SET seat_count = (
+	SELECT count(*) FROM seats WHERE seats.store_id = stores.id AND seats.deleted_at IS NULL
+)`
+
+// syncSeatCount recounts the seats of the store storeID.
+func (r *Repo) syncSeatCount(ctx context.Context, storeID uint) error {
+	return r.conn(ctx).Exec(syncSeatCountSQL+" WHERE id = ?", storeID).Error
+}
+
+// DecodeSeatMap returns the seat map of the store, or nil when it has
+// none or only a map from before the schema.
+func (s *Store) DecodeSeatMap() (*SeatMap, error) {
+	if s.SeatMapVersion == 0 || len(s.SeatMap) == 0 {
+		return nil, nil
+	}
+	m := &SeatMap{}
+	if err := json.Unmarshal(s.SeatMap, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// diffSeatMap compares the map with seats, every seat of the store
+// including deleted ones.
+func diffSeatMap(seats []Seat, m *SeatMap) (*SeatMapDiff, error) {
+	byID := make(map[uint]*Seat, len(seats))
+	for i := range seats {
+		byID[seats[i].ID] = &seats[i]
+	}
+	diff := &SeatMapDiff{}
+	placed := map[uint]bool{}
+	for i := range m.Floors {
+		for j := range m.Floors[i].Seats {
+			ms := &m.Floors[i].Seats[j]
+			if ms.SeatID == 0 {
+				diff.Create = append(diff.Create, ms)
+				continue
+			}
+			seat, ok := byID[ms.SeatID]
+			if !ok {
+				return nil, seatMapError(fmt.Sprintf("floors[%d].seats[%d].seat_id", i, j), "no seat %d in the store", ms.SeatID)
+			}
+			placed[seat.ID] = true
+			switch {
+			case seat.DeletedAt.Valid:
+				diff.Restore = append(diff.Restore, ms)
+			case seat.Label != ms.Label || seat.Zone != ms.Zone || seat.Class != ms.Class || !sameAttributes(seat.Attributes, ms.Attributes):
+				diff.Update = append(diff.Update, ms)
+			}
+		}
+	}
+	for _, seat := range seats {
+		if !seat.DeletedAt.Valid && !placed[seat.ID] {
+			diff.Delete = append(diff.Delete, seat.ID)
+		}
+	}
+	sort.Slice(diff.Delete, func(i, j int) bool { return diff.Delete[i] < diff.Delete[j] })
+	return diff, nil
+}
+
+func sameAttributes(a, b SeatAttributes) bool {
+	a, _ = a.normalize()
+	b, _ = b.normalize()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repo) diffSeatMap(ctx context.Context, storeID uint, m *SeatMap) (*SeatMapDiff, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	seats := make([]Seat, 0)
+	if err := r.conn(ctx).Unscoped().Where("store_id = ?", storeID).Find(&seats).Error; err != nil {
+		return nil, err
+	}
+	return diffSeatMap(seats, m)
+}
+
+// DiffSeatMap returns what applying m to store would change.
+func (r *Repo) DiffSeatMap(ctx context.Context, store *Store, m *SeatMap) (*SeatMapDiff, error) {
+	return r.diffSeatMap(ctx, store.ID, m)
+}
+
+// ApplySeatMap makes m the seat map of store, creating, updating, restoring
+// and deleting seats to match it. base is the version m was edited from;
+// if the map changed since, ErrSeatMapConflict is returned. Seats created
+// get their IDs filled in m.
+func (r *Repo) ApplySeatMap(ctx context.Context, store *Store, m *SeatMap, base uint, note, actor string) (*SeatMapRevision, error) {
+	rev := &SeatMapRevision{StoreID: store.ID, Map: m, Note: truncate(note, 255), Actor: actor}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		locked := &Store{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(locked, "id = ?", store.ID).Error
+		if err != nil {
+			return err
+		}
+		if locked.SeatMapVersion != base {
+			return ErrSeatMapConflict
+		}
+		diff, err := tx.diffSeatMap(ctx, store.ID, m)
+		if err != nil {
+			return err
+		}
+
+		if len(diff.Delete) > 0 {
+			var booked int64
+			err := tx.conn(ctx).Model(&Session{}).
+				Where("seat_id IN ?", diff.Delete).
+				Where("status IN ?", blockingSessionStatuses).
+				Where("period && tstzrange(?::timestamptz, NULL)", time.Now()).
+				Count(&booked).Error
+			if err != nil {
+				return err
+			}
+			if booked > 0 {
+				return ErrSeatBooked
+			}
+			if err := tx.conn(ctx).Where("id IN ?", diff.Delete).Delete(&Seat{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, ms := range diff.Create {
+			seat := &Seat{
+				StoreID:       store.ID,
+				Label:         ms.Label,
+				Zone:          ms.Zone,
+				Class:         ms.Class,
+				Attributes:    ms.Attributes,
+				CurrentStatus: SeatStatusEnumVacancy,
+			}
+			if err := tx.conn(ctx).Create(seat).Error; err != nil {
+				return err
+			}
+			ms.SeatID = seat.ID
+		}
+		for _, ms := range append(diff.Update, diff.Restore...) {
+			err := tx.conn(ctx).Unscoped().Model(&Seat{}).Where("id = ?", ms.SeatID).Updates(map[string]interface{}{
+				"label":      ms.Label,
+				"zone":       ms.Zone,
+				"class":      ms.Class,
+				"attributes": ms.Attributes,
+				"deleted_at": nil,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		rev.Version = base + 1
+		if err := tx.conn(ctx).Create(rev).Error; err != nil {
+			return err
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		err = tx.conn(ctx).Model(&Store{}).Where("id = ?", store.ID).Updates(map[string]interface{}{
+			"seat_map":         data,
+			"seat_map_version": rev.Version,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.syncSeatCount(ctx, store.ID); err != nil {
+			return err
+		}
+		store.SeatMap = data
+		store.SeatMapVersion = rev.Version
+		store.SeatCount = m.SeatCount()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// ListSeatMapRevisions returns the versions of the seat map of store,
+// newest first.
+func (r *Repo) ListSeatMapRevisions(ctx context.Context, store *Store) ([]*SeatMapRevision, error) {
+	result := make([]*SeatMapRevision, 0)
+	tx := r.conn(ctx).Where("store_id = ?", store.ID).Order("version desc").Find(&result)
+	return result, tx.Error
+}
+
+func (r *Repo) GetSeatMapRevision(ctx context.Context, store *Store, version uint) (*SeatMapRevision, error) {
+	rev := &SeatMapRevision{}
+	err := r.conn(ctx).Where("store_id = ? AND version = ?", store.ID, version).First(rev).Error
+	return rev, err
+}
+
+// RollbackSeatMap applies the map of an earlier version again, as a new
+// version.
+func (r *Repo) RollbackSeatMap(ctx context.Context, store *Store, version, base uint, actor string) (*SeatMapRevision, error) {
+	old, err := r.GetSeatMapRevision(ctx, store, version)
+	if err != nil {
+		return nil, err
+	}
+	return r.ApplySeatMap(ctx, store, old.Map, base, fmt.Sprintf("rollback to version %d", version), actor)
+}
@@ -0,0 +1,136 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+const seatMapJSON = `{
+	"format": 1,
+	"floors": [{
+		"id": "1f", "name": "Ground floor", "width": 20, "height": 10,
+		"zones": [{"id": "quiet", "name": "Quiet room", "outline": [{"x": 0, "y": 0}, {"x": 10, "y": 10}]}],
+		"walls": [{"from": {"x": 10, "y": 0}, "to": {"x": 10, "y": 8}}],
+		"doors": [{"at": {"x": 10, "y": 9}, "width": 1, "rotation": 90}],
+		"seats": [
+			{"seat_id": 1, "label": "A1", "zone": "quiet", "attributes": ["window", "power"], "at": {"x": 2, "y": 2}},
+			{"label": "B1", "at": {"x": 15, "y": 5}, "rotation": 180}
+		]
+	}]
+}`
+
+func parseSeatMap(t *testing.T) *models.SeatMap {
+	t.Helper()
+	m := &models.SeatMap{}
+	if err := json.Unmarshal([]byte(seatMapJSON), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSeatMapValidate(t *testing.T) {
+	if err := parseSeatMap(t).Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	cases := []struct {
+		name string
+		edit func(m *models.SeatMap)
+		path string
+	}{
+		{"format", func(m *models.SeatMap) { m.Format = 2 }, "format"},
+		{"seat off the floor", func(m *models.SeatMap) { m.Floors[0].Seats[1].At.X = 21 }, "floors[0].seats[1].at"},
+		{"unknown zone", func(m *models.SeatMap) { m.Floors[0].Seats[1].Zone = "loud" }, "floors[0].seats[1].zone"},
+		{"seat placed twice", func(m *models.SeatMap) { m.Floors[0].Seats[1].SeatID = 1 }, "floors[0].seats[1].seat_id"},
+		{"rotation", func(m *models.SeatMap) { m.Floors[0].Seats[0].Rotation = 360 }, "floors[0].seats[0].rotation"},
+		{"attribute", func(m *models.SeatMap) { m.Floors[0].Seats[0].Attributes = models.SeatAttributes{"sofa"} }, "floors[0].seats[0].attributes"},
+	}
+	for _, c := range cases {
+		m := parseSeatMap(t)
+		c.edit(m)
+		err := m.Validate()
+		var mapErr *models.SeatMapError
+		if !errors.As(err, &mapErr) || mapErr.Path != c.path || !errors.Is(err, models.ErrSeatMapInvalid) {
+			t.Errorf("%s: Validate() = %v, want an error at %s", c.name, err, c.path)
+		}
+	}
+}
+
+func TestApplySeatMap(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"stores": [{"id": 1, "name": "main"}, {"id": 2, "name": "other"}],
+		"seats": [
+			{"id": 1, "store_id": 1, "label": "A"},
+			{"id": 2, "store_id": 1, "label": "A"},
+			{"id": 3, "store_id": 2, "label": "A"}
+		]
+	}`))
+	ctx := context.Background()
+	store := repo.GetStoreByID(ctx, 1)
+
+	m := parseSeatMap(t)
+	diff, err := repo.DiffSeatMap(ctx, store, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Create) != 1 || len(diff.Update) != 1 || len(diff.Delete) != 1 || diff.Delete[0] != 2 {
+		t.Errorf("diff = %+v, want seat B1 created, 1 updated and 2 deleted", diff)
+	}
+
+	rev, err := repo.ApplySeatMap(ctx, store, m, 0, "first map", models.SessionActorSystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Version != 1 || store.SeatMapVersion != 1 || m.Floors[0].Seats[1].SeatID == 0 {
+		t.Errorf("revision %d, store version %d, new seat %d", rev.Version, store.SeatMapVersion, m.Floors[0].Seats[1].SeatID)
+	}
+	created := m.Floors[0].Seats[1].SeatID
+	if seat := repo.GetSeatByID(ctx, 1); seat.Label != "A1" || seat.Zone != "quiet" || len(seat.Attributes) != 2 {
+		t.Errorf("seat 1 = %+v, want it to match the map", seat)
+	}
+	if repo.GetSeatByID(ctx, 2) != nil {
+		t.Error("seat 2 is not deleted")
+	}
+	if store = repo.GetStoreByID(ctx, 1); store.SeatCount != 2 {
+		t.Errorf("SeatCount = %d, want 2", store.SeatCount)
+	}
+
+	if _, err := repo.ApplySeatMap(ctx, store, parseSeatMap(t), 0, "stale", models.SessionActorSystem); !errors.Is(err, models.ErrSeatMapConflict) {
+		t.Errorf("applying over a stale version: error = %v, want ErrSeatMapConflict", err)
+	}
+	other := parseSeatMap(t)
+	other.Floors[0].Seats[0].SeatID = 3
+	if _, err := repo.ApplySeatMap(ctx, store, other, 1, "", models.SessionActorSystem); !errors.Is(err, models.ErrSeatMapInvalid) {
+		t.Errorf("placing a seat of another store: error = %v, want ErrSeatMapInvalid", err)
+	}
+
+	// a map with seat 2 back and without the seat created above
+	m2 := &models.SeatMap{Format: models.SeatMapFormat, Floors: []models.SeatMapFloor{{
+		ID: "1f", Width: 5, Height: 5,
+		Seats: []models.SeatMapSeat{{SeatID: 1, Label: "A1"}, {SeatID: 2, Label: "A2"}},
+	}}}
+	if _, err := repo.ApplySeatMap(ctx, store, m2, 1, "", models.SessionActorSystem); err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetSeatByID(ctx, 2) == nil || repo.GetSeatByID(ctx, created) != nil {
+		t.Error("seat 2 is not restored or the created seat is not deleted")
+	}
+
+	rev, err = repo.RollbackSeatMap(ctx, store, 1, 2, models.SessionActorSystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Version != 3 || repo.GetSeatByID(ctx, created) == nil || repo.GetSeatByID(ctx, 2) != nil {
+		t.Errorf("rollback to version 1 did not bring its seats back")
+	}
+	revs, err := repo.ListSeatMapRevisions(ctx, store)
+	if err != nil || len(revs) != 3 || revs[0].Version != 3 {
+		t.Errorf("ListSeatMapRevisions() = %d revisions, %v", len(revs), err)
+	}
+}
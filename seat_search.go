@@ -0,0 +1,249 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type SeatAttribute string
+
+const (
+	SeatAttributeWindow   SeatAttribute = "window"
+	SeatAttributePower    SeatAttribute = "power"
+	SeatAttributeQuiet    SeatAttribute = "quiet"
+	SeatAttributeStanding SeatAttribute = "standing"
+	SeatAttributeLamp     SeatAttribute = "lamp"
+	SeatAttributeMonitor  SeatAttribute = "monitor"
+)
+
+var seatAttributes = map[SeatAttribute]bool{
+	SeatAttributeWindow:   true,
+	SeatAttributePower:    true,
+	SeatAttributeQuiet:    true,
+	SeatAttributeStanding: true,
+	SeatAttributeLamp:     true,
+	SeatAttributeMonitor:  true,
+}
+
+// SeatAttributes is the set of features a seat has, kept sorted.
+type SeatAttributes []SeatAttribute
+
+func (a SeatAttributes) Value() (driver.Value, error) {
+	if a == nil {
+		a = SeatAttributes{}
+	}
+	return json.Marshal(a)
+}
+
+func (a *SeatAttributes) Scan(v interface{}) error {
+	return scanJSON(v, a)
+}
+
+// Has reports whether the seat has attr.
+func (a SeatAttributes) Has(attr SeatAttribute) bool {
+	for _, x := range a {
+		if x == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize checks attrs are known and returns them sorted, without
+// repeats.
+func (a SeatAttributes) normalize() (SeatAttributes, error) {
+	result := make(SeatAttributes, 0, len(a))
+	for _, attr := range a {
+		if !seatAttributes[attr] {
+			return nil, ErrInvalidArgument
+		}
+		if !result.Has(attr) {
+			result = append(result, attr)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+func migrateSeatAttributes(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, field := range []string{"Zone", "Attributes"} {
+		if !m.HasColumn(&Seat{}, field) {
+			if err := m.AddColumn(&Seat{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	return execAll(db,
+		`CREATE INDEX IF NOT EXISTS idx_seats_attributes ON seats USING gin (attributes jsonb_path_ops)`,
+	)
+}
+
+func dropSeatAttributes(db *gorm.DB) error {
+	if err := execAll(db, `DROP INDEX IF EXISTS idx_seats_attributes`); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	if err := m.DropColumn(&Seat{}, "Attributes"); err != nil {
+		return err
+	}
+	return m.DropColumn(&Seat{}, "Zone")
+}
+
+// SetSeatAttributes sets the zone and the attributes of seat.
+func (r *Repo) SetSeatAttributes(ctx context.Context, seat *Seat, zone string, attrs SeatAttributes) error {
+	attrs, err := attrs.normalize()
+	if err != nil {
+		return err
+	}
+	err = r.conn(ctx).Model(seat).Updates(map[string]interface{}{
+		"zone":       zone,
+		"attributes": attrs,
+	}).Error
+	if err != nil {
+		return err
+	}
+	seat.Zone = zone
+	seat.Attributes = attrs
+	return nil
+}
+
+// SeatQuery looks for seats free from Start to End, in the store StoreID
+// or else in the stores within Near.
+type SeatQuery struct {
+	StoreID uint     `json:"store_id"`
+	Near    *GeoArea `json:"near"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Zone, when set, is the only zone searched.
+	Zone string `json:"zone"`
+	// Attributes are those every seat found has.
+	Attributes SeatAttributes `json:"attributes"`
+	// Preferred are attributes ranking the seats having more of them
+	// first.
+	Preferred SeatAttributes `json:"preferred"`
+
+	// Limit caps the number of seats found; zero means no cap.
+	Limit int `json:"limit"`
+}
+
+// SeatMatch is a seat found by SearchSeats.
+type SeatMatch struct {
+	Seat  *Seat  `json:"seat"`
+	Store *Store `json:"-"`
+	// Preferred counts the preferred attributes the seat has.
+	Preferred int `json:"preferred"`
+	// DistanceKm is how far the store is from the centre of the area
+	// searched, zero when searching one store.
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// SearchSeats returns the seats matching q that are free for all its time
+// range at stores open all that time. Seats with more preferred
+// attributes come first, then those closer by.
+func (r *Repo) SearchSeats(ctx context.Context, q *SeatQuery) ([]*SeatMatch, error) {
+	if q.Start.IsZero() || !q.End.After(q.Start) {
+		return nil, ErrInvalidTime
+	}
+	required, err := q.Attributes.normalize()
+	if err != nil {
+		return nil, err
+	}
+	preferred, err := q.Preferred.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	stores, err := r.searchStores(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*Store, len(stores))
+	storeIDs := make([]uint, 0, len(stores))
+	for _, s := range stores {
+		if s.Status == StoreStatusClosed || !s.IsOpen(q.Start, q.End) {
+			continue
+		}
+		byID[s.ID] = s
+		storeIDs = append(storeIDs, s.ID)
+	}
+	if len(storeIDs) == 0 {
+		return []*SeatMatch{}, nil
+	}
+
+	seats := make([]*Seat, 0)
+	tx := r.conn(ctx).Where("store_id IN ?", storeIDs)
+	if len(required) > 0 {
+		tx = tx.Where("attributes @> ?::jsonb", required)
+	}
+	if q.Zone != "" {
+		tx = tx.Where("zone = ?", q.Zone)
+	}
+	if err := tx.Find(&seats).Error; err != nil {
+		return nil, err
+	}
+	if len(seats) == 0 {
+		return []*SeatMatch{}, nil
+	}
+
+	seatIDs := make([]uint, len(seats))
+	for i, seat := range seats {
+		seatIDs[i] = seat.ID
+	}
+	busy, err := r.blockingSessions(ctx, seatIDs, q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*SeatMatch, 0, len(seats))
+	for _, seat := range seats {
+		if len(busy[seat.ID]) > 0 {
+			continue
+		}
+		m := &SeatMatch{Seat: seat, Store: byID[seat.StoreID]}
+		for _, attr := range preferred {
+			if seat.Attributes.Has(attr) {
+				m.Preferred++
+			}
+		}
+		if q.StoreID == 0 {
+			m.DistanceKm = q.Near.DistanceKm(m.Store)
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Preferred != b.Preferred {
+			return a.Preferred > b.Preferred
+		}
+		if a.DistanceKm != b.DistanceKm {
+			return a.DistanceKm < b.DistanceKm
+		}
+		return a.Seat.ID < b.Seat.ID
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result, nil
+}
+
+// searchStores returns the stores q searches.
+func (r *Repo) searchStores(ctx context.Context, q *SeatQuery) ([]*Store, error) {
+	stores := make([]*Store, 0)
+	if q.StoreID != 0 {
+		err := r.conn(ctx).Where("id = ?", q.StoreID).Find(&stores).Error
+		return stores, err
+	}
+	if q.Near == nil || q.Near.RadiusKm <= 0 {
+		return nil, ErrInvalidArgument
+	}
+	err := q.Near.scope(r.conn(ctx)).Find(&stores).Error
+	return stores, err
+}
@@ -0,0 +1,96 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestSearchSeats(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"stores": [
+			{"id": 1, "name": "near", "latitude": 31.2304, "longitude": 121.4737},
+			{"id": 2, "name": "farther", "latitude": 31.2400, "longitude": 121.4900},
+			{"id": 3, "name": "far", "latitude": 39.9042, "longitude": 116.4074}
+		],
+		"seats": [
+			{"id": 1, "store_id": 1, "label": "A", "zone": "quiet", "attributes": ["power", "window"]},
+			{"id": 2, "store_id": 1, "label": "A", "zone": "quiet", "attributes": ["power"]},
+			{"id": 3, "store_id": 1, "label": "B", "attributes": ["window"]},
+			{"id": 4, "store_id": 2, "label": "A", "attributes": ["power", "window"]},
+			{"id": 5, "store_id": 3, "label": "A", "attributes": ["power", "window"]}
+		],
+		"sessions": [
+			{"id": 1, "user_id": 1, "seat_id": 1,
+			 "start_time": "2022-03-01T09:00:00+08:00",
+			 "end_time": "2022-03-01T11:00:00+08:00"}
+		]
+	}`))
+	ctx := context.Background()
+
+	ids := func(matches []*models.SeatMatch) []uint {
+		result := make([]uint, len(matches))
+		for i, m := range matches {
+			result[i] = m.Seat.ID
+		}
+		return result
+	}
+	search := func(q *models.SeatQuery) []uint {
+		t.Helper()
+		matches, err := repo.SearchSeats(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids(matches)
+	}
+
+	near := &models.GeoArea{Latitude: 31.2304, Longitude: 121.4737, RadiusKm: 5}
+	got := search(&models.SeatQuery{
+		Near:       near,
+		Start:      *at(t, "10:00"),
+		End:        *at(t, "12:00"),
+		Attributes: models.SeatAttributes{models.SeatAttributePower},
+		Preferred:  models.SeatAttributes{models.SeatAttributeWindow},
+	})
+	// seat 1 is taken, seat 5 is too far and seat 3 has no power; seat 4
+	// has a window, so it comes before the closer seat 2.
+	if want := []uint{4, 2}; !equalIDs(got, want) {
+		t.Errorf("SearchSeats(near) = %v, want %v", got, want)
+	}
+
+	got = search(&models.SeatQuery{StoreID: 1, Start: *at(t, "12:00"), End: *at(t, "13:00"), Zone: "quiet"})
+	if want := []uint{1, 2}; !equalIDs(got, want) {
+		t.Errorf("SearchSeats(zone) = %v, want %v", got, want)
+	}
+
+	_, err := repo.SearchSeats(ctx, &models.SeatQuery{StoreID: 1, Start: *at(t, "12:00"), End: *at(t, "13:00"), Attributes: models.SeatAttributes{"sofa"}})
+	if !errors.Is(err, models.ErrInvalidArgument) {
+		t.Errorf("searching an unknown attribute: error = %v, want ErrInvalidArgument", err)
+	}
+
+	seat := repo.GetSeatByID(ctx, 3)
+	err = repo.SetSeatAttributes(ctx, seat, "", models.SeatAttributes{models.SeatAttributeWindow, models.SeatAttributePower, models.SeatAttributePower})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seat = repo.GetSeatByID(ctx, 3); len(seat.Attributes) != 2 || seat.Attributes[0] != models.SeatAttributePower {
+		t.Errorf("attributes = %v, want [power window]", seat.Attributes)
+	}
+}
+
+func equalIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
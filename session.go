@@ -1,29 +1,145 @@
 package models
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type SessionStatus string
 
 const (
-	SessionStatusValid    SessionStatus = "valid"
-	SessionStatusCanceled SessionStatus = "valid"
-	SessionStatusOnGoing  SessionStatus = "on_going"
-	SessionStatusExpired  SessionStatus = "expired"
-	SessionStatusDone     SessionStatus = "done"
+	SessionStatusHeld      SessionStatus = "held"
+	SessionStatusValid     SessionStatus = "valid"
+	SessionStatusCheckedIn SessionStatus = "checked_in"
+	SessionStatusCanceled  SessionStatus = "canceled"
+	SessionStatusOnGoing   SessionStatus = "on_going"
+	SessionStatusExpired   SessionStatus = "expired"
+	SessionStatusNoShow    SessionStatus = "no_show"
+	SessionStatusDone      SessionStatus = "done"
+
+	// SessionStatusReserved and SessionStatusCompleted name the stored
+	// "valid" and "done" values after the lifecycle they stand for.
+	SessionStatusReserved  = SessionStatusValid
+	SessionStatusCompleted = SessionStatusDone
 )
 
+// blockingSessionStatuses are the statuses under which a session holds its
+// seat. They are mirrored by the predicates of the exclusion constraints.
+var blockingSessionStatuses = []SessionStatus{
+	SessionStatusHeld,
+	SessionStatusReserved,
+	SessionStatusCheckedIn,
+	SessionStatusOnGoing,
+}
+
+// defaultSessionLength is used when a reservation has no end time.
+const defaultSessionLength = time.Hour + time.Minute*10
+
+const (
+	sessionSeatPeriodConstraint = "sessions_seat_period_excl"
+	sessionUserPeriodConstraint = "sessions_user_period_excl"
+
+	pgExclusionViolation = "23P01"
+)
+
+// The period column is generated from start_time and end_time. Two GiST
+// exclusion constraints on it keep a seat, and a user, from holding two
+// overlapping sessions; only sessions in a blocking status are covered.
+var sessionPeriodUpSQL = []string{
+	`CREATE EXTENSION IF NOT EXISTS btree_gist`,
+	`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS period tstzrange
+		GENERATED ALWAYS AS (tstzrange(start_time, end_time, '[)')) STORED`,
+}
+
+var sessionPeriodDownSQL = []string{
+	`ALTER TABLE sessions DROP CONSTRAINT IF EXISTS ` + sessionUserPeriodConstraint,
+	`ALTER TABLE sessions DROP CONSTRAINT IF EXISTS ` + sessionSeatPeriodConstraint,
+	`ALTER TABLE sessions DROP COLUMN IF EXISTS period`,
+}
+
+// replaceSessionExclusion (re)creates the exclusion constraints so that
+// they cover sessions in the given statuses.
+func replaceSessionExclusion(db *gorm.DB, statuses ...SessionStatus) error {
+	quoted := make([]string, len(statuses))
+	for i, st := range statuses {
+		quoted[i] = "'" + string(st) + "'"
+	}
+	predicate := "WHERE (deleted_at IS NULL AND status IN (" + strings.Join(quoted, ", ") + "))"
+
+	return execAll(db,
+		`ALTER TABLE sessions DROP CONSTRAINT IF EXISTS `+sessionSeatPeriodConstraint,
+		`ALTER TABLE sessions DROP CONSTRAINT IF EXISTS `+sessionUserPeriodConstraint,
+		`ALTER TABLE sessions ADD CONSTRAINT `+sessionSeatPeriodConstraint+`
+			EXCLUDE USING gist (seat_id WITH =, period WITH &&) `+predicate,
+		`ALTER TABLE sessions ADD CONSTRAINT `+sessionUserPeriodConstraint+`
+			EXCLUDE USING gist (user_id WITH =, period WITH &&) `+predicate,
+	)
+}
+
+// resolveLegacyOverlapSQL cancels every blocking session that overlaps an
+// older one on the same seat or of the same user, provided that older one
+// does not itself lose to an even older session. Run until nothing changes,
+// it keeps the first booking of every conflict.
+const resolveLegacyOverlapSQL = `
+UPDATE sessions s SET status = ?
+WHERE s.deleted_at IS NULL AND s.status IN ?
+AND EXISTS (
+	SELECT 1 FROM sessions t
+	WHERE t.deleted_at IS NULL AND t.status IN ? AND t.id < s.id
+	AND (t.seat_id = s.seat_id OR t.user_id = s.user_id) AND t.period && s.period
+	AND NOT EXISTS (
+		SELECT 1 FROM sessions u
+		WHERE u.deleted_at IS NULL AND u.status IN ? AND u.id < t.id
+		AND (u.seat_id = t.seat_id OR u.user_id = t.user_id) AND u.period && t.period
+	)
+)`
+
+func migrateSessionPeriod(db *gorm.DB) error {
+	// sessions saved without an end would hold their seat forever
+	err := db.Exec(
+		"UPDATE sessions SET end_time = start_time + ? * interval '1 second' WHERE end_time IS NULL",
+		int64(defaultSessionLength/time.Second),
+	).Error
+	if err != nil {
+		return err
+	}
+	if err := execAll(db, sessionPeriodUpSQL...); err != nil {
+		return err
+	}
+
+	// cancelled sessions used to be stored as valid, so old data overlaps
+	blocking := []SessionStatus{SessionStatusValid, SessionStatusOnGoing}
+	for {
+		tx := db.Exec(resolveLegacyOverlapSQL, SessionStatusCanceled, blocking, blocking, blocking)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if tx.RowsAffected == 0 {
+			break
+		}
+	}
+	return replaceSessionExclusion(db, blocking...)
+}
+
+func dropSessionPeriod(db *gorm.DB) error {
+	return execAll(db, sessionPeriodDownSQL...)
+}
+
 type Session struct {
 	gorm.Model
 	User   User `json:"-"`
@@ -37,18 +153,37 @@ type Session struct {
 
 	ActualEndTime *time.Time
 	BillingFee    Price
+	// BillingBreakdown itemises BillingFee when it was computed by a
+	// TariffBiller.
+	BillingBreakdown *BillingBreakdown `gorm:"type:jsonb" json:"billing_breakdown,omitempty"`
 
 	Status SessionStatus `gorm:"default:'valid'"`
 	// Validate *bool `gorm:"default:true"`
 
 	Token string `gorm:"uniqueIndex,type:varchar(1024)"`
+
+	// set on sessions materialised from a recurring reservation, Occurrence
+	// being the start time the series planned for this session.
+	RecurringReservationID *uint      `gorm:"index" json:"recurring_reservation_id,omitempty"`
+	Occurrence             *time.Time `json:"occurrence,omitempty"`
+}
+
+// SessionConflictError is returned when a reservation overlaps an existing
+// session. It matches ErrSeatTaken or ErrUserHasBooking under errors.Is.
+type SessionConflictError struct {
+	RequestError
+	// Session is the session that holds the requested time, or nil if it
+	// could not be determined.
+	Session *Session
 }
 
-func CreateSession(key []byte, u *User, s *Seat, startTime, endTime *time.Time) string {
-	uid := u.ID
+func (e *SessionConflictError) Unwrap() error {
+	return e.RequestError
+}
+
+func newSessionToken(key []byte, uid, sid uint) (string, error) {
 	uidBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(uidBytes, uint64(uid))
-	sid := s.ID
 	sidBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(sidBytes, uint64(sid))
 
@@ -69,60 +204,206 @@ func CreateSession(key []byte, u *User, s *Seat, startTime, endTime *time.Time)
 
 	encrypt, err := aes.NewCipher(key)
 	if err != nil {
-		return ""
+		return "", err
 	}
 
 	ciphertext := make([]byte, aes.BlockSize+len(hash))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		logrus.WithError(err).Error("failed to generate cipher when creating session")
-		return ""
+		return "", err
 	}
 
 	stream := cipher.NewCFBEncrypter(encrypt, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], hash)
 
-	token := base64.URLEncoding.EncodeToString(ciphertext)
+	return base64.URLEncoding.EncodeToString(ciphertext), nil
+}
+
+// randomToken returns n random bytes, hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
 
-	err = SaveSession(token, u, s, startTime, endTime)
+func (r *Repo) CreateSession(ctx context.Context, key []byte, u *User, s *Seat, startTime, endTime *time.Time) string {
+	session, err := r.ReserveSession(ctx, key, u, s, startTime, endTime)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to save session into database")
 		return ""
 	}
-	return token
+	return session.Token
 }
 
-func SaveSession(token string, u *User, s *Seat, startTime, endTime *time.Time) error {
-	tx := db.Create(&Session{
-		User:      *u,
+// ReserveSession books seat s for u in one atomic insert. Overlaps are
+// rejected by the database, and reported as a *SessionConflictError; times
+// the store is closed fail with ErrStoreClosed.
+func (r *Repo) ReserveSession(ctx context.Context, key []byte, u *User, s *Seat, startTime, endTime *time.Time) (*Session, error) {
+	session := &Session{
+		UserID:    u.ID,
+		SeatID:    s.ID,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}
+	if err := r.reserve(ctx, key, session); err != nil {
+		return nil, err
+	}
+	session.User = *u
+	session.Seat = *s
+	return session, nil
+}
+
+// reserve issues a token for session and inserts it as a reservation.
+func (r *Repo) reserve(ctx context.Context, key []byte, session *Session) error {
+	token, err := newSessionToken(key, session.UserID, session.SeatID)
+	if err != nil {
+		logrus.WithError(err).Error("failed to generate cipher when creating session")
+		return err
+	}
+	session.Token = token
+	session.Status = SessionStatusReserved
+	return r.insertSession(ctx, session)
+}
+
+func (r *Repo) SaveSession(ctx context.Context, token string, u *User, s *Seat, startTime, endTime *time.Time) error {
+	return r.insertSession(ctx, &Session{
 		UserID:    u.ID,
-		Seat:      *s,
 		SeatID:    s.ID,
 		Token:     token,
 		StartTime: startTime,
 		EndTime:   endTime,
+		Status:    SessionStatusValid,
 	})
-	return tx.Error
 }
 
-func GetSession(session string) *Session {
+func (r *Repo) insertSession(ctx context.Context, session *Session) error {
+	if session.EndTime == nil {
+		end := session.StartTime.Add(defaultSessionLength)
+		session.EndTime = &end
+	}
+	if !session.EndTime.After(*session.StartTime) {
+		return ErrInvalidTime
+	}
+	if err := r.checkStoreOpen(ctx, session.SeatID, *session.StartTime, *session.EndTime); err != nil {
+		return err
+	}
+
+	// the insert runs in its own (sub)transaction so that the clashing
+	// session can still be looked up after a violation.
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		return tx.conn(ctx).Omit(clause.Associations).Create(session).Error
+	})
+	return r.sessionConflict(ctx, err, session)
+}
+
+// rescheduleSession moves s to [start, end). Overlaps are reported as by
+// ReserveSession.
+func (r *Repo) rescheduleSession(ctx context.Context, s *Session, start, end *time.Time) error {
+	if !end.After(*start) {
+		return ErrInvalidTime
+	}
+	if err := r.checkStoreOpen(ctx, s.SeatID, *start, *end); err != nil {
+		return err
+	}
+
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		return tx.conn(ctx).Model(&Session{}).
+			Where("id = ?", s.ID).
+			Updates(map[string]interface{}{
+				"start_time": start,
+				"end_time":   end,
+			}).
+			Error
+	})
+	if err != nil {
+		probe := *s
+		probe.StartTime = start
+		probe.EndTime = end
+		return r.sessionConflict(ctx, err, &probe)
+	}
+	s.StartTime = start
+	s.EndTime = end
+	return nil
+}
+
+// checkStoreOpen fails with ErrStoreClosed unless the store of seatID is
+// open all the time from start to end.
+func (r *Repo) checkStoreOpen(ctx context.Context, seatID uint, start, end time.Time) error {
+	if seat := r.GetSeatByID(ctx, seatID); seat != nil {
+		if store := r.GetStoreByID(ctx, seat.StoreID); store != nil && !store.IsOpen(start, end) {
+			return ErrStoreClosed
+		}
+	}
+	return nil
+}
+
+// sessionConflict translates an exclusion violation raised while saving s
+// into a *SessionConflictError.
+func (r *Repo) sessionConflict(ctx context.Context, err error, s *Session) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgExclusionViolation {
+		return err
+	}
+
+	conflict := &SessionConflictError{}
+	column, id := "seat_id", s.SeatID
+	switch pgErr.ConstraintName {
+	case sessionSeatPeriodConstraint:
+		conflict.RequestError = ErrSeatTaken.Wrap(err)
+	case sessionUserPeriodConstraint:
+		conflict.RequestError = ErrUserHasBooking.Wrap(err)
+		column, id = "user_id", s.UserID
+	default:
+		return err
+	}
+
+	clash, lookupErr := r.findClashingSession(ctx, column, id, s.ID, s.StartTime, s.EndTime)
+	if lookupErr != nil {
+		logrus.WithError(lookupErr).Error("failed to look up the clashing session")
+	}
+	conflict.Session = clash
+	return conflict
+}
+
+// findClashingSession returns a blocking session whose column equals id
+// and whose period overlaps [start, end), ignoring the session except.
+func (r *Repo) findClashingSession(ctx context.Context, column string, id, except uint, start, end *time.Time) (*Session, error) {
+	clash := Session{}
+	tx := r.conn(ctx).
+		Where(column+" = ?", id).
+		Where("id <> ?", except).
+		Where("status IN ?", blockingSessionStatuses).
+		Where("period && tstzrange(?::timestamptz, ?::timestamptz, '[)')", start, end).
+		Order("start_time asc").
+		Limit(1).
+		Find(&clash)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return nil, tx.Error
+	}
+	return &clash, nil
+}
+
+func (r *Repo) GetSession(ctx context.Context, session string) *Session {
 	var s Session
-	tx := db.Preload("User").Preload("Seat").Where("token = ?", session).First(&s)
+	tx := r.conn(ctx).Preload("User").Preload("Seat").Where("token = ?", session).First(&s)
 	if tx.Error != nil {
 		return nil
 	}
 	return &s
 }
 
-func (s *Session) SetEndTime(t *time.Time) error {
+func (r *Repo) SetSessionEndTime(ctx context.Context, s *Session, t *time.Time) error {
 	s.EndTime = t
-	tx := db.Save(s)
+	tx := r.conn(ctx).Save(s)
 	return tx.Error
 }
 
-func (s *Session) SetStatus(status SessionStatus) error {
-	s.Status = status
-	return db.Save(s).Error
+// SetSessionStatus moves s to status on behalf of the system. See
+// TransitionSession.
+func (r *Repo) SetSessionStatus(ctx context.Context, s *Session, status SessionStatus) error {
+	return r.TransitionSession(ctx, s, status, SessionActorSystem)
 }
 
 // func (s *Session) SetValidate(v bool) error {
@@ -131,107 +412,61 @@ func (s *Session) SetStatus(status SessionStatus) error {
 // 	return tx.Error
 // }
 
-func ValidateSession(uid, seatID uint, start, end *time.Time) error {
-	var cnt int64 = 0
+// ValidateSession checks ahead of time whether a reservation would
+// conflict. The exclusion constraints remain the authority: a reservation
+// that passes here may still fail in ReserveSession under concurrency.
+func (r *Repo) ValidateSession(ctx context.Context, uid, seatID uint, start, end *time.Time) error {
 	if end == nil {
-		t := start.Add(time.Hour + time.Minute*10)
+		t := start.Add(defaultSessionLength)
 		end = &t
 	}
+	if !end.After(*start) {
+		return ErrInvalidTime
+	}
+	if err := r.checkStoreOpen(ctx, seatID, *start, *end); err != nil {
+		return err
+	}
 
-	// following circumstance is not valid
-	// 1. application -> start |-----------| end
-	//                  |----------|
-	//
-	// 2. application -> start |-----------| end
-	//                               |-----------|
-	//
-	// 3. application-> start |-----------| end
-	//                  |-----------------------|
-	//
-	// 4. application -> start |-----------|end
-	//                            |----|
-	//
-	// 5. user also cannot apply if there exists
-	// a session that has been appointed with
-	// time range which overlaps with given time range
-
-	tx := db.
-		Model(&Session{}).
-		Where("seat_id = ?", seatID).
-		Where(
-			`(start_time <= ? AND end_time <= ? AND end_time >= ?)
-			 OR
-			 (start_time >= ? AND end_time >= ? AND start_time <= ?)
-			 OR
-			 (start_time <= ? AND end_time >= ?)
-			 OR
-			 (start_time >= ? AND end_time <= ?)`,
-			start, end, start,
-			start, end, end,
-			start, end,
-			start, end,
-		).
-		Count(&cnt)
-
-	if tx.Error != nil {
-		logrus.WithError(tx.Error).Error("Failed to validate session time when query seat vacancy")
-		return tx.Error
-	}
-	if cnt != 0 {
-		return NewRequestError("座位已被预约")
-	}
-
-	tx = db.
-		Model(&Session{}).
-		Where("user_id = ?", uid).
-		Where("status = ?", SessionStatusValid).
-		Where(
-			`(start_time <= ? AND end_time <= ? AND end_time >= ?)
-			OR
-			(start_time >= ? AND end_time >= ? AND start_time <= ?)
-			OR
-			(start_time <= ? AND end_time >= ?)
-			OR
-			(start_time >= ? AND end_time <= ?)`,
-			start, end, start,
-			start, end, end,
-			start, end,
-			start, end,
-		).
-		Count(&cnt)
+	clash, err := r.findClashingSession(ctx, "seat_id", seatID, 0, start, end)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to validate session time when query seat vacancy")
+		return err
+	}
+	if clash != nil {
+		return &SessionConflictError{RequestError: ErrSeatTaken, Session: clash}
+	}
 
-	if tx.Error != nil {
-		logrus.WithError(tx.Error).Error("Failed to validate session time when querying user exising session")
-		return tx.Error
+	clash, err = r.findClashingSession(ctx, "user_id", uid, 0, start, end)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to validate session time when querying user exising session")
+		return err
 	}
-	if cnt != 0 {
-		return NewRequestError("用户已有预约")
+	if clash != nil {
+		return &SessionConflictError{RequestError: ErrUserHasBooking, Session: clash}
 	}
 
 	return nil
 }
 
-func GetSessionViaUser(u *User) *Session {
+func (r *Repo) GetSessionViaUser(ctx context.Context, u *User) *Session {
 	session := u.Session
 	if session == "" {
 		return nil
 	}
 
-	s := GetSession(session)
+	s := r.GetSession(ctx, session)
 	if s == nil {
 		return nil
 	}
 	return s
 }
 
-func GetUserSessionHistory(u *User, page int) []*Session {
+func (r *Repo) GetUserSessionHistory(ctx context.Context, u *User, page int) []*Session {
 	sessions := make([]*Session, 0)
-	_ = db.Model(&Session{}).
-		Where("user_id = ?", u.ID).
-		Where("status = ?", SessionStatusValid).
-		Where("end_time < ?", time.Now()).
-		Update("status", SessionStatusExpired)
-	tx := db.
+	if _, err := r.expireSessions(ctx, time.Now(), "user_id = ?", u.ID); err != nil {
+		logrus.WithError(err).Error("Failed to expire user sessions")
+	}
+	tx := r.conn(ctx).
 		Order("start_time desc").
 		Offset((page-1)*10).
 		Limit(10).
@@ -242,12 +477,12 @@ func GetUserSessionHistory(u *User, page int) []*Session {
 	return sessions
 }
 
-func (s *Session) SetBillingFee(fee Price) error {
+func (r *Repo) SetSessionBillingFee(ctx context.Context, s *Session, fee Price) error {
 	s.BillingFee = fee
-	return db.Save(s).Error
+	return r.conn(ctx).Save(s).Error
 }
 
-func (s *Session) SetActualEndTime(time *time.Time) error {
+func (r *Repo) SetSessionActualEndTime(ctx context.Context, s *Session, time *time.Time) error {
 	s.ActualEndTime = time
-	return db.Save(s).Error
+	return r.conn(ctx).Save(s).Error
 }
@@ -0,0 +1,269 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SessionBiller computes the fee of session s for the time it was used,
+// from start to end.
+type SessionBiller interface {
+	Bill(ctx context.Context, tx *Repo, s *Session, start, end time.Time) (Price, error)
+}
+
+// DefaultHourlyRate is the rate of DefaultTariff.
+var DefaultHourlyRate = ToPrice(6)
+
+// FlatRateBiller charges PerHour, prorated by the started minute.
+type FlatRateBiller struct {
+	PerHour Price
+}
+
+func (b FlatRateBiller) Bill(ctx context.Context, tx *Repo, s *Session, start, end time.Time) (Price, error) {
+	if !end.After(start) {
+		return 0, nil
+	}
+	minutes := (end.Sub(start) + time.Minute - 1) / time.Minute
+	return Price((uint64(b.PerHour)*uint64(minutes) + 59) / 60), nil
+}
+
+// SetSessionBiller replaces the biller used to settle sessions.
+func (r *Repo) SetSessionBiller(b SessionBiller) {
+	r.biller = b
+}
+
+// now reads the clock of the biller when it has one.
+func (r *Repo) now() time.Time {
+	if b, ok := r.biller.(*TariffBiller); ok {
+		return b.Clock.Now()
+	}
+	return time.Now()
+}
+
+// lockSession reloads s for update and checks that it is in one of the
+// given statuses.
+func (r *Repo) lockSession(ctx context.Context, s *Session, statuses ...SessionStatus) (*Session, error) {
+	current := &Session{}
+	err := r.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(current, s.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range statuses {
+		if current.Status == st {
+			return current, nil
+		}
+	}
+	return nil, ErrIllegalTransition
+}
+
+// billingStart returns when billing of s started: when it went on-going,
+// or its start time if it never did.
+func (r *Repo) billingStart(ctx context.Context, s *Session) (time.Time, error) {
+	event := SessionEvent{}
+	tx := r.conn(ctx).
+		Where("session_id = ? AND to_status = ?", s.ID, SessionStatusOnGoing).
+		Order("id desc").
+		Limit(1).
+		Find(&event)
+	if tx.Error != nil {
+		return time.Time{}, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return *s.StartTime, nil
+	}
+	return event.CreatedAt, nil
+}
+
+// ExtendSession moves the end of s to end, provided the seat and the user
+// are free for the extra time.
+func (r *Repo) ExtendSession(ctx context.Context, s *Session, end time.Time) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current, err := tx.lockSession(ctx, s, SessionStatusReserved, SessionStatusCheckedIn, SessionStatusOnGoing)
+		if err != nil {
+			return err
+		}
+		if current.EndTime != nil && !end.After(*current.EndTime) {
+			return ErrInvalidTime
+		}
+		if err := tx.rescheduleSession(ctx, current, current.StartTime, &end); err != nil {
+			return err
+		}
+		s.EndTime = current.EndTime
+		return nil
+	})
+}
+
+// settleSession checks the user out of the locked session s at and saves
+// its fee, billed only if it was on-going. If at is before the booked end,
+// the rest of the booked time becomes available to others.
+func (r *Repo) settleSession(ctx context.Context, s *Session, at time.Time) error {
+	var fee Price
+	if s.Status == SessionStatusOnGoing {
+		start, err := r.billingStart(ctx, s)
+		if err != nil {
+			return err
+		}
+		fee, err = r.biller.Bill(ctx, r, s, start, at)
+		if err != nil {
+			return err
+		}
+	}
+
+	updates := map[string]interface{}{
+		"actual_end_time": at,
+		"billing_fee":     fee,
+	}
+	if s.BillingBreakdown != nil {
+		updates["billing_breakdown"] = s.BillingBreakdown
+	}
+	if at.After(*s.StartTime) && (s.EndTime == nil || at.Before(*s.EndTime)) {
+		updates["end_time"] = at
+	}
+	if err := r.conn(ctx).Model(s).Updates(updates).Error; err != nil {
+		return err
+	}
+	s.ActualEndTime = &at
+	s.BillingFee = fee
+	return nil
+}
+
+// EndSessionEarly checks the user out of s at, settles its fee and
+// completes it, which frees the seat and its devices. The rest of the
+// booked time becomes available to others.
+func (r *Repo) EndSessionEarly(ctx context.Context, s *Session, at time.Time, actor string) (Price, error) {
+	var fee Price
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current, err := tx.lockSession(ctx, s, SessionStatusCheckedIn, SessionStatusOnGoing)
+		if err != nil {
+			return err
+		}
+		if err := tx.settleSession(ctx, current, at); err != nil {
+			return err
+		}
+		if err := tx.TransitionSession(ctx, current, SessionStatusCompleted, actor); err != nil {
+			return err
+		}
+
+		fee = current.BillingFee
+		s.Status = current.Status
+		s.EndTime = current.EndTime
+		s.ActualEndTime = &at
+		s.BillingFee = fee
+		return nil
+	})
+	return fee, err
+}
+
+// settleSessionHook settles a session completing without EndSessionEarly
+// at the time it completes, then charges its fee to the user. A balance
+// too low to pay leaves the fee owed; ChargeSession may be retried later.
+func settleSessionHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	if s.ActualEndTime == nil {
+		settled := *s
+		settled.Status = e.From
+		if err := tx.settleSession(ctx, &settled, tx.now()); err != nil {
+			return err
+		}
+		s.ActualEndTime = settled.ActualEndTime
+		s.EndTime = settled.EndTime
+		s.BillingFee = settled.BillingFee
+		s.BillingBreakdown = settled.BillingBreakdown
+	}
+
+	_, err := tx.ChargeSession(ctx, s, e.Actor)
+	if errors.Is(err, ErrInsufficientCredit) {
+		logrus.WithField("session", s.ID).Warn("Balance does not cover the session fee, left owed")
+		return nil
+	}
+	return err
+}
+
+// TransferSession moves the live session s to seat, which must be in the
+// same store, vacant and free for the rest of the session, and the store
+// open until the session ends. The user's current seat follows,
+// and the device tokens of the old seat are replaced by tokens for the
+// devices of the new one, valid for tokenExpiration minutes.
+func (r *Repo) TransferSession(ctx context.Context, key []byte, s *Session, seat *Seat, tokenExpiration uint) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current, err := tx.lockSession(ctx, s, SessionStatusCheckedIn, SessionStatusOnGoing)
+		if err != nil {
+			return err
+		}
+		if current.SeatID == seat.ID {
+			return ErrInvalidArgument
+		}
+
+		target := Seat{}
+		err = tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&target, seat.ID).Error
+		if err != nil {
+			return err
+		}
+		if target.CurrentStatus != SeatStatusEnumVacancy {
+			return ErrSeatTaken
+		}
+		from := Seat{}
+		if err := tx.conn(ctx).First(&from, current.SeatID).Error; err != nil {
+			return err
+		}
+		if from.StoreID != target.StoreID {
+			return ErrInvalidArgument
+		}
+		if now := time.Now(); current.EndTime != nil && current.EndTime.After(now) {
+			if err := tx.checkStoreOpen(ctx, target.ID, now, *current.EndTime); err != nil {
+				return err
+			}
+		}
+
+		oldSeatID := current.SeatID
+		err = tx.WithTx(ctx, func(sp *Repo) error {
+			return sp.conn(ctx).Model(&Session{}).Where("id = ?", current.ID).Update("seat_id", target.ID).Error
+		})
+		if err != nil {
+			probe := *current
+			probe.SeatID = target.ID
+			return tx.sessionConflict(ctx, err, &probe)
+		}
+		current.SeatID = target.ID
+
+		db := tx.conn(ctx)
+		if err := db.Model(&Seat{}).Where("id = ?", oldSeatID).Update("current_status", SeatStatusEnumVacancy).Error; err != nil {
+			return err
+		}
+		if err := db.Model(&target).Update("current_status", SeatStatusEnumOccupied).Error; err != nil {
+			return err
+		}
+		if err := db.Model(&User{}).Where("id = ?", current.UserID).Update("current_occupied_seat_id", target.ID).Error; err != nil {
+			return err
+		}
+
+		if err := db.Model(&DeviceToken{}).Where("session_id = ?", current.ID).Update("valid", false).Error; err != nil {
+			return err
+		}
+		if err := tx.freeSeatDevices(ctx, oldSeatID); err != nil {
+			return err
+		}
+
+		devices := make([]Device, 0)
+		if err := db.Find(&devices, "seat_id = ?", target.ID).Error; err != nil {
+			return err
+		}
+		user := &User{}
+		user.ID = current.UserID
+		for i := range devices {
+			if _, err := tx.issueDeviceToken(ctx, key, tokenExpiration, &devices[i], user, current); err != nil {
+				return err
+			}
+		}
+
+		s.SeatID = target.ID
+		return nil
+	})
+}
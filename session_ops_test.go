@@ -0,0 +1,149 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+	"gorm.io/gorm/clause"
+)
+
+func TestFlatRateBiller(t *testing.T) {
+	b := models.FlatRateBiller{PerHour: models.ToPrice(6)}
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	cases := []struct {
+		d    time.Duration
+		want models.Price
+	}{
+		{0, 0},
+		{time.Hour, 600},
+		{30 * time.Minute, 300},
+		{30*time.Minute + time.Second, 310},
+		{-time.Minute, 0},
+	}
+	for _, c := range cases {
+		got, err := b.Bill(context.Background(), nil, nil, start, start.Add(c.d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("Bill(%v) = %d, want %d", c.d, got, c.want)
+		}
+	}
+}
+
+func TestSessionOperations(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+	db := repo.DB()
+
+	alice := &models.User{}
+	alice.ID = 1
+	bob := &models.User{}
+	bob.ID = 2
+	seat1 := &models.Seat{}
+	seat1.ID = 1
+	seat2 := &models.Seat{}
+	seat2.ID = 2
+
+	now := time.Now().Truncate(time.Minute)
+	ptr := func(ts time.Time) *time.Time { return &ts }
+
+	s, err := repo.ReserveSession(ctx, sessionKey, alice, seat1, ptr(now.Add(-time.Hour)), ptr(now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob books seat 1 right after alice
+	if _, err := repo.ReserveSession(ctx, sessionKey, bob, seat1, ptr(now.Add(2*time.Hour)), ptr(now.Add(3*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []models.SessionStatus{models.SessionStatusCheckedIn, models.SessionStatusOnGoing} {
+		if err := repo.TransitionSession(ctx, s, st, models.UserActor(alice)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("extend", func(t *testing.T) {
+		if err := repo.ExtendSession(ctx, s, now.Add(90*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if !s.EndTime.Equal(now.Add(90 * time.Minute)) {
+			t.Errorf("end = %v, want %v", s.EndTime, now.Add(90*time.Minute))
+		}
+		err := repo.ExtendSession(ctx, s, now.Add(150*time.Minute))
+		if !errors.Is(err, models.ErrSeatTaken) {
+			t.Errorf("extending into bob's session: error = %v, want ErrSeatTaken", err)
+		}
+		if err := repo.ExtendSession(ctx, s, now); !errors.Is(err, models.ErrInvalidTime) {
+			t.Errorf("shrinking: error = %v, want ErrInvalidTime", err)
+		}
+	})
+
+	t.Run("transfer", func(t *testing.T) {
+		err := db.Omit(clause.Associations).Create(&models.Device{
+			DeviceID: "lamp-2",
+			SeatID:   &seat2.ID,
+			Status:   models.DeviceStatusOnline,
+		}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modelstest.LoadJSON(t, repo, []byte(`{
+			"stores": [{"id": 2, "name": "branch"}],
+			"seats": [{"id": 3, "store_id": 2, "label": "B"}]
+		}`))
+		elsewhere := &models.Seat{}
+		elsewhere.ID = 3
+		if err := repo.TransferSession(ctx, sessionKey, s, elsewhere, 60); !errors.Is(err, models.ErrInvalidArgument) {
+			t.Errorf("transfer to another store: error = %v, want ErrInvalidArgument", err)
+		}
+
+		if err := repo.TransferSession(ctx, sessionKey, s, seat2, 60); err != nil {
+			t.Fatal(err)
+		}
+		if s.SeatID != seat2.ID {
+			t.Errorf("session seat = %d, want %d", s.SeatID, seat2.ID)
+		}
+		if seat := repo.GetSeatByID(ctx, 1); seat.CurrentStatus != models.SeatStatusEnumVacancy {
+			t.Error("old seat is still occupied")
+		}
+		if seat := repo.GetSeatByID(ctx, 2); seat.CurrentStatus != models.SeatStatusEnumOccupied {
+			t.Error("new seat is not occupied")
+		}
+		u, _ := repo.FindUser(ctx, alice.ID)
+		if u.CurrentOccupiedSeatID == nil || *u.CurrentOccupiedSeatID != seat2.ID {
+			t.Errorf("user's current seat = %v, want %d", u.CurrentOccupiedSeatID, seat2.ID)
+		}
+		if d := repo.GetDeviceByID(ctx, "lamp-2"); d.CurrentToken == nil {
+			t.Error("no token was issued for the new seat's device")
+		}
+	})
+
+	t.Run("end early", func(t *testing.T) {
+		repo.SetSessionBiller(models.FlatRateBiller{PerHour: models.ToPrice(6)})
+		fee, err := repo.EndSessionEarly(ctx, s, time.Now(), models.UserActor(alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee == 0 {
+			t.Error("no fee was charged")
+		}
+		if s.Status != models.SessionStatusCompleted {
+			t.Errorf("status = %s, want completed", s.Status)
+		}
+		if seat := repo.GetSeatByID(ctx, 2); seat.CurrentStatus != models.SeatStatusEnumVacancy {
+			t.Error("seat is still occupied")
+		}
+		if d := repo.GetDeviceByID(ctx, "lamp-2"); d.CurrentToken != nil {
+			t.Error("device kept its token")
+		}
+		if _, err := repo.EndSessionEarly(ctx, s, time.Now(), models.UserActor(alice)); !errors.Is(err, models.ErrIllegalTransition) {
+			t.Errorf("ending twice: error = %v, want ErrIllegalTransition", err)
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sessionTransitions lists the statuses a session may move to from each
+// status. Statuses without an entry are terminal.
+//
+//	held -> reserved -> checked_in -> on_going -> completed
+//	  |         |            |
+//	  +---------+------------+--> canceled, expired
+//	            +--> no_show
+var sessionTransitions = map[SessionStatus][]SessionStatus{
+	SessionStatusHeld: {
+		SessionStatusReserved,
+		SessionStatusCanceled,
+		SessionStatusExpired,
+	},
+	SessionStatusReserved: {
+		SessionStatusCheckedIn,
+		SessionStatusCanceled,
+		SessionStatusNoShow,
+		SessionStatusExpired,
+	},
+	SessionStatusCheckedIn: {
+		SessionStatusOnGoing,
+		SessionStatusCompleted,
+		SessionStatusCanceled,
+		SessionStatusExpired,
+	},
+	SessionStatusOnGoing: {
+		SessionStatusCompleted,
+	},
+}
+
+// CanTransitionSession reports whether a session may move from one status
+// to another.
+func CanTransitionSession(from, to SessionStatus) bool {
+	for _, st := range sessionTransitions[from] {
+		if st == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether no transition leaves status.
+func (status SessionStatus) IsTerminal() bool {
+	return len(sessionTransitions[status]) == 0
+}
+
+// occupiesSeat reports whether the user is sitting at the seat while the
+// session is in status.
+func (status SessionStatus) occupiesSeat() bool {
+	return status == SessionStatusCheckedIn || status == SessionStatusOnGoing
+}
+
+const SessionActorSystem = "system"
+
+// UserActor identifies a user in a session event.
+func UserActor(u *User) string {
+	return fmt.Sprintf("user:%d", u.ID)
+}
+
+// AdministratorActor identifies an administrator in a session event.
+func AdministratorActor(a *Administrator) string {
+	return fmt.Sprintf("admin:%d", a.ID)
+}
+
+// SessionEvent records one status transition of a session.
+type SessionEvent struct {
+	ID        uint          `gorm:"primarykey" json:"id"`
+	SessionID uint          `gorm:"index;not null" json:"session_id"`
+	From      SessionStatus `gorm:"column:from_status;type:varchar(32);not null" json:"from"`
+	To        SessionStatus `gorm:"column:to_status;type:varchar(32);not null" json:"to"`
+	Actor     string        `gorm:"type:varchar(64);not null" json:"actor"`
+	CreatedAt time.Time     `gorm:"not null" json:"created_at"`
+}
+
+func migrateSessionEvents(db *gorm.DB) error {
+	if err := createTables(db, &SessionEvent{}); err != nil {
+		return err
+	}
+	return replaceSessionExclusion(db, SessionStatusValid, SessionStatusCheckedIn, SessionStatusOnGoing)
+}
+
+func dropSessionEvents(db *gorm.DB) error {
+	if err := replaceSessionExclusion(db, SessionStatusValid, SessionStatusOnGoing); err != nil {
+		return err
+	}
+	return db.Migrator().DropTable(&SessionEvent{})
+}
+
+// SessionHook is run inside the transition's transaction when a session
+// enters a status. Returning an error aborts the transition.
+type SessionHook func(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error
+
+type sessionHooks struct {
+	mu    sync.RWMutex
+	hooks map[SessionStatus][]SessionHook
+}
+
+func newSessionHooks() *sessionHooks {
+	h := &sessionHooks{hooks: make(map[SessionStatus][]SessionHook)}
+	for _, st := range []SessionStatus{SessionStatusCheckedIn, SessionStatusOnGoing} {
+		h.add(st, occupySeatHook)
+	}
+	for _, st := range []SessionStatus{
+		SessionStatusCompleted,
+		SessionStatusCanceled,
+		SessionStatusNoShow,
+		SessionStatusExpired,
+	} {
+		h.add(st, releaseSeatHook)
+		h.add(st, revokeDeviceTokensHook)
+	}
+	h.add(SessionStatusCompleted, settleSessionHook)
+	h.add(SessionStatusNoShow, noShowHook)
+	h.add(SessionStatusReserved, confirmHoldHook)
+	for _, st := range []SessionStatus{
+		SessionStatusCanceled,
+		SessionStatusNoShow,
+		SessionStatusExpired,
+	} {
+		h.add(st, offerToWaitlistHook)
+	}
+	return h
+}
+
+func (h *sessionHooks) add(status SessionStatus, hook SessionHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks[status] = append(h.hooks[status], hook)
+}
+
+func (h *sessionHooks) get(status SessionStatus) []SessionHook {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.hooks[status]
+}
+
+// OnSessionEnter registers hook to run whenever a session enters status.
+// Hooks run in registration order, after the builtin ones that occupy
+// and free the seat, revoke device tokens, settle completed sessions,
+// handle no-shows and pass freed slots on to the waitlist.
+func (r *Repo) OnSessionEnter(status SessionStatus, hook SessionHook) {
+	r.hooks.add(status, hook)
+}
+
+func occupySeatHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	err := tx.conn(ctx).Model(&Seat{}).
+		Where("id = ?", s.SeatID).
+		Update("current_status", SeatStatusEnumOccupied).
+		Error
+	if err != nil {
+		return err
+	}
+	return tx.conn(ctx).Model(&User{}).
+		Where("id = ?", s.UserID).
+		Update("current_occupied_seat_id", s.SeatID).
+		Error
+}
+
+// freeSeatDevices puts the occupied devices of a seat back online and
+// drops their tokens.
+func (r *Repo) freeSeatDevices(ctx context.Context, seatID uint) error {
+	err := r.conn(ctx).Model(&Device{}).
+		Where("seat_id = ? AND status = ?", seatID, DeviceStatusOccupied).
+		Update("status", DeviceStatusOnline).
+		Error
+	if err != nil {
+		return err
+	}
+	return r.conn(ctx).Model(&Device{}).
+		Where("seat_id = ?", seatID).
+		Update("current_token", nil).
+		Error
+}
+
+// releaseSeatHook frees the seat and its devices and stops billing,
+// provided the user was actually sitting there; a reservation that ends
+// before check-in leaves whoever is at the seat alone.
+func releaseSeatHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	if !e.From.occupiesSeat() {
+		return nil
+	}
+	err := tx.conn(ctx).Model(&Seat{}).
+		Where("id = ?", s.SeatID).
+		Update("current_status", SeatStatusEnumVacancy).
+		Error
+	if err != nil {
+		return err
+	}
+	err = tx.freeSeatDevices(ctx, s.SeatID)
+	if err != nil {
+		return err
+	}
+	return tx.conn(ctx).Model(&User{}).
+		Where("id = ?", s.UserID).
+		Updates(map[string]interface{}{
+			"billing_status":           UserBillingStatusNone,
+			"current_occupied_seat_id": nil,
+		}).
+		Error
+}
+
+func revokeDeviceTokensHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	return tx.conn(ctx).Model(&DeviceToken{}).
+		Where("session_id = ?", s.ID).
+		Update("valid", false).
+		Error
+}
+
+// TransitionSession moves s to status, records the transition as a
+// SessionEvent attributed to actor and runs the hooks of the new status,
+// all in one transaction. Illegal transitions return ErrIllegalTransition.
+func (r *Repo) TransitionSession(ctx context.Context, s *Session, to SessionStatus, actor string) error {
+	current := Session{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		db := tx.conn(ctx)
+		err := db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, s.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		if !CanTransitionSession(current.Status, to) {
+			return ErrIllegalTransition
+		}
+
+		err = db.Model(&current).Update("status", to).Error
+		if err != nil {
+			return err
+		}
+		event := &SessionEvent{
+			SessionID: current.ID,
+			From:      current.Status,
+			To:        to,
+			Actor:     actor,
+		}
+		if err := db.Create(event).Error; err != nil {
+			return err
+		}
+		current.Status = to
+
+		for _, hook := range tx.hooks.get(to) {
+			if err := hook(ctx, tx, &current, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Status = current.Status
+	s.UpdatedAt = current.UpdatedAt
+	return nil
+}
+
+// GetSessionEvents lists the transitions of s, oldest first.
+func (r *Repo) GetSessionEvents(ctx context.Context, s *Session) ([]SessionEvent, error) {
+	events := make([]SessionEvent, 0)
+	tx := r.conn(ctx).Where("session_id = ?", s.ID).Order("id asc").Find(&events)
+	return events, tx.Error
+}
+
+// ExpireSessions expires every reservation whose end time is before now,
+// and returns how many were expired.
+func (r *Repo) ExpireSessions(ctx context.Context, now time.Time) (int, error) {
+	return r.expireSessions(ctx, now, "TRUE")
+}
+
+func (r *Repo) expireSessions(ctx context.Context, now time.Time, query string, args ...interface{}) (int, error) {
+	sessions := make([]*Session, 0)
+	tx := r.conn(ctx).
+		Where(query, args...).
+		Where("status IN ?", []SessionStatus{SessionStatusReserved, SessionStatusCheckedIn}).
+		Where("end_time < ?", now).
+		Find(&sessions)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	expired := 0
+	for _, s := range sessions {
+		err := r.TransitionSession(ctx, s, SessionStatusExpired, SessionActorSystem)
+		if errors.Is(err, ErrIllegalTransition) {
+			// moved on concurrently
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("session", s.ID).Error("Failed to expire session")
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
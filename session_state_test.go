@@ -0,0 +1,132 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestCanTransitionSession(t *testing.T) {
+	cases := []struct {
+		from, to models.SessionStatus
+		want     bool
+	}{
+		{models.SessionStatusReserved, models.SessionStatusCheckedIn, true},
+		{models.SessionStatusReserved, models.SessionStatusNoShow, true},
+		{models.SessionStatusReserved, models.SessionStatusOnGoing, false},
+		{models.SessionStatusReserved, models.SessionStatusCompleted, false},
+		{models.SessionStatusCheckedIn, models.SessionStatusOnGoing, true},
+		{models.SessionStatusOnGoing, models.SessionStatusCompleted, true},
+		{models.SessionStatusOnGoing, models.SessionStatusCanceled, false},
+		{models.SessionStatusCompleted, models.SessionStatusReserved, false},
+		{models.SessionStatusCanceled, models.SessionStatusCheckedIn, false},
+		{models.SessionStatusExpired, models.SessionStatusCompleted, false},
+	}
+	for _, c := range cases {
+		if got := models.CanTransitionSession(c.from, c.to); got != c.want {
+			t.Errorf("CanTransitionSession(%s, %s) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestTransitionSession(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	entered := make([]models.SessionStatus, 0)
+	repo.OnSessionEnter(models.SessionStatusCompleted, func(ctx context.Context, tx *models.Repo, s *models.Session, e *models.SessionEvent) error {
+		entered = append(entered, e.To)
+		return nil
+	})
+
+	s := &models.Session{}
+	s.ID = 1
+	alice := &models.User{}
+	alice.ID = 1
+
+	steps := []models.SessionStatus{
+		models.SessionStatusCheckedIn,
+		models.SessionStatusOnGoing,
+	}
+	for _, st := range steps {
+		if err := repo.TransitionSession(ctx, s, st, models.UserActor(alice)); err != nil {
+			t.Fatalf("TransitionSession(%s) error = %v", st, err)
+		}
+	}
+
+	seat := repo.GetSeatByID(ctx, 1)
+	if seat.CurrentStatus != models.SeatStatusEnumOccupied {
+		t.Errorf("seat status = %v after check-in, want occupied", seat.CurrentStatus)
+	}
+
+	err := repo.TransitionSession(ctx, s, models.SessionStatusCanceled, models.SessionActorSystem)
+	if !errors.Is(err, models.ErrIllegalTransition) {
+		t.Fatalf("on_going -> canceled error = %v, want ErrIllegalTransition", err)
+	}
+
+	if err := repo.SetSessionStatus(ctx, s, models.SessionStatusCompleted); err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != models.SessionStatusCompleted {
+		t.Errorf("status = %s, want %s", s.Status, models.SessionStatusCompleted)
+	}
+	if len(entered) != 1 {
+		t.Errorf("completed hook ran %d times, want 1", len(entered))
+	}
+
+	seat = repo.GetSeatByID(ctx, 1)
+	if seat.CurrentStatus != models.SeatStatusEnumVacancy {
+		t.Errorf("seat status = %v after completion, want vacancy", seat.CurrentStatus)
+	}
+
+	events, err := repo.GetSessionEvents(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		from, to models.SessionStatus
+		actor    string
+	}{
+		{models.SessionStatusReserved, models.SessionStatusCheckedIn, "user:1"},
+		{models.SessionStatusCheckedIn, models.SessionStatusOnGoing, "user:1"},
+		{models.SessionStatusOnGoing, models.SessionStatusCompleted, models.SessionActorSystem},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.From != w.from || e.To != w.to || e.Actor != w.actor {
+			t.Errorf("event %d = %s -> %s by %s, want %s -> %s by %s", i, e.From, e.To, e.Actor, w.from, w.to, w.actor)
+		}
+	}
+}
+
+func TestTransitionSessionHookAborts(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	boom := errors.New("boom")
+	repo.OnSessionEnter(models.SessionStatusCanceled, func(ctx context.Context, tx *models.Repo, s *models.Session, e *models.SessionEvent) error {
+		return boom
+	})
+
+	s := &models.Session{}
+	s.ID = 1
+	if err := repo.TransitionSession(ctx, s, models.SessionStatusCanceled, models.SessionActorSystem); !errors.Is(err, boom) {
+		t.Fatalf("TransitionSession() error = %v, want %v", err, boom)
+	}
+
+	events, err := repo.GetSessionEvents(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("aborted transition left %d events", len(events))
+	}
+}
@@ -0,0 +1,197 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+const bookingFixture = `{
+	"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"}
+	],
+	"stores": [{"id": 1, "name": "main"}],
+	"seats": [
+		{"id": 1, "store_id": 1, "label": "A"},
+		{"id": 2, "store_id": 1, "label": "A"}
+	],
+	"sessions": [
+		{"id": 1, "user_id": 1, "seat_id": 1,
+		 "start_time": "2022-03-01T09:00:00+08:00",
+		 "end_time": "2022-03-01T11:00:00+08:00"}
+	]
+}`
+
+func at(t *testing.T, clock string) *time.Time {
+	t.Helper()
+	ts, err := time.Parse(time.RFC3339, "2022-03-01T"+clock+":00+08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ts
+}
+
+func TestValidateSessionOverlap(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	cases := []struct {
+		name       string
+		user, seat uint
+		start, end string
+		wantErr    bool
+	}{
+		{"overlaps start", 2, 1, "08:00", "09:30", true},
+		{"overlaps end", 2, 1, "10:00", "12:00", true},
+		{"covers", 2, 1, "08:00", "12:00", true},
+		{"inside", 2, 1, "09:30", "10:30", true},
+		{"before", 2, 1, "07:00", "08:00", false},
+		{"after", 2, 1, "11:30", "12:30", false},
+		{"other seat", 2, 2, "09:30", "10:30", false},
+		{"user already booked", 1, 2, "10:00", "10:30", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := repo.ValidateSession(ctx, c.user, c.seat, at(t, c.start), at(t, c.end))
+			if (err != nil) != c.wantErr {
+				t.Errorf("ValidateSession() error = %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+var sessionKey = []byte("0123456789abcdef")
+
+func TestReserveSession(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+	alice := &models.User{}
+	alice.ID = 1
+	bob := &models.User{}
+	bob.ID = 2
+	seat1 := &models.Seat{}
+	seat1.ID = 1
+	seat2 := &models.Seat{}
+	seat2.ID = 2
+
+	cases := []struct {
+		name     string
+		user     *models.User
+		seat     *models.Seat
+		start    string
+		end      string
+		canceled bool
+		wantErr  error
+	}{
+		{"seat taken", bob, seat1, "10:00", "12:00", false, models.ErrSeatTaken},
+		{"user has booking", alice, seat2, "10:30", "11:30", false, models.ErrUserHasBooking},
+		{"back to back", bob, seat1, "11:00", "12:00", false, nil},
+		{"other seat", bob, seat2, "09:00", "11:00", false, nil},
+		{"canceled does not block", bob, seat1, "09:00", "10:00", true, nil},
+		{"end before start", bob, seat1, "13:00", "12:00", false, models.ErrInvalidTime},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			modelstest.Truncate(t, repo)
+			modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+			if c.canceled {
+				err := repo.DB().Model(&models.Session{}).
+					Where("id = ?", 1).
+					Update("status", models.SessionStatusCanceled).
+					Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := repo.ReserveSession(ctx, sessionKey, c.user, c.seat, at(t, c.start), at(t, c.end))
+			if c.wantErr == nil {
+				if err != nil {
+					t.Fatalf("ReserveSession() error = %v", err)
+				}
+				if s.Token == "" {
+					t.Error("ReserveSession() returned a session without token")
+				}
+				return
+			}
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("ReserveSession() error = %v, want %v", err, c.wantErr)
+			}
+			if errors.Is(c.wantErr, models.ErrInvalidTime) {
+				return
+			}
+			conflict := &models.SessionConflictError{}
+			if !errors.As(err, &conflict) {
+				t.Fatalf("ReserveSession() error = %T, want *SessionConflictError", err)
+			}
+			if conflict.Session == nil || conflict.Session.ID != 1 {
+				t.Errorf("conflicting session = %+v, want session 1", conflict.Session)
+			}
+		})
+	}
+}
+
+func TestSessionPeriodMigratesLegacyRows(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+	if err := repo.MigrateTo(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db := repo.DB()
+	err := db.Exec(`INSERT INTO users (id, type, username, phone) VALUES (1, 1, 'alice', '13800000001'), (2, 1, 'bob', '13800000002')`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO stores (id, name) VALUES (1, 'main')`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO seats (id, store_id, label) VALUES (1, 1, 'A'), (2, 1, 'B')`).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 2 overlaps 1 and loses; 3 only overlaps 2 and so stays; 4 has no end
+	err = db.Exec(`INSERT INTO sessions (id, user_id, seat_id, start_time, end_time, status) VALUES
+		(1, 1, 1, ?, ?, 'valid'),
+		(2, 2, 1, ?, ?, 'valid'),
+		(3, 2, 1, ?, ?, 'valid'),
+		(4, 1, 2, ?, NULL, 'valid')`,
+		at(t, "09:00"), at(t, "11:00"),
+		at(t, "10:00"), at(t, "12:00"),
+		at(t, "11:30"), at(t, "12:30"),
+		at(t, "13:00"),
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	want := map[uint]models.SessionStatus{
+		1: models.SessionStatusValid,
+		2: models.SessionStatusCanceled,
+		3: models.SessionStatusValid,
+		4: models.SessionStatusValid,
+	}
+	sessions := make([]models.Session, 0)
+	if err := db.Order("id").Find(&sessions).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sessions {
+		if s.Status != want[s.ID] {
+			t.Errorf("session %d status = %q, want %q", s.ID, s.Status, want[s.ID])
+		}
+		if s.ID == 4 && (s.EndTime == nil || !s.EndTime.After(*s.StartTime)) {
+			t.Errorf("session 4 end time = %v, want it backfilled", s.EndTime)
+		}
+	}
+}
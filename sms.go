@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"strconv"
@@ -21,42 +22,42 @@ type ValidationCodeSms struct {
 	Used      bool   `gorm:"type:bool;default:false"`
 }
 
-func (sms *ValidationCodeSms) SetStatusUsed() {
+func (r *Repo) SetSmsStatusUsed(ctx context.Context, sms *ValidationCodeSms) error {
 	sms.Used = true
-	db.Save(sms)
+	return r.conn(ctx).Save(sms).Error
 }
 
-func FindSmsOfPhone(phone string) *ValidationCodeSms {
+func (r *Repo) FindSmsOfPhone(ctx context.Context, phone string) *ValidationCodeSms {
 	sms := &ValidationCodeSms{}
-	r := db.Order("expires_at desc").First(&sms, "phone = ?", phone)
+	tx := r.conn(ctx).Order("expires_at desc").First(&sms, "phone = ?", phone)
 
-	if r.Error != nil {
+	if tx.Error != nil {
 		return nil
 	}
 	return sms
 }
 
-func FindSmsOfUser(u *User) *ValidationCodeSms {
-	return FindSmsOfPhone(u.Phone)
+func (r *Repo) FindSmsOfUser(ctx context.Context, u *User) *ValidationCodeSms {
+	return r.FindSmsOfPhone(ctx, u.Phone)
 }
 
-func NewValidationCodeSmsOf(phone string, len uint, expireTime uint) *ValidationCodeSms {
+func (r *Repo) NewValidationCodeSmsOf(ctx context.Context, phone string, len uint, expireTime uint) *ValidationCodeSms {
 	sms := ValidationCodeSms{
 		Phone:     phone,
 		Code:      genValidationCode(len),
 		ExpiresAt: time.Now().Add(time.Minute * time.Duration(expireTime)),
 		Used:      false,
 	}
-	db.Create(&sms)
+	r.conn(ctx).Create(&sms)
 	return &sms
 }
 
-func NewValidationCodeSmsOfUser(u *User, len, expireTime uint) *ValidationCodeSms {
-	return NewValidationCodeSmsOf(u.Phone, len, expireTime)
+func (r *Repo) NewValidationCodeSmsOfUser(ctx context.Context, u *User, len, expireTime uint) *ValidationCodeSms {
+	return r.NewValidationCodeSmsOf(ctx, u.Phone, len, expireTime)
 }
 
-func DeleteValidationCodeSms(sms *ValidationCodeSms) {
-	db.Delete(sms, "id = ?", sms.ID)
+func (r *Repo) DeleteValidationCodeSms(ctx context.Context, sms *ValidationCodeSms) error {
+	return r.conn(ctx).Delete(sms, "id = ?", sms.ID).Error
 }
 
 func genValidationCode(len uint) string {
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -20,18 +21,24 @@ type Store struct {
 	Status          StoreStatus `gorm:"type:int"`
 	OpeningHours    uint
 	OpeningWeekdays uint
+	TimeZone        string           `gorm:"type:varchar(64);not null;default:'Asia/Shanghai'" json:"time_zone"`
+	Schedule        *OpeningSchedule `gorm:"type:jsonb" json:"schedule"`
 
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
 
 	SeatCount uint
-	SeatMap   []byte
+	// SeatMap holds the JSON of a SeatMap once SeatMapVersion is set.
+	SeatMap        []byte
+	SeatMapVersion uint `gorm:"not null;default:0" json:"seat_map_version"`
 
 	Seats []Seat
 
 	Cover    string
 	Name     string
 	Facility string
+
+	StoreRating
 }
 
 // depreacated
@@ -45,31 +52,48 @@ type StoreSeatsStautusSummaryWithSectorLabel struct {
 	Status []SeatStatusInADay `json:"status"`
 }
 
-func getSeatsOfStore(sid uint) []Seat {
+func (r *Repo) getSeatsOfStore(ctx context.Context, sid uint) []Seat {
 	seats := make([]Seat, 0)
-	_ = db.Where("store_id = ?", sid).Find(&seats)
+	_ = r.conn(ctx).Where("store_id = ?", sid).Find(&seats)
 	return seats
 }
 
-func (s *Store) GetStoreSeatStatus(day time.Time) ([]StoreSeatsStautusSummaryWithSectorLabel, error) {
-	seats := getSeatsOfStore(s.ID)
+func (r *Repo) GetStoreSeatStatus(ctx context.Context, s *Store, day time.Time) ([]StoreSeatsStautusSummaryWithSectorLabel, error) {
+	seats := r.getSeatsOfStore(ctx, s.ID)
 
 	truncatedDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	ids := make([]uint, len(seats))
+	for i, seat := range seats {
+		ids[i] = seat.ID
+	}
+	timelines, err := r.GetSeatStatuses(ctx, s, ids, truncatedDay)
+	if err != nil {
+		return nil, ErrSeatStatusQuery.Wrap(err)
+	}
 	status := make([]SeatStatusInADay, 0)
 	for _, seat := range seats {
-		series := GetSeatStatusBySeatID(seat.ID, truncatedDay)
 		status = append(status, SeatStatusInADay{
 			Seat:   seat,
-			Status: series,
+			Status: timelines[seat.ID],
 		})
 	}
 
+	// seats are grouped by the zones of the seat map, or else by label
+	zones := map[string]string{}
+	if m, err := s.DecodeSeatMap(); err == nil && m != nil {
+		for _, f := range m.Floors {
+			for _, z := range f.Zones {
+				zones[z.ID] = z.Name
+			}
+		}
+	}
 	sectors := make(map[string][]SeatStatusInADay, 0)
 	for _, st := range status {
-		if _, ok := sectors[st.Seat.Label]; !ok {
-			sectors[st.Seat.Label] = make([]SeatStatusInADay, 0)
+		sector := st.Seat.Label
+		if name, ok := zones[st.Seat.Zone]; ok {
+			sector = name
 		}
-		sectors[st.Seat.Label] = append(sectors[st.Seat.Label], st)
+		sectors[sector] = append(sectors[sector], st)
 	}
 
 	result := make([]StoreSeatsStautusSummaryWithSectorLabel, 0)
@@ -83,56 +107,127 @@ func (s *Store) GetStoreSeatStatus(day time.Time) ([]StoreSeatsStautusSummaryWit
 	return result, nil
 }
 
-func GetSeatStatusBySeatID(seat_id uint, truncatedDay time.Time) SeatStatusSeries {
+// GetSeatStatusBySeatID returns when the seat is free or taken over the
+// opening hours of its store on the date of truncatedDay.
+func (r *Repo) GetSeatStatusBySeatID(ctx context.Context, seat_id uint, truncatedDay time.Time) SeatStatusSeries {
+	seat := r.GetSeatByID(ctx, seat_id)
+	if seat == nil {
+		return SeatStatusSeries{}
+	}
+	store := r.GetStoreByID(ctx, seat.StoreID)
+	if store == nil {
+		store = &Store{}
+	}
+	timelines, err := r.GetSeatStatuses(ctx, store, []uint{seat_id}, truncatedDay)
+	if err != nil {
+		logrus.WithError(err).Error("error when finding sessions for seat vacancy time range")
+		return SeatStatusSeries{}
+	}
+	return timelines[seat_id]
+}
+
+// GetSeatStatuses returns the timelines of the seats of store with the
+// given IDs on the date of day, finding their sessions in one query.
+func (r *Repo) GetSeatStatuses(ctx context.Context, store *Store, seatIDs []uint, day time.Time) (map[uint]SeatStatusSeries, error) {
+	result := make(map[uint]SeatStatusSeries, len(seatIDs))
+	open := store.OpenIntervalsOn(day)
+	if len(open) == 0 || len(seatIDs) == 0 {
+		for _, id := range seatIDs {
+			result[id] = SeatStatusSeries{}
+		}
+		return result, nil
+	}
+	sessions, err := r.blockingSessions(ctx, seatIDs, open[0].Start, open[len(open)-1].End)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range seatIDs {
+		result[id] = seatTimeline(open, sessions[id])
+	}
+	return result, nil
+}
+
+// blockingSessions returns, by seat, the sessions blocking the seats
+// between from and to, in order of start time.
+func (r *Repo) blockingSessions(ctx context.Context, seatIDs []uint, from, to time.Time) (map[uint][]Session, error) {
 	sessions := make([]Session, 0)
-	tx := db.Where("seat_id = ? AND start_time > ?", seat_id, truncatedDay).Order("start_time asc").Find(&sessions)
+	tx := r.conn(ctx).
+		Where("seat_id IN ?", seatIDs).
+		Where("status IN ?", blockingSessionStatuses).
+		Where("period && tstzrange(?::timestamptz, ?::timestamptz, '[)')", from, to).
+		Order("start_time asc").
+		Find(&sessions)
 	if tx.Error != nil {
-		logrus.WithError(tx.Error).Error("error when finding sessions for seat vacancy time range")
-		return SeatStatusSeries{}
+		return nil, tx.Error
+	}
+	result := make(map[uint][]Session)
+	for _, s := range sessions {
+		result[s.SeatID] = append(result[s.SeatID], s)
 	}
+	return result, nil
+}
 
+// seatTimeline splits the open intervals of a day into the times the seat
+// is free and those the sessions take, with five minutes either side.
+func seatTimeline(open []OpenInterval, sessions []Session) SeatStatusSeries {
 	result := make(SeatStatusSeries, 0)
-	start_time := truncatedDay.Add(time.Hour + 8) // 8:00 AM
-	for _, s := range sessions {
-		if start_time.Before(s.StartTime.Add(-time.Minute * 5)) {
+	for _, iv := range open {
+		start_time := iv.Start
+		for _, s := range sessions {
+			end := s.StartTime.Add(defaultSessionLength)
+			if s.EndTime != nil {
+				end = *s.EndTime
+			}
+			busyFrom, busyUntil := s.StartTime.Add(-time.Minute*5), end.Add(time.Minute*5)
+			if !busyUntil.After(start_time) || !busyFrom.Before(iv.End) {
+				continue
+			}
+			if busyFrom.Before(start_time) {
+				busyFrom = start_time
+			}
+			if busyUntil.After(iv.End) {
+				busyUntil = iv.End
+			}
+			if start_time.Before(busyFrom) {
+				result = append(result, SeatStatusInTimeRange{
+					StartTime: start_time,
+					EndTime:   busyFrom,
+					Status:    SeatStatusEnumVacancy,
+				})
+			}
+			result = append(result, SeatStatusInTimeRange{
+				StartTime: busyFrom,
+				EndTime:   busyUntil,
+				Status:    SeatStatusEnumOccupied,
+			})
+			start_time = busyUntil
+		}
+
+		// the time left after the final session, until the store closes
+		if start_time.Before(iv.End) {
 			result = append(result, SeatStatusInTimeRange{
 				StartTime: start_time,
-				EndTime:   s.StartTime.Add(-time.Minute * 5),
+				EndTime:   iv.End,
 				Status:    SeatStatusEnumVacancy,
 			})
 		}
-		result = append(result, SeatStatusInTimeRange{
-			StartTime: s.StartTime.Add(-time.Minute * 5),
-			EndTime:   s.EndTime.Add(time.Minute * 5),
-			Status:    SeatStatusEnumOccupied,
-		})
-		start_time = s.EndTime.Add(time.Minute * 5)
-	}
-
-	// if there exists ramaining time after the final session and before 00:00 AM next day, append it.
-	if start_time.Before(truncatedDay.Add(time.Hour * 24)) {
-		result = append(result, SeatStatusInTimeRange{
-			StartTime: start_time,
-			EndTime:   truncatedDay.Add(time.Hour * 24),
-			Status:    SeatStatusEnumVacancy,
-		})
 	}
 
 	return result
 }
 
-func GetStore() *Store {
+func (r *Repo) GetStore(ctx context.Context) *Store {
 	store := &Store{}
-	tx := db.First(store)
+	tx := r.conn(ctx).First(store)
 	if tx.Error != nil {
 		return nil
 	}
 	return store
 }
 
-func GetStoreByID(id uint) *Store {
+func (r *Repo) GetStoreByID(ctx context.Context, id uint) *Store {
 	store := &Store{}
-	tx := db.First(store, "id = ?", id)
+	tx := r.conn(ctx).First(store, "id = ?", id)
 	if tx.Error != nil {
 		return nil
 	}
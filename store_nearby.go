@@ -0,0 +1,208 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	DefaultNearbyStoresLimit = 20
+	MaxNearbyStoresLimit     = 100
+)
+
+// StoreFilters narrows FindStoresNear.
+type StoreFilters struct {
+	// OpenNow keeps only the stores open at the moment.
+	OpenNow bool `json:"open_now"`
+	// MinFreeSeats keeps only the stores with as many seats free now.
+	MinFreeSeats uint `json:"min_free_seats"`
+	// Attributes keeps only the stores with a seat having them all.
+	Attributes SeatAttributes `json:"attributes"`
+
+	// Limit is the size of a page, DefaultNearbyStoresLimit when zero.
+	Limit int `json:"limit"`
+	// Cursor is the NextCursor of the page before, empty for the first.
+	Cursor string `json:"cursor"`
+}
+
+// NearbyStore is a store found by FindStoresNear, with its state at the
+// time of the search.
+type NearbyStore struct {
+	Store      *Store  `json:"store"`
+	DistanceKm float64 `json:"distance_km"`
+	Open       bool    `json:"open"`
+	// FreeSeats counts the seats not taken now, zero when closed.
+	FreeSeats uint `json:"free_seats"`
+}
+
+type NearbyStores struct {
+	Stores []*NearbyStore `json:"stores"`
+	// NextCursor fetches the page after, empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func migrateStoreLocations(db *gorm.DB) error {
+	return execAll(db,
+		`CREATE INDEX IF NOT EXISTS idx_stores_location ON stores USING gist (point(longitude, latitude))`,
+	)
+}
+
+func dropStoreLocations(db *gorm.DB) error {
+	return execAll(db, `DROP INDEX IF EXISTS idx_stores_location`)
+}
+
+// storeCursor is the position of the last store of a page.
+type storeCursor struct {
+	distance float64
+	id       uint
+}
+
+func (c storeCursor) String() string {
+	s := strconv.FormatFloat(c.distance, 'g', -1, 64) + ":" + strconv.FormatUint(uint64(c.id), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseStoreCursor(s string) (*storeCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidPage.Wrap(err)
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidPage
+	}
+	d, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, ErrInvalidPage.Wrap(err)
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidPage.Wrap(err)
+	}
+	return &storeCursor{distance: d, id: uint(id)}, nil
+}
+
+// FindStoresNear returns the stores within radiusKm kilometres of a point,
+// closest first, a page at a time.
+func (r *Repo) FindStoresNear(ctx context.Context, lat, lng, radiusKm float64, f *StoreFilters) (*NearbyStores, error) {
+	if f == nil {
+		f = &StoreFilters{}
+	}
+	if !(radiusKm > 0) || !(lat >= -90 && lat <= 90) || !(lng >= -180 && lng <= 180) {
+		return nil, ErrInvalidArgument
+	}
+	attrs, err := f.Attributes.normalize()
+	if err != nil {
+		return nil, err
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultNearbyStoresLimit
+	}
+	if limit > MaxNearbyStoresLimit {
+		limit = MaxNearbyStoresLimit
+	}
+	after, err := parseStoreCursor(f.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	area := GeoArea{Latitude: lat, Longitude: lng, RadiusKm: radiusKm}
+	now := time.Now()
+	result := &NearbyStores{Stores: make([]*NearbyStore, 0, limit)}
+	for {
+		type candidate struct {
+			ID       uint
+			Distance float64
+		}
+		candidates := make([]candidate, 0)
+		tx := area.scope(r.conn(ctx).Model(&Store{})).
+			Select("id, "+distanceSQL+" AS distance", lat, lat, lng).
+			Where("status <> ?", StoreStatusClosed)
+		if len(attrs) > 0 {
+			tx = tx.Where("EXISTS (SELECT 1 FROM seats WHERE seats.store_id = stores.id AND seats.deleted_at IS NULL AND seats.attributes @> ?::jsonb)", attrs)
+		}
+		if after != nil {
+			tx = tx.Where("("+distanceSQL+", id) > (?, ?)", lat, lat, lng, after.distance, after.id)
+		}
+		if err := tx.Order("distance, id").Limit(limit + 1).Scan(&candidates).Error; err != nil {
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			return result, nil
+		}
+
+		ids := make([]uint, len(candidates))
+		for i, c := range candidates {
+			ids[i] = c.ID
+		}
+		stores, free, err := r.nearbyStoreState(ctx, ids, now)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range candidates {
+			after = &storeCursor{distance: c.Distance, id: c.ID}
+			store, ok := stores[c.ID]
+			if !ok {
+				continue
+			}
+			s := &NearbyStore{Store: store, DistanceKm: c.Distance, Open: store.IsOpenAt(now)}
+			if s.Open {
+				s.FreeSeats = free[c.ID]
+			}
+			if (f.OpenNow && !s.Open) || s.FreeSeats < f.MinFreeSeats {
+				continue
+			}
+			result.Stores = append(result.Stores, s)
+			if len(result.Stores) == limit {
+				if i < len(candidates)-1 || len(candidates) > limit {
+					result.NextCursor = after.String()
+				}
+				return result, nil
+			}
+		}
+		if len(candidates) <= limit {
+			return result, nil
+		}
+	}
+}
+
+// nearbyStoreState loads the stores with the given IDs and counts their
+// seats free at now.
+func (r *Repo) nearbyStoreState(ctx context.Context, ids []uint, now time.Time) (map[uint]*Store, map[uint]uint, error) {
+	list := make([]*Store, 0, len(ids))
+	if err := r.conn(ctx).Where("id IN ?", ids).Find(&list).Error; err != nil {
+		return nil, nil, err
+	}
+	stores := make(map[uint]*Store, len(list))
+	for _, s := range list {
+		stores[s.ID] = s
+	}
+
+	counts := make([]struct {
+		StoreID uint
+		Free    uint
+	}, 0)
+	err := r.conn(ctx).Model(&Seat{}).
+		Select("store_id, count(*) AS free").
+		Where("store_id IN ?", ids).
+		Where("NOT EXISTS (SELECT 1 FROM sessions WHERE sessions.seat_id = seats.id AND sessions.status IN ? AND sessions.period @> ?::timestamptz)", blockingSessionStatuses, now).
+		Group("store_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	free := make(map[uint]uint, len(counts))
+	for _, c := range counts {
+		free[c.StoreID] = c.Free
+	}
+	return stores, free, nil
+}
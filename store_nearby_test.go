@@ -0,0 +1,106 @@
+package models_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestFindStoresNear(t *testing.T) {
+	repo := modelstest.New(t)
+	now := time.Now()
+	modelstest.LoadJSON(t, repo, []byte(fmt.Sprintf(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"stores": [
+			{"id": 1, "name": "a", "latitude": 31.2304, "longitude": 121.4737},
+			{"id": 2, "name": "b", "latitude": 31.2350, "longitude": 121.4737},
+			{"id": 3, "name": "c", "latitude": 31.2400, "longitude": 121.4737,
+			 "schedule": {"weekly": [[], [], [], [], [], [], []]}},
+			{"id": 4, "name": "d", "latitude": 31.2450, "longitude": 121.4737, "status": 1},
+			{"id": 5, "name": "e", "latitude": 31.2500, "longitude": 121.4737},
+			{"id": 6, "name": "far", "latitude": 39.9042, "longitude": 116.4074}
+		],
+		"seats": [
+			{"id": 1, "store_id": 1, "label": "A"},
+			{"id": 2, "store_id": 1, "label": "A", "attributes": ["power"]},
+			{"id": 3, "store_id": 2, "label": "A"},
+			{"id": 4, "store_id": 3, "label": "A"},
+			{"id": 5, "store_id": 5, "label": "A", "attributes": ["power"]}
+		],
+		"sessions": [
+			{"id": 1, "user_id": 1, "seat_id": 1, "start_time": %q, "end_time": %q}
+		]
+	}`, now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))))
+	ctx := context.Background()
+
+	names := func(page *models.NearbyStores) []string {
+		result := make([]string, len(page.Stores))
+		for i, s := range page.Stores {
+			result[i] = s.Store.Name
+		}
+		return result
+	}
+
+	// store d is closed by the administrators, and far is out of range
+	page, err := repo.FindStoresNear(ctx, 31.2304, 121.4737, 5, &models.StoreFilters{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(page); fmt.Sprint(got) != "[a b]" || page.NextCursor == "" {
+		t.Fatalf("first page = %v, cursor %q", got, page.NextCursor)
+	}
+	if page.Stores[0].DistanceKm != 0 || page.Stores[1].DistanceKm < 0.5 || page.Stores[1].DistanceKm > 0.52 {
+		t.Errorf("distances = %v, %v", page.Stores[0].DistanceKm, page.Stores[1].DistanceKm)
+	}
+	if !page.Stores[0].Open || page.Stores[0].FreeSeats != 1 {
+		t.Errorf("store a open %v with %d free seats, want open with 1", page.Stores[0].Open, page.Stores[0].FreeSeats)
+	}
+	page, err = repo.FindStoresNear(ctx, 31.2304, 121.4737, 5, &models.StoreFilters{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(page); fmt.Sprint(got) != "[c e]" || page.NextCursor != "" || page.Stores[0].Open {
+		t.Errorf("second page = %v, cursor %q", got, page.NextCursor)
+	}
+
+	page, err = repo.FindStoresNear(ctx, 31.2304, 121.4737, 5, &models.StoreFilters{
+		OpenNow:      true,
+		MinFreeSeats: 1,
+		Attributes:   models.SeatAttributes{models.SeatAttributePower},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(page); fmt.Sprint(got) != "[a e]" {
+		t.Errorf("filtered = %v, want [a e]", got)
+	}
+
+	if _, err := repo.FindStoresNear(ctx, 31.2304, 121.4737, 5, &models.StoreFilters{Cursor: "!"}); err == nil {
+		t.Error("a bad cursor is accepted")
+	}
+}
+
+func TestFindStoresNearAntimeridian(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"stores": [
+			{"id": 1, "name": "east", "latitude": -17.7, "longitude": 179.99},
+			{"id": 2, "name": "west", "latitude": -17.7, "longitude": -179.99}
+		]
+	}`))
+	ctx := context.Background()
+
+	for _, lng := range []float64{179.99, -179.99} {
+		page, err := repo.FindStoresNear(ctx, -17.7, lng, 5, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Stores) != 2 {
+			t.Errorf("FindStoresNear(%v) found %d stores, want both sides of the antimeridian", lng, len(page.Stores))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxReviewPhotos caps the photos of a review.
+var MaxReviewPhotos = 9
+
+type StoreReviewStatus string
+
+const (
+	StoreReviewStatusPending  StoreReviewStatus = "pending"
+	StoreReviewStatusApproved StoreReviewStatus = "approved"
+	StoreReviewStatusRejected StoreReviewStatus = "rejected"
+)
+
+type StoreReviewSort string
+
+const (
+	StoreReviewSortNewest  StoreReviewSort = "newest"
+	StoreReviewSortHighest StoreReviewSort = "highest"
+	StoreReviewSortLowest  StoreReviewSort = "lowest"
+)
+
+// StoreRating aggregates the approved reviews of a store. The sub-ratings
+// average the reviews that gave them.
+type StoreRating struct {
+	ReviewCount       uint    `gorm:"not null;default:0" json:"review_count"`
+	Rating            float64 `gorm:"not null;default:0" json:"rating"`
+	QuietnessRating   float64 `gorm:"not null;default:0" json:"quietness_rating"`
+	CleanlinessRating float64 `gorm:"not null;default:0" json:"cleanliness_rating"`
+	NetworkRating     float64 `gorm:"not null;default:0" json:"network_rating"`
+}
+
+// StoreReview is what a user thinks of a store after a session there.
+// Ratings go from 1 to 5; a sub-rating of 0 was not given. Reviews are
+// shown and counted once approved.
+type StoreReview struct {
+	gorm.Model
+	Store     Store   `json:"-"`
+	StoreID   uint    `gorm:"not null;index" json:"store_id"`
+	User      User    `json:"-"`
+	UserID    uint    `gorm:"not null;index" json:"user_id"`
+	Session   Session `json:"-"`
+	SessionID uint    `gorm:"not null;uniqueIndex" json:"session_id"`
+
+	Rating      uint8   `gorm:"not null" json:"rating"`
+	Quietness   uint8   `gorm:"not null;default:0" json:"quietness"`
+	Cleanliness uint8   `gorm:"not null;default:0" json:"cleanliness"`
+	Network     uint8   `gorm:"not null;default:0" json:"network"`
+	Content     string  `gorm:"type:text;not null;default:''" json:"content"`
+	Photos      []*File `gorm:"many2many:store_review_photos" json:"photos"`
+
+	Status         StoreReviewStatus `gorm:"type:varchar(16);not null;default:'pending';index" json:"status"`
+	ModerationNote string            `gorm:"type:varchar(255);not null;default:''" json:"-"`
+	ModeratedBy    string            `gorm:"type:varchar(64);not null;default:''" json:"-"`
+	ModeratedAt    *time.Time        `json:"-"`
+
+	Reply     string     `gorm:"type:text;not null;default:''" json:"reply"`
+	RepliedBy string     `gorm:"type:varchar(64);not null;default:''" json:"-"`
+	RepliedAt *time.Time `json:"replied_at"`
+}
+
+func migrateStoreReviews(db *gorm.DB) error {
+	if err := createTables(db, &StoreReview{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	for _, field := range []string{"ReviewCount", "Rating", "QuietnessRating", "CleanlinessRating", "NetworkRating"} {
+		if !m.HasColumn(&Store{}, field) {
+			if err := m.AddColumn(&Store{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropStoreReviews(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropTable("store_review_photos", &StoreReview{}); err != nil {
+		return err
+	}
+	for _, field := range []string{"ReviewCount", "Rating", "QuietnessRating", "CleanlinessRating", "NetworkRating"} {
+		if err := m.DropColumn(&Store{}, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validRating(v uint8, optional bool) bool {
+	return (optional && v == 0) || (v >= 1 && v <= 5)
+}
+
+// CreateStoreReview records the review u gives of the store of a session
+// of theirs that is done, filling in its user and store. Each session is
+// reviewed once.
+func (r *Repo) CreateStoreReview(ctx context.Context, u *User, review *StoreReview, photoIDs []uint) error {
+	if !validRating(review.Rating, false) || !validRating(review.Quietness, true) ||
+		!validRating(review.Cleanliness, true) || !validRating(review.Network, true) ||
+		len(photoIDs) > MaxReviewPhotos {
+		return ErrInvalidArgument
+	}
+	return r.WithTx(ctx, func(tx *Repo) error {
+		s := &Session{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(s, "id = ?", review.SessionID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrReviewNotAllowed.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		if s.UserID != u.ID || s.Status != SessionStatusDone {
+			return ErrReviewNotAllowed
+		}
+		var reviewed int64
+		err = tx.conn(ctx).Unscoped().Model(&StoreReview{}).Where("session_id = ?", s.ID).Count(&reviewed).Error
+		if err != nil {
+			return err
+		}
+		if reviewed > 0 {
+			return ErrAlreadyReviewed
+		}
+		seat := &Seat{}
+		if err := tx.conn(ctx).Unscoped().First(seat, "id = ?", s.SeatID).Error; err != nil {
+			return err
+		}
+
+		photos := make([]*File, 0, len(photoIDs))
+		if len(photoIDs) > 0 {
+			if err := tx.conn(ctx).Where("id IN ?", photoIDs).Find(&photos).Error; err != nil {
+				return err
+			}
+			if len(photos) != len(photoIDs) {
+				return ErrInvalidArgument
+			}
+		}
+
+		review.ID = 0
+		review.UserID = u.ID
+		review.StoreID = seat.StoreID
+		review.Photos = photos
+		review.Status = StoreReviewStatusPending
+		review.Reply, review.RepliedBy, review.RepliedAt = "", "", nil
+		return tx.conn(ctx).Create(review).Error
+	})
+}
+
+func (r *Repo) GetStoreReview(ctx context.Context, id uint) (*StoreReview, error) {
+	review := &StoreReview{}
+	err := r.conn(ctx).Preload("Photos").First(review, "id = ?", id).Error
+	return review, err
+}
+
+// DeleteStoreReview deletes a review of u.
+func (r *Repo) DeleteStoreReview(ctx context.Context, review *StoreReview, u *User) error {
+	if review.UserID != u.ID {
+		return ErrReviewNotAllowed
+	}
+	return r.WithTx(ctx, func(tx *Repo) error {
+		if err := tx.conn(ctx).Delete(review).Error; err != nil {
+			return err
+		}
+		return tx.refreshStoreRating(ctx, review.StoreID)
+	})
+}
+
+// ModerateStoreReview approves or rejects a review, updating the rating
+// of its store.
+func (r *Repo) ModerateStoreReview(ctx context.Context, review *StoreReview, status StoreReviewStatus, note, actor string) error {
+	if status != StoreReviewStatusApproved && status != StoreReviewStatusRejected {
+		return ErrInvalidArgument
+	}
+	now := time.Now()
+	return r.WithTx(ctx, func(tx *Repo) error {
+		err := tx.conn(ctx).Model(review).Updates(map[string]interface{}{
+			"status":          status,
+			"moderation_note": truncate(note, 255),
+			"moderated_by":    actor,
+			"moderated_at":    now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		review.Status = status
+		review.ModerationNote = truncate(note, 255)
+		review.ModeratedBy = actor
+		review.ModeratedAt = &now
+		return tx.refreshStoreRating(ctx, review.StoreID)
+	})
+}
+
+// ReplyToStoreReview sets the reply of the merchant to a review, an empty
+// reply removing it.
+func (r *Repo) ReplyToStoreReview(ctx context.Context, review *StoreReview, reply, actor string) error {
+	var at *time.Time
+	if reply != "" {
+		now := time.Now()
+		at = &now
+	}
+	err := r.conn(ctx).Model(review).Updates(map[string]interface{}{
+		"reply":      reply,
+		"replied_by": actor,
+		"replied_at": at,
+	}).Error
+	if err != nil {
+		return err
+	}
+	review.Reply, review.RepliedBy, review.RepliedAt = reply, actor, at
+	return nil
+}
+
+// refreshStoreRating recounts the approved reviews of the store storeID.
+func (r *Repo) refreshStoreRating(ctx context.Context, storeID uint) error {
+	return r.conn(ctx).Exec(`UPDATE stores SET
+		(review_count, rating, quietness_rating, cleanliness_rating, network_rating) = (
+			SELECT count(*),
+				coalesce(avg(rating), 0),
+				coalesce(avg(nullif(quietness, 0)), 0),
+				coalesce(avg(nullif(cleanliness, 0)), 0),
+				coalesce(avg(nullif(network, 0)), 0)
+			FROM store_reviews
+			WHERE store_id = stores.id AND status = ? AND deleted_at IS NULL
+		)
+		WHERE id = ?`, StoreReviewStatusApproved, storeID).Error
+}
+
+// ListStoreReviews returns a page of the approved reviews of store.
+func (r *Repo) ListStoreReviews(ctx context.Context, store *Store, sort StoreReviewSort, limit, page uint) ([]*StoreReview, error) {
+	if page < 1 || limit < 1 {
+		return nil, ErrInvalidPage
+	}
+	order := "created_at desc, id desc"
+	switch sort {
+	case StoreReviewSortNewest, "":
+	case StoreReviewSortHighest:
+		order = "rating desc, " + order
+	case StoreReviewSortLowest:
+		order = "rating asc, " + order
+	default:
+		return nil, ErrInvalidArgument
+	}
+	result := make([]*StoreReview, 0)
+	tx := r.conn(ctx).
+		Preload("Photos").
+		Where("store_id = ? AND status = ?", store.ID, StoreReviewStatusApproved).
+		Order(order).
+		Limit(int(limit)).
+		Offset(int(limit * (page - 1))).
+		Find(&result)
+	return result, tx.Error
+}
+
+// ListPendingStoreReviews returns a page of the reviews waiting for
+// moderation, oldest first.
+func (r *Repo) ListPendingStoreReviews(ctx context.Context, limit, page uint) ([]*StoreReview, error) {
+	if page < 1 || limit < 1 {
+		return nil, ErrInvalidPage
+	}
+	result := make([]*StoreReview, 0)
+	tx := r.conn(ctx).
+		Preload("Photos").
+		Where("status = ?", StoreReviewStatusPending).
+		Order("created_at asc, id asc").
+		Limit(int(limit)).
+		Offset(int(limit * (page - 1))).
+		Find(&result)
+	return result, tx.Error
+}
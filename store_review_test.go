@@ -0,0 +1,101 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestStoreReviews(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [
+			{"id": 1, "username": "alice", "phone": "13800000001"},
+			{"id": 2, "username": "bob", "phone": "13800000002"}
+		],
+		"stores": [{"id": 1, "name": "main"}],
+		"seats": [{"id": 1, "store_id": 1, "label": "A"}],
+		"sessions": [
+			{"id": 1, "user_id": 1, "seat_id": 1, "status": "done",
+			 "start_time": "2022-03-01T09:00:00+08:00", "end_time": "2022-03-01T11:00:00+08:00"},
+			{"id": 2, "user_id": 2, "seat_id": 1, "status": "done",
+			 "start_time": "2022-03-01T12:00:00+08:00", "end_time": "2022-03-01T13:00:00+08:00"},
+			{"id": 3, "user_id": 1, "seat_id": 1, "status": "valid",
+			 "start_time": "2022-03-02T09:00:00+08:00", "end_time": "2022-03-02T11:00:00+08:00"}
+		]
+	}`))
+	ctx := context.Background()
+	alice, _ := repo.FindUser(ctx, 1)
+	bob, _ := repo.FindUser(ctx, 2)
+	photo := &models.File{Filename: "desk", Ext: "jpg"}
+	if err := repo.DB().Create(photo).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.CreateStoreReview(ctx, alice, &models.StoreReview{SessionID: 3, Rating: 5}, nil); !errors.Is(err, models.ErrReviewNotAllowed) {
+		t.Errorf("reviewing an unfinished session: error = %v, want ErrReviewNotAllowed", err)
+	}
+	if err := repo.CreateStoreReview(ctx, alice, &models.StoreReview{SessionID: 2, Rating: 5}, nil); !errors.Is(err, models.ErrReviewNotAllowed) {
+		t.Errorf("reviewing the session of another user: error = %v, want ErrReviewNotAllowed", err)
+	}
+
+	good := &models.StoreReview{SessionID: 1, Rating: 5, Quietness: 4, Content: "quiet and bright"}
+	if err := repo.CreateStoreReview(ctx, alice, good, []uint{photo.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if good.StoreID != 1 || good.Status != models.StoreReviewStatusPending {
+		t.Errorf("review = %+v", good)
+	}
+	if err := repo.CreateStoreReview(ctx, alice, &models.StoreReview{SessionID: 1, Rating: 1}, nil); !errors.Is(err, models.ErrAlreadyReviewed) {
+		t.Errorf("reviewing a session twice: error = %v, want ErrAlreadyReviewed", err)
+	}
+	bad := &models.StoreReview{SessionID: 2, Rating: 2, Quietness: 2, Network: 3}
+	if err := repo.CreateStoreReview(ctx, bob, bad, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store := repo.GetStoreByID(ctx, 1)
+	if reviews, err := repo.ListStoreReviews(ctx, store, "", 10, 1); err != nil || len(reviews) != 0 {
+		t.Errorf("reviews before moderation = %d, %v, want none", len(reviews), err)
+	}
+	pending, err := repo.ListPendingStoreReviews(ctx, 10, 1)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("pending reviews = %d, %v, want 2", len(pending), err)
+	}
+	for _, review := range pending {
+		if err := repo.ModerateStoreReview(ctx, review, models.StoreReviewStatusApproved, "", "admin:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store = repo.GetStoreByID(ctx, 1)
+	want := models.StoreRating{ReviewCount: 2, Rating: 3.5, QuietnessRating: 3, NetworkRating: 3}
+	if store.StoreRating != want {
+		t.Errorf("rating = %+v, want %+v", store.StoreRating, want)
+	}
+
+	reviews, err := repo.ListStoreReviews(ctx, store, models.StoreReviewSortLowest, 10, 1)
+	if err != nil || len(reviews) != 2 || reviews[0].ID != bad.ID || len(reviews[1].Photos) != 1 {
+		t.Errorf("lowest first = %v, %v", reviews, err)
+	}
+
+	if err := repo.ReplyToStoreReview(ctx, bad, "sorry, the network is fixed now", "admin:1"); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := repo.GetStoreReview(ctx, bad.ID); r.Reply == "" || r.RepliedAt == nil {
+		t.Errorf("reply = %q at %v", r.Reply, r.RepliedAt)
+	}
+
+	if err := repo.DeleteStoreReview(ctx, bad, alice); !errors.Is(err, models.ErrReviewNotAllowed) {
+		t.Errorf("deleting the review of another user: error = %v", err)
+	}
+	if err := repo.DeleteStoreReview(ctx, bad, bob); err != nil {
+		t.Fatal(err)
+	}
+	if store = repo.GetStoreByID(ctx, 1); store.ReviewCount != 1 || store.Rating != 5 {
+		t.Errorf("rating after deletion = %+v", store.StoreRating)
+	}
+}
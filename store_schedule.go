@@ -0,0 +1,353 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultStoreTimeZone is the time zone of stores that do not set one.
+const DefaultStoreTimeZone = "Asia/Shanghai"
+
+// TimeOfDay is a time on the clock, in minutes since midnight. 24:00 is
+// the end of the day.
+type TimeOfDay uint
+
+const endOfDay TimeOfDay = 24 * 60
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t/60, t%60)
+}
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *TimeOfDay) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	var h, m uint
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || m >= 60 || h*60+m > uint(endOfDay) {
+		return fmt.Errorf("invalid time of day %q", s)
+	}
+	*t = TimeOfDay(h*60 + m)
+	return nil
+}
+
+// on returns t on the given day in loc.
+func (t TimeOfDay) on(year int, month time.Month, day int, loc *time.Location) time.Time {
+	return time.Date(year, month, day, int(t/60), int(t%60), 0, 0, loc)
+}
+
+// OpeningPeriod is a span of a day the store is open.
+type OpeningPeriod struct {
+	Open  TimeOfDay `json:"open"`
+	Close TimeOfDay `json:"close"`
+}
+
+// ScheduleOverride replaces the weekly hours on one date, for holidays
+// and special days. No periods means the store is closed all day.
+type ScheduleOverride struct {
+	Date    string          `json:"date"` // 2006-01-02
+	Periods []OpeningPeriod `json:"periods"`
+	Note    string          `json:"note,omitempty"`
+}
+
+// StoreClosure closes the store from From until Until, whatever its
+// hours.
+type StoreClosure struct {
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// OpeningSchedule is when a store is open, in its own time zone.
+type OpeningSchedule struct {
+	// Weekly holds the hours of each day of the week, indexed by
+	// time.Weekday.
+	Weekly    [7][]OpeningPeriod `json:"weekly"`
+	Overrides []ScheduleOverride `json:"overrides,omitempty"`
+	Closures  []StoreClosure     `json:"closures,omitempty"`
+}
+
+func (s OpeningSchedule) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *OpeningSchedule) Scan(v interface{}) error {
+	return scanJSON(v, s)
+}
+
+// legacySchedule decodes the OpeningHours and OpeningWeekdays of a store.
+// OpeningHours holds the opening and closing times as HHMMHHMM, so
+// 8002200 is 08:00 to 22:00; OpeningWeekdays is a bit mask of the days
+// open, bit 0 being Sunday. Zero means every hour or every day, as do
+// hours that do not decode to a period.
+func legacySchedule(hours, weekdays uint) *OpeningSchedule {
+	period, ok := legacyPeriod(hours)
+	if !ok {
+		period = OpeningPeriod{Open: 0, Close: endOfDay}
+	}
+	s := &OpeningSchedule{}
+	for d := range s.Weekly {
+		if weekdays == 0 || weekdays&(1<<uint(d)) != 0 {
+			s.Weekly[d] = []OpeningPeriod{period}
+		}
+	}
+	return s
+}
+
+// legacyPeriod decodes OpeningHours, reporting whether they make a
+// period.
+func legacyPeriod(hours uint) (OpeningPeriod, bool) {
+	period := OpeningPeriod{Open: 0, Close: endOfDay}
+	if hours == 0 {
+		return period, true
+	}
+	open, shut := hours/10000, hours%10000
+	if open/100 > 23 || open%100 >= 60 || shut%100 >= 60 {
+		return period, false
+	}
+	period.Open = TimeOfDay(open/100*60 + open%100)
+	if shut != 0 {
+		period.Close = TimeOfDay(shut/100*60 + shut%100)
+	}
+	return period, period.Open < period.Close && period.Close <= endOfDay
+}
+
+// Validate checks the periods of s are in order and do not overlap and
+// that its dates parse.
+func (s *OpeningSchedule) Validate() error {
+	check := func(periods []OpeningPeriod) error {
+		var last TimeOfDay
+		for i, p := range periods {
+			if p.Open >= p.Close || p.Close > endOfDay || (i > 0 && p.Open < last) {
+				return ErrInvalidArgument
+			}
+			last = p.Close
+		}
+		return nil
+	}
+	for _, periods := range s.Weekly {
+		if err := check(periods); err != nil {
+			return err
+		}
+	}
+	for _, o := range s.Overrides {
+		if _, err := time.Parse("2006-01-02", o.Date); err != nil {
+			return ErrInvalidArgument.Wrap(err)
+		}
+		if err := check(o.Periods); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.Closures {
+		if !c.Until.After(c.From) {
+			return ErrInvalidArgument
+		}
+	}
+	return nil
+}
+
+// OpenInterval is a time the store is open without a break.
+type OpenInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (s *OpeningSchedule) periodsOn(day time.Time) []OpeningPeriod {
+	date := day.Format("2006-01-02")
+	for _, o := range s.Overrides {
+		if o.Date == date {
+			return o.Periods
+		}
+	}
+	return s.Weekly[day.Weekday()]
+}
+
+// OpenIntervals returns when the store is open on the days from first to
+// last, both taken as dates in loc. Intervals that touch are merged, so
+// a store open until midnight and from midnight again is open across it.
+func (s *OpeningSchedule) OpenIntervals(first, last time.Time, loc *time.Location) []OpenInterval {
+	first, last = first.In(loc), last.In(loc)
+	day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, loc)
+
+	intervals := make([]OpenInterval, 0)
+	for ; !day.After(end); day = day.AddDate(0, 0, 1) {
+		for _, p := range s.periodsOn(day) {
+			iv := OpenInterval{
+				Start: p.Open.on(day.Year(), day.Month(), day.Day(), loc),
+				End:   p.Close.on(day.Year(), day.Month(), day.Day(), loc),
+			}
+			if n := len(intervals); n > 0 && !iv.Start.After(intervals[n-1].End) {
+				intervals[n-1].End = iv.End
+				continue
+			}
+			intervals = append(intervals, iv)
+		}
+	}
+
+	closures := append([]StoreClosure{}, s.Closures...)
+	sort.Slice(closures, func(i, j int) bool { return closures[i].From.Before(closures[j].From) })
+	for _, c := range closures {
+		cut := make([]OpenInterval, 0, len(intervals))
+		for _, iv := range intervals {
+			if !c.From.Before(iv.End) || !c.Until.After(iv.Start) {
+				cut = append(cut, iv)
+				continue
+			}
+			if iv.Start.Before(c.From) {
+				cut = append(cut, OpenInterval{Start: iv.Start, End: c.From})
+			}
+			if c.Until.Before(iv.End) {
+				cut = append(cut, OpenInterval{Start: c.Until, End: iv.End})
+			}
+		}
+		intervals = cut
+	}
+	return intervals
+}
+
+// IsOpen reports whether the store is open all the time from start to end.
+func (s *OpeningSchedule) IsOpen(start, end time.Time, loc *time.Location) bool {
+	// the day before start, for periods running on past midnight
+	for _, iv := range s.OpenIntervals(start.AddDate(0, 0, -1), end, loc) {
+		if !start.Before(iv.Start) && !end.After(iv.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// zone returns the time zone of the store.
+func (s *Store) zone() *time.Location {
+	name := s.TimeZone
+	if name == "" {
+		name = DefaultStoreTimeZone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// OpeningSchedule returns the schedule of the store, falling back to its
+// legacy hours.
+func (s *Store) OpeningSchedule() *OpeningSchedule {
+	if s.Schedule != nil {
+		return s.Schedule
+	}
+	return legacySchedule(s.OpeningHours, s.OpeningWeekdays)
+}
+
+// IsOpen reports whether the store is open all the time from start to end.
+func (s *Store) IsOpen(start, end time.Time) bool {
+	return s.OpeningSchedule().IsOpen(start, end, s.zone())
+}
+
+// IsOpenAt reports whether the store is open at t.
+func (s *Store) IsOpenAt(t time.Time) bool {
+	for _, iv := range s.OpenIntervalsOn(t.In(s.zone())) {
+		if !t.Before(iv.Start) && t.Before(iv.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenIntervalsOn returns when the store is open on the date of day, in
+// the store's time zone.
+func (s *Store) OpenIntervalsOn(day time.Time) []OpenInterval {
+	loc := s.zone()
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	next := date.AddDate(0, 0, 1)
+	result := make([]OpenInterval, 0)
+	for _, iv := range s.OpeningSchedule().OpenIntervals(date.AddDate(0, 0, -1), date, loc) {
+		if iv.Start.Before(date) {
+			iv.Start = date
+		}
+		if iv.End.After(next) {
+			iv.End = next
+		}
+		if iv.End.After(iv.Start) {
+			result = append(result, iv)
+		}
+	}
+	return result
+}
+
+func migrateStoreSchedules(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, field := range []string{"TimeZone", "Schedule"} {
+		if !m.HasColumn(&Store{}, field) {
+			if err := m.AddColumn(&Store{}, field); err != nil {
+				return err
+			}
+		}
+	}
+	stores := make([]*Store, 0)
+	err := db.Where("schedule IS NULL AND (opening_hours <> 0 OR opening_weekdays <> 0)").Find(&stores).Error
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		if _, ok := legacyPeriod(s.OpeningHours); !ok {
+			// left unset, so the store is open at every hour of its days
+			logrus.WithField("store", s.ID).Warnf("Ignoring invalid opening hours %d", s.OpeningHours)
+			continue
+		}
+		err := db.Model(s).Update("schedule", legacySchedule(s.OpeningHours, s.OpeningWeekdays)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropStoreSchedules(db *gorm.DB) error {
+	m := db.Migrator()
+	if err := m.DropColumn(&Store{}, "Schedule"); err != nil {
+		return err
+	}
+	return m.DropColumn(&Store{}, "TimeZone")
+}
+
+// SetStoreSchedule replaces the schedule and time zone of store.
+func (r *Repo) SetStoreSchedule(ctx context.Context, store *Store, schedule *OpeningSchedule, timeZone string) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	if timeZone == "" {
+		timeZone = DefaultStoreTimeZone
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return ErrInvalidArgument.Wrap(err)
+	}
+	err := r.conn(ctx).Model(store).Updates(map[string]interface{}{
+		"schedule":  schedule,
+		"time_zone": timeZone,
+	}).Error
+	if err != nil {
+		return err
+	}
+	store.Schedule = schedule
+	store.TimeZone = timeZone
+	return nil
+}
+
+// AddStoreClosure closes store from from until until.
+func (r *Repo) AddStoreClosure(ctx context.Context, store *Store, from, until time.Time, reason string) error {
+	schedule := *store.OpeningSchedule()
+	schedule.Closures = append(append([]StoreClosure{}, schedule.Closures...), StoreClosure{From: from, Until: until, Reason: reason})
+	return r.SetStoreSchedule(ctx, store, &schedule, store.TimeZone)
+}
@@ -0,0 +1,141 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+// scheduleJSON opens 09:00-18:00 on weekdays and 20:00 to 02:00 the next
+// day on Saturdays, closes on Sundays and on 2022-03-08.
+const scheduleJSON = `{
+	"weekly": [
+		[{"open": "00:00", "close": "02:00"}],
+		[{"open": "09:00", "close": "18:00"}],
+		[{"open": "09:00", "close": "18:00"}],
+		[{"open": "09:00", "close": "18:00"}],
+		[{"open": "09:00", "close": "18:00"}],
+		[{"open": "09:00", "close": "18:00"}],
+		[{"open": "20:00", "close": "24:00"}]
+	],
+	"overrides": [{"date": "2022-03-08", "periods": [], "note": "holiday"}],
+	"closures": [{"from": "2022-03-02T12:00:00+08:00", "until": "2022-03-02T14:00:00+08:00"}]
+}`
+
+func TestOpeningSchedule(t *testing.T) {
+	var schedule models.OpeningSchedule
+	if err := json.Unmarshal([]byte(scheduleJSON), &schedule); err != nil {
+		t.Fatal(err)
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	store := &models.Store{Schedule: &schedule}
+
+	ts := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	cases := []struct {
+		name       string
+		start, end string
+		want       bool
+	}{
+		{"weekday", "2022-03-01T10:00:00+08:00", "2022-03-01T12:00:00+08:00", true},
+		{"before opening", "2022-03-01T08:00:00+08:00", "2022-03-01T10:00:00+08:00", false},
+		{"after closing", "2022-03-01T17:00:00+08:00", "2022-03-01T19:00:00+08:00", false},
+		{"closure", "2022-03-02T11:00:00+08:00", "2022-03-02T13:00:00+08:00", false},
+		{"after closure", "2022-03-02T14:00:00+08:00", "2022-03-02T16:00:00+08:00", true},
+		{"across midnight", "2022-03-05T23:00:00+08:00", "2022-03-06T01:30:00+08:00", true},
+		{"past late closing", "2022-03-05T23:00:00+08:00", "2022-03-06T03:00:00+08:00", false},
+		{"holiday", "2022-03-08T10:00:00+08:00", "2022-03-08T11:00:00+08:00", false},
+		{"other time zone", "2022-03-01T02:00:00Z", "2022-03-01T04:00:00Z", true},
+	}
+	for _, c := range cases {
+		if got := store.IsOpen(ts(c.start), ts(c.end)); got != c.want {
+			t.Errorf("%s: IsOpen() = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	intervals := store.OpenIntervalsOn(ts("2022-03-06T12:00:00+08:00"))
+	if len(intervals) != 1 || !intervals[0].Start.Equal(ts("2022-03-06T00:00:00+08:00")) || !intervals[0].End.Equal(ts("2022-03-06T02:00:00+08:00")) {
+		t.Errorf("OpenIntervalsOn(Sunday) = %v, want the two hours after midnight", intervals)
+	}
+	if intervals := store.OpenIntervalsOn(ts("2022-03-02T12:00:00+08:00")); len(intervals) != 2 {
+		t.Errorf("OpenIntervalsOn(closure day) = %v, want the day split in two", intervals)
+	}
+
+	// a store with legacy hours, 08:00 to 22:00 on Monday to Friday
+	legacy := &models.Store{OpeningHours: 8002200, OpeningWeekdays: 0x3e}
+	if !legacy.IsOpen(ts("2022-03-01T08:00:00+08:00"), ts("2022-03-01T22:00:00+08:00")) {
+		t.Error("legacy store is not open during its hours")
+	}
+	if legacy.IsOpen(ts("2022-03-06T10:00:00+08:00"), ts("2022-03-06T11:00:00+08:00")) {
+		t.Error("legacy store is open on Sunday")
+	}
+	// hours that are not a period are ignored rather than closing the store
+	for _, hours := range []uint{25002200, 8602200, 22000800} {
+		broken := &models.Store{OpeningHours: hours}
+		if !broken.IsOpen(ts("2022-03-01T03:00:00+08:00"), ts("2022-03-01T23:00:00+08:00")) {
+			t.Errorf("store with invalid hours %d is not open all day", hours)
+		}
+	}
+	if !(&models.Store{}).IsOpen(ts("2022-03-06T03:00:00+08:00"), ts("2022-03-07T03:00:00+08:00")) {
+		t.Error("store without hours is not always open")
+	}
+}
+
+func TestBookingOutsideOpeningHours(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{
+		"users": [{"id": 1, "username": "alice", "phone": "13800000001"}],
+		"stores": [{"id": 1, "name": "main", "time_zone": "Asia/Shanghai", "schedule": `+scheduleJSON+`}],
+		"seats": [{"id": 1, "store_id": 1, "label": "A"}],
+		"sessions": [
+			{"id": 1, "user_id": 1, "seat_id": 1,
+			 "start_time": "2022-03-01T10:00:00+08:00",
+			 "end_time": "2022-03-01T11:00:00+08:00"}
+		]
+	}`))
+	ctx := context.Background()
+
+	if err := repo.ValidateSession(ctx, 1, 1, at(t, "07:00"), at(t, "08:00")); !errors.Is(err, models.ErrStoreClosed) {
+		t.Errorf("booking before opening: error = %v, want ErrStoreClosed", err)
+	}
+	if err := repo.ValidateSession(ctx, 1, 1, at(t, "15:00"), at(t, "16:00")); err != nil {
+		t.Errorf("booking during opening hours: %v", err)
+	}
+
+	series := repo.GetSeatStatusBySeatID(ctx, 1, *at(t, "00:00"))
+	if len(series) != 3 {
+		t.Fatalf("seat status = %+v, want vacancy, occupied, vacancy", series)
+	}
+	if !series[0].StartTime.Equal(*at(t, "09:00")) || !series[2].EndTime.Equal(*at(t, "18:00")) {
+		t.Errorf("seat status runs %v to %v, want 09:00 to 18:00", series[0].StartTime, series[2].EndTime)
+	}
+	if series[1].Status != models.SeatStatusEnumOccupied || !series[1].StartTime.Equal(*at(t, "09:55")) {
+		t.Errorf("seat status = %+v, want occupied from 09:55", series[1])
+	}
+
+	alice, _ := repo.FindUser(ctx, 1)
+	seat := &models.Seat{}
+	seat.ID = 1
+	if _, err := repo.ReserveSession(ctx, sessionKey, alice, seat, at(t, "07:00"), at(t, "08:00")); !errors.Is(err, models.ErrStoreClosed) {
+		t.Errorf("reserving before opening: error = %v, want ErrStoreClosed", err)
+	}
+	s, err := repo.ReserveSession(ctx, sessionKey, alice, seat, at(t, "15:00"), at(t, "16:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ExtendSession(ctx, s, *at(t, "19:00")); !errors.Is(err, models.ErrStoreClosed) {
+		t.Errorf("extending past closing: error = %v, want ErrStoreClosed", err)
+	}
+}
@@ -1,6 +1,10 @@
 package models
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
 
 type StoreStar struct {
 	StoreID uint `gorm:"primaryKey"`
@@ -9,12 +13,12 @@ type StoreStar struct {
 	User    User
 }
 
-func StarStore(s Store, u *User) *StoreStar {
+func (r *Repo) StarStore(ctx context.Context, s Store, u *User) *StoreStar {
 	ss := &StoreStar{
 		StoreID: s.ID,
 		UserID:  u.ID,
 	}
-	tx := db.FirstOrCreate(ss)
+	tx := r.conn(ctx).FirstOrCreate(ss)
 	if tx.Error != nil {
 		logrus.WithError(tx.Error).Error("error on recording stared store")
 		return nil
@@ -22,8 +26,8 @@ func StarStore(s Store, u *User) *StoreStar {
 	return ss
 }
 
-func UnstarStore(s Store, u *User) bool {
-	tx := db.Delete(&StoreStar{}, "store_id = ? AND user_id = ?", s.ID, u.ID)
+func (r *Repo) UnstarStore(ctx context.Context, s Store, u *User) bool {
+	tx := r.conn(ctx).Delete(&StoreStar{}, "store_id = ? AND user_id = ?", s.ID, u.ID)
 	if tx.Error != nil {
 		logrus.WithError(tx.Error).Error("error on deleting stared store")
 		return false
@@ -31,9 +35,9 @@ func UnstarStore(s Store, u *User) bool {
 	return true
 }
 
-func GetStaredStores(u *User, page int) []Store {
+func (r *Repo) GetStaredStores(ctx context.Context, u *User, page int) []Store {
 	var list []StoreStar
-	tx := db.Preload("Store").Where("user_id = ?", u.ID).Limit(10).Offset((page - 1) * 10).Find(&list)
+	tx := r.conn(ctx).Preload("Store").Where("user_id = ?", u.ID).Limit(10).Offset((page - 1) * 10).Find(&list)
 	if tx.Error != nil {
 		logrus.WithError(tx.Error).Error("error when querying for user stared store")
 		return make([]Store, 0)
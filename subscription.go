@@ -0,0 +1,359 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// SubscriptionGracePeriod is how long a member keeps their benefits
+	// after the paid time runs out, to give a renewal time to go through.
+	SubscriptionGracePeriod = 3 * 24 * time.Hour
+	// SubscriptionRenewLead is how long before expiry an auto-renewing
+	// subscription gets its renewal order.
+	SubscriptionRenewLead = 3 * 24 * time.Hour
+)
+
+// subscriptionMonths returns how many months the subscription good
+// goodID buys.
+func subscriptionMonths(goodID uint) (int, bool) {
+	switch goodID {
+	case GetMonthlySubscriptionGoodID():
+		return 1, true
+	case GetSeasonSubscriptionGoodID():
+		return 3, true
+	}
+	return 0, false
+}
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusActive SubscriptionStatus = "active"
+	// the paid time is over but the grace period is not
+	SubscriptionStatusGrace  SubscriptionStatus = "grace"
+	SubscriptionStatusLapsed SubscriptionStatus = "lapsed"
+)
+
+// Subscription is a user's membership. While it is active or in grace the
+// user is pro until ExpiresAt plus the grace period.
+type Subscription struct {
+	gorm.Model
+	User      User               `json:"-"`
+	UserID    uint               `gorm:"not null;uniqueIndex" json:"user_id"`
+	Good      Good               `json:"-"`
+	GoodID    uint               `gorm:"not null" json:"good_id"`
+	Status    SubscriptionStatus `gorm:"type:varchar(16);not null;index" json:"status"`
+	StartedAt time.Time          `gorm:"not null" json:"started_at"`
+	ExpiresAt time.Time          `gorm:"not null;index" json:"expires_at"`
+	AutoRenew bool               `gorm:"not null;default:false" json:"auto_renew"`
+	// RenewalOrder is the pending order created by the auto-renew
+	// scheduler for the next period.
+	RenewalOrder   *Order `json:"-"`
+	RenewalOrderID *uint  `json:"renewal_order_id"`
+}
+
+func (s *Subscription) proDeadline() time.Time {
+	return s.ExpiresAt.Add(SubscriptionGracePeriod)
+}
+
+type SubscriptionEventKind string
+
+const (
+	SubscriptionEventImported     SubscriptionEventKind = "imported"
+	SubscriptionEventActivated    SubscriptionEventKind = "activated"
+	SubscriptionEventExtended     SubscriptionEventKind = "extended"
+	SubscriptionEventRenewalOrder SubscriptionEventKind = "renewal_ordered"
+	SubscriptionEventAutoRenewOn  SubscriptionEventKind = "auto_renew_on"
+	SubscriptionEventAutoRenewOff SubscriptionEventKind = "auto_renew_off"
+	SubscriptionEventGraceStarted SubscriptionEventKind = "grace_started"
+	SubscriptionEventLapsed       SubscriptionEventKind = "lapsed"
+	SubscriptionEventRefunded     SubscriptionEventKind = "refunded"
+)
+
+// SubscriptionHistory records a change to a subscription.
+type SubscriptionHistory struct {
+	ID             uint                  `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time             `json:"created_at"`
+	SubscriptionID uint                  `gorm:"not null;index" json:"subscription_id"`
+	UserID         uint                  `gorm:"not null;index" json:"user_id"`
+	Kind           SubscriptionEventKind `gorm:"type:varchar(32);not null" json:"kind"`
+	OrderID        *uint                 `json:"order_id,omitempty"`
+	Status         SubscriptionStatus    `gorm:"type:varchar(16);not null" json:"status"`
+	ExpiresAt      time.Time             `json:"expires_at"`
+}
+
+const importSubscriptionsSQL = `
+INSERT INTO subscriptions (created_at, updated_at, user_id, good_id, status, started_at, expires_at, auto_renew)
+SELECT now(), now(), u.id, ?, 'active', now(), u.pro_deadline, false
+FROM users u
+WHERE u.is_pro AND u.pro_deadline > now() AND u.deleted_at IS NULL
+  AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = u.id)`
+
+const importSubscriptionHistorySQL = `
+INSERT INTO subscription_histories (created_at, subscription_id, user_id, kind, status, expires_at)
+SELECT now(), s.id, s.user_id, 'imported', s.status, s.expires_at
+FROM subscriptions s
+WHERE NOT EXISTS (SELECT 1 FROM subscription_histories h WHERE h.subscription_id = s.id)`
+
+// migrateSubscriptions creates the subscription tables and imports the
+// members whose pro deadline had been set by hand.
+func migrateSubscriptions(db *gorm.DB) error {
+	if err := createTables(db, &Subscription{}, &SubscriptionHistory{}); err != nil {
+		return err
+	}
+	if err := db.Exec(importSubscriptionsSQL, GetMonthlySubscriptionGoodID()).Error; err != nil {
+		return err
+	}
+	return execAll(db, importSubscriptionHistorySQL)
+}
+
+func dropSubscriptions(db *gorm.DB) error {
+	return db.Migrator().DropTable(&SubscriptionHistory{}, &Subscription{})
+}
+
+func (r *Repo) recordSubscription(ctx context.Context, s *Subscription, kind SubscriptionEventKind, orderID *uint) error {
+	return r.conn(ctx).Create(&SubscriptionHistory{
+		SubscriptionID: s.ID,
+		UserID:         s.UserID,
+		Kind:           kind,
+		OrderID:        orderID,
+		Status:         s.Status,
+		ExpiresAt:      s.ExpiresAt,
+	}).Error
+}
+
+// syncPro copies the membership of s onto its user.
+func (r *Repo) syncPro(ctx context.Context, s *Subscription) error {
+	updates := map[string]interface{}{
+		"is_pro":       s.Status != SubscriptionStatusLapsed,
+		"pro_deadline": s.proDeadline(),
+	}
+	if s.Status == SubscriptionStatusLapsed {
+		updates["pro_deadline"] = s.ExpiresAt
+	}
+	return r.conn(ctx).Model(&User{}).Where("id = ?", s.UserID).Updates(updates).Error
+}
+
+// activateSubscription applies the paid subscription order o. Paying
+// while a subscription is active or in grace stacks the new period on
+// top of the current one; otherwise a new period starts at paidAt.
+func (r *Repo) activateSubscription(ctx context.Context, o *Order, paidAt time.Time) error {
+	months, ok := subscriptionMonths(o.GoodID)
+	if !ok {
+		return ErrInvalidArgument
+	}
+	if o.Amount > 1 {
+		months *= int(o.Amount)
+	}
+
+	sub := &Subscription{}
+	tx := r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ?", o.AffiliateID).
+		Limit(1).
+		Find(sub)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	kind := SubscriptionEventExtended
+	if tx.RowsAffected == 0 || sub.Status == SubscriptionStatusLapsed {
+		kind = SubscriptionEventActivated
+		sub.UserID = o.AffiliateID
+		sub.StartedAt = paidAt
+		sub.ExpiresAt = paidAt.AddDate(0, months, 0)
+		sub.RenewalOrderID = nil
+	} else {
+		sub.ExpiresAt = sub.ExpiresAt.AddDate(0, months, 0)
+	}
+	sub.GoodID = o.GoodID
+	sub.Status = SubscriptionStatusActive
+	if o.Type == OrderTypeSubscriptionAutoRenew {
+		sub.AutoRenew = true
+	}
+	if sub.RenewalOrderID != nil {
+		// paid now, or left unpaid for a period this one replaces
+		renewal := Order{}
+		err := r.conn(ctx).Select("status").First(&renewal, *sub.RenewalOrderID).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if *sub.RenewalOrderID == o.ID || err != nil || renewal.Status == OrderStatusCancelled {
+			sub.RenewalOrderID = nil
+		}
+	}
+
+	if err := r.conn(ctx).Omit(clause.Associations).Save(sub).Error; err != nil {
+		return err
+	}
+	if err := r.recordSubscription(ctx, sub, kind, &o.ID); err != nil {
+		return err
+	}
+	return r.syncPro(ctx, sub)
+}
+
+// GetUserSubscription returns u's subscription, or nil if u never had one.
+func (r *Repo) GetUserSubscription(ctx context.Context, u *User) (*Subscription, error) {
+	sub := &Subscription{}
+	tx := r.conn(ctx).Where("user_id = ?", u.ID).Limit(1).Find(sub)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return nil, tx.Error
+	}
+	return sub, nil
+}
+
+func (r *Repo) ListSubscriptionHistory(ctx context.Context, u *User) ([]*SubscriptionHistory, error) {
+	history := make([]*SubscriptionHistory, 0)
+	tx := r.conn(ctx).Where("user_id = ?", u.ID).Order("id asc").Find(&history)
+	return history, tx.Error
+}
+
+// SetSubscriptionAutoRenew turns auto-renewal of u's subscription on or off.
+func (r *Repo) SetSubscriptionAutoRenew(ctx context.Context, u *User, on bool) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		sub := &Subscription{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", u.ID).First(sub).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidArgument.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		if sub.AutoRenew == on {
+			return nil
+		}
+		if err := tx.conn(ctx).Model(sub).Update("auto_renew", on).Error; err != nil {
+			return err
+		}
+		kind := SubscriptionEventAutoRenewOff
+		if on {
+			kind = SubscriptionEventAutoRenewOn
+		}
+		return tx.recordSubscription(ctx, sub, kind, nil)
+	})
+}
+
+// CreateRenewalOrders creates a pending renewal order for every
+// auto-renewing subscription expiring within SubscriptionRenewLead of now
+// that does not have one yet, and returns the orders. A renewal order can
+// be paid until the grace period ends; one left unpaid is not reissued.
+func (r *Repo) CreateRenewalOrders(ctx context.Context, now time.Time) ([]*Order, error) {
+	subs := make([]*Subscription, 0)
+	tx := r.conn(ctx).
+		Where("auto_renew AND renewal_order_id IS NULL").
+		Where("status IN ?", []SubscriptionStatus{SubscriptionStatusActive, SubscriptionStatusGrace}).
+		Where("expires_at < ?", now.Add(SubscriptionRenewLead)).
+		Find(&subs)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	orders := make([]*Order, 0, len(subs))
+	for _, candidate := range subs {
+		var order *Order
+		err := r.WithTx(ctx, func(tx *Repo) error {
+			sub := &Subscription{}
+			err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(sub, candidate.ID).Error
+			if err != nil {
+				return err
+			}
+			if !sub.AutoRenew || sub.RenewalOrderID != nil || sub.Status == SubscriptionStatusLapsed {
+				return nil
+			}
+			good, err := tx.GetGoodByID(ctx, sub.GoodID)
+			if err != nil {
+				return err
+			}
+			// payable until the membership would otherwise end
+			expires := sub.proDeadline()
+			order = &Order{
+				TimestamppedID: now.Format("20060102150405") + randomToken(4),
+				Date:           now,
+				Price:          good.Price,
+				Amount:         1,
+				Type:           OrderTypeSubscriptionAutoRenew,
+				GoodID:         good.ID,
+				AffiliateID:    sub.UserID,
+				Status:         OrderStatusPending,
+				ExpiresAt:      &expires,
+			}
+			if err := tx.CreateOrder(ctx, order); err != nil {
+				return err
+			}
+			if err := tx.conn(ctx).Model(sub).Update("renewal_order_id", order.ID).Error; err != nil {
+				return err
+			}
+			return tx.recordSubscription(ctx, sub, SubscriptionEventRenewalOrder, &order.ID)
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("subscription", candidate.ID).Error("Failed to create renewal order")
+			return orders, err
+		}
+		if order != nil {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// SweepSubscriptions moves subscriptions whose paid time is over into
+// grace, and those whose grace period is over to lapsed, clearing their
+// user's pro status. It returns how many subscriptions lapsed.
+func (r *Repo) SweepSubscriptions(ctx context.Context, now time.Time) (int, error) {
+	subs := make([]*Subscription, 0)
+	tx := r.conn(ctx).
+		Where("status IN ?", []SubscriptionStatus{SubscriptionStatusActive, SubscriptionStatusGrace}).
+		Where("expires_at < ?", now).
+		Find(&subs)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	lapsed := 0
+	for _, candidate := range subs {
+		err := r.WithTx(ctx, func(tx *Repo) error {
+			sub := &Subscription{}
+			err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(sub, candidate.ID).Error
+			if err != nil {
+				return err
+			}
+			// renewed meanwhile
+			if !sub.ExpiresAt.Before(now) {
+				return nil
+			}
+
+			kind := SubscriptionEventGraceStarted
+			status := SubscriptionStatusGrace
+			if !sub.proDeadline().After(now) {
+				kind = SubscriptionEventLapsed
+				status = SubscriptionStatusLapsed
+			}
+			if sub.Status == status {
+				return nil
+			}
+			sub.Status = status
+			if err := tx.conn(ctx).Model(sub).Update("status", status).Error; err != nil {
+				return err
+			}
+			if err := tx.recordSubscription(ctx, sub, kind, nil); err != nil {
+				return err
+			}
+			if status == SubscriptionStatusLapsed {
+				lapsed++
+				return tx.syncPro(ctx, sub)
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("subscription", candidate.ID).Error("Failed to sweep subscription")
+			return lapsed, err
+		}
+	}
+	return lapsed, nil
+}
@@ -0,0 +1,176 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	alice := &models.User{}
+	alice.ID = 1
+
+	pay := func(id string, good uint, typ models.OrderType) *models.Order {
+		t.Helper()
+		o := &models.Order{TimestamppedID: id, Amount: 1, Type: typ, GoodID: good, AffiliateID: 1}
+		if err := repo.CreateOrder(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.CommitOrderPaid(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	subscription := func() *models.Subscription {
+		t.Helper()
+		sub, err := repo.GetUserSubscription(ctx, alice)
+		if err != nil || sub == nil {
+			t.Fatalf("GetUserSubscription() = %v, %v", sub, err)
+		}
+		return sub
+	}
+
+	start := time.Now()
+	pay("20220301000001", models.GetMonthlySubscriptionGoodID(), models.OrderTypeSubscription)
+	sub := subscription()
+	if sub.Status != models.SubscriptionStatusActive {
+		t.Errorf("status = %s, want active", sub.Status)
+	}
+	u, _ := repo.FindUser(ctx, 1)
+	if !u.IsPro || u.ProDeadline == nil || !u.ProDeadline.Equal(sub.ExpiresAt.Add(models.SubscriptionGracePeriod)) {
+		t.Errorf("user is_pro = %v, deadline = %v, want pro until expiry plus grace", u.IsPro, u.ProDeadline)
+	}
+
+	// buying again before expiry stacks
+	expires := sub.ExpiresAt
+	pay("20220301000002", models.GetSeasonSubscriptionGoodID(), models.OrderTypeSubscription)
+	sub = subscription()
+	if want := expires.AddDate(0, 3, 0); !sub.ExpiresAt.Equal(want) {
+		t.Errorf("stacked expiry = %v, want %v", sub.ExpiresAt, want)
+	}
+
+	if err := repo.SetSubscriptionAutoRenew(ctx, alice, true); err != nil {
+		t.Fatal(err)
+	}
+	if orders, err := repo.CreateRenewalOrders(ctx, start); err != nil || len(orders) != 0 {
+		t.Errorf("renewal orders long before expiry = %d, %v, want none", len(orders), err)
+	}
+	due := sub.ExpiresAt.Add(-time.Hour)
+	orders, err := repo.CreateRenewalOrders(ctx, due)
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("renewal orders before expiry = %d, %v, want 1", len(orders), err)
+	}
+	if d := orders[0].ExpiresAt; d == nil || !d.Equal(sub.ExpiresAt.Add(models.SubscriptionGracePeriod)) {
+		t.Errorf("renewal order deadline = %v, want the end of grace", d)
+	}
+	if again, err := repo.CreateRenewalOrders(ctx, due); err != nil || len(again) != 0 {
+		t.Errorf("renewal orders created twice: %d, %v", len(again), err)
+	}
+	if err := repo.CommitOrderPaid(ctx, orders[0]); err != nil {
+		t.Fatal(err)
+	}
+	renewed := subscription()
+	if want := sub.ExpiresAt.AddDate(0, 3, 0); !renewed.ExpiresAt.Equal(want) || renewed.RenewalOrderID != nil {
+		t.Errorf("renewed expiry = %v, renewal order = %v, want %v and none", renewed.ExpiresAt, renewed.RenewalOrderID, want)
+	}
+
+	if err := repo.SetSubscriptionAutoRenew(ctx, alice, false); err != nil {
+		t.Fatal(err)
+	}
+	inGrace := renewed.ExpiresAt.Add(time.Hour)
+	if n, err := repo.SweepSubscriptions(ctx, inGrace); err != nil || n != 0 {
+		t.Errorf("SweepSubscriptions() in grace = %d, %v, want 0", n, err)
+	}
+	if sub := subscription(); sub.Status != models.SubscriptionStatusGrace {
+		t.Errorf("status in grace = %s", sub.Status)
+	}
+	if u, _ := repo.FindUser(ctx, 1); !u.IsPro {
+		t.Error("user lost pro status during grace")
+	}
+	if n, err := repo.SweepSubscriptions(ctx, inGrace.Add(models.SubscriptionGracePeriod)); err != nil || n != 1 {
+		t.Errorf("SweepSubscriptions() after grace = %d, %v, want 1", n, err)
+	}
+	if u, _ := repo.FindUser(ctx, 1); u.IsPro {
+		t.Error("user is still pro after the subscription lapsed")
+	}
+
+	history, err := repo.ListSubscriptionHistory(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.SubscriptionEventKind{
+		models.SubscriptionEventActivated,
+		models.SubscriptionEventExtended,
+		models.SubscriptionEventAutoRenewOn,
+		models.SubscriptionEventRenewalOrder,
+		models.SubscriptionEventExtended,
+		models.SubscriptionEventAutoRenewOff,
+		models.SubscriptionEventGraceStarted,
+		models.SubscriptionEventLapsed,
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got %d history entries, want %d", len(history), len(want))
+	}
+	for i, h := range history {
+		if h.Kind != want[i] {
+			t.Errorf("history[%d] = %s, want %s", i, h.Kind, want[i])
+		}
+	}
+}
+
+func TestUnpaidRenewalOrderIsNotReissued(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 1, "username": "alice", "phone": "13800000001"}]}`))
+	ctx := context.Background()
+	alice := &models.User{}
+	alice.ID = 1
+
+	o := &models.Order{TimestamppedID: "20220301000011", Amount: 1, Type: models.OrderTypeSubscriptionAutoRenew, GoodID: models.GetMonthlySubscriptionGoodID(), AffiliateID: 1}
+	if err := repo.CreateOrder(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitOrderPaid(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := repo.GetUserSubscription(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due := sub.ExpiresAt.Add(-time.Hour)
+	orders, err := repo.CreateRenewalOrders(ctx, due)
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("CreateRenewalOrders() = %d, %v, want 1", len(orders), err)
+	}
+	if n, err := repo.ExpirePendingOrders(ctx, due.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("renewal order expired before the end of grace: %d, %v", n, err)
+	}
+	if n, err := repo.ExpirePendingOrders(ctx, orders[0].ExpiresAt.Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("ExpirePendingOrders() = %d, %v, want 1", n, err)
+	}
+	if again, err := repo.CreateRenewalOrders(ctx, due.Add(time.Hour)); err != nil || len(again) != 0 {
+		t.Errorf("renewal order reissued after it expired: %d, %v", len(again), err)
+	}
+
+	// buying the next period by hand lets it be renewed in turn
+	manual := &models.Order{TimestamppedID: "20220301000012", Amount: 1, Type: models.OrderTypeSubscription, GoodID: models.GetMonthlySubscriptionGoodID(), AffiliateID: 1}
+	if err := repo.CreateOrder(ctx, manual); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CommitOrderPaid(ctx, manual); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ = repo.GetUserSubscription(ctx, alice)
+	if sub.RenewalOrderID != nil {
+		t.Errorf("renewal order %d is still linked to the new period", *sub.RenewalOrderID)
+	}
+	if next, err := repo.CreateRenewalOrders(ctx, sub.ExpiresAt.Add(-time.Hour)); err != nil || len(next) != 1 {
+		t.Errorf("CreateRenewalOrders() for the next period = %d, %v, want 1", len(next), err)
+	}
+}
@@ -1,8 +1,8 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"regexp"
 	"strconv"
 	"time"
@@ -51,9 +51,9 @@ func Jsonb2RawMessage(j postgres.Jsonb) json.RawMessage {
 	return j.RawMessage
 }
 
-func GetThreadByID(id uint) *Thread {
+func (r *Repo) GetThreadByID(ctx context.Context, id uint) *Thread {
 	thread := Thread{}
-	tx := db.Preload("Author").First(&thread, id)
+	tx := r.conn(ctx).Preload("Author").First(&thread, id)
 	if tx.Error != nil || thread.Deleted {
 		return nil
 	} else {
@@ -61,19 +61,19 @@ func GetThreadByID(id uint) *Thread {
 	}
 }
 
-func SearchThread(keyword string, uid, page uint) []*Post {
+func (r *Repo) SearchThread(ctx context.Context, keyword string, uid, page uint) []*Post {
 	threads := make([]*Thread, 0)
 
-	db.Preload("Author").Where("title like ? AND level = 1 AND deleted = false", "%"+keyword+"%").Limit(10).Find(&threads)
+	r.conn(ctx).Preload("Author").Where("title like ? AND level = 1 AND deleted = false", "%"+keyword+"%").Limit(10).Find(&threads)
 	res := make([]*Post, len(threads))
 	for i, thread := range threads {
-		res[i] = ConstructPostObject(*thread, uid)
+		res[i] = r.ConstructPostObject(ctx, *thread, uid)
 	}
 
 	ok, _ := regexp.Match("\\d+", []byte(keyword))
 	if ok {
 		id, _ := strconv.ParseUint(keyword, 10, 32)
-		res = append(res, ConstructPostObject(*GetThreadByID(uint(id)), uid))
+		res = append(res, r.ConstructPostObject(ctx, *r.GetThreadByID(ctx, uint(id)), uid))
 	}
 	return res
 }
@@ -115,7 +115,7 @@ type Post struct {
 	Deleted bool `json:"deleted"`
 }
 
-func ConstructPostObject(t Thread, uid uint) *Post {
+func (r *Repo) ConstructPostObject(ctx context.Context, t Thread, uid uint) *Post {
 	threadId := t.ID
 	if t.Level != 1 {
 		return nil
@@ -125,11 +125,11 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 		ID:         t.ID,
 		Title:      t.Title,
 		Content:    Jsonb2RawMessage(t.Content),
-		Likes:      FindThreadLikeCount(threadId),
-		Stars:      FindThreadStarCount(threadId),
-		Author:     t.Author.GetPublicInfomation(),
-		StaredByMe: threadStaredByUser(threadId, uid),
-		LikedByMe:  threadLikedByUser(threadId, uid),
+		Likes:      r.FindThreadLikeCount(ctx, threadId),
+		Stars:      r.FindThreadStarCount(ctx, threadId),
+		Author:     r.GetPublicInfomation(ctx, t.Author),
+		StaredByMe: r.threadStaredByUser(ctx, threadId, uid),
+		LikedByMe:  r.threadLikedByUser(ctx, threadId, uid),
 
 		Time:    t.CreatedAt,
 		Deleted: t.Deleted,
@@ -137,7 +137,7 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 
 	// find comments
 	commentThreads := make([]Thread, 0)
-	tx := db.Preload("Author").Where("parent_id = ? AND deleted = false", threadId).Order("like_count desc, id desc").Find(&commentThreads)
+	tx := r.conn(ctx).Preload("Author").Where("parent_id = ? AND deleted = false", threadId).Order("like_count desc, id desc").Find(&commentThreads)
 
 	if tx.Error != nil {
 		logrus.Error(tx.Error)
@@ -150,9 +150,9 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 		comments[i] = Comment{
 			ID:              commentThread.ID,
 			Content:         Jsonb2RawMessage(commentThread.Content),
-			Author:          commentThread.Author.GetPublicInfomation(),
-			Likes:           FindThreadLikeCount(commentThread.ID),
-			LikedByMe:       threadLikedByUser(commentThread.ID, uid),
+			Author:          r.GetPublicInfomation(ctx, commentThread.Author),
+			Likes:           r.FindThreadLikeCount(ctx, commentThread.ID),
+			LikedByMe:       r.threadLikedByUser(ctx, commentThread.ID, uid),
 			Time:            commentThread.CreatedAt,
 			commentThreadId: commentThread.ID,
 		}
@@ -161,7 +161,7 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 	// find replies for each comment
 	for i, comment := range comments {
 		replyThreads := make([]Thread, 0)
-		tx := db.Preload("Author").Where("parent_id = ? AND deleted = false", comment.commentThreadId).Find(&replyThreads)
+		tx := r.conn(ctx).Preload("Author").Where("parent_id = ? AND deleted = false", comment.commentThreadId).Find(&replyThreads)
 		if tx.Error != nil {
 			logrus.Error(tx.Error)
 			return nil
@@ -173,7 +173,7 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 				ID:      reply.ID,
 				Content: Jsonb2RawMessage(reply.Content),
 				ReplyTo: *reply.ReplyToID,
-				Author:  reply.Author.GetPublicInfomation(),
+				Author:  r.GetPublicInfomation(ctx, reply.Author),
 				Time:    reply.CreatedAt,
 			}
 		}
@@ -183,7 +183,7 @@ func ConstructPostObject(t Thread, uid uint) *Post {
 	return &res
 }
 
-func NewPost(title, content string, author uint) (*Thread, error) {
+func (r *Repo) NewPost(ctx context.Context, title, content string, author uint) (*Thread, error) {
 	thread := Thread{
 		Title:    title,
 		Content:  String2Jsonb(content),
@@ -191,16 +191,19 @@ func NewPost(title, content string, author uint) (*Thread, error) {
 		Level:    ThreadLevelPost,
 	}
 
-	tx := db.Create(&thread)
+	tx := r.conn(ctx).Create(&thread)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	return &thread, nil
 }
 
-var CommentOnThread = ReplyToThread
+// CommentOnThread is an alias of ReplyToThread.
+func (r *Repo) CommentOnThread(ctx context.Context, thread uint, author uint, content string) error {
+	return r.ReplyToThread(ctx, thread, author, content)
+}
 
-func ReplyToThread(thread uint, author uint, content string) error {
+func (r *Repo) ReplyToThread(ctx context.Context, thread uint, author uint, content string) error {
 	commentThread := Thread{
 		Content:         String2Jsonb(content),
 		ParentID:        &thread,
@@ -209,16 +212,16 @@ func ReplyToThread(thread uint, author uint, content string) error {
 		Level:           ThreadLevelComment,
 	}
 
-	tx := db.Create(&commentThread)
+	tx := r.conn(ctx).Create(&commentThread)
 	if tx.Error == nil {
-		PushThreadReplyNotification(thread, commentThread.ID)
+		r.PushThreadReplyNotification(ctx, thread, commentThread.ID)
 	}
 	return tx.Error
 }
 
-func ReplyToComment(comment, author uint, content string) error {
+func (r *Repo) ReplyToComment(ctx context.Context, comment, author uint, content string) error {
 	postId := uint(0)
-	err := db.Model(&Thread{}).Select("parent_id").Where("id = ?", comment).Scan(&postId).Error
+	err := r.conn(ctx).Model(&Thread{}).Select("parent_id").Where("id = ?", comment).Scan(&postId).Error
 	if err != nil {
 		return err
 	}
@@ -231,16 +234,16 @@ func ReplyToComment(comment, author uint, content string) error {
 		ReplyToID:       &comment,
 	}
 
-	tx := db.Create(&replyThread)
+	tx := r.conn(ctx).Create(&replyThread)
 	if tx.Error == nil {
-		PushThreadReplyNotification(comment, replyThread.ID)
+		r.PushThreadReplyNotification(ctx, comment, replyThread.ID)
 	}
 	return tx.Error
 }
 
-func ReplyToReply(comment, author, replyTo uint, content string) error {
+func (r *Repo) ReplyToReply(ctx context.Context, comment, author, replyTo uint, content string) error {
 	postId := uint(0)
-	err := db.Model(&Thread{}).Select("affiliate_post_id").Where("id = ?", replyTo).Scan(&postId).Error
+	err := r.conn(ctx).Model(&Thread{}).Select("affiliate_post_id").Where("id = ?", replyTo).Scan(&postId).Error
 	if err != nil {
 		return err
 	}
@@ -253,67 +256,68 @@ func ReplyToReply(comment, author, replyTo uint, content string) error {
 		Level:           ThreadLevelReply,
 	}
 
-	tx := db.Create(&replyThread)
+	tx := r.conn(ctx).Create(&replyThread)
 	if tx.Error == nil {
-		PushThreadReplyNotification(comment, replyThread.ID)
+		r.PushThreadReplyNotification(ctx, comment, replyThread.ID)
 	}
 	return tx.Error
 }
 
-func LikeThread(threadId uint, userId uint) error {
+func (r *Repo) LikeThread(ctx context.Context, threadId uint, userId uint) error {
 	thread := Thread{}
-	tx := db.First(&thread, threadId)
+	tx := r.conn(ctx).First(&thread, threadId)
 	if tx.Error != nil || thread.Deleted {
-		return NewRequestError("帖子不存在")
+		return ErrThreadNotFound
 	}
 
-	return CreateThreadLike(threadId, userId)
+	return r.CreateThreadLike(ctx, threadId, userId)
 }
 
-func UnlikeThread(threadId uint, userId uint) error {
+func (r *Repo) UnlikeThread(ctx context.Context, threadId uint, userId uint) error {
 	thread := Thread{}
-	tx := db.First(&thread, threadId)
+	tx := r.conn(ctx).First(&thread, threadId)
 	if tx.Error != nil || thread.Deleted {
-		return NewRequestError("帖子不存在")
+		return ErrThreadNotFound
 	}
 
-	return DeleteThreadLikeOfThreadForUser(threadId, userId)
+	return r.DeleteThreadLikeOfThreadForUser(ctx, threadId, userId)
 }
 
-func StarThread(threadId uint, userId uint) error {
+func (r *Repo) StarThread(ctx context.Context, threadId uint, userId uint) error {
 	thread := Thread{}
-	tx := db.First(&thread, threadId)
+	tx := r.conn(ctx).First(&thread, threadId)
 	if tx.Error != nil || thread.Deleted {
-		return NewRequestError("帖子不存在")
+		return ErrThreadNotFound
 	}
 
 	if thread.Level != ThreadLevelPost {
-		return NewRequestError("不能收藏评论")
+		return ErrCannotStarComment
 	}
 
-	return CreateThreadStar(threadId, userId)
+	return r.CreateThreadStar(ctx, threadId, userId)
 }
 
-func UnstarThread(threadId uint, userId uint) error {
+func (r *Repo) UnstarThread(ctx context.Context, threadId uint, userId uint) error {
 	thread := Thread{}
-	tx := db.First(&thread, threadId)
+	tx := r.conn(ctx).First(&thread, threadId)
 	if tx.Error != nil {
-		return NewRequestError("帖子不存在")
+		return ErrThreadNotFound
 	}
 
-	return DeleteThreadStarOfThreadForUser(threadId, userId)
+	return r.DeleteThreadStarOfThreadForUser(ctx, threadId, userId)
 }
 
-func DeleteThread(id uint) error {
+func (r *Repo) DeleteThread(ctx context.Context, id uint) error {
 	thread := Thread{}
-	tx := db.First(&thread, id)
+	tx := r.conn(ctx).First(&thread, id)
 	if tx.Error != nil {
-		return NewRequestError("帖子不存在")
+		return ErrThreadNotFound
 	}
 
 	thread.Deleted = true
-	tx = db.Save(thread)
-	_ = DeleteNotificationOfManyType(
+	tx = r.conn(ctx).Save(thread)
+	_ = r.DeleteNotificationOfManyType(
+		ctx,
 		[]NotificationType{NotificationTypeThreadLike, NotificationTypeThreadReply},
 		thread.ID,
 	)
@@ -321,12 +325,12 @@ func DeleteThread(id uint) error {
 	return tx.Error
 }
 
-func GetRandomThreads(count int, uid uint) ([]*Post, error) {
+func (r *Repo) GetRandomThreads(ctx context.Context, count int, uid uint) ([]*Post, error) {
 	if count <= 0 {
-		return nil, errors.New("count must be greater than 0")
+		return nil, ErrInvalidArgument
 	}
 	threads := make([]Thread, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Preload("Author").
 		Where("deleted = false AND level = 1").
 		Order("random()").
@@ -336,31 +340,31 @@ func GetRandomThreads(count int, uid uint) ([]*Post, error) {
 
 	posts := make([]*Post, len(threads))
 	for i, thread := range threads {
-		posts[i] = ConstructPostObject(thread, uid)
+		posts[i] = r.ConstructPostObject(ctx, thread, uid)
 	}
 	return posts, tx.Error
 }
 
-func GetUserReplies(uid uint, page int) ([]Thread, error) {
+func (r *Repo) GetUserReplies(ctx context.Context, uid uint, page int) ([]Thread, error) {
 	if page <= 0 {
-		return nil, errors.New("count must be greater than 0")
+		return nil, ErrInvalidPage
 	}
 	threads := make([]Thread, 0)
-	tx := db.Preload("Author").Preload("AffiliatePost").Where("deleted = false AND level > 1 AND author_id = ?", uid).Order("id desc").Offset((page - 1) * 10).Limit(10).Find(&threads)
+	tx := r.conn(ctx).Preload("Author").Preload("AffiliatePost").Where("deleted = false AND level > 1 AND author_id = ?", uid).Order("id desc").Offset((page - 1) * 10).Limit(10).Find(&threads)
 
 	return threads, tx.Error
 }
 
-func GetUserPosts(uid uint, page int) ([]*Post, error) {
+func (r *Repo) GetUserPosts(ctx context.Context, uid uint, page int) ([]*Post, error) {
 	if page <= 0 {
-		return nil, errors.New("page must be greater than 0")
+		return nil, ErrInvalidPage
 	}
 	threads := make([]Thread, 0)
-	tx := db.Preload("Author").Where("deleted = false AND author_id = ? AND level = 1", uid).Order("id desc").Offset((page - 1) * 10).Limit(10).Find(&threads)
+	tx := r.conn(ctx).Preload("Author").Where("deleted = false AND author_id = ? AND level = 1", uid).Order("id desc").Offset((page - 1) * 10).Limit(10).Find(&threads)
 
 	posts := make([]*Post, len(threads))
 	for i, thread := range threads {
-		posts[i] = ConstructPostObject(thread, uid)
+		posts[i] = r.ConstructPostObject(ctx, thread, uid)
 	}
 	return posts, tx.Error
 }
@@ -372,9 +376,9 @@ type PostSummary struct {
 	Author  *User           `gorm:"author"`
 }
 
-func GetPostSummary(id uint) *PostSummary {
+func (r *Repo) GetPostSummary(ctx context.Context, id uint) *PostSummary {
 	thread := Thread{}
-	tx := db.Preload("author").First(&thread, id)
+	tx := r.conn(ctx).Preload("author").First(&thread, id)
 	if tx.Error != nil {
 		return nil
 	}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 
 	"gorm.io/gorm"
@@ -14,70 +15,70 @@ type ThreadLike struct {
 	User     User
 }
 
-func CreateThreadLike(tid uint, uid uint) error {
-	if threadLikedByUser(tid, uid) {
-		return NewRequestError("已经点过赞了")
+func (r *Repo) CreateThreadLike(ctx context.Context, tid uint, uid uint) error {
+	if r.threadLikedByUser(ctx, tid, uid) {
+		return ErrAlreadyLiked
 	}
 
 	tl := ThreadLike{
 		ThreadID: tid,
 		UserID:   uid,
 	}
-	err := db.Save(tl).Error
+	err := r.conn(ctx).Save(tl).Error
 	if err != nil {
 		return err
 	}
-	PushThreadLikeNotification(tid, uid)
+	r.PushThreadLikeNotification(ctx, tid, uid)
 
-	err = db.Model(&Thread{}).Update("like_count", gorm.Expr("like_count + ?", 1)).Where("id = ?", tid).Error
+	err = r.conn(ctx).Model(&Thread{}).Update("like_count", gorm.Expr("like_count + ?", 1)).Where("id = ?", tid).Error
 	return err
 }
 
-func DeleteThreadLike(t *ThreadLike) error {
-	if !threadLikedByUser(t.ThreadID, t.UserID) {
-		return NewRequestError("没有点过赞")
+func (r *Repo) DeleteThreadLike(ctx context.Context, t *ThreadLike) error {
+	if !r.threadLikedByUser(ctx, t.ThreadID, t.UserID) {
+		return ErrNotLiked
 	}
 
-	err := db.Delete(t).Error
+	err := r.conn(ctx).Delete(t).Error
 	if err != nil {
 		return err
 	}
-	_ = DeleteNotification(NotificationTypeThreadLike, t.UserID, t.ThreadID)
-	err = db.Model(&Thread{}).Update("like_count", gorm.Expr("like_count - ?", 1)).Where("id = ?", t.ThreadID).Error
+	_ = r.DeleteNotification(ctx, NotificationTypeThreadLike, t.UserID, t.ThreadID)
+	err = r.conn(ctx).Model(&Thread{}).Update("like_count", gorm.Expr("like_count - ?", 1)).Where("id = ?", t.ThreadID).Error
 	return err
 }
 
-func DeleteThreadLikeOfThreadForUser(threadID uint, uid uint) error {
-	if !threadLikedByUser(threadID, uid) {
-		return NewRequestError("没有点过赞")
+func (r *Repo) DeleteThreadLikeOfThreadForUser(ctx context.Context, threadID uint, uid uint) error {
+	if !r.threadLikedByUser(ctx, threadID, uid) {
+		return ErrNotLiked
 	}
-	err := db.
+	err := r.conn(ctx).
 		Where("thread_id = ? AND user_id = ?", threadID, uid).
 		Delete(ThreadLike{}).
 		Error
 	if err != nil {
 		return err
 	}
-	_ = DeleteNotification(NotificationTypeThreadLike, threadID, uid)
+	_ = r.DeleteNotification(ctx, NotificationTypeThreadLike, threadID, uid)
 
-	err = db.Model(&Thread{}).Update("like_count", gorm.Expr("like_count - ?", 1)).Where("id = ?", threadID).Error
+	err = r.conn(ctx).Model(&Thread{}).Update("like_count", gorm.Expr("like_count - ?", 1)).Where("id = ?", threadID).Error
 	return err
 }
 
-func FindThreadLikeForUser(uid uint) ([]ThreadLike, error) {
+func (r *Repo) FindThreadLikeForUser(ctx context.Context, uid uint) ([]ThreadLike, error) {
 	var tls []ThreadLike
-	err := db.Where("user_id = ?", uid).Find(&tls).Error
+	err := r.conn(ctx).Where("user_id = ?", uid).Find(&tls).Error
 	return tls, err
 }
 
-func FindThreadLikeCount(threadID uint) uint {
+func (r *Repo) FindThreadLikeCount(ctx context.Context, threadID uint) uint {
 	var count int64 = 0
-	_ = db.Model(ThreadLike{}).Where("thread_id = ?", threadID).Count(&count).Error
+	_ = r.conn(ctx).Model(ThreadLike{}).Where("thread_id = ?", threadID).Count(&count).Error
 	return uint(count)
 }
 
-func threadLikedByUser(threadId, userId uint) bool {
+func (r *Repo) threadLikedByUser(ctx context.Context, threadId, userId uint) bool {
 	var count int64 = 0
-	_ = db.Model(ThreadLike{}).Where("thread_id = ? AND user_id = ?", threadId, userId).Count(&count).Error
+	_ = r.conn(ctx).Model(ThreadLike{}).Where("thread_id = ? AND user_id = ?", threadId, userId).Count(&count).Error
 	return count > 0
 }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 
 	"gorm.io/gorm"
@@ -14,9 +15,9 @@ type ThreadStar struct {
 	User     User
 }
 
-func CreateThreadStar(threadId, userId uint) error {
-	if threadStaredByUser(threadId, userId) {
-		return NewRequestError("已经收藏过了")
+func (r *Repo) CreateThreadStar(ctx context.Context, threadId, userId uint) error {
+	if r.threadStaredByUser(ctx, threadId, userId) {
+		return ErrAlreadyStarred
 	}
 
 	tl := ThreadStar{
@@ -24,33 +25,33 @@ func CreateThreadStar(threadId, userId uint) error {
 		UserID:   userId,
 	}
 
-	err := db.Save(tl).Error
+	err := r.conn(ctx).Save(tl).Error
 	if err != nil {
 		return err
 	}
 
-	err = db.Model(&Thread{}).Update("star_count", gorm.Expr("star_count + ?", 1)).Where("id = ?", threadId).Error
+	err = r.conn(ctx).Model(&Thread{}).Update("star_count", gorm.Expr("star_count + ?", 1)).Where("id = ?", threadId).Error
 	return err
 }
 
-func DeleteThreadStar(t *ThreadStar) error {
-	if !threadStaredByUser(t.ThreadID, t.UserID) {
-		return NewRequestError("没有收藏过")
+func (r *Repo) DeleteThreadStar(ctx context.Context, t *ThreadStar) error {
+	if !r.threadStaredByUser(ctx, t.ThreadID, t.UserID) {
+		return ErrNotStarred
 	}
 
-	err := db.Delete(t).Error
+	err := r.conn(ctx).Delete(t).Error
 	if err != nil {
 		return err
 	}
-	err = db.Model(&Thread{}).Update("star_count", gorm.Expr("star_count - ?", 1)).Where("id = ?", t.ThreadID).Error
+	err = r.conn(ctx).Model(&Thread{}).Update("star_count", gorm.Expr("star_count - ?", 1)).Where("id = ?", t.ThreadID).Error
 	return err
 }
 
-func DeleteThreadStarOfThreadForUser(threadID uint, uid uint) error {
-	if !threadStaredByUser(threadID, uid) {
-		return NewRequestError("没有收藏过")
+func (r *Repo) DeleteThreadStarOfThreadForUser(ctx context.Context, threadID uint, uid uint) error {
+	if !r.threadStaredByUser(ctx, threadID, uid) {
+		return ErrNotStarred
 	}
-	err := db.
+	err := r.conn(ctx).
 		Where("thread_id = ? AND user_id = ?", threadID, uid).
 		Delete(ThreadStar{}).
 		Error
@@ -58,37 +59,37 @@ func DeleteThreadStarOfThreadForUser(threadID uint, uid uint) error {
 		return err
 	}
 
-	err = db.Model(&Thread{}).Update("star_count", gorm.Expr("star_count - ?", 1)).Where("id = ?", threadID).Error
+	err = r.conn(ctx).Model(&Thread{}).Update("star_count", gorm.Expr("star_count - ?", 1)).Where("id = ?", threadID).Error
 	return err
 }
 
-func FindThreadStarForUser(uid uint) ([]ThreadStar, error) {
+func (r *Repo) FindThreadStarForUser(ctx context.Context, uid uint) ([]ThreadStar, error) {
 	var tls []ThreadStar
-	err := db.Where("user_id = ?", uid).Find(&tls).Error
+	err := r.conn(ctx).Where("user_id = ?", uid).Find(&tls).Error
 	return tls, err
 }
 
-func FindThreadStarCount(threadID uint) uint {
+func (r *Repo) FindThreadStarCount(ctx context.Context, threadID uint) uint {
 	var count int64 = 0
-	_ = db.Model(ThreadStar{}).Where("thread_id = ?", threadID).Count(&count).Error
+	_ = r.conn(ctx).Model(ThreadStar{}).Where("thread_id = ?", threadID).Count(&count).Error
 	return uint(count)
 }
 
-func threadStaredByUser(threadId, userId uint) bool {
+func (r *Repo) threadStaredByUser(ctx context.Context, threadId, userId uint) bool {
 	var count int64 = 0
-	_ = db.Model(ThreadStar{}).Where("thread_id = ? AND user_id = ?", threadId, userId).Count(&count).Error
+	_ = r.conn(ctx).Model(ThreadStar{}).Where("thread_id = ? AND user_id = ?", threadId, userId).Count(&count).Error
 	return count > 0
 }
 
-func GetUserStaredThreads(uid uint, page int) ([]*Post, error) {
+func (r *Repo) GetUserStaredThreads(ctx context.Context, uid uint, page int) ([]*Post, error) {
 	const perPage = 10
 	threadStars := make([]ThreadStar, 0)
-	tx := db.Where("user_id = ?", uid).Limit(perPage).Offset(perPage * (page - 1)).Find(&threadStars)
+	tx := r.conn(ctx).Where("user_id = ?", uid).Limit(perPage).Offset(perPage * (page - 1)).Find(&threadStars)
 
 	posts := make([]*Post, len(threadStars))
 	for i, star := range threadStars {
-		thread := GetThreadByID(star.ThreadID)
-		posts[i] = ConstructPostObject(*thread, uid)
+		thread := r.GetThreadByID(ctx, star.ThreadID)
+		posts[i] = r.ConstructPostObject(ctx, *thread, uid)
 	}
 
 	return posts, tx.Error
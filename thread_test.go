@@ -1,32 +1,40 @@
-package models
+package models_test
 
 import (
+	"context"
 	"testing"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
 )
 
+const forumFixture = `{
+	"users": [
+		{"id": 1, "username": "alice", "phone": "13800000001"},
+		{"id": 2, "username": "bob", "phone": "13800000002"}
+	],
+	"threads": [
+		{"id": 1, "title": "hello", "author_id": 1, "content": {"length": 0, "content": []}}
+	]
+}`
+
 func TestThread(t *testing.T) {
 	raw := `{"length":2000,"content":[{"type":"paragraph","content":[{"style":"normal","content":"这是一个段落\n"},{"style":"bold","content":"支持粗体、"},{"style":"underline","content":"下划线、"},{"style":"italic","content":"斜体、"},{"style":"del","content":"删除线、"},{"style":"bold,underline","content":"混合。"}]},{"type":"image","url":"https://pic1.zhimg.com/v2-064053037ffdff311bff33d1b1184db8_1440w.jpg","desc":"这里是图片描述"},{"type":"reference","content":"这是一段引用"},{"type":"header","level":1,"content":"这是一级标题"},{"type":"ul","items":["这是一个无序列表1","这是一个无序列表2"]},{"type":"ol","items":["这是一个有序列表1","这是一个有序列表2"]}]}`
 
-	err := Connect(getDcs())
-	if err != nil {
-		t.Error("failed to connect to database.")
-		t.Fatal(err)
-	}
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(forumFixture))
 
-	_, err = NewPost("test_thread", raw, 1)
+	_, err := repo.NewPost(context.Background(), "test_thread", raw, 1)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestGetRandomPost(t *testing.T) {
-	err := Connect(getDcs())
-	if err != nil {
-		t.Error("failed to connect to database.")
-		t.Fatal(err)
-	}
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(forumFixture))
 
-	post, err := GetRandomThreads(10, 1)
+	post, err := repo.GetRandomThreads(context.Background(), 10, 1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -37,3 +45,73 @@ func TestGetRandomPost(t *testing.T) {
 		}
 	}
 }
+
+func TestThreadLike(t *testing.T) {
+	repo := modelstest.New(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		name    string
+		actions []func() error
+		wantErr bool
+		likes   uint
+	}{
+		{
+			name:    "like once",
+			actions: []func() error{func() error { return repo.LikeThread(ctx, 1, 2) }},
+			likes:   1,
+		},
+		{
+			name: "like twice",
+			actions: []func() error{
+				func() error { return repo.LikeThread(ctx, 1, 2) },
+				func() error { return repo.LikeThread(ctx, 1, 2) },
+			},
+			wantErr: true,
+			likes:   1,
+		},
+		{
+			name: "like then unlike",
+			actions: []func() error{
+				func() error { return repo.LikeThread(ctx, 1, 2) },
+				func() error { return repo.UnlikeThread(ctx, 1, 2) },
+			},
+			likes: 0,
+		},
+		{
+			name:    "unlike without like",
+			actions: []func() error{func() error { return repo.UnlikeThread(ctx, 1, 2) }},
+			wantErr: true,
+			likes:   0,
+		},
+		{
+			name:    "like missing thread",
+			actions: []func() error{func() error { return repo.LikeThread(ctx, 42, 2) }},
+			wantErr: true,
+			likes:   0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			modelstest.Truncate(t, repo)
+			modelstest.LoadJSON(t, repo, []byte(forumFixture))
+
+			var err error
+			for _, action := range c.actions {
+				if e := action(); e != nil {
+					err = e
+				}
+			}
+			if (err != nil) != c.wantErr {
+				t.Errorf("error = %v, want error %v", err, c.wantErr)
+			}
+			if err != nil && !models.IsRequestError(err) {
+				t.Errorf("error %v is not a request error", err)
+			}
+			if likes := repo.FindThreadLikeCount(ctx, 1); likes != c.likes {
+				t.Errorf("like count is %d, want %d", likes, c.likes)
+			}
+		})
+	}
+}
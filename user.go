@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -85,6 +86,8 @@ type User struct {
 	Session             string            `gorm:"type:text;default:''" json:"-"`
 
 	RemainingCredit Price `gorm:"default:0" json:"-"`
+	// NoShowCount counts the reservations the user never showed up for.
+	NoShowCount uint `gorm:"default:0" json:"-"`
 
 	// 被这些人关注
 	Followers []*User `gorm:"many2many:user_relations;foreignKey:ID;joinForeignKey:following_id;References:ID;joinReferences:user_id"`
@@ -120,7 +123,7 @@ func encryptPassword(pass string, salt string) string {
 	return str
 }
 
-func NewWxUser(username, openid, unionid, session string) (*User, error) {
+func (r *Repo) NewWxUser(ctx context.Context, username, openid, unionid, session string) (*User, error) {
 	u := &User{
 		Username:    username,
 		Type:        UserTypeWx,
@@ -135,11 +138,15 @@ func NewWxUser(username, openid, unionid, session string) (*User, error) {
 		ProDeadline: nil,
 		Avatar:      "",
 	}
-	result := db.Create(&u)
-	return u, result.Error
+	result := r.conn(ctx).Create(&u)
+	if result.Error != nil {
+		return u, result.Error
+	}
+	r.IssueSignupCoupons(ctx, u)
+	return u, nil
 }
 
-func NewPhoneUser(username, phone string) (*User, error) {
+func (r *Repo) NewPhoneUser(ctx context.Context, username, phone string) (*User, error) {
 	u := &User{
 		Username:    username,
 		Type:        UserTypePhone,
@@ -154,35 +161,39 @@ func NewPhoneUser(username, phone string) (*User, error) {
 		ProDeadline: nil,
 		Avatar:      "",
 	}
-	result := db.Create(&u)
-	return u, result.Error
+	result := r.conn(ctx).Create(&u)
+	if result.Error != nil {
+		return u, result.Error
+	}
+	r.IssueSignupCoupons(ctx, u)
+	return u, nil
 }
 
-func FindWxUser(openid string) (*User, bool) {
+func (r *Repo) FindWxUser(ctx context.Context, openid string) (*User, bool) {
 	var u User
-	result := db.First(&u, "openid = ?", openid)
+	result := r.conn(ctx).First(&u, "openid = ?", openid)
 	return &u, result.Error == nil
 }
 
-func FindUser(id uint) (*User, bool) {
+func (r *Repo) FindUser(ctx context.Context, id uint) (*User, bool) {
 	var u User
-	result := db.First(&u, "id = ?", id)
+	result := r.conn(ctx).First(&u, "id = ?", id)
 	return &u, result.Error == nil
 }
 
-func FindUserByPhone(phone string) (*User, bool) {
+func (r *Repo) FindUserByPhone(ctx context.Context, phone string) (*User, bool) {
 	var u User
-	result := db.First(&u, "phone = ?", phone)
+	result := r.conn(ctx).First(&u, "phone = ?", phone)
 	return &u, result.Error == nil
 }
 
-func UpdateUser(id uint, updateField map[string]interface{}) error {
-	_, e := FindUser(id)
+func (r *Repo) UpdateUser(ctx context.Context, id uint, updateField map[string]interface{}) error {
+	_, e := r.FindUser(ctx, id)
 	if !e {
-		return errors.New("用户不存在")
+		return ErrUserNotFound
 	}
 
-	err := db.
+	err := r.conn(ctx).
 		Model(&User{}).
 		Where("id = ?", id).
 		Omit("Password", "Salt", "Openid", "Phone", "Unionid", "IsPro", "proDeadline", "RemainingCredit").
@@ -190,39 +201,39 @@ func UpdateUser(id uint, updateField map[string]interface{}) error {
 		Error
 	if err != nil {
 		logrus.WithField("error", err).Panic("Error on querying user.")
-		return errors.New("查找用户时出现错误")
+		return ErrQueryUserFailed.Wrap(err)
 	}
 	return nil
 }
 
-func SetPassword(user *User, password, oldPassword string) error {
+func (r *Repo) SetPassword(ctx context.Context, user *User, password, oldPassword string) error {
 	if user.Password != "" {
 		validationPassword := encryptPassword(oldPassword, user.Salt)
 		if validationPassword != user.Password {
-			return NewRequestError("密码错误")
+			return ErrWrongPassword
 		}
 	}
 
 	salt := genSalt()
-	tx := db.Model(user).Updates(map[string]interface{}{
+	tx := r.conn(ctx).Model(user).Updates(map[string]interface{}{
 		"salt":     salt,
 		"password": encryptPassword(password, salt),
 	})
 
 	if tx.Error != nil {
-		return errors.New("更新密码时出现错误")
+		return ErrUpdatePassword.Wrap(tx.Error)
 	}
 
 	return nil
 }
 
-func (u *User) SetAvatar(avatar string) error {
-	tx := db.Model(u).Updates(map[string]interface{}{
+func (r *Repo) SetUserAvatar(ctx context.Context, u *User, avatar string) error {
+	tx := r.conn(ctx).Model(u).Updates(map[string]interface{}{
 		"avatar": avatar,
 	})
 
 	if tx.Error != nil {
-		return errors.New("更新头像时出现错误")
+		return ErrUpdateAvatar.Wrap(tx.Error)
 	}
 
 	return nil
@@ -232,25 +243,25 @@ func (u *User) CheckPassword(password string) bool {
 	return encryptPassword(password, u.Salt) == u.Password
 }
 
-func (u *User) GetFollowersCount() int64 {
+func (r *Repo) GetFollowersCount(ctx context.Context, u *User) int64 {
 	var count int64 = 0
-	db.
+	r.conn(ctx).
 		Table("user_relations").
 		Where("following_id = ?", u.ID).
 		Count(&count)
 	return count
 }
 
-func (u *User) GetFollowingsCount() int64 {
+func (r *Repo) GetFollowingsCount(ctx context.Context, u *User) int64 {
 	var count int64 = 0
-	db.
+	r.conn(ctx).
 		Table("user_relations").
 		Where("user_id = ?", u.ID).
 		Count(&count)
 	return count
 }
 
-func (u *User) GetAuthBaseInfomation(signup bool) map[string]interface{} {
+func (r *Repo) GetAuthBaseInfomation(ctx context.Context, u *User, signup bool) map[string]interface{} {
 	return map[string]interface{}{
 		"signup":           signup,
 		"openid":           u.Openid,
@@ -261,15 +272,15 @@ func (u *User) GetAuthBaseInfomation(signup bool) map[string]interface{} {
 		"is_pro":           u.IsPro,
 		"pro_deadline":     u.ProDeadline,
 		"remaining_credit": u.RemainingCredit.ToFloat64(),
-		"followers_count":  u.GetFollowersCount(),
-		"followings_count": u.GetFollowingsCount(),
+		"followers_count":  r.GetFollowersCount(ctx, u),
+		"followings_count": r.GetFollowingsCount(ctx, u),
 		"password_set":     u.Password != "",
 		"status":           u.Status,
 		"billing_status":   u.BillingStatus,
 	}
 }
 
-func (u *User) GetPhoneAuthBaseInfomation(signup bool) map[string]interface{} {
+func (r *Repo) GetPhoneAuthBaseInfomation(ctx context.Context, u *User, signup bool) map[string]interface{} {
 	return map[string]interface{}{
 		"signup":           signup,
 		"phone":            u.Phone,
@@ -280,22 +291,22 @@ func (u *User) GetPhoneAuthBaseInfomation(signup bool) map[string]interface{} {
 		"is_pro":           u.IsPro,
 		"pro_deadline":     u.ProDeadline,
 		"remaining_credit": u.RemainingCredit.ToFloat64(),
-		"followers_count":  u.GetFollowersCount(),
-		"followings_count": u.GetFollowingsCount(),
+		"followers_count":  r.GetFollowersCount(ctx, u),
+		"followings_count": r.GetFollowingsCount(ctx, u),
 		"password_set":     u.Password != "",
 		"status":           u.Status,
 		"billing_status":   u.BillingStatus,
 	}
 }
 
-func (u *User) GetDetailedInfomation(whoInquery *User) map[string]interface{} {
+func (r *Repo) GetDetailedInfomation(ctx context.Context, u *User, whoInquery *User) map[string]interface{} {
 	var tmp int64 = 0
-	db.
+	r.conn(ctx).
 		Table("user_relations").
 		Where("user_id = ? and following_id = ?", whoInquery.ID, u.ID).
 		Count(&tmp)
 	isFollowing := tmp == 1
-	db.
+	r.conn(ctx).
 		Table("user_relations").
 		Where("user_id = ? and following_id = ?", u.ID, whoInquery.ID).
 		Count(&tmp)
@@ -308,8 +319,8 @@ func (u *User) GetDetailedInfomation(whoInquery *User) map[string]interface{} {
 		"username":         u.Username,
 		"bio":              u.Bio,
 		"is_pro":           u.IsPro,
-		"followers_count":  u.GetFollowersCount(),
-		"followings_count": u.GetFollowingsCount(),
+		"followers_count":  r.GetFollowersCount(ctx, u),
+		"followings_count": r.GetFollowingsCount(ctx, u),
 		"status":           u.Status,
 		"is_following":     isFollowing,
 		"is_follower":      isFollower,
@@ -330,59 +341,59 @@ type UserPublicInfomation struct {
 	Status          UserStatus `json:"status"`
 }
 
-func (u *User) GetPublicInfomation() UserPublicInfomation {
+func (r *Repo) GetPublicInfomation(ctx context.Context, u *User) UserPublicInfomation {
 	return UserPublicInfomation{
 		ID:              u.ID,
 		Username:        u.Username,
 		Avatar:          u.Avatar,
 		Bio:             u.Bio,
 		IsPro:           u.IsPro,
-		FollowersCount:  u.GetFollowersCount(),
-		FollowingsCount: u.GetFollowingsCount(),
+		FollowersCount:  r.GetFollowersCount(ctx, u),
+		FollowingsCount: r.GetFollowingsCount(ctx, u),
 		Status:          u.Status,
 	}
 }
 
-func FollowUser(user, userToBeFollowed *User) error {
-	tx := db.Find(&UserRelation{}, "user_id = ? AND following_id = ?", user.ID, userToBeFollowed.ID)
+func (r *Repo) FollowUser(ctx context.Context, user, userToBeFollowed *User) error {
+	tx := r.conn(ctx).Find(&UserRelation{}, "user_id = ? AND following_id = ?", user.ID, userToBeFollowed.ID)
 	if tx.Error != nil {
-		return errors.New("查询用户时出现错误")
+		return ErrQueryUserFailed.Wrap(tx.Error)
 	}
 	if tx.RowsAffected != 0 {
 		// already followed
 		return nil
 	}
 
-	user.Followings = append(user.Followings, userToBeFollowed)
-	tx = db.Save(user)
+	tx = r.conn(ctx).Create(&UserRelation{UserID: int(user.ID), FollowingID: int(userToBeFollowed.ID)})
 	if tx.Error != nil {
 		logrus.WithError(tx.Error).Errorf("error on updateing at follow user method.")
-		return errors.New("更新用户时出现错误")
+		return ErrUpdateUserFailed.Wrap(tx.Error)
 	}
+	user.Followings = append(user.Followings, userToBeFollowed)
 
-	PushFollowNotification(userToBeFollowed.ID, user.ID)
+	r.PushFollowNotification(ctx, userToBeFollowed.ID, user.ID)
 
 	return nil
 }
 
-func UnfollowUser(user, userToBeFollowed *User) error {
-	r := &UserRelation{}
-	tx := db.Find(r, "user_id = ? AND following_id = ?", user.ID, userToBeFollowed.ID)
+func (r *Repo) UnfollowUser(ctx context.Context, user, userToBeFollowed *User) error {
+	rel := &UserRelation{}
+	tx := r.conn(ctx).Find(rel, "user_id = ? AND following_id = ?", user.ID, userToBeFollowed.ID)
 	if tx.Error != nil {
-		return errors.New("查询用户时出现错误")
+		return ErrQueryUserFailed.Wrap(tx.Error)
 	}
 	if tx.RowsAffected != 1 {
 		// already unfollowed
 		return nil
 	}
 
-	tx = db.Delete(r)
+	tx = r.conn(ctx).Delete(rel)
 	if tx.Error != nil {
 		logrus.WithError(tx.Error).Errorf("error on updating at unfollow user method.")
-		return errors.New("更新用户时出现错误")
+		return ErrUpdateUserFailed.Wrap(tx.Error)
 	}
 
-	err := DeleteNotification(NotificationTypeFollows, userToBeFollowed.ID, user.ID)
+	err := r.DeleteNotification(ctx, NotificationTypeFollows, userToBeFollowed.ID, user.ID)
 	if err != nil {
 		logrus.WithError(err).Errorf("error on deleting notification at unfollow user method.")
 	}
@@ -390,26 +401,26 @@ func UnfollowUser(user, userToBeFollowed *User) error {
 	return nil
 }
 
-func (u *User) IncreaseCreditBy(cnt float64) error {
-	u.RemainingCredit += Price(uint64(u.RemainingCredit) + uint64(cnt*100))
-	tx := db.Save(u)
-	if tx.Error != nil {
-		logrus.WithError(tx.Error).Errorf("error on updating at increase credit method.")
-		return errors.New("更新用户时出现错误")
+// IncreaseCreditBy credits u with cnt as an administrative adjustment.
+func (r *Repo) IncreaseCreditBy(ctx context.Context, u *User, cnt float64) error {
+	_, err := r.CreditUser(ctx, u, ToPrice(cnt), CreditReasonAdminAdjustment, nil, SessionActorSystem)
+	if err != nil {
+		logrus.WithError(err).Errorf("error on updating at increase credit method.")
+		return ErrUpdateUserFailed.Wrap(err)
 	}
 	return nil
 }
 
-func (u *User) DecreaseCreditBy(cnt float64) error {
-	remainingCredit := int64(u.RemainingCredit) - int64(cnt*100)
-	if remainingCredit < 0 {
-		remainingCredit = 0
+// DecreaseCreditBy debits u by cnt as an administrative adjustment. It
+// fails with ErrInsufficientCredit if u's balance does not cover cnt.
+func (r *Repo) DecreaseCreditBy(ctx context.Context, u *User, cnt float64) error {
+	_, err := r.DebitUser(ctx, u, ToPrice(cnt), CreditReasonAdminAdjustment, nil, SessionActorSystem)
+	if errors.Is(err, ErrInsufficientCredit) {
+		return err
 	}
-	u.RemainingCredit = Price(remainingCredit)
-	tx := db.Save(u)
-	if tx.Error != nil {
-		logrus.WithError(tx.Error).Errorf("error on updating at decrease credit method.")
-		return errors.New("更新用户时出现错误")
+	if err != nil {
+		logrus.WithError(err).Errorf("error on updating at decrease credit method.")
+		return ErrUpdateUserFailed.Wrap(err)
 	}
 	return nil
 }
@@ -418,43 +429,49 @@ func (u *User) CreditLessThan(v float64) bool {
 	return u.RemainingCredit.ToFloat64() < v
 }
 
-func (u *User) SetStatus(s UserStatus) error {
+// proAt reports whether u is a pro user at now, their pro status lasting
+// until ProDeadline when it is set.
+func (u *User) proAt(now time.Time) bool {
+	return u.IsPro && (u.ProDeadline == nil || u.ProDeadline.After(now))
+}
+
+func (r *Repo) SetUserStatus(ctx context.Context, u *User, s UserStatus) error {
 	u.Status = s
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("status", s).Error
 }
 
-func (u *User) SetBillingStatus(s UserBillingStatus) error {
+func (r *Repo) SetUserBillingStatus(ctx context.Context, u *User, s UserBillingStatus) error {
 	u.BillingStatus = s
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("billing_status", s).Error
 }
 
-func (u *User) SetRecentBillTime(t *time.Time) error {
+func (r *Repo) SetUserRecentBillTime(ctx context.Context, u *User, t *time.Time) error {
 	u.RecentBillStartTime = t
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("recent_bill_start_time", t).Error
 }
 
-func (u *User) SetProDeadline(t *time.Time) error {
+func (r *Repo) SetUserProDeadline(ctx context.Context, u *User, t *time.Time) error {
 	u.ProDeadline = t
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("pro_deadline", t).Error
 }
 
-func (u *User) SetCurrentOccupiedSeat(seat *Seat) error {
+func (r *Repo) SetUserCurrentOccupiedSeat(ctx context.Context, u *User, seat *Seat) error {
 	if seat == nil {
 		u.CurrentOccupiedSeatID = nil
 	} else {
 		u.CurrentOccupiedSeatID = &seat.ID
 	}
 
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("current_occupied_seat_id", u.CurrentOccupiedSeatID).Error
 }
 
-func (u *User) GetCurrentOccupiedDevices() []Device {
+func (r *Repo) GetUserCurrentOccupiedDevices(ctx context.Context, u *User) []Device {
 	ret := make([]Device, 0)
 	if u.CurrentOccupiedSeatID != nil {
 		return ret
 	}
 
-	tx := db.Find(&ret, "seat_id = ?", u.CurrentOccupiedSeatID)
+	tx := r.conn(ctx).Find(&ret, "seat_id = ?", u.CurrentOccupiedSeatID)
 	if tx.Error != nil {
 		return []Device{}
 	}
@@ -462,19 +479,19 @@ func (u *User) GetCurrentOccupiedDevices() []Device {
 	return ret
 }
 
-func (u *User) SetSession(s *Session) error {
+func (r *Repo) SetUserSession(ctx context.Context, u *User, s *Session) error {
 	u.Session = s.Token
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("session", u.Session).Error
 }
 
-func (u *User) ClearSession() error {
+func (r *Repo) ClearUserSession(ctx context.Context, u *User) error {
 	u.Session = ""
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("session", "").Error
 }
 
-func (u *User) SetWxSession(s string) error {
+func (r *Repo) SetUserWxSession(ctx context.Context, u *User, s string) error {
 	u.WxSession = s
-	return db.Save(u).Error
+	return r.conn(ctx).Model(u).Update("wx_session", s).Error
 }
 
 type BasicUserInfomation struct {
@@ -485,9 +502,9 @@ type BasicUserInfomation struct {
 	IsPro    bool   `json:"is_pro"`
 }
 
-func (u *User) GetFollowers() ([]UserPublicInfomation, error) {
+func (r *Repo) GetUserFollowers(ctx context.Context, u *User) ([]UserPublicInfomation, error) {
 	followers := make([]uint, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Table("user_relations").
 		Select("user_id").
 		Find(&followers, "following_id = ?", u.ID)
@@ -497,7 +514,7 @@ func (u *User) GetFollowers() ([]UserPublicInfomation, error) {
 	}
 
 	users := make([]User, 0)
-	tx = db.
+	tx = r.conn(ctx).
 		Where("id in (?)", followers).
 		Find(&users)
 	if tx.Error != nil {
@@ -506,15 +523,15 @@ func (u *User) GetFollowers() ([]UserPublicInfomation, error) {
 
 	ret := make([]UserPublicInfomation, len(users))
 	for i := range users {
-		ret[i] = users[i].GetPublicInfomation()
+		ret[i] = r.GetPublicInfomation(ctx, &users[i])
 	}
 
 	return ret, nil
 }
 
-func (u *User) GetFollowings() ([]UserPublicInfomation, error) {
+func (r *Repo) GetUserFollowings(ctx context.Context, u *User) ([]UserPublicInfomation, error) {
 	followings := make([]uint, 0)
-	tx := db.
+	tx := r.conn(ctx).
 		Table("user_relations").
 		Select("following_id").
 		Find(&followings, "user_id = ?", u.ID)
@@ -524,7 +541,7 @@ func (u *User) GetFollowings() ([]UserPublicInfomation, error) {
 	}
 
 	users := make([]User, 0)
-	tx = db.
+	tx = r.conn(ctx).
 		Where("id in (?)", followings).
 		Find(&users)
 	if tx.Error != nil {
@@ -533,14 +550,14 @@ func (u *User) GetFollowings() ([]UserPublicInfomation, error) {
 
 	ret := make([]UserPublicInfomation, len(users))
 	for i := range users {
-		ret[i] = users[i].GetPublicInfomation()
+		ret[i] = r.GetPublicInfomation(ctx, &users[i])
 	}
 
 	return ret, nil
 }
 
-func GetUserCount() uint {
+func (r *Repo) GetUserCount(ctx context.Context) uint {
 	var count int64
-	db.Model(&User{}).Count(&count)
+	r.conn(ctx).Model(&User{}).Count(&count)
 	return uint(count)
 }
@@ -1,19 +1,23 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
 
 type VisitorMark struct {
 	ID   uint   `gorm:"primaryKey"`
 	Mark string `gorm:"not null;uniqueIndex"`
 }
 
-func CreateVisitorToken() (*VisitorMark, error) {
+func (r *Repo) CreateVisitorToken(ctx context.Context) (*VisitorMark, error) {
 	uuid := uuid.New()
 	token := VisitorMark{
 		Mark: uuid.String(),
 	}
 
-	err := db.Create(&token).Error
+	err := r.conn(ctx).Create(&token).Error
 	if err != nil {
 		return nil, err
 	} else {
@@ -21,8 +25,8 @@ func CreateVisitorToken() (*VisitorMark, error) {
 	}
 }
 
-func GetExistingVisitorToken(uuid string) (*VisitorMark, error) {
+func (r *Repo) GetExistingVisitorToken(ctx context.Context, uuid string) (*VisitorMark, error) {
 	result := VisitorMark{}
-	err := db.Model(&VisitorMark{}).Where("mark = ?", uuid).First(&result).Error
+	err := r.conn(ctx).Model(&VisitorMark{}).Where("mark = ?", uuid).First(&result).Error
 	return &result, err
 }
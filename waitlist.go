@@ -0,0 +1,333 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WaitlistHoldDuration is how long a waiter may take to confirm an offered
+// slot before it moves on to the next one.
+var WaitlistHoldDuration = 15 * time.Minute
+
+type WaitlistStatus string
+
+const (
+	WaitlistStatusWaiting   WaitlistStatus = "waiting"
+	WaitlistStatusHeld      WaitlistStatus = "held"
+	WaitlistStatusConfirmed WaitlistStatus = "confirmed"
+	WaitlistStatusLapsed    WaitlistStatus = "lapsed"
+	WaitlistStatusDeclined  WaitlistStatus = "declined"
+	WaitlistStatusCanceled  WaitlistStatus = "canceled"
+)
+
+// WaitlistEntry is a user's interest in a time range at a store, or at one
+// seat of it. An entry for the whole store may ask for seat attributes, in
+// which case only seats having all of them are offered. When a matching
+// slot frees up, the earliest waiter is offered a hold: a session in the
+// held status that blocks the seat until it is confirmed or HoldExpiresAt
+// passes.
+type WaitlistEntry struct {
+	gorm.Model
+	User    User  `json:"-"`
+	UserID  uint  `gorm:"not null;index" json:"user_id"`
+	Store   Store `json:"-"`
+	StoreID uint  `gorm:"not null;index" json:"store_id"`
+	Seat    *Seat `json:"-"`
+	SeatID  *uint `json:"seat_id"`
+	// Attributes are those the seat offered must have.
+	Attributes SeatAttributes `gorm:"type:jsonb;not null;default:'[]'" json:"attributes"`
+
+	StartTime time.Time `gorm:"not null" json:"start_time"`
+	EndTime   time.Time `gorm:"not null" json:"end_time"`
+
+	Status        WaitlistStatus `gorm:"type:varchar(16);not null;default:'waiting';index" json:"status"`
+	HoldSession   *Session       `json:"-"`
+	HoldSessionID *uint          `json:"hold_session_id"`
+	HoldExpiresAt *time.Time     `json:"hold_expires_at"`
+}
+
+func migrateWaitlist(db *gorm.DB) error {
+	if err := createTables(db, &WaitlistEntry{}); err != nil {
+		return err
+	}
+	return replaceSessionExclusion(db, SessionStatusHeld, SessionStatusValid, SessionStatusCheckedIn, SessionStatusOnGoing)
+}
+
+func dropWaitlist(db *gorm.DB) error {
+	if err := replaceSessionExclusion(db, SessionStatusValid, SessionStatusCheckedIn, SessionStatusOnGoing); err != nil {
+		return err
+	}
+	return db.Migrator().DropTable(&WaitlistEntry{})
+}
+
+func migrateWaitlistAttributes(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasColumn(&WaitlistEntry{}, "Attributes") {
+		return nil
+	}
+	return m.AddColumn(&WaitlistEntry{}, "Attributes")
+}
+
+func dropWaitlistAttributes(db *gorm.DB) error {
+	return db.Migrator().DropColumn(&WaitlistEntry{}, "Attributes")
+}
+
+// JoinWaitlist registers u's interest in [start, end) at store, restricted
+// to seat when it is not nil, or else to the seats having all of attrs.
+func (r *Repo) JoinWaitlist(ctx context.Context, u *User, store *Store, seat *Seat, attrs SeatAttributes, start, end time.Time) (*WaitlistEntry, error) {
+	if !end.After(start) || !end.After(time.Now()) {
+		return nil, ErrInvalidTime
+	}
+	attrs, err := attrs.normalize()
+	if err != nil {
+		return nil, err
+	}
+	entry := &WaitlistEntry{
+		UserID:     u.ID,
+		StoreID:    store.ID,
+		Attributes: attrs,
+		StartTime:  start,
+		EndTime:    end,
+		Status:     WaitlistStatusWaiting,
+	}
+	if seat != nil {
+		if seat.StoreID != 0 && seat.StoreID != store.ID {
+			return nil, ErrInvalidArgument
+		}
+		// a chosen seat is what it is
+		if len(attrs) > 0 {
+			return nil, ErrInvalidArgument
+		}
+		entry.SeatID = &seat.ID
+	}
+	if err := r.conn(ctx).Omit(clause.Associations).Create(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *Repo) GetWaitlistEntry(ctx context.Context, id uint) (*WaitlistEntry, error) {
+	entry := &WaitlistEntry{}
+	tx := r.conn(ctx).First(entry, id)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return entry, nil
+}
+
+func (r *Repo) ListUserWaitlist(ctx context.Context, u *User) ([]*WaitlistEntry, error) {
+	entries := make([]*WaitlistEntry, 0)
+	tx := r.conn(ctx).
+		Where("user_id = ? AND status IN ?", u.ID, []WaitlistStatus{WaitlistStatusWaiting, WaitlistStatusHeld}).
+		Order("start_time asc").
+		Find(&entries)
+	return entries, tx.Error
+}
+
+// LeaveWaitlist withdraws entry, giving up its hold if it has one.
+func (r *Repo) LeaveWaitlist(ctx context.Context, entry *WaitlistEntry, actor string) error {
+	return r.WithTx(ctx, func(tx *Repo) error {
+		current := WaitlistEntry{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, entry.ID).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != WaitlistStatusWaiting && current.Status != WaitlistStatusHeld {
+			return ErrIllegalTransition
+		}
+		err = tx.conn(ctx).Model(&current).Update("status", WaitlistStatusCanceled).Error
+		if err != nil {
+			return err
+		}
+		if current.Status == WaitlistStatusHeld && current.HoldSessionID != nil {
+			hold := &Session{}
+			hold.ID = *current.HoldSessionID
+			if err := tx.TransitionSession(ctx, hold, SessionStatusCanceled, actor); err != nil {
+				return err
+			}
+		}
+		entry.Status = WaitlistStatusCanceled
+		return nil
+	})
+}
+
+// ConfirmWaitlistHold turns the hold offered to entry into a reservation.
+func (r *Repo) ConfirmWaitlistHold(ctx context.Context, key []byte, entry *WaitlistEntry, actor string) (*Session, error) {
+	session := &Session{}
+	err := r.WithTx(ctx, func(tx *Repo) error {
+		current := WaitlistEntry{}
+		err := tx.conn(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, entry.ID).Error
+		if err != nil {
+			return err
+		}
+		if current.Status == WaitlistStatusLapsed {
+			return ErrHoldExpired
+		}
+		if current.Status != WaitlistStatusHeld || current.HoldSessionID == nil {
+			return ErrIllegalTransition
+		}
+		if current.HoldExpiresAt != nil && time.Now().After(*current.HoldExpiresAt) {
+			return ErrHoldExpired
+		}
+
+		if err := tx.conn(ctx).First(session, *current.HoldSessionID).Error; err != nil {
+			return err
+		}
+		token, err := newSessionToken(key, session.UserID, session.SeatID)
+		if err != nil {
+			return err
+		}
+		if err := tx.conn(ctx).Model(session).Update("token", token).Error; err != nil {
+			return err
+		}
+		session.Token = token
+		return tx.TransitionSession(ctx, session, SessionStatusReserved, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry.Status = WaitlistStatusConfirmed
+	return session, nil
+}
+
+// ExpireWaitlistHolds lets every hold that was not confirmed in time lapse,
+// passing its slot on to the next waiter, and returns how many lapsed.
+func (r *Repo) ExpireWaitlistHolds(ctx context.Context, now time.Time) (int, error) {
+	entries := make([]*WaitlistEntry, 0)
+	tx := r.conn(ctx).
+		Where("status = ? AND hold_expires_at < ?", WaitlistStatusHeld, now).
+		Order("hold_expires_at asc").
+		Find(&entries)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	lapsed := 0
+	for _, entry := range entries {
+		hold := &Session{}
+		hold.ID = *entry.HoldSessionID
+		err := r.TransitionSession(ctx, hold, SessionStatusExpired, SessionActorSystem)
+		if errors.Is(err, ErrIllegalTransition) {
+			// confirmed or canceled meanwhile
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("waitlist_entry", entry.ID).Error("Failed to expire waitlist hold")
+			return lapsed, err
+		}
+		lapsed++
+	}
+	return lapsed, nil
+}
+
+// confirmHoldHook marks the waitlist entry of a confirmed hold.
+func confirmHoldHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	if e.From != SessionStatusHeld {
+		return nil
+	}
+	return tx.conn(ctx).Model(&WaitlistEntry{}).
+		Where("hold_session_id = ? AND status = ?", s.ID, WaitlistStatusHeld).
+		Update("status", WaitlistStatusConfirmed).
+		Error
+}
+
+// offerToWaitlistHook closes the entry of a hold that ended unconfirmed,
+// then offers the freed slot to the next waiter.
+func offerToWaitlistHook(ctx context.Context, tx *Repo, s *Session, e *SessionEvent) error {
+	if e.From == SessionStatusHeld {
+		status := WaitlistStatusDeclined
+		if e.To == SessionStatusExpired {
+			status = WaitlistStatusLapsed
+		}
+		err := tx.conn(ctx).Model(&WaitlistEntry{}).
+			Where("hold_session_id = ? AND status = ?", s.ID, WaitlistStatusHeld).
+			Update("status", status).
+			Error
+		if err != nil {
+			return err
+		}
+	}
+	if s.EndTime == nil || !s.EndTime.After(time.Now()) {
+		return nil
+	}
+	_, err := tx.offerSlot(ctx, s.SeatID, *s.StartTime, *s.EndTime)
+	return err
+}
+
+// offerSlot gives the earliest waiter whose range overlaps [start, end)
+// on seatID, and whose attributes the seat has, a hold, provided the store
+// is open and the seat and the waiter are free for the waiter's whole
+// range. It returns the entry that got the hold, if any.
+func (r *Repo) offerSlot(ctx context.Context, seatID uint, start, end time.Time) (*WaitlistEntry, error) {
+	now := time.Now()
+	entries := make([]*WaitlistEntry, 0)
+	err := r.conn(ctx).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ?", WaitlistStatusWaiting).
+		Where("store_id = (SELECT store_id FROM seats WHERE id = ?)", seatID).
+		Where("seat_id IS NULL OR seat_id = ?", seatID).
+		Where("(SELECT attributes FROM seats WHERE id = ?) @> waitlist_entries.attributes", seatID).
+		Where("start_time < ? AND end_time > ?", end, start).
+		Where("end_time > ?", now).
+		Order("created_at asc, id asc").
+		Find(&entries).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		hold := &Session{
+			UserID:    entry.UserID,
+			SeatID:    seatID,
+			StartTime: &entry.StartTime,
+			EndTime:   &entry.EndTime,
+			Status:    SessionStatusHeld,
+			// replaced by a real token on confirmation
+			Token: "hold-" + randomToken(16),
+		}
+		err := r.insertSession(ctx, hold)
+		conflict := &SessionConflictError{}
+		if errors.As(err, &conflict) || errors.Is(err, ErrStoreClosed) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		expires := now.Add(WaitlistHoldDuration)
+		err = r.conn(ctx).Model(entry).Updates(map[string]interface{}{
+			"status":          WaitlistStatusHeld,
+			"hold_session_id": hold.ID,
+			"hold_expires_at": expires,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(map[string]interface{}{
+			"session_id": hold.ID,
+			"seat_id":    seatID,
+			"start_time": entry.StartTime,
+			"end_time":   entry.EndTime,
+			"expires_at": expires,
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = r.PushNotification(ctx, &Notification{
+			Type:                           NotificationTypeWaitlistHold,
+			UserID:                         entry.UserID,
+			AffiliateNotificationSubjectID: &entry.ID,
+			Data:                           data,
+		})
+		return entry, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,163 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Suse-Orphanage/models"
+	"github.com/Suse-Orphanage/models/modelstest"
+)
+
+func TestWaitlist(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	modelstest.LoadJSON(t, repo, []byte(`{"users": [{"id": 3, "username": "carol", "phone": "13800000003"}]}`))
+	ctx := context.Background()
+
+	users := make([]*models.User, 4)
+	for i := range users {
+		users[i] = &models.User{}
+		users[i].ID = uint(i)
+	}
+	alice, bob, carol := users[1], users[2], users[3]
+	store := &models.Store{}
+	store.ID = 1
+	seat := &models.Seat{}
+	seat.ID = 1
+	seat.StoreID = 1
+
+	base := time.Now().Truncate(time.Hour).Add(24 * time.Hour)
+	at := func(minutes int) time.Time {
+		return base.Add(time.Duration(minutes) * time.Minute)
+	}
+	ptr := func(ts time.Time) *time.Time { return &ts }
+
+	booked, err := repo.ReserveSession(ctx, sessionKey, alice, seat, ptr(at(0)), ptr(at(180)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobEntry, err := repo.JoinWaitlist(ctx, bob, store, seat, nil, at(0), at(120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolEntry, err := repo.JoinWaitlist(ctx, carol, store, nil, nil, at(90), at(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.TransitionSession(ctx, booked, models.SessionStatusCanceled, models.UserActor(alice)); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(id uint) *models.WaitlistEntry {
+		t.Helper()
+		e, err := repo.GetWaitlistEntry(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	if e := entry(bobEntry.ID); e.Status != models.WaitlistStatusHeld || e.HoldSessionID == nil {
+		t.Fatalf("bob's entry = %s, want held", e.Status)
+	}
+	if e := entry(carolEntry.ID); e.Status != models.WaitlistStatusWaiting {
+		t.Fatalf("carol's entry = %s, want waiting behind bob's hold", e.Status)
+	}
+	notifications, err := repo.QueryNotificationOfType(ctx, models.NotificationTypeWaitlistHold, *bob, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 {
+		t.Errorf("bob got %d hold notifications, want 1", len(notifications))
+	}
+
+	// bob lets the hold lapse, so it cascades to carol
+	lapsed, err := repo.ExpireWaitlistHolds(ctx, time.Now().Add(models.WaitlistHoldDuration+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lapsed != 1 {
+		t.Errorf("ExpireWaitlistHolds() = %d, want 1", lapsed)
+	}
+	if e := entry(bobEntry.ID); e.Status != models.WaitlistStatusLapsed {
+		t.Errorf("bob's entry = %s, want lapsed", e.Status)
+	}
+	if _, err := repo.ConfirmWaitlistHold(ctx, sessionKey, bobEntry, models.UserActor(bob)); !errors.Is(err, models.ErrHoldExpired) {
+		t.Errorf("confirming a lapsed hold: error = %v, want ErrHoldExpired", err)
+	}
+
+	if e := entry(carolEntry.ID); e.Status != models.WaitlistStatusHeld {
+		t.Fatalf("carol's entry = %s, want held", e.Status)
+	}
+	session, err := repo.ConfirmWaitlistHold(ctx, sessionKey, carolEntry, models.UserActor(carol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != models.SessionStatusReserved || session.UserID != carol.ID {
+		t.Errorf("confirmed session = %+v, want carol's reservation", session)
+	}
+	if strings.HasPrefix(session.Token, "hold-") {
+		t.Error("confirmed session kept the placeholder token")
+	}
+	if e := entry(carolEntry.ID); e.Status != models.WaitlistStatusConfirmed {
+		t.Errorf("carol's entry = %s, want confirmed", e.Status)
+	}
+}
+
+func TestWaitlistAttributes(t *testing.T) {
+	repo := modelstest.New(t)
+	modelstest.LoadJSON(t, repo, []byte(bookingFixture))
+	ctx := context.Background()
+
+	alice := &models.User{}
+	alice.ID = 1
+	bob := &models.User{}
+	bob.ID = 2
+	store := &models.Store{}
+	store.ID = 1
+	seats := make([]*models.Seat, 3)
+	for i := range seats {
+		seats[i] = &models.Seat{}
+		seats[i].ID = uint(i)
+		seats[i].StoreID = 1
+	}
+	if err := repo.SetSeatAttributes(ctx, seats[2], "", models.SeatAttributes{models.SeatAttributePower}); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Truncate(time.Hour).Add(24 * time.Hour)
+	start, end := base, base.Add(2*time.Hour)
+
+	if _, err := repo.JoinWaitlist(ctx, bob, store, seats[1], models.SeatAttributes{models.SeatAttributePower}, start, end); !errors.Is(err, models.ErrInvalidArgument) {
+		t.Errorf("JoinWaitlist() with a seat and attributes: error = %v, want ErrInvalidArgument", err)
+	}
+	entry, err := repo.JoinWaitlist(ctx, bob, store, nil, models.SeatAttributes{models.SeatAttributePower}, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seat := range seats[1:] {
+		booked, err := repo.ReserveSession(ctx, sessionKey, alice, seat, &start, &end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.TransitionSession(ctx, booked, models.SessionStatusCanceled, models.UserActor(alice)); err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := repo.GetWaitlistEntry(ctx, entry.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seat == seats[1] && e.Status != models.WaitlistStatusWaiting {
+			t.Fatalf("entry = %s after a seat without power freed up, want waiting", e.Status)
+		}
+		if seat == seats[2] && e.Status != models.WaitlistStatusHeld {
+			t.Fatalf("entry = %s after a seat with power freed up, want held", e.Status)
+		}
+	}
+}